@@ -2,11 +2,10 @@
 package controller
 
 import (
-	"fmt"
 	"github.com/pki-io/core/config"
 	"github.com/pki-io/core/document"
 	"github.com/pki-io/core/entity"
-	"github.com/pki-io/core/x509"
+	"github.com/pki-io/core/index"
 )
 
 const (
@@ -28,7 +27,7 @@ func NewAdmin(env *Environment) (*AdminController, error) {
 
 func (cont *AdminController) SetEnv(env *Environment) error {
 	if env == nil {
-		return fmt.Errorf("env cannot be nil")
+		return newError(ErrInvalidParams, nil, "env cannot be nil")
 	}
 
 	cont.env = env
@@ -37,7 +36,7 @@ func (cont *AdminController) SetEnv(env *Environment) error {
 
 func (cont *AdminController) GetEnv() (*Environment, error) {
 	if cont.env == nil {
-		return nil, fmt.Errorf("nil env")
+		return nil, newError(ErrNotFound, nil, "env")
 	}
 	return cont.env, nil
 }
@@ -107,7 +106,7 @@ func (cont *AdminController) CreateAdmin(name string) error {
 		return err
 	}
 
-	cont.admin.Data.Body.Id = x509.NewID()
+	cont.admin.Data.Body.Id = cont.env.NewID()
 	cont.admin.Data.Body.Name = name
 
 	logger.Debug("generating keys")
@@ -122,11 +121,17 @@ func (cont *AdminController) CreateAdmin(name string) error {
 
 func (cont *AdminController) LoadAdmin() error {
 	logger.Debug("loading admin")
-	orgName := cont.env.controllers.org.config.Data.Name
+	return cont.LoadOrgAdmin(cont.env.controllers.org.config.Data.Name)
+}
+
+// LoadOrgAdmin loads the admin for the named org from the home directory. It
+// doesn't need the org's config, e.g. when restoring the org.
+func (cont *AdminController) LoadOrgAdmin(orgName string) error {
+	logger.Debugf("loading admin for org '%s'", orgName)
 
 	adminOrgConfig, err := cont.config.GetOrg(orgName)
 	if err != nil {
-		return err
+		return newError(ErrNotFound, err, "getting admin config for org '%s'", orgName)
 	}
 
 	adminId := adminOrgConfig.AdminId
@@ -134,13 +139,13 @@ func (cont *AdminController) LoadAdmin() error {
 	logger.Debugf("reading file for admin id '%s'", adminId)
 	adminEntity, err := cont.env.fs.home.Read(adminId)
 	if err != nil {
-		return err
+		return wrapError(err, "reading admin '%s'", adminId)
 	}
 
 	logger.Debug("creating entity")
 	cont.admin, err = entity.New(adminEntity)
 	if err != nil {
-		return err
+		return wrapError(err, "loading admin '%s'", adminId)
 	}
 
 	logger.Trace("returning nil error")
@@ -153,13 +158,13 @@ func (cont *AdminController) GetAdmin(id string) (*entity.Entity, error) {
 
 	adminJson, err := cont.env.api.GetPublic(id, id)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "getting admin '%s'", id)
 	}
 
 	logger.Debug("creating entity")
 	admin, err := entity.New(adminJson)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "loading admin '%s'", id)
 	}
 
 	logger.Trace("returning admin")
@@ -199,13 +204,13 @@ func (cont *AdminController) SaveAdmin() error {
 
 	logger.Debugf("saving private admin '%s' to home", id)
 	if err := cont.env.fs.home.Write(id, cont.admin.Dump()); err != nil {
-		return err
+		return wrapError(err, "saving private admin '%s'", id)
 	}
 
 	// Send a public admin
 	logger.Debugf("sending public admin '%s'", id)
 	if err := cont.env.api.SendPublic(id, id, cont.admin.DumpPublic()); err != nil {
-		return err
+		return wrapError(err, "sending public admin '%s'", id)
 	}
 
 	logger.Trace("returning nil error")
@@ -230,7 +235,7 @@ func (cont *AdminController) SendOrgEntity() error {
 
 	logger.Debugf("sending private org '%s'", org.Id())
 	if err := cont.env.api.SendPrivate(org.Id(), org.Id(), container.Dump()); err != nil {
-		return err
+		return wrapError(err, "sending private org '%s'", org.Id())
 	}
 
 	logger.Trace("returning nil error")
@@ -251,7 +256,7 @@ func (cont *AdminController) SecureSendPublicToOrg(id, key string) error {
 
 	logger.Debugf("pushing admin invite to org '%s'", orgId)
 	if err := cont.env.api.PushIncoming(orgId, "invite", container.Dump()); err != nil {
-		return err
+		return wrapError(err, "pushing admin invite to org '%s'", orgId)
 	}
 
 	logger.Trace("returning nil error")
@@ -262,48 +267,50 @@ func (cont *AdminController) ProcessNextInvite() error {
 
 	org := cont.env.controllers.org.org
 
-	index, err := cont.env.controllers.org.GetIndex()
+	orgIndex, err := cont.env.controllers.org.GetIndex()
 	if err != nil {
 		return err
 	}
 
 	inviteJson, err := cont.env.api.PopIncoming(org.Id(), "invite")
 	if err != nil {
-		return err
+		return wrapError(err, "popping invite for org '%s'", org.Id())
 	}
 
 	container, err := document.NewContainer(inviteJson)
 	if err != nil {
 		cont.env.api.PushIncoming(org.Id(), "invite", inviteJson)
-		return err
+		return wrapError(err, "loading invite container")
 	}
 
 	inviteId := container.Data.Options.SignatureInputs["key-id"]
 	logger.Debugf("Reading invite key: %s", inviteId)
-	inviteKey, err := index.GetInviteKey(inviteId)
+	inviteKey, err := orgIndex.GetInviteKey(inviteId)
 	if err != nil {
 		cont.env.api.PushIncoming(org.Id(), "invite", inviteJson)
-		return err
+		return newError(ErrNotFound, err, "getting invite key '%s'", inviteId)
 	}
 
 	logger.Debug("Verifying and decrypting admin invite")
 	adminJson, err := org.VerifyAuthenticationThenDecrypt(container, inviteKey.Key)
 	if err != nil {
 		cont.env.api.PushIncoming(org.Id(), "invite", inviteJson)
-		return err
+		return newError(ErrVerificationFailed, err, "verifying invite with key '%s'", inviteId)
 	}
 
 	admin, err := entity.New(adminJson)
 	if err != nil {
 		cont.env.api.PushIncoming(org.Id(), "invite", inviteJson)
-		return err
+		return wrapError(err, "loading admin from invite '%s'", inviteId)
 	}
 
-	if err := index.AddAdmin(admin.Data.Body.Name, admin.Data.Body.Id); err != nil {
-		return err
-	}
-
-	if err := cont.env.controllers.org.SaveIndex(index); err != nil {
+	err = cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.AddAdmin(admin.Data.Body.Name, admin.Data.Body.Id); err != nil {
+			return newError(ErrAlreadyExists, err, "adding admin '%s' to org index", admin.Data.Body.Name)
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
@@ -317,7 +324,7 @@ func (cont *AdminController) ProcessNextInvite() error {
 	}
 
 	if err := cont.env.api.PushIncoming(admin.Data.Body.Id, "invite", orgContainer.Dump()); err != nil {
-		return err
+		return wrapError(err, "pushing org to admin '%s'", admin.Data.Body.Id)
 	}
 
 	// Delete invite ID
@@ -333,7 +340,7 @@ func (cont *AdminController) ProcessInvites() error {
 	for {
 		size, err := cont.env.api.IncomingSize(org.Id(), "invite")
 		if err != nil {
-			return err
+			return wrapError(err, "getting invite queue size for org '%s'", org.Id())
 		}
 
 		logger.Debugf("Found %d invites to process", size)
@@ -358,7 +365,7 @@ func (cont *AdminController) ShowEnv(params *AdminParams) (*entity.Entity, error
 
 	adminId, err := index.GetAdmin(*params.Name)
 	if err != nil {
-		return nil, err
+		return nil, newError(ErrNotFound, err, "getting admin '%s'", *params.Name)
 	}
 
 	admin, err := cont.GetAdmin(adminId)
@@ -372,21 +379,20 @@ func (cont *AdminController) ShowEnv(params *AdminParams) (*entity.Entity, error
 func (cont *AdminController) InviteEnv(params *AdminParams) ([2]string, error) {
 
 	logger.Debug("Creating new admin key")
-	id := x509.NewID()
-	key := x509.NewID()
+	id := cont.env.NewID()
+	key := cont.env.NewID()
 
 	logger.Debug("Saving key to index")
-	index, err := cont.env.controllers.org.GetIndex()
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.AddInviteKey(id, key, *params.Name); err != nil {
+			return newError(ErrAlreadyExists, err, "adding invite key for admin '%s'", *params.Name)
+		}
+		return nil
+	})
 	if err != nil {
 		return [2]string{}, err
 	}
 
-	index.AddInviteKey(id, key, *params.Name)
-
-	if err := cont.env.controllers.org.SaveIndex(index); err != nil {
-		return [2]string{}, err
-	}
-
 	return [2]string{id, key}, nil
 }
 
@@ -502,10 +508,10 @@ func (cont *AdminController) New(params *AdminParams) error {
 	logger.Debug("Creating admin entity")
 	cont.admin, err = entity.New(nil)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	cont.admin.Data.Body.Id = x509.NewID()
+	cont.admin.Data.Body.Id = cont.env.NewID()
 	cont.admin.Data.Body.Name = *params.Name
 
 	logger.Debug("Generating admin keys")
@@ -514,7 +520,7 @@ func (cont *AdminController) New(params *AdminParams) error {
 	}
 
 	if err := cont.SaveAdmin(); err != nil {
-		return nil
+		return err
 	}
 
 	if err := cont.LoadConfig(); err != nil {
@@ -589,27 +595,27 @@ func (cont *AdminController) Complete(params *AdminParams) error {
 
 	orgContainerJson, err := cont.env.api.PopIncoming(cont.admin.Data.Body.Id, "invite")
 	if err != nil {
-		return err
+		return wrapError(err, "popping invite response for admin '%s'", cont.admin.Id())
 	}
 
 	orgContainer, err := document.NewContainer(orgContainerJson)
 	if err != nil {
-		return err
+		return wrapError(err, "loading invite response container")
 	}
 
 	orgJson, err := cont.admin.VerifyAuthenticationThenDecrypt(orgContainer, *params.InviteKey)
 	if err != nil {
-		return err
+		return newError(ErrVerificationFailed, err, "verifying invite response for admin '%s'", cont.admin.Id())
 	}
 
 	org, err := entity.New(orgJson)
 	if err != nil {
-		return err
+		return wrapError(err, "loading org from invite response")
 	}
 
 	logger.Debug("Saving public org to home")
 	if err := cont.env.fs.home.Write(org.Data.Body.Id, org.DumpPublic()); err != nil {
-		return err
+		return wrapError(err, "saving public org '%s'", org.Id())
 	}
 
 	return nil
@@ -622,19 +628,16 @@ func (cont *AdminController) Delete(params *AdminParams) error {
 		return err
 	}
 
-	index, err := cont.env.controllers.org.GetIndex()
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.RemoveAdmin(*params.Name); err != nil {
+			return newError(ErrNotFound, err, "removing admin '%s'", *params.Name)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	if err := index.RemoveAdmin(*params.Name); err != nil {
-		return err
-	}
-
-	if err := cont.env.controllers.org.SaveIndex(index); err != nil {
-		return err
-	}
-
 	if err := cont.SendOrgEntity(); err != nil {
 		return err
 	}
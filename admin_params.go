@@ -1,9 +1,5 @@
 package controller
 
-import (
-	"fmt"
-)
-
 type AdminParams struct {
 	Name          *string
 	InviteId      *string
@@ -17,7 +13,7 @@ func NewAdminParams() *AdminParams {
 
 func (params *AdminParams) ValidateName(required bool) error {
 	if required && *params.Name == "" {
-		return fmt.Errorf("name cannot be empty")
+		return newError(ErrInvalidParams, nil, "name cannot be empty")
 	}
 	return nil
 }
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -59,3 +60,11 @@ func TestCreateAdmin(t *testing.T) {
 	err := admin.CreateAdmin("test")
 	assert.NoError(t, err)
 }
+
+func TestAdminNewSendFails(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	cont, _ := NewAdmin(backends.failingEnv(home))
+	err := cont.New(newTestAdminParams("admin2"))
+	assert.True(t, errors.Is(err, errTestSend))
+}
@@ -0,0 +1,573 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/pki-io/core/config"
+	"github.com/pki-io/core/document"
+	"github.com/pki-io/core/entity"
+	"github.com/pki-io/core/index"
+	"os"
+	"sort"
+	"time"
+)
+
+// BackupVersion is the version of the BackupArchive format.
+const BackupVersion int = 1
+
+// BackupArchive is everything needed to recreate an org. Private documents
+// are kept as the signed containers they're stored as, so the org's
+// signatures can be verified again when restoring. The archive itself is
+// encrypted for the org's admins and signed by the org.
+type BackupArchive struct {
+	Version    int    `json:"version"`
+	Created    string `json:"created"`
+	OrgId      string `json:"org-id"`
+	OrgName    string `json:"org-name"`
+	IndexId    string `json:"index-id"`
+	OrgConfig  string `json:"org-config"`
+	PublicOrg  string `json:"public-org"`
+	PrivateOrg string `json:"private-org"`
+	Index      string `json:"index"`
+	// Private documents by id
+	CAs          map[string]string `json:"cas"`
+	Certificates map[string]string `json:"certificates"`
+	CSRs         map[string]string `json:"csrs"`
+	Nodes        map[string]string `json:"nodes"`
+	Documents    map[string]string `json:"documents"`
+	// Public admin entities by id
+	Admins map[string]string `json:"admins"`
+}
+
+// BackupReport counts what was backed up or restored.
+type BackupReport struct {
+	OrgId        string
+	OrgName      string
+	CAs          int
+	Certificates int
+	CSRs         int
+	Nodes        int
+	PairingKeys  int
+	Admins       int
+	Documents    int
+}
+
+// backupDocuments are the private org documents that aren't in the index.
+// They're only backed up if they exist.
+var backupDocuments = []string{ProfilesDocument, IssuanceLogDocument, CAChainsDocument, CARequestsDocument}
+
+// backupSection is a kind of private document in the index and where it goes
+// in the archive.
+type backupSection struct {
+	kind string
+	ids  map[string]string
+	docs map[string]string
+}
+
+func newBackupSections(archive *BackupArchive, orgIndex *index.OrgIndex) []backupSection {
+	return []backupSection{
+		{"CA", orgIndex.GetCAs(), archive.CAs},
+		{"certificate", orgIndex.GetCerts(), archive.Certificates},
+		{"CSR", orgIndex.GetCSRs(), archive.CSRs},
+		{"node", orgIndex.GetNodes(), archive.Nodes},
+	}
+}
+
+func (archive *BackupArchive) report(orgIndex *index.OrgIndex) *BackupReport {
+	return &BackupReport{
+		OrgId:        archive.OrgId,
+		OrgName:      archive.OrgName,
+		CAs:          len(archive.CAs),
+		Certificates: len(archive.Certificates),
+		CSRs:         len(archive.CSRs),
+		Nodes:        len(archive.Nodes),
+		PairingKeys:  len(orgIndex.GetPairingKeys()),
+		Admins:       len(archive.Admins),
+		Documents:    len(archive.Documents),
+	}
+}
+
+// verifyBackupDocument checks a private document was signed by the org.
+func verifyBackupDocument(org *entity.Entity, kind, id, content string) error {
+	container, err := document.NewContainer(content)
+	if err != nil {
+		return wrapError(err, "loading %s container '%s'", kind, id)
+	}
+
+	if err := org.Verify(container); err != nil {
+		return newError(ErrVerificationFailed, err, "verifying %s '%s'", kind, id)
+	}
+
+	return nil
+}
+
+// Backup writes the org to an archive. Every private document is verified as
+// it's read, so a backup never contains documents the org didn't sign.
+func (cont *OrgController) Backup(params *OrgParams) (*BackupReport, error) {
+	logger.Debug("backing up org")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateBackupFile(); err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.StartSession(); err != nil {
+		return nil, err
+	}
+	defer cont.env.EndSession()
+
+	// As with Run, the session has loaded a new org controller
+	return cont.env.controllers.org.backup(*params.BackupFile)
+}
+
+func (cont *OrgController) backup(file string) (*BackupReport, error) {
+	// This saves reading the org for nothing, the file is created exclusively
+	// when it's written
+	logger.Debugf("checking whether backup file '%s' exists", file)
+	if _, err := os.Stat(file); err == nil {
+		return nil, newError(ErrAlreadyExists, nil, "backup file '%s'", file)
+	}
+
+	orgId := cont.OrgId()
+	orgIndex, err := cont.GetIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &BackupArchive{
+		Version:      BackupVersion,
+		Created:      cont.env.Now().UTC().Format(time.RFC3339),
+		OrgId:        orgId,
+		OrgName:      cont.config.Data.Name,
+		IndexId:      cont.config.Data.Index,
+		PublicOrg:    cont.org.DumpPublic(),
+		CAs:          make(map[string]string),
+		Certificates: make(map[string]string),
+		CSRs:         make(map[string]string),
+		Nodes:        make(map[string]string),
+		Documents:    make(map[string]string),
+		Admins:       make(map[string]string),
+	}
+
+	logger.Debug("reading local org config")
+	if archive.OrgConfig, err = cont.env.fs.local.Read(OrgConfigFile); err != nil {
+		return nil, wrapError(err, "reading org config")
+	}
+
+	get := func(kind, id string) (string, error) {
+		logger.Debugf("backing up %s '%s'", kind, id)
+		content, err := cont.env.api.GetPrivate(orgId, id)
+		if err != nil {
+			return "", wrapError(err, "getting %s '%s'", kind, id)
+		}
+
+		if err := verifyBackupDocument(cont.org, kind, id, content); err != nil {
+			return "", err
+		}
+		return content, nil
+	}
+
+	if archive.PrivateOrg, err = get("private org", orgId); err != nil {
+		return nil, err
+	}
+
+	if archive.Index, err = get("org index", archive.IndexId); err != nil {
+		return nil, err
+	}
+
+	for _, section := range newBackupSections(archive, orgIndex) {
+		for _, id := range section.ids {
+			if section.docs[id], err = get(section.kind, id); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, name := range backupDocuments {
+		content, err := get("org document", name)
+		if IsNotFound(err) || errors.Is(err, os.ErrNotExist) {
+			logger.Debugf("no org document '%s' to back up", name)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		archive.Documents[name] = content
+	}
+
+	adminIds, err := orgIndex.GetAdmins()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range adminIds {
+		logger.Debugf("backing up admin '%s'", id)
+		admin, err := cont.env.controllers.admin.GetAdmin(id)
+		if err != nil {
+			return nil, err
+		}
+		archive.Admins[id] = admin.DumpPublic()
+	}
+
+	archiveJson, err := json.Marshal(archive)
+	if err != nil {
+		return nil, wrapError(err, "dumping backup")
+	}
+
+	admins, err := cont.GetOrgAdmins()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("encrypting backup for admins")
+	container, err := cont.org.EncryptThenSignString(string(archiveJson), admins)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("writing backup file '%s'", file)
+	if err := writeNewFile(file, []byte(container.Dump())); err != nil {
+		return nil, err
+	}
+
+	logger.Trace("returning backup report")
+	return archive.report(orgIndex), nil
+}
+
+// Restore recreates an org from a backup archive in an empty local directory
+// named after the org. The admin must still have the org in their config to
+// decrypt the archive. The archive's public org must match the one in the
+// home directory or, if there isn't one, params.Fingerprint. Everything in
+// the archive is verified before anything is written.
+func (cont *OrgController) Restore(params *OrgParams) (*BackupReport, error) {
+	logger.Debug("restoring org")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateOrg(); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateBackupFile(); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateFingerprint(false); err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.LoadLocalFs(); err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.LoadHomeFs(); err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("checking whether org directory '%s' exists", *params.Org)
+	exists, err := cont.env.fs.local.Exists(*params.Org)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		return nil, newError(ErrAlreadyExists, nil, "org directory '%s'", *params.Org)
+	}
+
+	cont.env.controllers.admin, err = NewAdmin(cont.env)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.controllers.admin.LoadConfig(); err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.controllers.admin.LoadOrgAdmin(*params.Org); err != nil {
+		return nil, err
+	}
+
+	archive, org, orgIndex, err := cont.readBackup(*params.BackupFile, params.fingerprint())
+	if err != nil {
+		return nil, err
+	}
+
+	if archive.OrgName != *params.Org {
+		return nil, newError(ErrInvalidParams, nil, "backup is of org '%s', not '%s'", archive.OrgName, *params.Org)
+	}
+
+	logger.Debugf("creating org directory '%s'", *params.Org)
+	if err := cont.env.fs.local.CreateDirectory(*params.Org); err != nil {
+		return nil, err
+	}
+
+	logger.Debug("changing to org directory")
+	if err := cont.env.fs.local.ChangeToDirectory(*params.Org); err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.LoadAPI(); err != nil {
+		return nil, err
+	}
+
+	cont.org = org
+	orgId := org.Id()
+
+	for _, id := range sortedKeys(archive.Admins) {
+		logger.Debugf("restoring admin '%s'", id)
+		if err := cont.env.api.SendPublic(id, id, archive.Admins[id]); err != nil {
+			return nil, wrapError(err, "sending admin '%s'", id)
+		}
+	}
+
+	send := func(kind, id, content string) error {
+		logger.Debugf("restoring %s '%s'", kind, id)
+		if err := cont.env.api.SendPrivate(orgId, id, content); err != nil {
+			return wrapError(err, "sending %s '%s'", kind, id)
+		}
+		return nil
+	}
+
+	if err := send("private org", orgId, archive.PrivateOrg); err != nil {
+		return nil, err
+	}
+
+	if err := send("org index", archive.IndexId, archive.Index); err != nil {
+		return nil, err
+	}
+
+	for _, section := range newBackupSections(archive, orgIndex) {
+		for _, id := range sortedKeys(section.docs) {
+			if err := send(section.kind, id, section.docs[id]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(archive.Documents) {
+		if err := send("org document", name, archive.Documents[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	exists, err = cont.env.fs.home.Exists(orgId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		logger.Debugf("writing public org with id '%s' to home directory", orgId)
+		if err := cont.env.fs.home.Write(orgId, archive.PublicOrg); err != nil {
+			return nil, err
+		}
+	}
+
+	// The org config goes last, so an interrupted restore doesn't look like
+	// a working org
+	logger.Debug("writing local org config")
+	if err := cont.env.fs.local.Write(OrgConfigFile, archive.OrgConfig); err != nil {
+		return nil, err
+	}
+
+	logger.Trace("returning restore report")
+	return archive.report(orgIndex), nil
+}
+
+// readBackup decrypts and verifies a backup archive. It returns the archive,
+// the private org and the org's index. The public org is only trusted if it's
+// the one in the home directory or has the fingerprint, if that isn't empty.
+func (cont *OrgController) readBackup(file, fingerprint string) (*BackupArchive, *entity.Entity, *index.OrgIndex, error) {
+	data, err := readImportFile(file, "backup file")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	container, err := document.NewContainer(string(data))
+	if err != nil {
+		return nil, nil, nil, wrapError(err, "loading backup container")
+	}
+
+	logger.Debug("decrypting backup")
+	archiveJson, err := cont.env.controllers.admin.admin.Decrypt(container)
+	if err != nil {
+		return nil, nil, nil, newError(ErrDecryptionFailed, err, "decrypting backup")
+	}
+
+	archive := new(BackupArchive)
+	if err := json.Unmarshal([]byte(archiveJson), archive); err != nil {
+		return nil, nil, nil, wrapError(err, "loading backup")
+	}
+
+	if archive.Version != BackupVersion {
+		return nil, nil, nil, newError(ErrInvalidParams, nil, "unsupported backup version %d", archive.Version)
+	}
+
+	publicOrg, err := entity.New(archive.PublicOrg)
+	if err != nil {
+		return nil, nil, nil, wrapError(err, "loading public org from backup")
+	}
+
+	if publicOrg.Id() != archive.OrgId {
+		return nil, nil, nil, newError(ErrVerificationFailed, nil, "backup public org '%s' isn't org '%s'", publicOrg.Id(), archive.OrgId)
+	}
+
+	// Prefer the public org we already trust over the one in the archive
+	exists, err := cont.env.fs.home.Exists(archive.OrgId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if exists {
+		trustedJson, err := cont.env.fs.home.Read(archive.OrgId)
+		if err != nil {
+			return nil, nil, nil, wrapError(err, "reading public org '%s'", archive.OrgId)
+		}
+
+		trusted, err := entity.New(trustedJson)
+		if err != nil {
+			return nil, nil, nil, wrapError(err, "loading public org '%s'", archive.OrgId)
+		}
+
+		if trusted.DumpPublic() != publicOrg.DumpPublic() {
+			return nil, nil, nil, newError(ErrVerificationFailed, nil, "backup public org doesn't match public org '%s'", archive.OrgId)
+		}
+	} else if fingerprint == "" {
+		return nil, nil, nil, newError(ErrVerificationFailed, nil, "org '%s' isn't trusted, its public org isn't in the home directory and no fingerprint was given", archive.OrgId)
+	}
+
+	if fingerprint != "" && OrgFingerprint(publicOrg) != fingerprint {
+		return nil, nil, nil, newError(ErrVerificationFailed, nil, "backup public org doesn't have fingerprint '%s'", fingerprint)
+	}
+
+	logger.Debug("verifying backup")
+	if err := publicOrg.Verify(container); err != nil {
+		return nil, nil, nil, newError(ErrVerificationFailed, err, "verifying backup")
+	}
+
+	if err := verifyBackupDocument(publicOrg, "private org", archive.OrgId, archive.PrivateOrg); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := verifyBackupDocument(publicOrg, "org index", archive.IndexId, archive.Index); err != nil {
+		return nil, nil, nil, err
+	}
+
+	for name, content := range archive.Documents {
+		if err := verifyBackupDocument(publicOrg, "org document", name, content); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	orgContainer, _ := document.NewContainer(archive.PrivateOrg)
+	orgJson, err := cont.env.controllers.admin.admin.Decrypt(orgContainer)
+	if err != nil {
+		return nil, nil, nil, newError(ErrDecryptionFailed, err, "decrypting private org '%s'", archive.OrgId)
+	}
+
+	org, err := entity.New(orgJson)
+	if err != nil {
+		return nil, nil, nil, wrapError(err, "loading private org '%s'", archive.OrgId)
+	}
+
+	indexContainer, _ := document.NewContainer(archive.Index)
+	indexJson, err := org.Decrypt(indexContainer)
+	if err != nil {
+		return nil, nil, nil, newError(ErrDecryptionFailed, err, "decrypting org index '%s'", archive.IndexId)
+	}
+
+	orgIndex, err := index.NewOrg(indexJson)
+	if err != nil {
+		return nil, nil, nil, wrapError(err, "loading org index '%s'", archive.IndexId)
+	}
+
+	// Everything in the index has to be in the archive, and nothing else
+	for _, section := range newBackupSections(archive, orgIndex) {
+		if len(section.docs) != len(section.ids) {
+			return nil, nil, nil, newError(ErrVerificationFailed, nil, "backup has %d %ss but the index has %d", len(section.docs), section.kind, len(section.ids))
+		}
+
+		for name, id := range section.ids {
+			content, ok := section.docs[id]
+			if !ok {
+				return nil, nil, nil, newError(ErrVerificationFailed, nil, "backup is missing %s '%s'", section.kind, name)
+			}
+
+			if err := verifyBackupDocument(publicOrg, section.kind, id, content); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+
+	// Admins are public entities that the org doesn't sign one by one, so
+	// they're trusted through the org's signature on the archive, verified
+	// above. Each has to be the admin the index names, and no others.
+	adminIds, err := orgIndex.GetAdmins()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(archive.Admins) != len(adminIds) {
+		return nil, nil, nil, newError(ErrVerificationFailed, nil, "backup has %d admins but the index has %d", len(archive.Admins), len(adminIds))
+	}
+
+	for _, id := range adminIds {
+		adminJson, ok := archive.Admins[id]
+		if !ok {
+			return nil, nil, nil, newError(ErrVerificationFailed, nil, "backup is missing admin '%s'", id)
+		}
+
+		admin, err := entity.New(adminJson)
+		if err != nil {
+			return nil, nil, nil, wrapError(err, "loading admin '%s'", id)
+		}
+
+		if admin.Id() != id {
+			return nil, nil, nil, newError(ErrVerificationFailed, nil, "backup admin '%s' has id '%s'", id, admin.Id())
+		}
+	}
+
+	orgConfig, err := config.NewOrg()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := orgConfig.Load(archive.OrgConfig); err != nil {
+		return nil, nil, nil, wrapError(err, "loading backup org config")
+	}
+
+	if orgConfig.Data.Id != archive.OrgId || orgConfig.Data.Index != archive.IndexId {
+		return nil, nil, nil, newError(ErrVerificationFailed, nil, "backup org config isn't for org '%s'", archive.OrgId)
+	}
+
+	logger.Trace("returning backup")
+	return archive, org, orgIndex, nil
+}
+
+// writeNewFile writes data to a file that mustn't exist, so a backup never
+// replaces a file created since it was checked for.
+func writeNewFile(file string, data []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return newError(ErrAlreadyExists, err, "backup file '%s'", file)
+	} else if err != nil {
+		return wrapError(err, "creating backup file '%s'", file)
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(file)
+		return wrapError(err, "writing backup file '%s'", file)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
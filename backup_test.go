@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"github.com/pki-io/core/entity"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newTestBackupFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pkiio-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path.Join(dir, "test.backup"), func() { os.RemoveAll(dir) }
+}
+
+func TestOrgBackupRestore(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+	file, cleanup := newTestBackupFile(t)
+	defer cleanup()
+
+	caCont, _ := NewCA(backends.env(home))
+	_, err := caCont.New(newTestCAParams("ca"))
+	assert.NoError(t, err)
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	_, _, err = pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	params := newTestOrgParams("test", "admin")
+	params.BackupFile = stringPtr(file)
+
+	org, _ := NewOrg(backends.env(home))
+	report, err := org.Backup(params)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.CAs)
+	assert.Equal(t, 1, report.PairingKeys)
+	assert.Equal(t, 1, report.Admins)
+
+	// Backups are never overwritten
+	org, _ = NewOrg(backends.env(home))
+	_, err = org.Backup(params)
+	assert.True(t, IsAlreadyExists(err))
+
+	restored := newMemoryBackends()
+	org, _ = NewOrg(restored.env(home))
+	report, err = org.Restore(params)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.CAs)
+
+	caCont, _ = NewCA(restored.env(home))
+	ca, err := caCont.Show(newTestCAParams("ca"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ca", ca.Data.Body.Name)
+
+	org, _ = NewOrg(restored.env(home))
+	_, err = org.Restore(params)
+	assert.True(t, IsAlreadyExists(err))
+}
+
+func TestOrgRestoreUnpinned(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+	file, cleanup := newTestBackupFile(t)
+	defer cleanup()
+
+	params := newTestOrgParams("test", "admin")
+	params.BackupFile = stringPtr(file)
+
+	org, _ := NewOrg(backends.env(home))
+	_, err := org.Backup(params)
+	assert.NoError(t, err)
+
+	org, _ = NewOrg(backends.env(home))
+	publicOrg, err := org.Show(params)
+	assert.NoError(t, err)
+	fingerprint := OrgFingerprint(publicOrg)
+
+	// A home directory that has never seen the org
+	delete(home.files, home.path(publicOrg.Id()))
+
+	org, _ = NewOrg(newMemoryBackends().env(home))
+	_, err = org.Restore(params)
+	assert.True(t, IsVerificationFailed(err))
+
+	params.Fingerprint = stringPtr(strings.Repeat("0", 64))
+	org, _ = NewOrg(newMemoryBackends().env(home))
+	_, err = org.Restore(params)
+	assert.True(t, IsVerificationFailed(err))
+
+	params.Fingerprint = stringPtr(strings.ToUpper(fingerprint))
+	org, _ = NewOrg(newMemoryBackends().env(home))
+	_, err = org.Restore(params)
+	assert.NoError(t, err)
+}
+
+func TestOrgBackupUnsignedDocument(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+	file, cleanup := newTestBackupFile(t)
+	defer cleanup()
+
+	caCont, _ := NewCA(backends.env(home))
+	_, err := caCont.New(newTestCAParams("ca"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	orgIndex, err := env.controllers.org.GetIndex()
+	assert.NoError(t, err)
+	caId, err := orgIndex.GetCA("ca")
+	assert.NoError(t, err)
+
+	// Replace the CA with one signed by someone else
+	other, _ := entity.New(nil)
+	assert.NoError(t, other.GenerateKeys())
+	container, err := other.EncryptThenSignString("{}", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, backends.api.SendPrivate(env.controllers.org.OrgId(), caId, container.Dump()))
+
+	params := newTestOrgParams("test", "admin")
+	params.BackupFile = stringPtr(file)
+
+	org, _ := NewOrg(backends.env(home))
+	_, err = org.Backup(params)
+	assert.True(t, IsVerificationFailed(err))
+
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWriteNewFile(t *testing.T) {
+	file, cleanup := newTestBackupFile(t)
+	defer cleanup()
+
+	assert.NoError(t, writeNewFile(file, []byte("first")))
+
+	// A file created by someone else is never replaced
+	assert.True(t, IsAlreadyExists(writeNewFile(file, []byte("second"))))
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+}
@@ -0,0 +1,740 @@
+package controller
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/sha256"
+	stdx509 "crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/pki-io/core/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of bulk import entries.
+const (
+	ImportKindCA          string = "ca"
+	ImportKindCertificate string = "certificate"
+	ImportKindKey         string = "key"
+	ImportKindFile        string = "file"
+)
+
+const (
+	// opensslIndexFile is the certificate database of an OpenSSL CA directory
+	opensslIndexFile string = "index.txt"
+	// maxImportChainLength stops chain building going round cross-signed CAs
+	maxImportChainLength int = 10
+)
+
+// ImportRule maps the CAs and certificates found by a bulk import to names and
+// tags. Path is matched against the file's path relative to the import
+// directory, and Subject against the certificate's common name, both with
+// path.Match. A rule with neither matches everything.
+type ImportRule struct {
+	Path    string `json:"path,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	// Name replaces the common name as the name of the CA or certificate
+	Name string `json:"name,omitempty"`
+	// Tags are added to the tags of the other matching rules
+	Tags string `json:"tags,omitempty"`
+	// Skip leaves matching certificates out of the import
+	Skip bool `json:"skip,omitempty"`
+}
+
+// Validate checks the rule's patterns and tags.
+func (rule *ImportRule) Validate() error {
+	for _, pattern := range []string{rule.Path, rule.Subject} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return newError(ErrInvalidParams, err, "invalid import rule pattern '%s'", pattern)
+		}
+	}
+
+	if rule.Tags != "" {
+		if err := ValidateTags(rule.Tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rule *ImportRule) matches(file, subject string) bool {
+	if rule.Path != "" {
+		if ok, _ := path.Match(rule.Path, file); !ok {
+			return false
+		}
+	}
+
+	if rule.Subject != "" {
+		if ok, _ := path.Match(rule.Subject, subject); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ImportMapping is the mapping file of a bulk import.
+type ImportMapping struct {
+	Rules []*ImportRule `json:"rules"`
+}
+
+// LoadImportMapping reads and validates a JSON mapping file.
+func LoadImportMapping(file string) (*ImportMapping, error) {
+	data, err := readImportFile(file, "mapping file")
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := new(ImportMapping)
+	if err := json.Unmarshal(data, mapping); err != nil {
+		return nil, newError(ErrInvalidParams, err, "decoding mapping file '%s'", file)
+	}
+
+	for _, rule := range mapping.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, wrapError(err, "validating mapping file '%s'", file)
+		}
+	}
+	return mapping, nil
+}
+
+// apply returns the name from the first matching rule with one, the tags of
+// all matching rules and whether any of them skip the certificate.
+func (mapping *ImportMapping) apply(file, subject string) (string, []string, bool) {
+	var name string
+	var tags []string
+	var skip bool
+	for _, rule := range mapping.Rules {
+		if !rule.matches(file, subject) {
+			continue
+		}
+
+		if name == "" {
+			name = rule.Name
+		}
+
+		if rule.Tags != "" {
+			tags = append(tags, ParseTags(rule.Tags)...)
+		}
+		skip = skip || rule.Skip
+	}
+	return name, tags, skip
+}
+
+// opensslIndexEntry is a line of an OpenSSL CA's index.txt: the status of a
+// certificate, V for valid, R for revoked or E for expired, and its subject.
+type opensslIndexEntry struct {
+	Status  string
+	Subject string
+}
+
+// parseOpenSSLIndex reads an OpenSSL index.txt, keyed by serial number.
+func parseOpenSSLIndex(data string) map[string]*opensslIndexEntry {
+	entries := make(map[string]*opensslIndexEntry)
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(fields) < 6 {
+			continue
+		}
+		entries[normalizeSerial(fields[3])] = &opensslIndexEntry{Status: fields[0], Subject: fields[5]}
+	}
+	return entries
+}
+
+// normalizeSerial returns a hex serial number in upper case without leading
+// zeros.
+func normalizeSerial(serial string) string {
+	serial = strings.TrimLeft(strings.ToUpper(serial), "0")
+	if serial == "" {
+		return "0"
+	}
+	return serial
+}
+
+// importKind returns whether a certificate is imported as a CA or a
+// certificate. Legacy CAs are self-signed certificates without the CA basic
+// constraint.
+func importKind(cert *stdx509.Certificate, allowLegacy bool) string {
+	if cert.BasicConstraintsValid && cert.IsCA {
+		return ImportKindCA
+	}
+
+	if allowLegacy && bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+		return ImportKindCA
+	}
+	return ImportKindCertificate
+}
+
+// importTreeCert is a certificate found in a file of the import tree.
+type importTreeCert struct {
+	path string
+	cert *stdx509.Certificate
+}
+
+// importTreeKey is a private key found in a file of the import tree.
+type importTreeKey struct {
+	path string
+	key  stdcrypto.Signer
+}
+
+// importTree is what a bulk import found in the import directory.
+type importTree struct {
+	certs   []*importTreeCert
+	keys    []*importTreeKey
+	index   map[string]*opensslIndexEntry
+	skipped []*BulkImportEntry
+}
+
+// status returns a certificate's status in the OpenSSL index, or an empty
+// string if it isn't there.
+func (tree *importTree) status(cert *stdx509.Certificate) string {
+	entry, ok := tree.index[normalizeSerial(fmt.Sprintf("%X", cert.SerialNumber))]
+	if !ok || !strings.Contains(entry.Subject, "CN="+cert.Subject.CommonName) {
+		return ""
+	}
+	return entry.Status
+}
+
+// scanImportTree reads the certificates and keys under dir, in PEM files and
+// in DER and PKCS #12 files by their extension, and the OpenSSL index if dir
+// is an OpenSSL CA directory. Hidden files are ignored, and files that can't
+// be read are skipped and reported.
+func scanImportTree(dir, password string) (*importTree, error) {
+	tree := &importTree{index: make(map[string]*opensslIndexEntry)}
+
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(info.Name(), ".") && file != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		logger.Debugf("reading import file '%s'", rel)
+		data, err := fs.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		if rel == opensslIndexFile {
+			logger.Debug("reading OpenSSL index")
+			tree.index = parseOpenSSLIndex(data)
+			return nil
+		}
+
+		certs, keys, err := parseImportTreeFile(rel, []byte(data), password)
+		if err != nil {
+			logger.Warnf("skipping import file '%s': %s", rel, err)
+			tree.skipped = append(tree.skipped, &BulkImportEntry{Path: rel, Kind: ImportKindFile, Reason: err.Error()})
+			return nil
+		}
+
+		for _, cert := range certs {
+			tree.certs = append(tree.certs, &importTreeCert{path: rel, cert: cert})
+		}
+
+		for _, key := range keys {
+			tree.keys = append(tree.keys, &importTreeKey{path: rel, key: key})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError(err, "reading import directory '%s'", dir)
+	}
+
+	return tree, nil
+}
+
+// parseImportTreeFile reads the certificates and keys in a file of the import
+// tree. PEM blocks other than certificates and keys, e.g. CRLs, are ignored,
+// as are binary files without a certificate, key or PKCS #12 extension.
+func parseImportTreeFile(file string, data []byte, password string) ([]*stdx509.Certificate, []stdcrypto.Signer, error) {
+	var certs []*stdx509.Certificate
+	var keys []stdcrypto.Signer
+
+	if DetectFormat(data) == FormatPEM {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				return certs, keys, nil
+			}
+
+			switch {
+			case block.Type == "CERTIFICATE":
+				cert, err := stdx509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, nil, newError(ErrInvalidParams, err, "parsing certificate")
+				}
+				certs = append(certs, cert)
+			case isPrivateKeyBlock(block):
+				key, err := parsePrivateKeyBlock(block, password)
+				if err != nil {
+					return nil, nil, err
+				}
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	switch strings.ToLower(path.Ext(file)) {
+	case ".der", ".cer", ".crt":
+		certs, err := stdx509.ParseCertificates(data)
+		if err != nil {
+			return nil, nil, newError(ErrInvalidParams, err, "parsing DER certificate")
+		}
+		return certs, nil, nil
+	case ".key":
+		key, err := ParsePrivateKeyData(data, password)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, []stdcrypto.Signer{key}, nil
+	case ".p12", ".pfx":
+		key, certs, err := DecodePKCS12(data, password)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if key != nil {
+			keys = append(keys, key)
+		}
+		return certs, keys, nil
+	}
+
+	logger.Debugf("ignoring import file '%s'", file)
+	return nil, nil, nil
+}
+
+// BulkImportEntry is a CA, certificate, key or file found by a bulk import.
+type BulkImportEntry struct {
+	// Path is the file's path relative to the import directory
+	Path string
+	Name string
+	// Kind is one of the ImportKind* kinds
+	Kind string
+	// Issuer is the name of the issuing CA, if it was found in the tree
+	Issuer string
+	Tags   string
+	// Reason is why the entry was skipped or is a duplicate
+	Reason string
+	// Err is why the entry failed to import
+	Err error
+}
+
+// BulkImportReport is the outcome of a bulk import. Duplicates are
+// certificates found in more than one file, or already imported by an earlier
+// run. Skipped entries weren't imported for another reason: they were revoked,
+// expired, excluded by the mapping, superseded by a newer certificate with the
+// same name, clashed with a different CA or certificate in the org, or
+// couldn't be read.
+type BulkImportReport struct {
+	CAs          []*BulkImportEntry
+	Certificates []*BulkImportEntry
+	Duplicates   []*BulkImportEntry
+	Skipped      []*BulkImportEntry
+	Failed       []*BulkImportEntry
+}
+
+// BulkImportError is returned when some CAs or certificates couldn't be
+// imported. The others were imported.
+type BulkImportError struct {
+	Failed []*BulkImportEntry
+}
+
+func (e *BulkImportError) Error() string {
+	if len(e.Failed) == 0 {
+		return "no imports failed"
+	}
+	first := e.Failed[0]
+	return fmt.Sprintf("unable to import %d CAs and certificates, first '%s' from '%s': %s", len(e.Failed), first.Name, first.Path, first.Err)
+}
+
+// Unwrap returns the error of the first failed import.
+func (e *BulkImportError) Unwrap() error {
+	if len(e.Failed) == 0 {
+		return nil
+	}
+	return e.Failed[0].Err
+}
+
+// bulkImportItem is a CA or certificate to import.
+type bulkImportItem struct {
+	found    *importTreeCert
+	entry    *BulkImportEntry
+	imported *ImportedCert
+}
+
+// bulkImportPlan is what a bulk import will create, CAs in chain order, and
+// what it found but won't.
+type bulkImportPlan struct {
+	cas        []*bulkImportItem
+	certs      []*bulkImportItem
+	duplicates []*BulkImportEntry
+	skipped    []*BulkImportEntry
+}
+
+// planBulkImport works out the CAs and certificates to import from the
+// import tree: it drops duplicates, matches keys to certificates, names and
+// tags them with the mapping, skips revoked and expired certificates, keeps
+// only the newest certificate of each name, and builds each one's chain from
+// the CAs in the tree.
+func planBulkImport(tree *importTree, mapping *ImportMapping, allowLegacy bool, now time.Time) *bulkImportPlan {
+	plan := &bulkImportPlan{skipped: tree.skipped}
+
+	// The first file with a certificate is kept and the rest are duplicates
+	seen := make(map[[sha256.Size]byte]string)
+	unique := make([]*importTreeCert, 0)
+	for _, found := range tree.certs {
+		fingerprint := sha256.Sum256(found.cert.Raw)
+		if first, ok := seen[fingerprint]; ok {
+			plan.duplicates = append(plan.duplicates, &BulkImportEntry{
+				Path:   found.path,
+				Name:   found.cert.Subject.CommonName,
+				Kind:   importKind(found.cert, allowLegacy),
+				Reason: fmt.Sprintf("same certificate as '%s'", first),
+			})
+			continue
+		}
+
+		seen[fingerprint] = found.path
+		unique = append(unique, found)
+	}
+
+	keys := make(map[*importTreeCert]stdcrypto.Signer)
+	for _, found := range tree.keys {
+		matched := false
+		for _, c := range unique {
+			if CheckKeyMatches(found.key, c.cert.PublicKey) == nil {
+				keys[c] = found.key
+				matched = true
+			}
+		}
+
+		if !matched {
+			plan.skipped = append(plan.skipped, &BulkImportEntry{Path: found.path, Kind: ImportKindKey, Reason: "no certificate for private key"})
+		}
+	}
+
+	items := make(map[*importTreeCert]*bulkImportItem)
+	cas := make([]*importTreeCert, 0)
+	for _, found := range unique {
+		cert := found.cert
+		name, tags, skip := mapping.apply(found.path, cert.Subject.CommonName)
+		if name == "" {
+			name = cert.Subject.CommonName
+		}
+		if name == "" {
+			name = strings.TrimSuffix(path.Base(found.path), path.Ext(found.path))
+		}
+
+		entry := &BulkImportEntry{Path: found.path, Name: name, Kind: importKind(cert, allowLegacy), Tags: strings.Join(tags, ",")}
+		items[found] = &bulkImportItem{found: found, entry: entry, imported: &ImportedCert{Certificate: cert, Key: keys[found]}}
+		if entry.Kind == ImportKindCA {
+			cas = append(cas, found)
+		}
+
+		switch status := tree.status(cert); {
+		case skip:
+			entry.Reason = "excluded by mapping"
+		case status == "R":
+			entry.Reason = "revoked in OpenSSL index"
+		case status == "E" || now.After(cert.NotAfter):
+			entry.Reason = fmt.Sprintf("expired on %s", cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	issuerOf := func(cert *stdx509.Certificate) *importTreeCert {
+		for _, ca := range cas {
+			if ca.cert != cert && bytes.Equal(cert.RawIssuer, ca.cert.RawSubject) && cert.CheckSignatureFrom(ca.cert) == nil {
+				return ca
+			}
+		}
+		return nil
+	}
+
+	// Of the certificates with the same kind and name, the one that expires
+	// last is imported
+	kept := make(map[string]*bulkImportItem)
+	for _, found := range unique {
+		item := items[found]
+		if item.entry.Reason != "" {
+			plan.skipped = append(plan.skipped, item.entry)
+			continue
+		}
+
+		issuer := issuerOf(found.cert)
+		if issuer != nil {
+			item.entry.Issuer = items[issuer].entry.Name
+		}
+		for ; issuer != nil && len(item.imported.Chain) < maxImportChainLength; issuer = issuerOf(issuer.cert) {
+			item.imported.Chain = append(item.imported.Chain, issuer.cert)
+		}
+
+		key := item.entry.Kind + "/" + item.entry.Name
+		other, ok := kept[key]
+		if !ok {
+			kept[key] = item
+			continue
+		}
+
+		newer, older := item, other
+		if !item.found.cert.NotAfter.After(other.found.cert.NotAfter) {
+			newer, older = other, item
+		}
+		kept[key] = newer
+		older.entry.Reason = fmt.Sprintf("superseded by '%s'", newer.entry.Path)
+		plan.skipped = append(plan.skipped, older.entry)
+	}
+
+	for _, found := range unique {
+		item := items[found]
+		if kept[item.entry.Kind+"/"+item.entry.Name] != item {
+			continue
+		}
+
+		if item.entry.Kind == ImportKindCA {
+			plan.cas = append(plan.cas, item)
+		} else {
+			plan.certs = append(plan.certs, item)
+		}
+	}
+
+	// Roots first, then the CAs they issued
+	sort.SliceStable(plan.cas, func(i, j int) bool {
+		return len(plan.cas[i].imported.Chain) < len(plan.cas[j].imported.Chain)
+	})
+
+	return plan
+}
+
+type BulkImportController struct {
+	env *Environment
+}
+
+func NewBulkImport(env *Environment) (*BulkImportController, error) {
+	cont := new(BulkImportController)
+	cont.env = env
+	return cont, nil
+}
+
+// Import reads an OpenSSL CA directory, or any tree of certificate and key
+// files, and creates its CAs and certificates in the org, with each
+// certificate's chain from the CAs in the tree. Names and tags come from the
+// mapping file, if there is one, and otherwise names are common names.
+// Certificates whose names are already in the org are left alone, so
+// importing the same tree again changes nothing. The report says what was
+// imported and what wasn't, and a *BulkImportError is returned if some CAs or
+// certificates failed to import.
+func (cont *BulkImportController) Import(params *BulkImportParams) (*BulkImportReport, error) {
+	logger.Debug("bulk importing CAs and certificates")
+	logger.Trace("received params [NOT LOGGED]")
+
+	if err := params.ValidateDir(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateMappingFile(false); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateCertExpiry(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateAllowLegacyCA(false); err != nil {
+		return nil, err
+	}
+
+	mapping := new(ImportMapping)
+	if *params.MappingFile != "" {
+		var err error
+		if mapping, err = LoadImportMapping(*params.MappingFile); err != nil {
+			return nil, err
+		}
+	}
+
+	ok, err := fs.Exists(*params.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, newError(ErrNotFound, nil, "import directory '%s'", *params.Dir)
+	}
+
+	tree, err := scanImportTree(*params.Dir, paramPassword(params.Password))
+	if err != nil {
+		return nil, err
+	}
+
+	allowLegacy := params.AllowLegacyCA != nil && *params.AllowLegacyCA
+	plan := planBulkImport(tree, mapping, allowLegacy, cont.env.Now())
+	logger.Debugf("importing %d CAs and %d certificates", len(plan.cas), len(plan.certs))
+
+	if err := cont.env.StartSession(); err != nil {
+		return nil, err
+	}
+	defer cont.env.EndSession()
+
+	report := &BulkImportReport{Duplicates: plan.duplicates, Skipped: plan.skipped}
+	for _, item := range plan.cas {
+		cont.importCA(item, params, report)
+	}
+
+	for _, item := range plan.certs {
+		cont.importCert(item, report)
+	}
+
+	if len(report.Failed) > 0 {
+		return report, &BulkImportError{Failed: report.Failed}
+	}
+
+	logger.Trace("returning bulk import report")
+	return report, nil
+}
+
+func (cont *BulkImportController) importCA(item *bulkImportItem, params *BulkImportParams, report *BulkImportReport) {
+	entry := item.entry
+	caCont, err := NewCA(cont.env)
+	if err != nil {
+		cont.failed(entry, err, report)
+		return
+	}
+
+	if cont.checkExisting(item, report) {
+		return
+	}
+
+	caParams := NewCAParams()
+	fillParams(caParams)
+	*caParams.Name = entry.Name
+	*caParams.Tags = entry.Tags
+	*caParams.CertExpiry = *params.CertExpiry
+	*caParams.AllowLegacyCA = params.AllowLegacyCA != nil && *params.AllowLegacyCA
+
+	logger.Infof("importing CA '%s' from '%s'", entry.Name, entry.Path)
+	_, err = caCont.Import(caParams, item.imported)
+	if IsAlreadyExists(err) && cont.checkExisting(item, report) {
+		return
+	} else if err != nil {
+		cont.failed(entry, err, report)
+		return
+	}
+	report.CAs = append(report.CAs, entry)
+}
+
+func (cont *BulkImportController) importCert(item *bulkImportItem, report *BulkImportReport) {
+	entry := item.entry
+	certCont, err := NewCertificate(cont.env)
+	if err != nil {
+		cont.failed(entry, err, report)
+		return
+	}
+
+	if cont.checkExisting(item, report) {
+		return
+	}
+
+	certParams := NewCertificateParams()
+	fillParams(certParams)
+	*certParams.Name = entry.Name
+	*certParams.Tags = entry.Tags
+
+	logger.Infof("importing certificate '%s' from '%s'", entry.Name, entry.Path)
+	_, err = certCont.Import(certParams, item.imported)
+	if IsAlreadyExists(err) && cont.checkExisting(item, report) {
+		return
+	} else if err != nil {
+		cont.failed(entry, err, report)
+		return
+	}
+	report.Certificates = append(report.Certificates, entry)
+}
+
+// checkExisting looks the entry's name up in the latest org index, so names
+// taken since the import started, by this run or anyone else, are seen. If
+// the name is taken it reports the entry as a duplicate or skipped, or as
+// failed if the existing one can't be loaded, and returns true.
+func (cont *BulkImportController) checkExisting(item *bulkImportItem, report *BulkImportReport) bool {
+	entry := item.entry
+	orgIndex, err := cont.env.controllers.org.GetIndex()
+	if err != nil {
+		cont.failed(entry, err, report)
+		return true
+	}
+
+	var existingPem, kind string
+	if entry.Kind == ImportKindCA {
+		kind = "CA"
+		id, err := orgIndex.GetCA(entry.Name)
+		if err != nil {
+			return false
+		}
+
+		ca, err := cont.env.controllers.org.GetCA(id)
+		if err != nil {
+			cont.failed(entry, err, report)
+			return true
+		}
+		existingPem = ca.Data.Body.Certificate
+	} else {
+		kind = "certificate"
+		id, err := orgIndex.GetCert(entry.Name)
+		if err != nil {
+			return false
+		}
+
+		certCont, _ := NewCertificate(cont.env)
+		cert, err := certCont.GetCert(id)
+		if err != nil {
+			cont.failed(entry, err, report)
+			return true
+		}
+		existingPem = cert.Data.Body.Certificate
+	}
+
+	existingImport(entry, item.imported, existingPem, kind, report)
+	return true
+}
+
+func (cont *BulkImportController) failed(entry *BulkImportEntry, err error, report *BulkImportReport) {
+	logger.Warnf("unable to import '%s' from '%s': %s", entry.Name, entry.Path, err)
+	entry.Err = err
+	report.Failed = append(report.Failed, entry)
+}
+
+// existingImport reports an entry whose name is already in the org: as a
+// duplicate if it's the same certificate, imported by an earlier run, or as
+// skipped if it isn't.
+func existingImport(entry *BulkImportEntry, imported *ImportedCert, existingPem, kind string, report *BulkImportReport) {
+	certs, err := pemDecodeCertificates([]byte(existingPem))
+	if err == nil && len(certs) > 0 && bytes.Equal(certs[0].Raw, imported.Certificate.Raw) {
+		logger.Debugf("%s '%s' already imported", kind, entry.Name)
+		entry.Reason = "already imported"
+		report.Duplicates = append(report.Duplicates, entry)
+		return
+	}
+
+	entry.Reason = fmt.Sprintf("a different %s named '%s' already exists", kind, entry.Name)
+	report.Skipped = append(report.Skipped, entry)
+}
@@ -0,0 +1,36 @@
+package controller
+
+type BulkImportParams struct {
+	// Dir is an OpenSSL CA directory or any tree of certificate and key files
+	Dir *string
+	// MappingFile is an optional JSON file of ImportMapping rules
+	MappingFile *string
+	// Password decrypts encrypted keys and PKCS #12 files in the tree
+	Password *string
+	// CertExpiry is the certificate expiry in days for the imported CAs
+	CertExpiry *int
+	// AllowLegacyCA imports self-signed certificates without the CA basic
+	// constraint as CAs, and skips the CA checks, as for CAParams
+	AllowLegacyCA *bool
+}
+
+func NewBulkImportParams() *BulkImportParams {
+	return new(BulkImportParams)
+}
+
+func (params *BulkImportParams) ValidateDir(required bool) error {
+	if required && *params.Dir == "" {
+		return newError(ErrInvalidParams, nil, "import directory cannot be empty")
+	}
+	return nil
+}
+
+func (params *BulkImportParams) ValidateCertExpiry(required bool) error {
+	if required && *params.CertExpiry <= 0 {
+		return newError(ErrInvalidParams, nil, "certificate expiry must be a positive number of days")
+	}
+	return nil
+}
+
+func (params *BulkImportParams) ValidateMappingFile(required bool) error   { return nil }
+func (params *BulkImportParams) ValidateAllowLegacyCA(required bool) error { return nil }
@@ -0,0 +1,256 @@
+package controller
+
+import (
+	stdcrypto "crypto"
+	"crypto/rand"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// newTestImportCert issues a certificate from the parent, or a self-signed
+// one if parent is nil.
+func newTestImportCert(t *testing.T, cn string, serial int64, isCA bool, notAfter time.Time, parent *stdx509.Certificate, parentKey stdcrypto.Signer) (*stdx509.Certificate, stdcrypto.Signer) {
+	key, err := GenerateKey(KeySpecP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &stdx509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notAfter.Add(-48 * time.Hour),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = stdx509.KeyUsageCertSign
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := stdx509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := stdx509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestParseOpenSSLIndex(t *testing.T) {
+	index := parseOpenSSLIndex("V\t301231235959Z\t\t01\tunknown\t/CN=web\n" +
+		"R\t301231235959Z\t200101000000Z\t0A\tunknown\t/O=pki.io/CN=old\n" +
+		"garbage\n")
+
+	assert.Len(t, index, 2)
+	assert.Equal(t, "V", index["1"].Status)
+	assert.Equal(t, "R", index["A"].Status)
+	assert.Equal(t, "/O=pki.io/CN=old", index["A"].Subject)
+}
+
+func TestImportMapping(t *testing.T) {
+	mapping := &ImportMapping{Rules: []*ImportRule{
+		{Tags: "migrated"},
+		{Path: "certs/*.pem", Subject: "web*", Name: "web", Tags: "web,Prod"},
+		{Subject: "test*", Skip: true},
+	}}
+	for _, rule := range mapping.Rules {
+		assert.NoError(t, rule.Validate())
+	}
+
+	name, tags, skip := mapping.apply("certs/web1.pem", "web1.example.com")
+	assert.Equal(t, "web", name)
+	assert.Equal(t, []string{"migrated", "web", "prod"}, tags)
+	assert.False(t, skip)
+
+	name, tags, skip = mapping.apply("other/web1.pem", "web1.example.com")
+	assert.Equal(t, "", name)
+	assert.Equal(t, []string{"migrated"}, tags)
+
+	_, _, skip = mapping.apply("certs/test.pem", "test.example.com")
+	assert.True(t, skip)
+
+	assert.True(t, IsInvalidParams((&ImportRule{Path: "["}).Validate()))
+}
+
+func TestPlanBulkImport(t *testing.T) {
+	now := time.Now()
+	later := now.Add(365 * 24 * time.Hour)
+
+	root, rootKey := newTestImportCert(t, "root", 1, true, later, nil, nil)
+	inter, interKey := newTestImportCert(t, "inter", 2, true, later, root, rootKey)
+	web, webKey := newTestImportCert(t, "web", 3, false, later, inter, interKey)
+	oldWeb, _ := newTestImportCert(t, "web", 4, false, now.Add(time.Hour), inter, interKey)
+	revoked, _ := newTestImportCert(t, "revoked", 5, false, later, inter, interKey)
+	expired, _ := newTestImportCert(t, "expired", 6, false, now.Add(-time.Hour), inter, interKey)
+	_, strayKey := newTestImportCert(t, "stray", 7, false, later, nil, nil)
+
+	tree := &importTree{
+		certs: []*importTreeCert{
+			{path: "cacert.pem", cert: root},
+			{path: "certs/inter.pem", cert: inter},
+			{path: "newcerts/03.pem", cert: web},
+			{path: "certs/web.pem", cert: web},
+			{path: "newcerts/04.pem", cert: oldWeb},
+			{path: "newcerts/05.pem", cert: revoked},
+			{path: "newcerts/06.pem", cert: expired},
+		},
+		keys: []*importTreeKey{
+			{path: "private/inter.key", key: interKey},
+			{path: "private/web.key", key: webKey},
+			{path: "private/stray.key", key: strayKey},
+		},
+		index: parseOpenSSLIndex("R\t301231235959Z\t200101000000Z\t05\tunknown\t/CN=revoked\n"),
+	}
+
+	mapping := &ImportMapping{Rules: []*ImportRule{{Subject: "web", Tags: "web"}}}
+	plan := planBulkImport(tree, mapping, false, now)
+
+	// Roots come before the CAs they issue
+	assert.Len(t, plan.cas, 2)
+	assert.Equal(t, "root", plan.cas[0].entry.Name)
+	assert.Equal(t, "", plan.cas[0].entry.Issuer)
+	assert.Equal(t, "inter", plan.cas[1].entry.Name)
+	assert.Equal(t, "root", plan.cas[1].entry.Issuer)
+	assert.NotNil(t, plan.cas[1].imported.Key)
+
+	assert.Len(t, plan.certs, 1)
+	webItem := plan.certs[0]
+	assert.Equal(t, "newcerts/03.pem", webItem.entry.Path)
+	assert.Equal(t, "inter", webItem.entry.Issuer)
+	assert.Equal(t, "web", webItem.entry.Tags)
+	assert.Equal(t, []*stdx509.Certificate{inter, root}, webItem.imported.Chain)
+	assert.NoError(t, CheckKeyMatches(webItem.imported.Key, web.PublicKey))
+
+	assert.Len(t, plan.duplicates, 1)
+	assert.Equal(t, "certs/web.pem", plan.duplicates[0].Path)
+
+	reasons := make(map[string]string)
+	for _, entry := range plan.skipped {
+		reasons[entry.Path] = entry.Reason
+	}
+	assert.Len(t, reasons, 4)
+	assert.Equal(t, "no certificate for private key", reasons["private/stray.key"])
+	assert.Equal(t, "revoked in OpenSSL index", reasons["newcerts/05.pem"])
+	assert.Contains(t, reasons["newcerts/06.pem"], "expired")
+	assert.Equal(t, "superseded by 'newcerts/03.pem'", reasons["newcerts/04.pem"])
+}
+
+func TestScanImportTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkiio-import")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	root, rootKey := newTestImportCert(t, "root", 1, true, time.Now().Add(time.Hour), nil, nil)
+	keyPem, _ := PemEncodePrivateKey(rootKey)
+
+	write := func(name string, data []byte) {
+		assert.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0700))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), data, 0600))
+	}
+	write("cacert.pem", append(pemCert(root.Raw), []byte(keyPem)...))
+	write("certs/root.crt", root.Raw)
+	write("crl/crl.pem", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: []byte{0}}))
+	write("private/enc.pem", pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte{0}}))
+	write(".git/root.pem", pemCert(root.Raw))
+	write("serial", []byte("02\n"))
+	write("index.txt", []byte("V\t301231235959Z\t\t01\tunknown\t/CN=root\n"))
+
+	tree, err := scanImportTree(dir, "")
+	assert.NoError(t, err)
+	assert.Len(t, tree.certs, 2)
+	assert.Len(t, tree.keys, 1)
+	assert.Equal(t, "V", tree.status(root))
+
+	assert.Len(t, tree.skipped, 1)
+	assert.Equal(t, "private/enc.pem", tree.skipped[0].Path)
+	assert.Equal(t, ImportKindFile, tree.skipped[0].Kind)
+}
+
+func TestBulkImport(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	dir, err := ioutil.TempDir("", "pkiio-import")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	later := time.Now().Add(24 * time.Hour)
+	root, rootKey := newTestImportCert(t, "root", 1, true, later, nil, nil)
+	web, webKey := newTestImportCert(t, "web", 2, false, later, root, rootKey)
+	rootKeyPem, _ := PemEncodePrivateKey(rootKey)
+	webKeyPem, _ := PemEncodePrivateKey(webKey)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "cacert.pem"), append(pemCert(root.Raw), []byte(rootKeyPem)...), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "web.pem"), append(pemCert(web.Raw), []byte(webKeyPem)...), 0600))
+
+	mappingFile := path.Join(dir, "mapping.json")
+	assert.NoError(t, ioutil.WriteFile(mappingFile, []byte(`{"rules": [{"subject": "web", "name": "www", "tags": "web"}]}`), 0600))
+
+	params := NewBulkImportParams()
+	params.Dir = stringPtr(dir)
+	params.MappingFile = stringPtr(mappingFile)
+	params.Password = stringPtr("")
+	params.CertExpiry = intPtr(90)
+	params.AllowLegacyCA = boolPtr(false)
+
+	cont, _ := NewBulkImport(backends.env(home))
+	report, err := cont.Import(params)
+	assert.NoError(t, err)
+	assert.Len(t, report.CAs, 1)
+	assert.Len(t, report.Certificates, 1)
+	assert.Equal(t, "www", report.Certificates[0].Name)
+	assert.Equal(t, "root", report.Certificates[0].Issuer)
+
+	certCont, _ := NewCertificate(backends.env(home))
+	cert, err := certCont.Show(newTestCertificateParams("www"))
+	assert.NoError(t, err)
+	assert.Equal(t, string(pemCert(root.Raw)), cert.Data.Body.CACertificate)
+
+	// Importing again changes nothing
+	cont, _ = NewBulkImport(backends.env(home))
+	report, err = cont.Import(params)
+	assert.NoError(t, err)
+	assert.Len(t, report.CAs, 0)
+	assert.Len(t, report.Certificates, 0)
+	assert.Len(t, report.Duplicates, 2)
+	assert.Equal(t, "already imported", report.Duplicates[0].Reason)
+}
+
+func TestBulkImportNameTakenDuringRun(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	later := time.Now().Add(24 * time.Hour)
+	root, _ := newTestImportCert(t, "root", 1, true, later, nil, nil)
+	other, otherKey := newTestImportCert(t, "root", 2, true, later, nil, nil)
+	tree := &importTree{certs: []*importTreeCert{{path: "cacert.pem", cert: root}}, index: make(map[string]*opensslIndexEntry)}
+	plan := planBulkImport(tree, new(ImportMapping), false, time.Now())
+
+	env := backends.env(home)
+	assert.NoError(t, env.StartSession())
+	defer env.EndSession()
+
+	// Another CA takes the name after the import has planned its CAs
+	caCont, _ := NewCA(env)
+	_, err := caCont.Import(newTestCAParams("root"), &ImportedCert{Certificate: other, Key: otherKey})
+	assert.NoError(t, err)
+
+	params := NewBulkImportParams()
+	params.CertExpiry = intPtr(90)
+	params.AllowLegacyCA = boolPtr(false)
+	report := new(BulkImportReport)
+	cont, _ := NewBulkImport(env)
+	cont.importCA(plan.cas[0], params, report)
+	assert.Empty(t, report.Failed)
+	assert.Len(t, report.Skipped, 1)
+	assert.Equal(t, "a different CA named 'root' already exists", report.Skipped[0].Reason)
+}
@@ -2,14 +2,27 @@
 package controller
 
 import (
-	"fmt"
-	"github.com/pki-io/core/crypto"
-	"github.com/pki-io/core/document"
-	"github.com/pki-io/core/fs"
+	"bytes"
+	stdx509 "crypto/x509"
+	"errors"
+	"github.com/pki-io/core/index"
 	"github.com/pki-io/core/x509"
+	"os"
+	"strings"
 	"time"
 )
 
+// CAChainsDocument is the name of the org's private document holding the
+// chains of imported intermediate CAs, which the CAs themselves don't keep.
+const CAChainsDocument string = "ca-chains"
+
+// CAChain is an intermediate CA's chain, from its issuer up, as concatenated
+// PEM. ParentId is the id of the issuing CA if it's in the org.
+type CAChain struct {
+	ParentId string `json:"parent-id,omitempty"`
+	Chain    string `json:"chain"`
+}
+
 type CAController struct {
 	env *Environment
 }
@@ -24,32 +37,7 @@ func (cont *CAController) GetCA(id string) (*x509.CA, error) {
 	logger.Debugf("getting CA")
 	logger.Tracef("received id '%s", id)
 
-	logger.Debugf("getting CA json '%s' for org '%s'", id, cont.env.controllers.org.OrgId())
-	caContainerJson, err := cont.env.api.GetPrivate(cont.env.controllers.org.OrgId(), id)
-	if err != nil {
-		return nil, err
-	}
-
-	logger.Debug("creating new container from json")
-	caContainer, err := document.NewContainer(caContainerJson)
-	if err != nil {
-		return nil, err
-	}
-
-	logger.Debug("decrypting container")
-	caJson, err := cont.env.controllers.org.org.VerifyThenDecrypt(caContainer)
-	if err != nil {
-		return nil, err
-	}
-
-	logger.Debug("loading CA json to struct")
-	ca, err := x509.NewCA(caJson)
-	if err != nil {
-		return nil, err
-	}
-
-	logger.Trace("returning CA")
-	return ca, nil
+	return cont.env.controllers.org.GetCA(id)
 }
 
 func (cont *CAController) SaveCA(ca *x509.CA) error {
@@ -65,60 +53,180 @@ func (cont *CAController) SaveCA(ca *x509.CA) error {
 	logger.Debug("saving encrypted CA")
 	err = cont.env.api.SendPrivate(cont.env.controllers.org.org.Data.Body.Id, ca.Data.Body.Id, caContainer.Dump())
 	if err != nil {
-		return err
+		return wrapError(err, "sending CA '%s'", ca.Data.Body.Id)
 	}
 
+	cont.env.controllers.org.UncacheCA(ca.Data.Body.Id)
+
 	logger.Trace("returning nil error")
 	return nil
 }
 
-func (cont *CAController) ResetCATags(caId, tags string) error {
-	logger.Debug("resetting CA tags")
-	logger.Tracef("received caId '%s' and tags '%s", caId, tags)
+// GetCAChains returns the chains of the org's CAs by CA id and the ETag of the
+// stored document, which is empty if there isn't one yet.
+func (cont *CAController) GetCAChains() (map[string]*CAChain, string, error) {
+	logger.Debug("getting CA chains")
+
+	chains := make(map[string]*CAChain)
+	etag, err := cont.env.controllers.org.GetDocument(CAChainsDocument, &chains)
+	if IsNotFound(err) {
+		logger.Debug("no CA chains yet")
+		return chains, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
 
-	orgIndex, err := cont.env.controllers.org.GetIndex()
+	logger.Trace("returning CA chains")
+	return chains, etag, nil
+}
+
+// GetCAChain returns a CA's chain, or nil if it doesn't have one.
+func (cont *CAController) GetCAChain(caId string) (*CAChain, error) {
+	logger.Debug("getting CA chain")
+	logger.Tracef("received caId '%s'", caId)
+
+	chains, _, err := cont.GetCAChains()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := orgIndex.ClearCATags(caId); err != nil {
-		return err
+	logger.Trace("returning CA chain")
+	return chains[caId], nil
+}
+
+// UpdateCAChains applies update to the latest CA chains and saves them,
+// retrying if someone else saved them in the meantime.
+func (cont *CAController) UpdateCAChains(update func(map[string]*CAChain) error) error {
+	logger.Debug("updating CA chains")
+
+	for attempt := 0; attempt < IndexUpdateAttempts; attempt++ {
+		chains, etag, err := cont.GetCAChains()
+		if err != nil {
+			return err
+		}
+
+		if err := update(chains); err != nil {
+			return err
+		}
+
+		err = cont.env.controllers.org.SaveDocument(CAChainsDocument, chains, etag)
+		if !IsConflict(err) {
+			return err
+		}
+
+		logger.Info("CA chains changed while updating, retrying")
 	}
 
-	err = orgIndex.AddCATags(caId, ParseTags(tags))
-	if err != nil {
-		return err
+	return newError(ErrConflict, nil, "updating CA chains after %d attempts", IndexUpdateAttempts)
+}
+
+// SetCAChain stores the chain of an imported CA, with its parent if the
+// issuer is one of the org's CAs. An empty chain removes the CA's chain, e.g.
+// when it's replaced by a root.
+func (cont *CAController) SetCAChain(caId string, chain []*stdx509.Certificate) error {
+	logger.Debug("setting CA chain")
+	logger.Tracef("received caId '%s' and %d chain certificates", caId, len(chain))
+
+	if len(chain) == 0 {
+		chains, _, err := cont.GetCAChains()
+		if err != nil {
+			return err
+		}
+
+		if _, ok := chains[caId]; !ok {
+			logger.Trace("returning nil error")
+			return nil
+		}
 	}
 
-	err = cont.env.controllers.org.SaveIndex(orgIndex)
+	parentId := ""
+	if len(chain) > 0 {
+		var err error
+		if parentId, err = cont.findCA(chain[0]); err != nil {
+			return err
+		}
+	}
+
+	imported := &ImportedCert{Chain: chain}
+	err := cont.UpdateCAChains(func(chains map[string]*CAChain) error {
+		if len(chain) == 0 {
+			delete(chains, caId)
+		} else {
+			chains[caId] = &CAChain{ParentId: parentId, Chain: imported.ChainPEM()}
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return wrapError(err, "saving chain of CA '%s'", caId)
 	}
 
 	logger.Trace("returning nil error")
 	return nil
 }
 
-func (cont *CAController) AddCAToOrgIndex(ca *x509.CA, tags string) error {
-	logger.Debug("Adding CA to org index")
-	logger.Tracef("received ca [NOT LOGGED] with tags '%s'", tags)
+// findCA returns the id of the org's CA with the certificate, or an empty
+// string if there isn't one.
+func (cont *CAController) findCA(cert *stdx509.Certificate) (string, error) {
+	logger.Debug("finding CA by certificate")
 
 	orgIndex, err := cont.env.controllers.org.GetIndex()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	err = orgIndex.AddCA(ca.Data.Body.Name, ca.Data.Body.Id)
-	if err != nil {
-		return err
+	for name, id := range orgIndex.GetCAs() {
+		ca, err := cont.GetCA(id)
+		if err != nil {
+			return "", wrapError(err, "getting CA '%s'", name)
+		}
+
+		caCert, err := x509.PemDecodeX509Certificate([]byte(ca.Data.Body.Certificate))
+		if err == nil && bytes.Equal(caCert.Raw, cert.Raw) {
+			logger.Tracef("returning CA '%s'", name)
+			return id, nil
+		}
 	}
 
-	err = orgIndex.AddCATags(ca.Data.Body.Id, ParseTags(tags))
+	logger.Trace("returning no CA")
+	return "", nil
+}
+
+func (cont *CAController) ResetCATags(caId, tags string) error {
+	logger.Debug("resetting CA tags")
+	logger.Tracef("received caId '%s' and tags '%s", caId, tags)
+
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.ClearCATags(caId); err != nil {
+			return wrapError(err, "clearing tags for CA '%s'", caId)
+		}
+
+		if err := orgIndex.AddCATags(caId, ParseTags(tags)); err != nil {
+			return wrapError(err, "tagging CA '%s'", caId)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	err = cont.env.controllers.org.SaveIndex(orgIndex)
+	logger.Trace("returning nil error")
+	return nil
+}
+
+func (cont *CAController) AddCAToOrgIndex(ca *x509.CA, tags string) error {
+	logger.Debug("Adding CA to org index")
+	logger.Tracef("received ca [NOT LOGGED] with tags '%s'", tags)
+
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.AddCA(ca.Data.Body.Name, ca.Data.Body.Id); err != nil {
+			return newError(ErrAlreadyExists, err, "adding CA '%s' to org index", ca.Data.Body.Name)
+		}
+
+		if err := orgIndex.AddCATags(ca.Data.Body.Id, ParseTags(tags)); err != nil {
+			return wrapError(err, "tagging CA '%s'", ca.Data.Body.Name)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -131,16 +239,12 @@ func (cont *CAController) RemoveCAFromOrgIndex(name string) error {
 	logger.Debug("removing CA from org index")
 	logger.Tracef("received name '%s'", name)
 
-	orgIndex, err := cont.env.controllers.org.GetIndex()
-	if err != nil {
-		return err
-	}
-
-	if err := orgIndex.RemoveCA(name); err != nil {
-		return err
-	}
-
-	err = cont.env.controllers.org.SaveIndex(orgIndex)
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.RemoveCA(name); err != nil {
+			return newError(ErrNotFound, err, "removing CA '%s' from org index", name)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -160,6 +264,10 @@ func (cont *CAController) New(params *CAParams) (*x509.CA, error) {
 		return nil, err
 	}
 
+	if err := params.ValidateTags(false); err != nil {
+		return nil, err
+	}
+
 	if err := params.ValidateCAExpiry(true); err != nil {
 		return nil, err
 	}
@@ -172,10 +280,75 @@ func (cont *CAController) New(params *CAParams) (*x509.CA, error) {
 		return nil, err
 	}
 
+	if err := params.ValidateAllowLegacyCA(false); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateKeyRef(false); err != nil {
+		return nil, err
+	}
+
+	if paramKeyRef(params.KeyRef) != "" && *params.KeyFile != "" {
+		return nil, newError(ErrInvalidParams, nil, "a key file and key reference can't both be given")
+	}
+
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return nil, err
 	}
 
+	var imported *ImportedCert
+	if *params.CertFile != "" || *params.KeyFile != "" {
+		if *params.CertFile == "" {
+			return nil, newError(ErrInvalidParams, nil, "certificate file must be provided if importing")
+		}
+
+		var err error
+		imported, err = importCertificateFiles(*params.CertFile, *params.KeyFile, paramPassword(params.Password))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cont.create(params, imported)
+}
+
+// Import creates a CA from a certificate and key that have already been read,
+// e.g. by a bulk import, as New does for certificate and key files. The
+// certificate is validated as a CA unless params.AllowLegacyCA is set.
+func (cont *CAController) Import(params *CAParams, imported *ImportedCert) (*x509.CA, error) {
+	logger.Debug("importing CA")
+	logger.Trace("received params [NOT LOGGED]")
+
+	if err := params.ValidateName(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateTags(false); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateCertExpiry(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateAllowLegacyCA(false); err != nil {
+		return nil, err
+	}
+
+	if imported == nil || imported.Certificate == nil {
+		return nil, newError(ErrInvalidParams, nil, "certificate must be provided if importing")
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return nil, err
+	}
+
+	return cont.create(params, imported)
+}
+
+// create generates a CA, or sets it up from the imported certificate and key,
+// then saves it and adds it to the org index.
+func (cont *CAController) create(params *CAParams, imported *ImportedCert) (*x509.CA, error) {
 	logger.Debug("creating CA struct")
 	ca, err := x509.NewCA(nil)
 	if err != nil {
@@ -194,67 +367,38 @@ func (cont *CAController) New(params *CAParams) (*x509.CA, error) {
 	ca.Data.Body.DNScope.StreetAddress = *params.DnStreet
 	ca.Data.Body.DNScope.PostalCode = *params.DnPostal
 
-	if *params.CertFile == "" && *params.KeyFile == "" {
+	keyRef := paramKeyRef(params.KeyRef)
+	if imported == nil {
 		logger.Debug("generating keys")
-		ca.GenerateRoot()
-	} else {
-		if *params.CertFile == "" {
-			return nil, fmt.Errorf("certificate PEM file must be provided if importing")
+		if keyRef != "" {
+			err = GenerateRootCAWithKeyRef(ca, keyRef, cont.env.Now())
+		} else if spec := keySpecForType(*params.KeyType); spec != "" {
+			err = GenerateRootCA(ca, spec, cont.env.Now())
+		} else {
+			err = ca.GenerateRoot()
 		}
-
-		ok, err := fs.Exists(*params.CertFile)
 		if err != nil {
-			return nil, err
-		}
-
-		if !ok {
-			logger.Warnf("certificate file '%s' does not exist", *params.CertFile)
-			return nil, nil
+			return nil, wrapError(err, "generating CA '%s'", *params.Name)
 		}
-
-		logger.Debugf("reading certificate PEM file '%s", *params.CertFile)
-		certPem, err := fs.ReadFile(*params.CertFile)
-		if err != nil {
-			return nil, err
-		}
-
-		logger.Debug("decoding certificate PEM")
-		cert, err := x509.PemDecodeX509Certificate([]byte(certPem))
-		if err != nil {
+		ca.Data.Body.Id = cont.env.NewID()
+	} else {
+		cert := imported.Certificate
+		if err := cont.checkImportedCA(cert, ca.Data.Body.DNScope, params); err != nil {
 			return nil, err
 		}
 
-		ca.Data.Body.Id = x509.NewID()
-		ca.Data.Body.Certificate = certPem
+		ca.Data.Body.Id = cont.env.NewID()
+		ca.Data.Body.Certificate = imported.CertificatePEM()
 		ca.Data.Body.CertExpiry = *params.CertExpiry
 		caExpiry := int(cert.NotAfter.Sub(cert.NotBefore) / (time.Hour * 24))
 		ca.Data.Body.CAExpiry = caExpiry
 
-		if *params.KeyFile != "" {
-			ok, err = fs.Exists(*params.KeyFile)
-			if err != nil {
-				return nil, err
-			}
-
-			if !ok {
-				logger.Warnf("key file '%s' does not exist", *params.KeyFile)
-				return nil, nil
-			}
-
-			logger.Debugf("reading private key PEM file '%s'", *params.KeyFile)
-			keyPem, err := fs.ReadFile(*params.KeyFile)
-			if err != nil {
-				return nil, err
-			}
-
-			logger.Debug("decoding private key")
-			key, err := crypto.PemDecodePrivate([]byte(keyPem))
-			if err != nil {
+		if keyRef != "" {
+			if err := setCAKeyRef(ca, keyRef, cert); err != nil {
 				return nil, err
 			}
-
-			logger.Debug("getting key type")
-			keyType, err := crypto.GetKeyType(key)
+		} else if imported.Key != nil {
+			keyPem, keyType, err := imported.KeyPEM()
 			if err != nil {
 				return nil, err
 			}
@@ -269,6 +413,13 @@ func (cont *CAController) New(params *CAParams) (*x509.CA, error) {
 		return nil, err
 	}
 
+	// The chain is saved first so the CA is never listed without it
+	if imported != nil && len(imported.Chain) > 0 {
+		if err := cont.SetCAChain(ca.Data.Body.Id, imported.Chain); err != nil {
+			return nil, err
+		}
+	}
+
 	err = cont.AddCAToOrgIndex(ca, *params.Tags)
 	if err != nil {
 		return nil, err
@@ -278,10 +429,59 @@ func (cont *CAController) New(params *CAParams) (*x509.CA, error) {
 	return ca, nil
 }
 
-func (cont *CAController) List(params *CAParams) ([]*x509.CA, error) {
-	logger.Debug("listing CAs")
+// checkImportedCA validates an imported CA certificate, unless the params
+// allow legacy CAs.
+func (cont *CAController) checkImportedCA(cert *stdx509.Certificate, scope x509.DNScope, params *CAParams) error {
+	if params.AllowLegacyCA != nil && *params.AllowLegacyCA {
+		logger.Warnf("skipping CA checks for legacy CA certificate '%s'", cert.Subject.CommonName)
+		return nil
+	}
+
+	logger.Debug("validating imported CA certificate")
+	return ValidateCACertificate(cert, scope, cont.env.Now())
+}
+
+// setCAKeyRef makes the CA use a key held by an external signer instead of
+// storing its key. The key must be the certificate's.
+func setCAKeyRef(ca *x509.CA, ref string, cert *stdx509.Certificate) error {
+	signer, err := OpenKeyRef(ref)
+	if err != nil {
+		return err
+	}
+
+	if err := CheckKeyMatches(signer, cert.PublicKey); err != nil {
+		return wrapError(err, "checking key reference for CA '%s'", ca.Data.Body.Name)
+	}
+
+	keyType, err := KeyTypeOf(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	ca.Data.Body.KeyType = string(keyType)
+	ca.Data.Body.PrivateKey = ref
+	return nil
+}
+
+// CAListEntry is a CA in a list. CA is nil when listing the index only
+// or if the CA couldn't be loaded, in which case Err is set.
+type CAListEntry struct {
+	*ListEntry
+	CA *x509.CA
+}
+
+// ListEntries lists the CAs whose names match the name pattern and that have
+// all the tags in params. Items that can't be loaded are returned with their
+// error rather than failing the list.
+func (cont *CAController) ListEntries(params *CAParams) ([]*CAListEntry, error) {
+	logger.Debug("listing CAs entries")
 	logger.Trace("received params [NOT LOGGED]")
 
+	opts, err := NewListOptions(params.Name, params.Tags, params.Offset, params.Limit, params.IndexOnly)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return nil, err
 	}
@@ -291,17 +491,41 @@ func (cont *CAController) List(params *CAParams) ([]*x509.CA, error) {
 		return nil, err
 	}
 
+	entries := make([]*CAListEntry, 0)
+	for _, entry := range listIndex(index.GetCAs(), index.Data.Body.Tags.CAReverse, opts) {
+		caEntry := &CAListEntry{ListEntry: entry}
+		if !opts.IndexOnly {
+			caEntry.CA, entry.Err = cont.GetCA(entry.Id)
+		}
+		entries = append(entries, caEntry)
+	}
+
+	logger.Trace("returning CAs entries")
+	return entries, nil
+}
+
+// List returns the CAs that could be loaded. If some couldn't, they're
+// reported with a *ListError.
+func (cont *CAController) List(params *CAParams) ([]*x509.CA, error) {
+	logger.Debug("listing CAs")
+	logger.Trace("received params [NOT LOGGED]")
+
+	entries, err := cont.ListEntries(params)
+	if err != nil {
+		return nil, err
+	}
+
 	cas := make([]*x509.CA, 0)
-	for _, id := range index.GetCAs() {
-		ca, err := cont.GetCA(id)
-		if err != nil {
-			return nil, err
+	listEntries := make([]*ListEntry, 0)
+	for _, entry := range entries {
+		listEntries = append(listEntries, entry.ListEntry)
+		if entry.CA != nil {
+			cas = append(cas, entry.CA)
 		}
-		cas = append(cas, ca)
 	}
 
-	logger.Trace("returning CA list")
-	return cas, nil
+	logger.Trace("returning CAs list")
+	return cas, listError(listEntries)
 }
 
 func (cont *CAController) Show(params *CAParams) (*x509.CA, error) {
@@ -331,7 +555,7 @@ func (cont *CAController) Show(params *CAParams) (*x509.CA, error) {
 
 	caId, err := index.GetCA(*params.Name)
 	if err != nil {
-		return nil, err
+		return nil, newError(ErrNotFound, err, "getting CA '%s'", *params.Name)
 	}
 
 	ca, err := cont.GetCA(caId)
@@ -343,6 +567,222 @@ func (cont *CAController) Show(params *CAParams) (*x509.CA, error) {
 	return ca, nil
 }
 
+// Export returns the named CA's certificate in the export format, with its
+// chain if it's an imported intermediate and its private key if
+// params.Private is set.
+func (cont *CAController) Export(params *CAParams) ([]byte, error) {
+	logger.Debug("exporting CA")
+	logger.Trace("received params [NOT LOGGED]")
+
+	if err := params.ValidateExport(true); err != nil {
+		return nil, err
+	}
+
+	ca, err := cont.Show(params)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &Bundle{Name: ca.Data.Body.Name, Certificate: ca.Data.Body.Certificate, Created: cont.env.Now()}
+
+	chain, err := cont.GetCAChain(ca.Data.Body.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if chain != nil {
+		bundle.Chain = chain.Chain
+	}
+
+	if params.Private != nil && *params.Private {
+		if ca.Data.Body.PrivateKey == "" {
+			return nil, newError(ErrInvalidParams, nil, "CA '%s' has no private key to export", *params.Name)
+		}
+
+		if IsKeyRef(ca.Data.Body.PrivateKey) {
+			return nil, newError(ErrInvalidParams, nil, "CA '%s' key is held by an external signer and can't be exported", *params.Name)
+		}
+		bundle.PrivateKey = ca.Data.Body.PrivateKey
+	}
+
+	password := ""
+	if params.Password != nil {
+		password = *params.Password
+	}
+
+	logger.Debugf("encoding CA as %s", *params.Export)
+	out, err := bundle.Encode(*params.Export, password)
+	if err != nil {
+		return nil, wrapError(err, "exporting CA '%s'", *params.Name)
+	}
+
+	logger.Trace("returning exported CA")
+	return out, nil
+}
+
+// SignRequest signs a CA request exported by another org's
+// CSRController.ExportCARequest as an intermediate of the CA, e.g. in an
+// offline environment holding only a root CA. The requesting org's public
+// org must be in the home directory, see OrgController.PinOrg, and the request
+// must be for this CA. The response holds certificates only, and
+// params.CaExpiry overrides the CA expiry asked for.
+func (cont *CAController) SignRequest(params *CAParams) ([]byte, error) {
+	logger.Debug("signing CA request")
+	logger.Trace("received params [NOT LOGGED]")
+
+	if err := params.ValidateName(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateRequestFile(true); err != nil {
+		return nil, err
+	}
+
+	ca, err := cont.Show(params)
+	if err != nil {
+		return nil, err
+	}
+
+	request := new(CARequest)
+	orgId, err := readTransferFile(cont.env, *params.RequestFile, "CA request", request)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Type != CARequestType {
+		return nil, newError(ErrInvalidParams, nil, "'%s' isn't a CA request", *params.RequestFile)
+	}
+
+	if request.OrgId != orgId {
+		return nil, newError(ErrVerificationFailed, nil, "CA request from org '%s' was signed by org '%s'", request.OrgId, orgId)
+	}
+
+	csr, err := ParseCSRData([]byte(request.CSR))
+	if err != nil {
+		return nil, wrapError(err, "loading CA request '%s'", request.Name)
+	}
+
+	issuers, err := pemDecodeCertificates([]byte(request.Issuer))
+	if err != nil || len(issuers) != 1 {
+		return nil, newError(ErrInvalidParams, err, "loading issuer of CA request '%s'", request.Name)
+	}
+
+	caCert, err := x509.PemDecodeX509Certificate([]byte(ca.Data.Body.Certificate))
+	if err != nil {
+		return nil, wrapError(err, "decoding certificate of CA '%s'", *params.Name)
+	}
+
+	if !bytes.Equal(issuers[0].Raw, caCert.Raw) {
+		return nil, newError(ErrVerificationFailed, nil, "CA request '%s' is for CA '%s', not '%s'", request.Name, issuers[0].Subject.CommonName, *params.Name)
+	}
+
+	expiry := request.CAExpiry
+	if params.CaExpiry != nil && *params.CaExpiry > 0 {
+		expiry = *params.CaExpiry
+	}
+
+	if expiry <= 0 {
+		return nil, newError(ErrInvalidParams, nil, "CA expiry must be a positive number of days")
+	}
+
+	logger.Infof("signing CA request '%s' from org '%s' with CA '%s'", request.Name, orgId, *params.Name)
+	certPem, err := signIntermediateCA(ca, csr, expiry, cont.env.Now())
+	if err != nil {
+		return nil, wrapError(err, "signing CA request '%s' with CA '%s'", request.Name, *params.Name)
+	}
+
+	// The requesting org gets this CA's chain too if it's an intermediate
+	chainPem := ca.Data.Body.Certificate
+	chain, err := cont.GetCAChain(ca.Data.Body.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if chain != nil {
+		chainPem = strings.TrimSpace(chainPem) + "\n" + chain.Chain
+	}
+
+	org := cont.env.controllers.org.org
+	response := &CAResponse{
+		Type:        CAResponseType,
+		RequestId:   request.Id,
+		Name:        request.Name,
+		Certificate: certPem,
+		Chain:       chainPem,
+		OrgId:       org.Id(),
+		Created:     cont.env.Now().UTC().Format(time.RFC3339),
+	}
+
+	out, err := signTransferFile(org, response)
+	if err != nil {
+		return nil, wrapError(err, "signing CA response '%s'", request.Name)
+	}
+
+	logger.Trace("returning CA response")
+	return out, nil
+}
+
+// readCAResponse reads an offline CA's response to a CA request from this
+// org, whose public org must be in the home directory. The certificate must be
+// issued by the CA the request was for. It returns the certificate with the
+// key of the CSR the request was for, and the CSR, which is deleted once the
+// CA has its key.
+func (cont *CAController) readCAResponse(file string) (*ImportedCert, *x509.CSR, error) {
+	response := new(CAResponse)
+	orgId, err := readTransferFile(cont.env, file, "CA response", response)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if response.Type != CAResponseType {
+		return nil, nil, newError(ErrInvalidParams, nil, "'%s' isn't a CA response", file)
+	}
+
+	if response.OrgId != orgId {
+		return nil, nil, newError(ErrVerificationFailed, nil, "CA response from org '%s' was signed by org '%s'", response.OrgId, orgId)
+	}
+
+	csrCont, err := NewCSR(cont.env)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	csr, err := csrCont.GetCSR(response.RequestId)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, newError(ErrNotFound, err, "getting CSR for CA response '%s', it may have been imported already", response.Name)
+	} else if err != nil {
+		return nil, nil, wrapError(err, "getting CSR for CA response '%s'", response.Name)
+	}
+
+	requests, _, err := cont.env.controllers.org.GetCARequests()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	issuerPem, ok := requests[csr.Data.Body.Id]
+	if !ok {
+		return nil, nil, newError(ErrVerificationFailed, nil, "no CA request was exported for CSR '%s'", csr.Data.Body.Name)
+	}
+
+	issuers, err := pemDecodeCertificates([]byte(issuerPem))
+	if err != nil || len(issuers) != 1 {
+		return nil, nil, newError(ErrInvalidParams, err, "loading issuer of CA request for CSR '%s'", csr.Data.Body.Name)
+	}
+
+	cert, chain, err := checkCAResponse(response, csr, issuers[0], cont.env.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := PemDecodePrivateKey([]byte(csr.Data.Body.PrivateKey))
+	if err != nil {
+		return nil, nil, wrapError(err, "decoding private key for CSR '%s'", csr.Data.Body.Name)
+	}
+
+	logger.Infof("importing CA response '%s' from org '%s'", response.Name, orgId)
+	return &ImportedCert{Certificate: cert, Chain: chain, Key: key}, csr, nil
+}
+
 func (cont *CAController) Update(params *CAParams) error {
 	logger.Debug("updating CA")
 	logger.Trace("received params [NOT LOGGED]")
@@ -351,87 +791,125 @@ func (cont *CAController) Update(params *CAParams) error {
 		return err
 	}
 
-	if err := cont.env.LoadAdminEnv(); err != nil {
+	if err := params.ValidateTags(false); err != nil {
 		return err
 	}
 
-	index, err := cont.env.controllers.org.GetIndex()
-	if err != nil {
+	if err := params.ValidateAllowLegacyCA(false); err != nil {
 		return err
 	}
 
-	caId, err := index.GetCA(*params.Name)
-	if err != nil {
+	if err := params.ValidateResponseFile(false); err != nil {
 		return err
 	}
 
-	ca, err := cont.GetCA(caId)
+	if err := params.ValidateKeyRef(false); err != nil {
+		return err
+	}
+
+	keyRef := paramKeyRef(params.KeyRef)
+	if keyRef != "" && (*params.KeyFile != "" || (params.ResponseFile != nil && *params.ResponseFile != "")) {
+		return newError(ErrInvalidParams, nil, "a key reference can't be given with a key file or CA response")
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return err
+	}
+
+	index, err := cont.env.controllers.org.GetIndex()
 	if err != nil {
 		return err
 	}
 
-	if *params.CertFile != "" {
-		ok, err := fs.Exists(*params.CertFile)
-		if err != nil {
-			return err
-		}
-		if !ok {
-			logger.Warnf("certificate file '%s' does not exist", *params.CertFile)
-			return nil
+	var response *ImportedCert
+	var responseCSR *x509.CSR
+	if params.ResponseFile != nil && *params.ResponseFile != "" {
+		if *params.CertFile != "" || *params.KeyFile != "" {
+			return newError(ErrInvalidParams, nil, "certificate and key files can't be imported with a CA response")
 		}
 
-		logger.Debugf("reading certificate file '%s'", *params.CertFile)
-		certPem, err := fs.ReadFile(*params.CertFile)
+		response, responseCSR, err = cont.readCAResponse(*params.ResponseFile)
 		if err != nil {
 			return err
 		}
+	}
 
-		// TODO - better validation of pem
-		logger.Debug("decoding certificate file PEM")
-		_, err = x509.PemDecodeX509Certificate([]byte(certPem))
-		if err != nil {
+	caId, err := index.GetCA(*params.Name)
+	if err != nil && response != nil {
+		// The response is for a new intermediate CA
+		if *params.CertExpiry <= 0 {
+			return newError(ErrInvalidParams, nil, "certificate expiry must be set for new CA '%s'", *params.Name)
+		}
+
+		logger.Infof("creating CA '%s' from CA response", *params.Name)
+		if _, err := cont.create(params, response); err != nil {
 			return err
 		}
+		return cont.retireCSR(responseCSR)
+	} else if err != nil {
+		return newError(ErrNotFound, err, "getting CA '%s'", *params.Name)
+	}
 
-		logger.Trace("setting certificate")
-		ca.Data.Body.Certificate = certPem
+	ca, err := cont.GetCA(caId)
+	if err != nil {
+		return err
 	}
 
-	if *params.KeyFile != "" {
-		ok, err := fs.Exists(*params.KeyFile)
+	var importedCert *stdx509.Certificate
+	var importedChain []*stdx509.Certificate
+	if response != nil {
+		importedCert = response.Certificate
+		importedChain = response.Chain
+		logger.Trace("setting certificate and key from CA response")
+		ca.Data.Body.Certificate = response.CertificatePEM()
+
+		keyPem, keyType, err := response.KeyPEM()
 		if err != nil {
 			return err
 		}
-		if !ok {
-			logger.Warnf("key file '%s' does not exist", *params.KeyFile)
-			return nil
-		}
 
-		logger.Debugf("seading key file '%s'", *params.KeyFile)
-		keyPem, err := fs.ReadFile(*params.KeyFile)
+		ca.Data.Body.KeyType = string(keyType)
+		ca.Data.Body.PrivateKey = keyPem
+	} else if *params.CertFile != "" || *params.KeyFile != "" {
+		imported, err := importCertificateFiles(*params.CertFile, *params.KeyFile, paramPassword(params.Password))
 		if err != nil {
 			return err
 		}
 
-		// TODO - better validation of pem
-		logger.Debug("decoding key file PEM")
-		key, err := crypto.PemDecodePrivate([]byte(keyPem))
-		if err != nil {
-			return err
+		if imported.Certificate != nil {
+			importedCert = imported.Certificate
+			importedChain = imported.Chain
+			logger.Trace("setting certificate")
+			ca.Data.Body.Certificate = imported.CertificatePEM()
 		}
 
-		logger.Debug("getting key type")
-		keyType, err := crypto.GetKeyType(key)
-		if err != nil {
-			return err
+		if imported.Key != nil {
+			keyPem, keyType, err := imported.KeyPEM()
+			if err != nil {
+				return err
+			}
+
+			ca.Data.Body.KeyType = string(keyType)
+			ca.Data.Body.PrivateKey = keyPem
 		}
 
-		ca.Data.Body.KeyType = string(keyType)
-		ca.Data.Body.PrivateKey = keyPem
+		if keyRef == "" {
+			if err := checkStoredKeyMatches(ca.Data.Body.Certificate, ca.Data.Body.PrivateKey); err != nil {
+				return wrapError(err, "updating CA '%s'", *params.Name)
+			}
+		}
 	}
 
-	if *params.Tags != "" {
-		cont.ResetCATags(caId, *params.Tags)
+	if keyRef != "" {
+		cert, err := x509.PemDecodeX509Certificate([]byte(ca.Data.Body.Certificate))
+		if err != nil {
+			return wrapError(err, "decoding certificate for CA '%s'", *params.Name)
+		}
+
+		logger.Debug("setting key reference")
+		if err := setCAKeyRef(ca, keyRef, cert); err != nil {
+			return err
+		}
 	}
 
 	if *params.CaExpiry != 0 {
@@ -479,11 +957,62 @@ func (cont *CAController) Update(params *CAParams) error {
 		ca.Data.Body.DNScope.PostalCode = *params.DnPostal
 	}
 
+	// Everything is checked before anything is saved
+	if importedCert != nil {
+		if err := cont.checkImportedCA(importedCert, ca.Data.Body.DNScope, params); err != nil {
+			return err
+		}
+	}
+
 	err = cont.SaveCA(ca)
 	if err != nil {
 		return err
 	}
 
+	if importedCert != nil {
+		if err := cont.SetCAChain(caId, importedChain); err != nil {
+			return err
+		}
+	}
+
+	if *params.Tags != "" {
+		if err := cont.ResetCATags(caId, *params.Tags); err != nil {
+			return err
+		}
+	}
+
+	if responseCSR != nil {
+		if err := cont.retireCSR(responseCSR); err != nil {
+			return err
+		}
+	}
+
+	logger.Trace("returning nil error")
+	return nil
+}
+
+// retireCSR deletes the CSR a CA response was for once the CA has its key, so
+// the key isn't left in the CSR and the response can't be imported again.
+func (cont *CAController) retireCSR(csr *x509.CSR) error {
+	logger.Debugf("retiring CSR '%s'", csr.Data.Body.Name)
+
+	csrCont, err := NewCSR(cont.env)
+	if err != nil {
+		return err
+	}
+
+	if err := csrCont.DeleteCSR(csr.Data.Body.Id, csr.Data.Body.Name); err != nil {
+		return wrapError(err, "retiring CSR '%s' after importing its CA response", csr.Data.Body.Name)
+	}
+
+	err = cont.env.controllers.org.UpdateCARequests(func(requests map[string]string) error {
+		delete(requests, csr.Data.Body.Id)
+		return nil
+	})
+	if err != nil {
+		return wrapError(err, "retiring CA request for CSR '%s'", csr.Data.Body.Name)
+	}
+
 	logger.Trace("returning nil error")
 	return nil
 }
@@ -504,27 +1033,34 @@ func (cont *CAController) Delete(params *CAParams) error {
 		return err
 	}
 
-	index, err := cont.env.controllers.org.GetIndex()
+	orgIndex, err := cont.env.controllers.org.GetIndex()
 	if err != nil {
 		return err
 	}
 
-	caId, err := index.GetCA(*params.Name)
+	caId, err := orgIndex.GetCA(*params.Name)
 	if err != nil {
-		return err
+		return newError(ErrNotFound, err, "getting CA '%s'", *params.Name)
 	}
 
 	logger.Debugf("deleting private file for CA '%s' in org '%s'", caId, cont.env.controllers.org.OrgId())
 	if err := cont.env.api.DeletePrivate(cont.env.controllers.org.OrgId(), caId); err != nil {
-		return err
+		return wrapError(err, "deleting CA '%s'", *params.Name)
 	}
 
-	if err := index.RemoveCA(*params.Name); err != nil {
+	cont.env.controllers.org.UncacheCA(caId)
+
+	err = cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.RemoveCA(*params.Name); err != nil {
+			return newError(ErrNotFound, err, "removing CA '%s' from org index", *params.Name)
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
-	err = cont.env.controllers.org.SaveIndex(index)
-	if err != nil {
+	if err := cont.SetCAChain(caId, nil); err != nil {
 		return err
 	}
 
@@ -1,9 +1,5 @@
 package controller
 
-import (
-	"fmt"
-)
-
 // First-class types only
 type CAParams struct {
 	Name          *string
@@ -23,6 +19,24 @@ type CAParams struct {
 	Private       *bool
 	CertFile      *string
 	KeyFile       *string
+	// Password protects PKCS #12 and JKS exports, and decrypts imported
+	// encrypted PKCS #8 and PKCS #12 files
+	Password *string
+	// AllowLegacyCA skips the CA checks on imported certificates, for legacy
+	// roots without CA basic constraints or key usages. The key must still
+	// match the certificate.
+	AllowLegacyCA *bool
+	// RequestFile is a CA request for an offline CA to sign, and
+	// ResponseFile is the offline CA's response to import
+	RequestFile  *string
+	ResponseFile *string
+	// KeyRef refers to a key held by an external signer, e.g. a PKCS #11
+	// token, which the CA stores instead of its private key
+	KeyRef *string
+	// Offset, Limit and IndexOnly apply to listing
+	Offset    *int
+	Limit     *int
+	IndexOnly *bool
 }
 
 func NewCAParams() *CAParams {
@@ -34,15 +48,17 @@ func NewCAParams() *CAParams {
 
 func (params *CAParams) ValidateName(required bool) error {
 	if required && *params.Name == "" {
-		return fmt.Errorf("name cannot be empty")
+		return newError(ErrInvalidParams, nil, "name cannot be empty")
 	}
 	return nil
 }
 
-func (params *CAParams) ValidateTags(required bool) error          { return nil }
+func (params *CAParams) ValidateTags(required bool) error {
+	return validateTagsParam(params.Tags, required)
+}
+
 func (params *CAParams) ValidateCAExpiry(required bool) error      { return nil }
 func (params *CAParams) ValidateCertExpiry(required bool) error    { return nil }
-func (params *CAParams) ValidateKeyType(required bool) error       { return nil }
 func (params *CAParams) ValidateDnLocality(required bool) error    { return nil }
 func (params *CAParams) ValidateDnState(required bool) error       { return nil }
 func (params *CAParams) ValidateDnOrg(required bool) error         { return nil }
@@ -51,7 +67,43 @@ func (params *CAParams) ValidateDnCountry(required bool) error     { return nil
 func (params *CAParams) ValidateDnStreet(required bool) error      { return nil }
 func (params *CAParams) ValidateDnPostal(required bool) error      { return nil }
 func (params *CAParams) ValidateConfirmDelete(required bool) error { return nil }
-func (params *CAParams) ValidateExport(required bool) error        { return nil }
 func (params *CAParams) ValidatePrivate(required bool) error       { return nil }
 func (params *CAParams) ValidateCertFile(required bool) error      { return nil }
 func (params *CAParams) ValidateKeyFile(required bool) error       { return nil }
+func (params *CAParams) ValidateAllowLegacyCA(required bool) error { return nil }
+func (params *CAParams) ValidateResponseFile(required bool) error  { return nil }
+
+func (params *CAParams) ValidateKeyRef(required bool) error {
+	if params.KeyRef == nil || *params.KeyRef == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "key reference cannot be empty")
+		}
+		return nil
+	}
+
+	_, err := ParseKeyRef(*params.KeyRef)
+	return err
+}
+
+func (params *CAParams) ValidateRequestFile(required bool) error {
+	if required && (params.RequestFile == nil || *params.RequestFile == "") {
+		return newError(ErrInvalidParams, nil, "request file cannot be empty")
+	}
+	return nil
+}
+
+func (params *CAParams) ValidateKeyType(required bool) error {
+	if params.KeyType == nil || *params.KeyType == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "key type cannot be empty")
+		}
+		return nil
+	}
+	return ValidateKeyType(*params.KeyType)
+}
+
+// ValidateExport checks the export format, which is one of the Export*
+// formats, and that there's a password if the format needs one.
+func (params *CAParams) ValidateExport(required bool) error {
+	return validateExportParams(params.Export, params.Password, required)
+}
@@ -0,0 +1,240 @@
+package controller
+
+import (
+	stdx509 "crypto/x509"
+	"errors"
+	"github.com/pki-io/core/x509"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCANewMissingCertFile(t *testing.T) {
+	setupOrg(t)
+	defer teardown()
+
+	cont, _ := NewCA(NewEnvironment())
+	params := newTestCAParams("ca")
+	params.CertFile = stringPtr(path.Join(os.Getenv("PKIIO_LOCAL"), "missing.pem"))
+
+	ca, err := cont.New(params)
+	assert.Nil(t, ca)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestCANewMissingKeyFile(t *testing.T) {
+	setupOrg(t)
+	defer teardown()
+
+	certFile, _ := writeTestCertificate(t, os.Getenv("PKIIO_LOCAL"), true)
+
+	cont, _ := NewCA(NewEnvironment())
+	params := newTestCAParams("ca")
+	params.CertFile = stringPtr(certFile)
+	params.KeyFile = stringPtr(path.Join(os.Getenv("PKIIO_LOCAL"), "missing.pem"))
+
+	ca, err := cont.New(params)
+	assert.Nil(t, ca)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestCANewNotACA(t *testing.T) {
+	setupOrg(t)
+	defer teardown()
+
+	certFile, keyFile := writeTestCertificate(t, os.Getenv("PKIIO_LOCAL"), false)
+
+	cont, _ := NewCA(NewEnvironment())
+	params := newTestCAParams("ca")
+	params.CertFile = stringPtr(certFile)
+	params.KeyFile = stringPtr(keyFile)
+
+	ca, err := cont.New(params)
+	assert.Nil(t, ca)
+	assert.True(t, IsVerificationFailed(err))
+
+	params.AllowLegacyCA = boolPtr(true)
+	ca, err = cont.New(params)
+	assert.NoError(t, err)
+	assert.NotNil(t, ca)
+}
+
+func TestCAUpdateMissingCertFile(t *testing.T) {
+	setupOrg(t)
+	defer teardown()
+
+	cont, _ := NewCA(NewEnvironment())
+	_, err := cont.New(newTestCAParams("ca"))
+	assert.NoError(t, err)
+
+	params := newTestCAParams("ca")
+	params.CaExpiry = intPtr(0)
+	params.CertExpiry = intPtr(0)
+	params.CertFile = stringPtr(path.Join(os.Getenv("PKIIO_LOCAL"), "missing.pem"))
+
+	cont, _ = NewCA(NewEnvironment())
+	err = cont.Update(params)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestCAListPartial(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	_, err := caCont.New(newTestCAParams("ca1"))
+	assert.NoError(t, err)
+	ca2, err := caCont.New(newTestCAParams("ca2"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	backends.api.SendPrivate(env.controllers.org.OrgId(), ca2.Data.Body.Id, "corrupt")
+
+	caCont, _ = NewCA(backends.env(home))
+	cas, err := caCont.List(newTestCAParams(""))
+	assert.Len(t, cas, 1)
+	listErr, ok := err.(*ListError)
+	assert.True(t, ok)
+	assert.Equal(t, "ca2", listErr.Failed[0].Name)
+
+	params := newTestCAParams("")
+	params.IndexOnly = boolPtr(true)
+	caCont, _ = NewCA(backends.env(home))
+	entries, err := caCont.ListEntries(params)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Nil(t, entries[0].CA)
+}
+
+func TestCAKeyRef(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	dir, err := ioutil.TempDir("", "pkiio-token")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ref, err := NewSoftToken(dir).GenerateKey("ca", KeySpecP256)
+	assert.NoError(t, err)
+
+	params := newTestCAParams("ca")
+	params.KeyRef = stringPtr(ref)
+	caCont, _ := NewCA(backends.env(home))
+	ca, err := caCont.New(params)
+	assert.NoError(t, err)
+	assert.Equal(t, ref, ca.Data.Body.PrivateKey)
+
+	params = newTestCAParams("ca")
+	params.Export = stringPtr(ExportPEM)
+	params.Private = boolPtr(true)
+	caCont, _ = NewCA(backends.env(home))
+	_, err = caCont.Export(params)
+	assert.True(t, IsInvalidParams(err))
+
+	csrCont, _ := NewCSR(backends.env(home))
+	_, err = csrCont.New(newTestCSRParams("web"))
+	assert.NoError(t, err)
+
+	signParams := newTestCSRParams("web")
+	signParams.Ca = stringPtr("ca")
+	csrCont, _ = NewCSR(backends.env(home))
+	cert, err := csrCont.Sign(signParams)
+	assert.NoError(t, err)
+
+	caCert, _ := x509.PemDecodeX509Certificate([]byte(ca.Data.Body.Certificate))
+	signed, _ := x509.PemDecodeX509Certificate([]byte(cert.Data.Body.Certificate))
+	assert.NoError(t, signed.CheckSignatureFrom(caCert))
+}
+
+func TestCAUpdateResetTagsFails(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	_, err := caCont.New(newTestCAParams("ca"))
+	assert.NoError(t, err)
+
+	params := newTestCAParams("ca")
+	params.Tags = stringPtr("web")
+	params.CaExpiry = intPtr(0)
+	params.CertExpiry = intPtr(0)
+
+	caCont, _ = NewCA(backends.failingEnv(home))
+	err = caCont.Update(params)
+	assert.True(t, errors.Is(err, errTestSend))
+}
+
+func TestCAUpdateChecksBeforeTags(t *testing.T) {
+	setupOrg(t)
+	defer teardown()
+
+	cont, _ := NewCA(NewEnvironment())
+	_, err := cont.New(newTestCAParams("ca"))
+	assert.NoError(t, err)
+
+	certFile, keyFile := writeTestCertificate(t, os.Getenv("PKIIO_LOCAL"), false)
+
+	params := newTestCAParams("ca")
+	params.CaExpiry = intPtr(0)
+	params.CertExpiry = intPtr(0)
+	params.CertFile = stringPtr(certFile)
+	params.KeyFile = stringPtr(keyFile)
+	params.Tags = stringPtr("web")
+
+	cont, _ = NewCA(NewEnvironment())
+	err = cont.Update(params)
+	assert.True(t, IsVerificationFailed(err))
+
+	env := NewEnvironment()
+	assert.NoError(t, env.LoadAdminEnv())
+	orgIndex, err := env.controllers.org.GetIndex()
+	assert.NoError(t, err)
+	assert.Empty(t, orgIndex.Data.Body.Tags.CAForward["web"])
+}
+
+func TestCAImportChain(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	later := time.Now().Add(24 * time.Hour)
+	root, rootKey := newTestImportCert(t, "root", 1, true, later, nil, nil)
+	inter, interKey := newTestImportCert(t, "inter", 2, true, later, root, rootKey)
+
+	caCont, _ := NewCA(backends.env(home))
+	rootCA, err := caCont.Import(newTestCAParams("root"), &ImportedCert{Certificate: root, Key: rootKey})
+	assert.NoError(t, err)
+
+	caCont, _ = NewCA(backends.env(home))
+	interCA, err := caCont.Import(newTestCAParams("inter"), &ImportedCert{Certificate: inter, Key: interKey, Chain: []*stdx509.Certificate{root}})
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	caCont, _ = NewCA(env)
+	chain, err := caCont.GetCAChain(interCA.Data.Body.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, rootCA.Data.Body.Id, chain.ParentId)
+	assert.Equal(t, string(pemCert(root.Raw)), chain.Chain)
+
+	params := newTestCAParams("inter")
+	params.Export = stringPtr(ExportPEM)
+	params.Private = boolPtr(false)
+	caCont, _ = NewCA(backends.env(home))
+	out, err := caCont.Export(params)
+	assert.NoError(t, err)
+	certs, err := pemDecodeCertificates(out)
+	assert.NoError(t, err)
+	assert.Equal(t, []*stdx509.Certificate{inter, root}, certs)
+
+	deleteParams := newTestCAParams("inter")
+	deleteParams.ConfirmDelete = stringPtr("inter")
+	caCont, _ = NewCA(backends.env(home))
+	assert.NoError(t, caCont.Delete(deleteParams))
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	caCont, _ = NewCA(env)
+	chains, _, err := caCont.GetCAChains()
+	assert.NoError(t, err)
+	assert.Empty(t, chains)
+}
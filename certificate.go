@@ -3,10 +3,8 @@ package controller
 
 import (
 	"crypto/x509/pkix"
-	"fmt"
-	"github.com/pki-io/core/crypto"
 	"github.com/pki-io/core/document"
-	"github.com/pki-io/core/fs"
+	"github.com/pki-io/core/index"
 	"github.com/pki-io/core/x509"
 	"time"
 )
@@ -39,21 +37,16 @@ func (cont *CertificateController) ResetCertTags(certId, tags string) error {
 	logger.Debug("resetting certificate tags")
 	logger.Tracef("received certificate id '%s' and tags '%s'", certId, tags)
 
-	orgIndex, err := cont.env.controllers.org.GetIndex()
-	if err != nil {
-		return err
-	}
-
-	if err := orgIndex.ClearCertTags(certId); err != nil {
-		return err
-	}
-
-	err = orgIndex.AddCertTags(certId, ParseTags(tags))
-	if err != nil {
-		return err
-	}
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.ClearCertTags(certId); err != nil {
+			return wrapError(err, "clearing tags for certificate '%s'", certId)
+		}
 
-	err = cont.env.controllers.org.SaveIndex(orgIndex)
+		if err := orgIndex.AddCertTags(certId, ParseTags(tags)); err != nil {
+			return wrapError(err, "tagging certificate '%s'", certId)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -69,25 +62,30 @@ func (cont *CertificateController) GetCert(id string) (*x509.Certificate, error)
 	logger.Debugf("getting private file '%s' from org", id)
 	certContainerJson, err := cont.env.api.GetPrivate(cont.env.controllers.org.org.Data.Body.Id, id)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "getting certificate '%s'", id)
 	}
 
 	logger.Debug("creating new container")
 	certContainer, err := document.NewContainer(certContainerJson)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "loading certificate container '%s'", id)
+	}
+
+	logger.Debug("verifying container")
+	if err := cont.env.controllers.org.org.Verify(certContainer); err != nil {
+		return nil, newError(ErrVerificationFailed, err, "verifying certificate '%s'", id)
 	}
 
 	logger.Debug("decrypting container")
-	certJson, err := cont.env.controllers.org.org.VerifyThenDecrypt(certContainer)
+	certJson, err := cont.env.controllers.org.org.Decrypt(certContainer)
 	if err != nil {
-		return nil, err
+		return nil, newError(ErrDecryptionFailed, err, "decrypting certificate '%s'", id)
 	}
 
 	logger.Debug("loading certificate json")
 	cert, err := x509.NewCertificate(certJson)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "loading certificate '%s'", id)
 	}
 
 	logger.Trace("returning nil error")
@@ -107,7 +105,7 @@ func (cont *CertificateController) SaveCert(cert *x509.Certificate) error {
 	logger.Debug("saving encrypted cert")
 	err = cont.env.api.SendPrivate(cont.env.controllers.org.org.Data.Body.Id, cert.Data.Body.Id, certContainer.Dump())
 	if err != nil {
-		return err
+		return wrapError(err, "sending certificate '%s'", cert.Data.Body.Id)
 	}
 
 	logger.Trace("returning nil error")
@@ -118,22 +116,16 @@ func (cont *CertificateController) AddCertToOrgIndex(cert *x509.Certificate, tag
 	logger.Debug("adding certificate to org index")
 	logger.Tracef("received certificate with id '%s' and tags '%s'", cert.Id(), tags)
 
-	orgIndex, err := cont.env.controllers.org.GetIndex()
-	if err != nil {
-		return err
-	}
-
-	err = orgIndex.AddCert(cert.Data.Body.Name, cert.Data.Body.Id)
-	if err != nil {
-		return err
-	}
-
-	err = orgIndex.AddCertTags(cert.Data.Body.Id, ParseTags(tags))
-	if err != nil {
-		return err
-	}
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.AddCert(cert.Data.Body.Name, cert.Data.Body.Id); err != nil {
+			return newError(ErrAlreadyExists, err, "adding certificate '%s' to org index", cert.Data.Body.Name)
+		}
 
-	err = cont.env.controllers.org.SaveIndex(orgIndex)
+		if err := orgIndex.AddCertTags(cert.Data.Body.Id, ParseTags(tags)); err != nil {
+			return wrapError(err, "tagging certificate '%s'", cert.Data.Body.Name)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -150,10 +142,66 @@ func (cont *CertificateController) New(params *CertificateParams) (*x509.Certifi
 		return nil, nil, err
 	}
 
+	if err := params.ValidateTags(false); err != nil {
+		return nil, nil, err
+	}
+
+	if err := params.ValidateKeyType(false); err != nil {
+		return nil, nil, err
+	}
+
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return nil, nil, err
 	}
 
+	var imported *ImportedCert
+	if *params.CertFile != "" || *params.KeyFile != "" {
+		if *params.CertFile == "" {
+			return nil, nil, newError(ErrInvalidParams, nil, "certificate file must be provided if importing")
+		}
+
+		logger.Debugf("importing certificate from '%s'", *params.CertFile)
+		var err error
+		imported, err = importCertificateFiles(*params.CertFile, *params.KeyFile, paramPassword(params.Password))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return cont.create(params, imported)
+}
+
+// Import creates a certificate from a certificate, chain and key that have
+// already been read, e.g. by a bulk import, as New does for certificate and
+// key files.
+func (cont *CertificateController) Import(params *CertificateParams, imported *ImportedCert) (*x509.Certificate, error) {
+	logger.Debug("importing certificate")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateName(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateTags(false); err != nil {
+		return nil, err
+	}
+
+	if imported == nil || imported.Certificate == nil {
+		return nil, newError(ErrInvalidParams, nil, "certificate must be provided if importing")
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return nil, err
+	}
+
+	cert, _, err := cont.create(params, imported)
+	return cert, err
+}
+
+// create generates a certificate, signed by params.Ca if set, or sets it up
+// from the imported certificate, chain and key, then saves it and adds it to
+// the org index unless it's standalone. It returns the signing CA, if any.
+func (cont *CertificateController) create(params *CertificateParams, imported *ImportedCert) (*x509.Certificate, *x509.CA, error) {
 	// TODO - This should really be in a certificate function
 	subject := pkix.Name{CommonName: *params.Name}
 
@@ -185,16 +233,23 @@ func (cont *CertificateController) New(params *CertificateParams) (*x509.Certifi
 		return nil, nil, err
 	}
 
+	cert.Data.Body.Id = cont.env.NewID()
 	cert.Data.Body.Name = *params.Name
 	cert.Data.Body.Expiry = *params.Expiry
 
 	var ca *x509.CA
 
-	if *params.CertFile == "" && *params.KeyFile == "" {
+	if imported == nil {
 		cert.Data.Body.KeyType = *params.KeyType
 		logger.Debug("generating certificate and key")
+		spec := keySpecForType(*params.KeyType)
 		if *params.Ca == "" {
-			if err := cert.Generate(nil, &subject); err != nil {
+			if spec != "" {
+				err = GenerateCertificate(cert, nil, spec, subject, cont.env.Now())
+			} else {
+				err = cert.Generate(nil, &subject)
+			}
+			if err != nil {
 				return nil, nil, err
 			}
 		} else {
@@ -205,7 +260,7 @@ func (cont *CertificateController) New(params *CertificateParams) (*x509.Certifi
 
 			caId, err := index.GetCA(*params.Ca)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, newError(ErrNotFound, err, "getting CA '%s'", *params.Ca)
 			}
 
 			ca, err = cont.GetCA(caId)
@@ -214,69 +269,23 @@ func (cont *CertificateController) New(params *CertificateParams) (*x509.Certifi
 			}
 
 			logger.Debugf("generating certificate and signing with CA '%s'", caId)
-			if err := cert.Generate(ca, &subject); err != nil {
+			if spec == "" {
+				spec = defaultKeySpecs[*params.KeyType]
+			}
+
+			if err := GenerateCertificate(cert, ca, spec, subject, cont.env.Now()); err != nil {
 				return nil, nil, err
 			}
 		}
 	} else {
-		if *params.CertFile == "" {
-			return nil, nil, fmt.Errorf("certificate PEM file must be provided if importing")
-		}
-
-		logger.Debugf("importing certificate from '%s'", *params.CertFile)
-		ok, err := fs.Exists(*params.CertFile)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		if !ok {
-			logger.Warnf("certificate file '%s' does not exist", *params.CertFile)
-			return nil, nil, nil
-		}
-
-		logger.Debug("reading certificate from file")
-		certPem, err := fs.ReadFile(*params.CertFile)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		logger.Debug("decoding certificate PEM")
-		importCert, err := x509.PemDecodeX509Certificate([]byte(certPem))
-		if err != nil {
-			return nil, nil, err
-		}
-
-		cert.Data.Body.Id = x509.NewID()
-		cert.Data.Body.Certificate = certPem
+		importCert := imported.Certificate
+		cert.Data.Body.Certificate = imported.CertificatePEM()
+		cert.Data.Body.CACertificate = imported.ChainPEM()
 		certExpiry := int(importCert.NotAfter.Sub(importCert.NotBefore) / (time.Hour * 24))
 		cert.Data.Body.Expiry = certExpiry
 
-		if *params.KeyFile != "" {
-			logger.Debugf("importing certificate privte key from '%s'", *params.KeyFile)
-			ok, err := fs.Exists(*params.KeyFile)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			if !ok {
-				logger.Warnf("key file '%s' does not exist", *params.KeyFile)
-				return nil, nil, nil
-			}
-
-			logger.Debug("reading private key file")
-			keyPem, err := fs.ReadFile(*params.KeyFile)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			logger.Debug("decoding private key PEM")
-			key, err := crypto.PemDecodePrivate([]byte(keyPem))
-			if err != nil {
-				return nil, nil, err
-			}
-
-			logger.Debug("getting key type")
-			keyType, err := crypto.GetKeyType(key)
+		if imported.Key != nil {
+			keyPem, keyType, err := imported.KeyPEM()
 			if err != nil {
 				return nil, nil, err
 			}
@@ -309,9 +318,24 @@ func (cont *CertificateController) New(params *CertificateParams) (*x509.Certifi
 	return cert, ca, nil
 }
 
-func (cont *CertificateController) List(params *CertificateParams) ([]*x509.Certificate, error) {
-	logger.Debug("listing certificates")
-	logger.Tracef("received params: %s", params)
+// CertificateListEntry is a certificate in a list. Certificate is nil when listing the index only
+// or if the certificate couldn't be loaded, in which case Err is set.
+type CertificateListEntry struct {
+	*ListEntry
+	Certificate *x509.Certificate
+}
+
+// ListEntries lists the certificates whose names match the name pattern and that have
+// all the tags in params. Items that can't be loaded are returned with their
+// error rather than failing the list.
+func (cont *CertificateController) ListEntries(params *CertificateParams) ([]*CertificateListEntry, error) {
+	logger.Debug("listing certificates entries")
+	logger.Trace("received params [NOT LOGGED]")
+
+	opts, err := NewListOptions(params.Name, params.Tags, params.Offset, params.Limit, params.IndexOnly)
+	if err != nil {
+		return nil, err
+	}
 
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return nil, err
@@ -322,18 +346,41 @@ func (cont *CertificateController) List(params *CertificateParams) ([]*x509.Cert
 		return nil, err
 	}
 
-	certs := make([]*x509.Certificate, 0)
-	for _, id := range index.GetCerts() {
-		cert, err := cont.GetCert(id)
-		if err != nil {
-			return nil, err
+	entries := make([]*CertificateListEntry, 0)
+	for _, entry := range listIndex(index.GetCerts(), index.Data.Body.Tags.CertReverse, opts) {
+		certEntry := &CertificateListEntry{ListEntry: entry}
+		if !opts.IndexOnly {
+			certEntry.Certificate, entry.Err = cont.GetCert(entry.Id)
 		}
+		entries = append(entries, certEntry)
+	}
+
+	logger.Trace("returning certificates entries")
+	return entries, nil
+}
+
+// List returns the certificates that could be loaded. If some couldn't, they're
+// reported with a *ListError.
+func (cont *CertificateController) List(params *CertificateParams) ([]*x509.Certificate, error) {
+	logger.Debug("listing certificates")
+	logger.Trace("received params [NOT LOGGED]")
+
+	entries, err := cont.ListEntries(params)
+	if err != nil {
+		return nil, err
+	}
 
-		certs = append(certs, cert)
+	certs := make([]*x509.Certificate, 0)
+	listEntries := make([]*ListEntry, 0)
+	for _, entry := range entries {
+		listEntries = append(listEntries, entry.ListEntry)
+		if entry.Certificate != nil {
+			certs = append(certs, entry.Certificate)
+		}
 	}
 
-	logger.Trace("returning certificates")
-	return certs, nil
+	logger.Trace("returning certificates list")
+	return certs, listError(listEntries)
 }
 
 func (cont *CertificateController) Show(params *CertificateParams) (*x509.Certificate, error) {
@@ -363,7 +410,7 @@ func (cont *CertificateController) Show(params *CertificateParams) (*x509.Certif
 
 	certId, err := index.GetCert(*params.Name)
 	if err != nil {
-		return nil, err
+		return nil, newError(ErrNotFound, err, "getting certificate '%s'", *params.Name)
 	}
 
 	cert, err := cont.GetCert(certId)
@@ -375,6 +422,50 @@ func (cont *CertificateController) Show(params *CertificateParams) (*x509.Certif
 	return cert, nil
 }
 
+// Export returns the named certificate and its chain in the export format,
+// with its private key if params.Private is set.
+func (cont *CertificateController) Export(params *CertificateParams) ([]byte, error) {
+	logger.Debug("exporting certificate")
+	logger.Trace("received params [NOT LOGGED]")
+
+	if err := params.ValidateExport(true); err != nil {
+		return nil, err
+	}
+
+	cert, err := cont.Show(params)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &Bundle{
+		Name:        cert.Data.Body.Name,
+		Certificate: cert.Data.Body.Certificate,
+		Chain:       cert.Data.Body.CACertificate,
+		Created:     cont.env.Now(),
+	}
+
+	if params.Private != nil && *params.Private {
+		if cert.Data.Body.PrivateKey == "" {
+			return nil, newError(ErrInvalidParams, nil, "certificate '%s' has no private key to export", *params.Name)
+		}
+		bundle.PrivateKey = cert.Data.Body.PrivateKey
+	}
+
+	password := ""
+	if params.Password != nil {
+		password = *params.Password
+	}
+
+	logger.Debugf("encoding certificate as %s", *params.Export)
+	out, err := bundle.Encode(*params.Export, password)
+	if err != nil {
+		return nil, wrapError(err, "exporting certificate '%s'", *params.Name)
+	}
+
+	logger.Trace("returning exported certificate")
+	return out, nil
+}
+
 func (cont *CertificateController) Update(params *CertificateParams) error {
 	logger.Debug("updating certificate")
 	logger.Tracef("received params: %s", params)
@@ -383,6 +474,10 @@ func (cont *CertificateController) Update(params *CertificateParams) error {
 		return err
 	}
 
+	if err := params.ValidateTags(false); err != nil {
+		return err
+	}
+
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return err
 	}
@@ -394,7 +489,7 @@ func (cont *CertificateController) Update(params *CertificateParams) error {
 
 	certId, err := index.GetCert(*params.Name)
 	if err != nil {
-		return err
+		return newError(ErrNotFound, err, "getting certificate '%s'", *params.Name)
 	}
 
 	cert, err := cont.GetCert(certId)
@@ -402,68 +497,38 @@ func (cont *CertificateController) Update(params *CertificateParams) error {
 		return err
 	}
 
-	if *params.CertFile != "" {
-		ok, err := fs.Exists(*params.CertFile)
-		if err != nil {
-			return err
-		}
-		if !ok {
-			logger.Warnf("certificate file '%s' does not exist", *params.CertFile)
-			return nil
-		}
-
-		logger.Debugf("reading certificate file '%s'", *params.CertFile)
-
-		certPem, err := fs.ReadFile(*params.CertFile)
-		if err != nil {
-			return err
-		}
-
-		// TODO - better validation of pem
-		logger.Debug("decoding certificate file PEM")
-		_, err = x509.PemDecodeX509Certificate([]byte(certPem))
+	if *params.CertFile != "" || *params.KeyFile != "" {
+		imported, err := importCertificateFiles(*params.CertFile, *params.KeyFile, paramPassword(params.Password))
 		if err != nil {
 			return err
 		}
 
-		cert.Data.Body.Certificate = certPem
-	}
-
-	if *params.KeyFile != "" {
-		ok, err := fs.Exists(*params.KeyFile)
-		if err != nil {
-			return err
-		}
-		if !ok {
-			logger.Warnf("key file '%s' does not exist", *params.KeyFile)
-			return nil
+		if imported.Certificate != nil {
+			cert.Data.Body.Certificate = imported.CertificatePEM()
+			if len(imported.Chain) > 0 {
+				cert.Data.Body.CACertificate = imported.ChainPEM()
+			}
 		}
 
-		logger.Debugf("reading key file '%s'", *params.KeyFile)
-
-		keyPem, err := fs.ReadFile(*params.KeyFile)
-		if err != nil {
-			return err
-		}
+		if imported.Key != nil {
+			keyPem, keyType, err := imported.KeyPEM()
+			if err != nil {
+				return err
+			}
 
-		logger.Debug("decoding key file PEM")
-		key, err := crypto.PemDecodePrivate([]byte(keyPem))
-		if err != nil {
-			return err
+			cert.Data.Body.KeyType = string(keyType)
+			cert.Data.Body.PrivateKey = keyPem
 		}
 
-		logger.Debug("getting key type")
-		keyType, err := crypto.GetKeyType(key)
-		if err != nil {
-			return err
+		if err := checkStoredKeyMatches(cert.Data.Body.Certificate, cert.Data.Body.PrivateKey); err != nil {
+			return wrapError(err, "updating certificate '%s'", *params.Name)
 		}
-
-		cert.Data.Body.KeyType = string(keyType)
-		cert.Data.Body.PrivateKey = keyPem
 	}
 
 	if *params.Tags != "" {
-		cont.ResetCertTags(certId, *params.Tags)
+		if err := cont.ResetCertTags(certId, *params.Tags); err != nil {
+			return err
+		}
 	}
 
 	err = cont.SaveCert(cert)
@@ -491,26 +556,27 @@ func (cont *CertificateController) Delete(params *CertificateParams) error {
 		return err
 	}
 
-	index, err := cont.env.controllers.org.GetIndex()
+	orgIndex, err := cont.env.controllers.org.GetIndex()
 	if err != nil {
 		return err
 	}
 
-	certId, err := index.GetCert(*params.Name)
+	certId, err := orgIndex.GetCert(*params.Name)
 	if err != nil {
-		return err
+		return newError(ErrNotFound, err, "getting certificate '%s'", *params.Name)
 	}
 
 	logger.Debugf("removing certificate file '%s'", certId)
 	if err := cont.env.api.DeletePrivate(cont.env.controllers.org.OrgId(), certId); err != nil {
-		return err
-	}
-
-	if err := index.RemoveCert(*params.Name); err != nil {
-		return err
+		return wrapError(err, "deleting certificate '%s'", *params.Name)
 	}
 
-	err = cont.env.controllers.org.SaveIndex(index)
+	err = cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.RemoveCert(*params.Name); err != nil {
+			return newError(ErrNotFound, err, "removing certificate '%s' from org index", *params.Name)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -1,9 +1,5 @@
 package controller
 
-import (
-	"fmt"
-)
-
 type CertificateParams struct {
 	Name           *string
 	Tags           *string
@@ -23,6 +19,13 @@ type CertificateParams struct {
 	Private        *bool
 	CertFile       *string
 	KeyFile        *string
+	// Password protects PKCS #12 and JKS exports, and decrypts imported
+	// encrypted PKCS #8 and PKCS #12 files
+	Password *string
+	// Offset, Limit and IndexOnly apply to listing
+	Offset    *int
+	Limit     *int
+	IndexOnly *bool
 }
 
 func NewCertificateParams() *CertificateParams {
@@ -31,15 +34,17 @@ func NewCertificateParams() *CertificateParams {
 
 func (params *CertificateParams) ValidateName(required bool) error {
 	if required && *params.Name == "" {
-		return fmt.Errorf("name cannot be empty")
+		return newError(ErrInvalidParams, nil, "name cannot be empty")
 	}
 	return nil
 }
 
-func (params *CertificateParams) ValidateStandalone(required bool) error    { return nil }
-func (params *CertificateParams) ValidateTags(required bool) error          { return nil }
+func (params *CertificateParams) ValidateStandalone(required bool) error { return nil }
+func (params *CertificateParams) ValidateTags(required bool) error {
+	return validateTagsParam(params.Tags, required)
+}
+
 func (params *CertificateParams) ValidateExpiry(required bool) error        { return nil }
-func (params *CertificateParams) ValidateKeyType(required bool) error       { return nil }
 func (params *CertificateParams) ValidateDnLocality(required bool) error    { return nil }
 func (params *CertificateParams) ValidateDnState(required bool) error       { return nil }
 func (params *CertificateParams) ValidateDnOrg(required bool) error         { return nil }
@@ -48,7 +53,22 @@ func (params *CertificateParams) ValidateDnCountry(required bool) error     { re
 func (params *CertificateParams) ValidateDnStreet(required bool) error      { return nil }
 func (params *CertificateParams) ValidateDnPostal(required bool) error      { return nil }
 func (params *CertificateParams) ValidateConfirmDelete(required bool) error { return nil }
-func (params *CertificateParams) ValidateExport(required bool) error        { return nil }
 func (params *CertificateParams) ValidatePrivate(required bool) error       { return nil }
 func (params *CertificateParams) ValidateCertFile(required bool) error      { return nil }
 func (params *CertificateParams) ValidateKeyFile(required bool) error       { return nil }
+
+func (params *CertificateParams) ValidateKeyType(required bool) error {
+	if params.KeyType == nil || *params.KeyType == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "key type cannot be empty")
+		}
+		return nil
+	}
+	return ValidateKeyType(*params.KeyType)
+}
+
+// ValidateExport checks the export format, which is one of the Export*
+// formats, and that there's a password if the format needs one.
+func (params *CertificateParams) ValidateExport(required bool) error {
+	return validateExportParams(params.Export, params.Password, required)
+}
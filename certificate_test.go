@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCertificateNewMissingCertFile(t *testing.T) {
+	setupOrg(t)
+	defer teardown()
+
+	cont, _ := NewCertificate(NewEnvironment())
+	params := newTestCertificateParams("cert")
+	params.CertFile = stringPtr(path.Join(os.Getenv("PKIIO_LOCAL"), "missing.pem"))
+
+	cert, ca, err := cont.New(params)
+	assert.Nil(t, cert)
+	assert.Nil(t, ca)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestCertificateNewMissingKeyFile(t *testing.T) {
+	setupOrg(t)
+	defer teardown()
+
+	certFile, _ := writeTestCertificate(t, os.Getenv("PKIIO_LOCAL"), false)
+
+	cont, _ := NewCertificate(NewEnvironment())
+	params := newTestCertificateParams("cert")
+	params.CertFile = stringPtr(certFile)
+	params.KeyFile = stringPtr(path.Join(os.Getenv("PKIIO_LOCAL"), "missing.pem"))
+
+	cert, _, err := cont.New(params)
+	assert.Nil(t, cert)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestCertificateNewIds(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	_, err := caCont.New(newTestCAParams("ca"))
+	assert.NoError(t, err)
+
+	ids := make(map[string]bool)
+	for _, name := range []string{"web", "db", "self"} {
+		params := newTestCertificateParams(name)
+		if name != "self" {
+			params.Ca = stringPtr("ca")
+		}
+
+		certCont, _ := NewCertificate(backends.env(home))
+		cert, _, err := certCont.New(params)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, cert.Data.Body.Id)
+		ids[cert.Data.Body.Id] = true
+	}
+	assert.Len(t, ids, 3)
+
+	env := backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	orgIndex, err := env.controllers.org.GetIndex()
+	assert.NoError(t, err)
+	assert.Len(t, orgIndex.GetCerts(), 3)
+}
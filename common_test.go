@@ -1,10 +1,20 @@
 package controller
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"path"
 	"strings"
+	"testing"
+	"time"
 )
 
 func setup() {
@@ -47,3 +57,260 @@ func teardown() {
 	}
 
 }
+
+func stringPtr(s string) *string { return &s }
+func intPtr(i int) *int          { return &i }
+func boolPtr(b bool) *bool       { return &b }
+
+// setupOrg creates the test directories, initialises an org in them and points
+// PKIIO_LOCAL at the new org directory so that the admin environment loads.
+func setupOrg(t *testing.T) {
+	setup()
+
+	org, err := NewOrg(NewEnvironment())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := NewOrgParams()
+	params.Org = stringPtr("test")
+	params.Admin = stringPtr("admin")
+	if err := org.Init(params); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Setenv("PKIIO_LOCAL", path.Join(os.Getenv("PKIIO_LOCAL"), "test")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its key to dir.
+func writeTestCertificate(t *testing.T, dir string, isCA bool) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &stdx509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = stdx509.KeyUsageCertSign | stdx509.KeyUsageCRLSign
+	}
+
+	der, err := stdx509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := stdx509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := path.Join(dir, "cert.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := path.Join(dir, "key.pem")
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func newTestCAParams(name string) *CAParams {
+	params := NewCAParams()
+	params.Name = stringPtr(name)
+	params.Tags = stringPtr("")
+	params.CaExpiry = intPtr(365)
+	params.CertExpiry = intPtr(90)
+	params.KeyType = stringPtr("ec")
+	params.DnLocality = stringPtr("")
+	params.DnState = stringPtr("")
+	params.DnOrg = stringPtr("")
+	params.DnOrgUnit = stringPtr("")
+	params.DnCountry = stringPtr("")
+	params.DnStreet = stringPtr("")
+	params.DnPostal = stringPtr("")
+	params.ConfirmDelete = stringPtr("")
+	params.Export = stringPtr("")
+	params.Private = boolPtr(false)
+	params.CertFile = stringPtr("")
+	params.KeyFile = stringPtr("")
+	params.AllowLegacyCA = boolPtr(false)
+	params.RequestFile = stringPtr("")
+	params.ResponseFile = stringPtr("")
+	params.KeyRef = stringPtr("")
+	return params
+}
+
+func newTestCertificateParams(name string) *CertificateParams {
+	params := NewCertificateParams()
+	params.Name = stringPtr(name)
+	params.Tags = stringPtr("")
+	params.StandaloneFile = stringPtr("")
+	params.Expiry = intPtr(90)
+	params.Ca = stringPtr("")
+	params.KeyType = stringPtr("ec")
+	params.DnLocality = stringPtr("")
+	params.DnState = stringPtr("")
+	params.DnOrg = stringPtr("")
+	params.DnOrgUnit = stringPtr("")
+	params.DnCountry = stringPtr("")
+	params.DnStreet = stringPtr("")
+	params.DnPostal = stringPtr("")
+	params.ConfirmDelete = stringPtr("")
+	params.Export = stringPtr("")
+	params.Private = boolPtr(false)
+	params.CertFile = stringPtr("")
+	params.KeyFile = stringPtr("")
+	return params
+}
+
+func newTestCSRParams(name string) *CSRParams {
+	params := NewCSRParams()
+	params.Name = stringPtr(name)
+	params.Tags = stringPtr("")
+	params.StandaloneFile = stringPtr("")
+	params.Expiry = intPtr(90)
+	params.Ca = stringPtr("")
+	params.KeyType = stringPtr("ec")
+	params.DnLocality = stringPtr("")
+	params.DnState = stringPtr("")
+	params.DnOrg = stringPtr("")
+	params.DnOrgUnit = stringPtr("")
+	params.DnCountry = stringPtr("")
+	params.DnStreet = stringPtr("")
+	params.DnPostal = stringPtr("")
+	params.ConfirmDelete = stringPtr("")
+	params.Export = stringPtr("")
+	params.Private = boolPtr(false)
+	params.KeepSubject = boolPtr(false)
+	params.CsrFile = stringPtr("")
+	params.KeyFile = stringPtr("")
+	params.CaCertFile = stringPtr("")
+	return params
+}
+
+// memoryBackends holds the shared in-memory stores for one test org. Each
+// call to env returns a fresh Environment, like a new CLI invocation would.
+type memoryBackends struct {
+	api   *MemoryAPI
+	local *MemoryFs
+}
+
+func newMemoryBackends() *memoryBackends {
+	return &memoryBackends{api: NewMemoryAPI(), local: NewMemoryFs()}
+}
+
+func (b *memoryBackends) env(home *MemoryFs) *Environment {
+	return NewEnvironmentWithOptions(&EnvironmentOptions{
+		API:   b.api,
+		Local: b.local,
+		Home:  home,
+	})
+}
+
+func newTestOrgParams(org, admin string) *OrgParams {
+	params := NewOrgParams()
+	params.Org = stringPtr(org)
+	params.Admin = stringPtr(admin)
+	params.ConfirmDelete = stringPtr("")
+	params.Private = boolPtr(false)
+	return params
+}
+
+func newTestAdminParams(name string) *AdminParams {
+	params := NewAdminParams()
+	params.Name = stringPtr(name)
+	params.InviteId = stringPtr("")
+	params.InviteKey = stringPtr("")
+	params.ConfirmDelete = stringPtr("")
+	return params
+}
+
+func newTestNodeParams(name string) *NodeParams {
+	params := NewNodeParams()
+	params.Name = stringPtr(name)
+	params.Host = stringPtr("")
+	params.OrgId = stringPtr("")
+	params.Tags = stringPtr("")
+	params.PairingId = stringPtr("")
+	params.PairingKey = stringPtr("")
+	params.AgentFile = stringPtr("")
+	params.InstallFile = stringPtr("")
+	params.SSHOptions = stringPtr("")
+	params.ConfirmDelete = stringPtr("")
+	params.Export = stringPtr("")
+	params.Private = boolPtr(false)
+	return params
+}
+
+func newTestPairingKeyParams(tags string) *PairingKeyParams {
+	params := NewPairingKeyParams()
+	params.Id = stringPtr("")
+	params.Tags = stringPtr(tags)
+	params.ConfirmDelete = stringPtr("")
+	params.Private = boolPtr(false)
+	return params
+}
+
+// errTestSend is returned by failingAPI sends.
+var errTestSend = errors.New("test send failure")
+
+// failingAPI is a MemoryAPI whose sends fail once failSends is set, or just
+// its swaps once failSwaps is set, or whose queue sizes fail once failSizes is
+// set, for testing that controllers report failed API calls.
+type failingAPI struct {
+	*MemoryAPI
+	failSends bool
+	failSwaps bool
+	failSizes bool
+}
+
+func (f *failingAPI) OutgoingSize(dstId, queue string) (int, error) {
+	if f.failSizes {
+		return 0, errTestSend
+	}
+	return f.MemoryAPI.OutgoingSize(dstId, queue)
+}
+
+func (f *failingAPI) SendPublic(dstId, name, content string) error {
+	if f.failSends {
+		return errTestSend
+	}
+	return f.MemoryAPI.SendPublic(dstId, name, content)
+}
+
+func (f *failingAPI) SendPrivate(dstId, name, content string) error {
+	if f.failSends {
+		return errTestSend
+	}
+	return f.MemoryAPI.SendPrivate(dstId, name, content)
+}
+
+func (f *failingAPI) SwapPrivate(dstId, name, content, etag string) error {
+	if f.failSends || f.failSwaps {
+		return errTestSend
+	}
+	return f.MemoryAPI.SwapPrivate(dstId, name, content, etag)
+}
+
+// failingEnv returns an environment for the org whose API sends fail.
+func (b *memoryBackends) failingEnv(home *MemoryFs) *Environment {
+	return NewEnvironmentWithOptions(&EnvironmentOptions{
+		API:   &failingAPI{MemoryAPI: b.api, failSends: true},
+		Local: b.local,
+		Home:  home,
+	})
+}
@@ -3,11 +3,10 @@ package controller
 
 import (
 	"crypto/x509/pkix"
-	"fmt"
-	"github.com/pki-io/core/crypto"
 	"github.com/pki-io/core/document"
-	"github.com/pki-io/core/fs"
+	"github.com/pki-io/core/index"
 	"github.com/pki-io/core/x509"
+	"time"
 )
 
 type CSRController struct {
@@ -33,21 +32,16 @@ func (cont *CSRController) ResetCSRTags(csrId, tags string) error {
 	logger.Debug("resetting CSR tags")
 	logger.Tracef("received CSR id '%s' and tags '%s'", csrId, tags)
 
-	orgIndex, err := cont.env.controllers.org.GetIndex()
-	if err != nil {
-		return err
-	}
-
-	if err := orgIndex.ClearCSRTags(csrId); err != nil {
-		return err
-	}
-
-	err = orgIndex.AddCSRTags(csrId, ParseTags(tags))
-	if err != nil {
-		return err
-	}
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.ClearCSRTags(csrId); err != nil {
+			return wrapError(err, "clearing tags for CSR '%s'", csrId)
+		}
 
-	err = cont.env.controllers.org.SaveIndex(orgIndex)
+		if err := orgIndex.AddCSRTags(csrId, ParseTags(tags)); err != nil {
+			return wrapError(err, "tagging CSR '%s'", csrId)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -63,25 +57,30 @@ func (cont *CSRController) GetCSR(id string) (*x509.CSR, error) {
 	logger.Debug("getting CSR from org")
 	csrContainerJson, err := cont.env.api.GetPrivate(cont.env.controllers.org.OrgId(), id)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "getting CSR '%s'", id)
 	}
 
 	logger.Debug("creating new container")
 	csrContainer, err := document.NewContainer(csrContainerJson)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "loading CSR container '%s'", id)
+	}
+
+	logger.Debug("verifying container")
+	if err := cont.env.controllers.org.org.Verify(csrContainer); err != nil {
+		return nil, newError(ErrVerificationFailed, err, "verifying CSR '%s'", id)
 	}
 
 	logger.Debug("decrypting container")
-	csrJson, err := cont.env.controllers.org.org.VerifyThenDecrypt(csrContainer)
+	csrJson, err := cont.env.controllers.org.org.Decrypt(csrContainer)
 	if err != nil {
-		return nil, err
+		return nil, newError(ErrDecryptionFailed, err, "decrypting CSR '%s'", id)
 	}
 
 	logger.Debug("loading CSR json")
 	csr, err := x509.NewCSR(csrJson)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "loading CSR '%s'", id)
 	}
 
 	logger.Trace("returning CSR")
@@ -101,7 +100,7 @@ func (cont *CSRController) SaveCSR(csr *x509.CSR) error {
 	logger.Debug("saving encrypted csr")
 	err = cont.env.api.SendPrivate(cont.env.controllers.org.org.Data.Body.Id, csr.Data.Body.Id, csrContainer.Dump())
 	if err != nil {
-		return err
+		return wrapError(err, "sending CSR '%s'", csr.Data.Body.Id)
 	}
 
 	logger.Trace("returning nil error")
@@ -112,22 +111,16 @@ func (cont *CSRController) AddCSRToOrgIndex(csr *x509.CSR, tags string) error {
 	logger.Debug("adding CSR to org index")
 	logger.Tracef("received CSR with id '%s' and tags '%s'", csr.Id(), tags)
 
-	orgIndex, err := cont.env.controllers.org.GetIndex()
-	if err != nil {
-		return err
-	}
-
-	err = orgIndex.AddCSR(csr.Data.Body.Name, csr.Data.Body.Id)
-	if err != nil {
-		return err
-	}
-
-	err = orgIndex.AddCSRTags(csr.Data.Body.Id, ParseTags(tags))
-	if err != nil {
-		return err
-	}
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.AddCSR(csr.Data.Body.Name, csr.Data.Body.Id); err != nil {
+			return newError(ErrAlreadyExists, err, "adding CSR '%s' to org index", csr.Data.Body.Name)
+		}
 
-	err = cont.env.controllers.org.SaveIndex(orgIndex)
+		if err := orgIndex.AddCSRTags(csr.Data.Body.Id, ParseTags(tags)); err != nil {
+			return wrapError(err, "tagging CSR '%s'", csr.Data.Body.Name)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -144,6 +137,14 @@ func (cont *CSRController) New(params *CSRParams) (*x509.CSR, error) {
 		return nil, err
 	}
 
+	if err := params.ValidateTags(false); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateKeyType(false); err != nil {
+		return nil, err
+	}
+
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return nil, err
 	}
@@ -179,70 +180,39 @@ func (cont *CSRController) New(params *CSRParams) (*x509.CSR, error) {
 		return nil, err
 	}
 
-	csr.Data.Body.Id = x509.NewID()
+	csr.Data.Body.Id = cont.env.NewID()
 	csr.Data.Body.Name = *params.Name
 
 	if *params.CsrFile == "" && *params.KeyFile == "" {
 		csr.Data.Body.KeyType = *params.KeyType
 		logger.Debug("generating CSR and key")
-		csr.Generate(&subject)
+		if spec := keySpecForType(*params.KeyType); spec != "" {
+			csrPem, keyPem, keyType, err := GenerateCSR(&CSRRequest{KeySpec: spec, Subject: subject})
+			if err != nil {
+				return nil, wrapError(err, "generating CSR '%s'", *params.Name)
+			}
+			csr.Data.Body.CSR = csrPem
+			csr.Data.Body.PrivateKey = keyPem
+			csr.Data.Body.KeyType = string(keyType)
+		} else if err := csr.Generate(&subject); err != nil {
+			return nil, wrapError(err, "generating CSR '%s'", *params.Name)
+		}
 	} else {
 		if *params.CsrFile == "" {
-			return nil, fmt.Errorf("CSR PEM file must be provided if importing")
+			return nil, newError(ErrInvalidParams, nil, "CSR file must be provided if importing")
 		}
 
 		logger.Debugf("importing CSR from '%s'", *params.CsrFile)
-		ok, err := fs.Exists(*params.CsrFile)
-		if err != nil {
-			return nil, err
-		}
-
-		if !ok {
-			logger.Warnf("CSR file '%s' does not exist", *params.CsrFile)
-			logger.Tracef("returning nil error")
-			return nil, nil
-		}
-
-		logger.Debug("reading file")
-		csrPem, err := fs.ReadFile(*params.CsrFile)
-		if err != nil {
-			return nil, err
-		}
-
-		logger.Debug("decoding CSR PEM")
-		_, err = x509.PemDecodeX509CSR([]byte(csrPem))
+		request, err := importCSRFile(*params.CsrFile)
 		if err != nil {
 			return nil, err
 		}
 
-		csr.Data.Body.CSR = csrPem
+		csr.Data.Body.CSR = pemEncodeCSR(request)
 
 		if *params.KeyFile != "" {
 			logger.Debugf("importing private key file from '%s'", *params.KeyFile)
-			ok, err := fs.Exists(*params.KeyFile)
-			if err != nil {
-				return nil, err
-			}
-
-			if !ok {
-				logger.Warnf("key file '%s' does not exist", *params.KeyFile)
-				logger.Trace("returning nil error")
-				return nil, nil
-			}
-
-			logger.Debugf("reading key file")
-			keyPem, err := fs.ReadFile(*params.KeyFile)
-			if err != nil {
-				return nil, err
-			}
-
-			logger.Debug("decoding private key PEM")
-			key, err := crypto.PemDecodePrivate([]byte(keyPem))
-			if err != nil {
-				return nil, err
-			}
-
-			keyType, err := crypto.GetKeyType(key)
+			keyPem, keyType, err := importCSRKeyFile(*params.KeyFile, paramPassword(params.Password), request)
 			if err != nil {
 				return nil, err
 			}
@@ -274,9 +244,24 @@ func (cont *CSRController) New(params *CSRParams) (*x509.CSR, error) {
 	return csr, nil
 }
 
-func (cont *CSRController) List(params *CSRParams) ([]*x509.CSR, error) {
-	logger.Debug("listing CSRs")
-	logger.Tracef("received params: %s", params)
+// CSRListEntry is a CSR in a list. CSR is nil when listing the index only
+// or if the CSR couldn't be loaded, in which case Err is set.
+type CSRListEntry struct {
+	*ListEntry
+	CSR *x509.CSR
+}
+
+// ListEntries lists the CSRs whose names match the name pattern and that have
+// all the tags in params. Items that can't be loaded are returned with their
+// error rather than failing the list.
+func (cont *CSRController) ListEntries(params *CSRParams) ([]*CSRListEntry, error) {
+	logger.Debug("listing CSRs entries")
+	logger.Trace("received params [NOT LOGGED]")
+
+	opts, err := NewListOptions(params.Name, params.Tags, params.Offset, params.Limit, params.IndexOnly)
+	if err != nil {
+		return nil, err
+	}
 
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return nil, err
@@ -287,17 +272,41 @@ func (cont *CSRController) List(params *CSRParams) ([]*x509.CSR, error) {
 		return nil, err
 	}
 
+	entries := make([]*CSRListEntry, 0)
+	for _, entry := range listIndex(index.GetCSRs(), index.Data.Body.Tags.CSRReverse, opts) {
+		csrEntry := &CSRListEntry{ListEntry: entry}
+		if !opts.IndexOnly {
+			csrEntry.CSR, entry.Err = cont.GetCSR(entry.Id)
+		}
+		entries = append(entries, csrEntry)
+	}
+
+	logger.Trace("returning CSRs entries")
+	return entries, nil
+}
+
+// List returns the CSRs that could be loaded. If some couldn't, they're
+// reported with a *ListError.
+func (cont *CSRController) List(params *CSRParams) ([]*x509.CSR, error) {
+	logger.Debug("listing CSRs")
+	logger.Trace("received params [NOT LOGGED]")
+
+	entries, err := cont.ListEntries(params)
+	if err != nil {
+		return nil, err
+	}
+
 	csrs := make([]*x509.CSR, 0)
-	for _, id := range index.GetCSRs() {
-		csr, err := cont.GetCSR(id)
-		if err != nil {
-			return nil, err
+	listEntries := make([]*ListEntry, 0)
+	for _, entry := range entries {
+		listEntries = append(listEntries, entry.ListEntry)
+		if entry.CSR != nil {
+			csrs = append(csrs, entry.CSR)
 		}
-		csrs = append(csrs, csr)
 	}
 
-	logger.Trace("returning CSRs")
-	return csrs, nil
+	logger.Trace("returning CSRs list")
+	return csrs, listError(listEntries)
 }
 
 func (cont *CSRController) Show(params *CSRParams) (*x509.CSR, error) {
@@ -328,7 +337,7 @@ func (cont *CSRController) Show(params *CSRParams) (*x509.CSR, error) {
 
 	csrId, err := index.GetCSR(*params.Name)
 	if err != nil {
-		return nil, err
+		return nil, newError(ErrNotFound, err, "getting CSR '%s'", *params.Name)
 	}
 
 	csr, err := cont.GetCSR(csrId)
@@ -348,18 +357,22 @@ func (cont *CSRController) Sign(params *CSRParams) (*x509.Certificate, error) {
 		return nil, err
 	}
 
+	if err := params.ValidateTags(false); err != nil {
+		return nil, err
+	}
+
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return nil, err
 	}
 
-	index, err := cont.env.controllers.org.GetIndex()
+	orgIndex, err := cont.env.controllers.org.GetIndex()
 	if err != nil {
 		return nil, err
 	}
 
-	csrId, err := index.GetCSR(*params.Name)
+	csrId, err := orgIndex.GetCSR(*params.Name)
 	if err != nil {
-		return nil, err
+		return nil, newError(ErrNotFound, err, "getting CSR '%s'", *params.Name)
 	}
 
 	csr, err := cont.GetCSR(csrId)
@@ -367,9 +380,9 @@ func (cont *CSRController) Sign(params *CSRParams) (*x509.Certificate, error) {
 		return nil, err
 	}
 
-	caId, err := index.GetCA(*params.Ca)
+	caId, err := orgIndex.GetCA(*params.Ca)
 	if err != nil {
-		return nil, err
+		return nil, newError(ErrNotFound, err, "getting CA '%s'", *params.Ca)
 	}
 
 	caCont, err := NewCA(cont.env)
@@ -382,11 +395,18 @@ func (cont *CSRController) Sign(params *CSRParams) (*x509.Certificate, error) {
 		return nil, err
 	}
 
+	if ca.Data.Body.PrivateKey == "" {
+		return nil, newError(ErrInvalidParams, nil, "CA '%s' has no private key to sign with", *params.Ca)
+	}
+
 	logger.Debug("signing CSR")
-	cert, err := ca.Sign(csr, *params.KeepSubject)
+	cert, err := signCSR(ca, csr, *params.KeepSubject, cont.env.Now())
+	if err != nil {
+		return nil, wrapError(err, "signing CSR '%s' with CA '%s'", *params.Name, *params.Ca)
+	}
 
 	logger.Debug("setting certificate ID")
-	cert.Data.Body.Id = x509.NewID()
+	cert.Data.Body.Id = cont.env.NewID()
 
 	org := cont.env.controllers.org.org
 	logger.Debug("encrypting certificate container for org")
@@ -397,13 +417,20 @@ func (cont *CSRController) Sign(params *CSRParams) (*x509.Certificate, error) {
 
 	logger.Debug("sending encrypted container to org")
 	if err := cont.env.api.SendPrivate(org.Data.Body.Id, cert.Data.Body.Id, certContainer.Dump()); err != nil {
-		return nil, err
+		return nil, wrapError(err, "sending certificate '%s'", cert.Data.Body.Id)
 	}
 
-	index.AddCert(cert.Data.Body.Name, cert.Data.Body.Id)
-	index.AddCertTags(cert.Data.Body.Id, ParseTags(*params.Tags))
+	err = cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.AddCert(cert.Data.Body.Name, cert.Data.Body.Id); err != nil {
+			return newError(ErrAlreadyExists, err, "adding certificate '%s' to org index", cert.Data.Body.Name)
+		}
 
-	if err := cont.env.controllers.org.SaveIndex(index); err != nil {
+		if err := orgIndex.AddCertTags(cert.Data.Body.Id, ParseTags(*params.Tags)); err != nil {
+			return wrapError(err, "tagging certificate '%s'", cert.Data.Body.Name)
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -411,6 +438,74 @@ func (cont *CSRController) Sign(params *CSRParams) (*x509.Certificate, error) {
 	return cert, nil
 }
 
+// ExportCARequest exports a signed request for the offline CA whose
+// certificate is in params.CaCertFile to sign the CSR as an intermediate CA
+// for params.Expiry days. The CSR's key stays in the org, and the response is
+// imported with CAController.Update, which only accepts a certificate issued
+// by that CA.
+func (cont *CSRController) ExportCARequest(params *CSRParams) ([]byte, error) {
+	logger.Debug("exporting CA request")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateName(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateExpiry(true); err != nil {
+		return nil, err
+	}
+
+	if *params.Expiry <= 0 {
+		return nil, newError(ErrInvalidParams, nil, "CA expiry must be a positive number of days")
+	}
+
+	if err := params.ValidateCaCertFile(true); err != nil {
+		return nil, err
+	}
+
+	issuer, err := readCACertFile(*params.CaCertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := cont.Show(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if csr.Data.Body.PrivateKey == "" {
+		return nil, newError(ErrInvalidParams, nil, "CSR '%s' has no private key for the CA", *params.Name)
+	}
+
+	org := cont.env.controllers.org.org
+	request := &CARequest{
+		Type:     CARequestType,
+		Id:       csr.Data.Body.Id,
+		Name:     csr.Data.Body.Name,
+		CSR:      csr.Data.Body.CSR,
+		CAExpiry: *params.Expiry,
+		Issuer:   (&ImportedCert{Certificate: issuer}).CertificatePEM(),
+		OrgId:    org.Id(),
+		Created:  cont.env.Now().UTC().Format(time.RFC3339),
+	}
+
+	out, err := signTransferFile(org, request)
+	if err != nil {
+		return nil, wrapError(err, "exporting CA request for CSR '%s'", *params.Name)
+	}
+
+	err = cont.env.controllers.org.UpdateCARequests(func(requests map[string]string) error {
+		requests[csr.Data.Body.Id] = request.Issuer
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError(err, "recording CA request for CSR '%s'", *params.Name)
+	}
+
+	logger.Trace("returning CA request")
+	return out, nil
+}
+
 func (cont *CSRController) Update(params *CSRParams) error {
 	logger.Debug("updating CSR")
 	logger.Tracef("received params: %s", params)
@@ -419,6 +514,10 @@ func (cont *CSRController) Update(params *CSRParams) error {
 		return err
 	}
 
+	if err := params.ValidateTags(false); err != nil {
+		return err
+	}
+
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return err
 	}
@@ -430,7 +529,7 @@ func (cont *CSRController) Update(params *CSRParams) error {
 
 	csrId, err := index.GetCSR(*params.Name)
 	if err != nil {
-		return err
+		return newError(ErrNotFound, err, "getting CSR '%s'", *params.Name)
 	}
 
 	csr, err := cont.GetCSR(csrId)
@@ -439,66 +538,37 @@ func (cont *CSRController) Update(params *CSRParams) error {
 	}
 
 	if *params.CsrFile != "" {
-		ok, err := fs.Exists(*params.CsrFile)
+		request, err := importCSRFile(*params.CsrFile)
 		if err != nil {
 			return err
 		}
-		if !ok {
-			logger.Warnf("CSR file '%s' does not exist", *params.CsrFile)
-			return nil
-		}
-
-		logger.Debugf("reading CSR file '%s'", *params.CsrFile)
 
-		csrPem, err := fs.ReadFile(*params.CsrFile)
-		if err != nil {
-			return err
-		}
-
-		// TODO - better validation of pem
-		logger.Debug("decoding CSR file PEM")
-		_, err = x509.PemDecodeX509CSR([]byte(csrPem))
-		if err != nil {
-			return err
-		}
-
-		csr.Data.Body.CSR = csrPem
+		csr.Data.Body.CSR = pemEncodeCSR(request)
 	}
 
 	if *params.KeyFile != "" {
-		ok, err := fs.Exists(*params.KeyFile)
-		if err != nil {
-			return err
-		}
-		if !ok {
-			logger.Warnf("key file '%s' does not exist", *params.KeyFile)
-			return nil
-		}
-
-		logger.Debugf("reading key file '%s'", *params.KeyFile)
-
-		keyPem, err := fs.ReadFile(*params.KeyFile)
+		request, err := ParseCSRData([]byte(csr.Data.Body.CSR))
 		if err != nil {
-			return err
-		}
-
-		logger.Debug("decoding key file PEM")
-		key, err := crypto.PemDecodePrivate([]byte(keyPem))
-		if err != nil {
-			return err
+			return wrapError(err, "decoding CSR '%s'", *params.Name)
 		}
 
-		keyType, err := crypto.GetKeyType(key)
+		keyPem, keyType, err := importCSRKeyFile(*params.KeyFile, paramPassword(params.Password), request)
 		if err != nil {
 			return err
 		}
 
 		csr.Data.Body.KeyType = string(keyType)
 		csr.Data.Body.PrivateKey = keyPem
+	} else if *params.CsrFile != "" && csr.Data.Body.PrivateKey != "" {
+		if err := checkStoredCSRKeyMatches(csr.Data.Body.CSR, csr.Data.Body.PrivateKey); err != nil {
+			return wrapError(err, "updating CSR '%s'", *params.Name)
+		}
 	}
 
 	if *params.Tags != "" {
-		cont.ResetCSRTags(csrId, *params.Tags)
+		if err := cont.ResetCSRTags(csrId, *params.Tags); err != nil {
+			return err
+		}
 	}
 
 	err = cont.SaveCSR(csr)
@@ -526,26 +596,40 @@ func (cont *CSRController) Delete(params *CSRParams) error {
 		return err
 	}
 
-	index, err := cont.env.controllers.org.GetIndex()
+	orgIndex, err := cont.env.controllers.org.GetIndex()
 	if err != nil {
 		return err
 	}
 
-	csrId, err := index.GetCSR(*params.Name)
+	csrId, err := orgIndex.GetCSR(*params.Name)
 	if err != nil {
-		return err
+		return newError(ErrNotFound, err, "getting CSR '%s'", *params.Name)
 	}
 
-	logger.Debug("removing CSR file")
-	if err := cont.env.api.DeletePrivate(cont.env.controllers.org.OrgId(), csrId); err != nil {
+	if err := cont.DeleteCSR(csrId, *params.Name); err != nil {
 		return err
 	}
 
-	if err := index.RemoveCSR(*params.Name); err != nil {
-		return err
+	logger.Trace("returning nil error")
+	return nil
+}
+
+// DeleteCSR deletes a CSR's private file, with its key, and removes it from
+// the org index.
+func (cont *CSRController) DeleteCSR(csrId, name string) error {
+	logger.Debug("removing CSR file")
+	logger.Tracef("received csrId '%s' and name '%s'", csrId, name)
+
+	if err := cont.env.api.DeletePrivate(cont.env.controllers.org.OrgId(), csrId); err != nil {
+		return wrapError(err, "deleting CSR '%s'", name)
 	}
 
-	err = cont.env.controllers.org.SaveIndex(index)
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.RemoveCSR(name); err != nil {
+			return newError(ErrNotFound, err, "removing CSR '%s' from org index", name)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
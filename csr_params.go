@@ -1,9 +1,5 @@
 package controller
 
-import (
-	"fmt"
-)
-
 type CSRParams struct {
 	Name           *string
 	Tags           *string
@@ -24,6 +20,15 @@ type CSRParams struct {
 	KeepSubject    *bool
 	CsrFile        *string
 	KeyFile        *string
+	// CaCertFile is the certificate of the offline CA ExportCARequest asks
+	// to sign the CSR
+	CaCertFile *string
+	// Password decrypts an imported encrypted PKCS #8 or PKCS #12 key file
+	Password *string
+	// Offset, Limit and IndexOnly apply to listing
+	Offset    *int
+	Limit     *int
+	IndexOnly *bool
 }
 
 func NewCSRParams() *CSRParams {
@@ -32,15 +37,17 @@ func NewCSRParams() *CSRParams {
 
 func (params *CSRParams) ValidateName(required bool) error {
 	if required && *params.Name == "" {
-		return fmt.Errorf("name cannot be empty")
+		return newError(ErrInvalidParams, nil, "name cannot be empty")
 	}
 	return nil
 }
 
-func (params *CSRParams) ValidateStandalone(required bool) error    { return nil }
-func (params *CSRParams) ValidateTags(required bool) error          { return nil }
+func (params *CSRParams) ValidateStandalone(required bool) error { return nil }
+func (params *CSRParams) ValidateTags(required bool) error {
+	return validateTagsParam(params.Tags, required)
+}
+
 func (params *CSRParams) ValidateExpiry(required bool) error        { return nil }
-func (params *CSRParams) ValidateKeyType(required bool) error       { return nil }
 func (params *CSRParams) ValidateDnLocality(required bool) error    { return nil }
 func (params *CSRParams) ValidateDnState(required bool) error       { return nil }
 func (params *CSRParams) ValidateDnOrg(required bool) error         { return nil }
@@ -54,3 +61,20 @@ func (params *CSRParams) ValidatePrivate(required bool) error       { return nil
 func (params *CSRParams) ValidateKeepSubject(required bool) error   { return nil }
 func (params *CSRParams) ValidateCSRFile(required bool) error       { return nil }
 func (params *CSRParams) ValidateKeyFile(required bool) error       { return nil }
+
+func (params *CSRParams) ValidateCaCertFile(required bool) error {
+	if required && (params.CaCertFile == nil || *params.CaCertFile == "") {
+		return newError(ErrInvalidParams, nil, "CA certificate file cannot be empty")
+	}
+	return nil
+}
+
+func (params *CSRParams) ValidateKeyType(required bool) error {
+	if params.KeyType == nil || *params.KeyType == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "key type cannot be empty")
+		}
+		return nil
+	}
+	return ValidateKeyType(*params.KeyType)
+}
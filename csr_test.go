@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestCSRSignWithoutCAKey(t *testing.T) {
+	setupOrg(t)
+	defer teardown()
+
+	certFile, _ := writeTestCertificate(t, os.Getenv("PKIIO_LOCAL"), true)
+
+	caCont, _ := NewCA(NewEnvironment())
+	caParams := newTestCAParams("ca")
+	caParams.CertFile = stringPtr(certFile)
+	_, err := caCont.New(caParams)
+	assert.NoError(t, err)
+
+	csrCont, _ := NewCSR(NewEnvironment())
+	_, err = csrCont.New(newTestCSRParams("csr"))
+	assert.NoError(t, err)
+
+	params := newTestCSRParams("csr")
+	params.Ca = stringPtr("ca")
+
+	csrCont, _ = NewCSR(NewEnvironment())
+	cert, err := csrCont.Sign(params)
+	assert.Nil(t, cert)
+	assert.True(t, IsInvalidParams(err))
+}
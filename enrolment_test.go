@@ -0,0 +1,647 @@
+package controller
+
+import (
+	stdx509 "crypto/x509"
+	"errors"
+	"github.com/pki-io/core/document"
+	"github.com/pki-io/core/x509"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// initMemoryOrg initialises an org called "test" with an admin called "admin"
+// and returns the backends and the admin's home.
+func initMemoryOrg(t *testing.T) (*memoryBackends, *MemoryFs) {
+	backends := newMemoryBackends()
+	home := NewMemoryFs()
+
+	org, _ := NewOrg(backends.env(home))
+	if err := org.Init(newTestOrgParams("test", "admin")); err != nil {
+		t.Fatal(err)
+	}
+
+	return backends, home
+}
+
+func TestEnrolment(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	caParams := newTestCAParams("web-ca")
+	caParams.Tags = stringPtr("web")
+	ca, err := caCont.New(caParams)
+	assert.NoError(t, err)
+	assert.NotNil(t, ca)
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	node, err := nodeCont.CreateLocalNode("node1", pairingId, pairingKey)
+	assert.NoError(t, err)
+
+	size, _ := backends.api.OutgoingSize(node.Id(), "csrs")
+	assert.Equal(t, MinCSRs, size)
+
+	orgId := env.controllers.org.OrgId()
+	size, _ = backends.api.IncomingSize(orgId, "registration")
+	assert.Equal(t, 1, size)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	assert.NoError(t, env.controllers.org.RunEnv(newTestOrgParams("test", "admin")))
+
+	size, _ = backends.api.IncomingSize(orgId, "registration")
+	assert.Equal(t, 0, size)
+	size, _ = backends.api.IncomingSize(node.Id(), "certs")
+	assert.Equal(t, 1, size)
+	size, _ = backends.api.OutgoingSize(node.Id(), "csrs")
+	assert.Equal(t, MinCSRs-1, size)
+
+	nodeCont, _ = NewNode(backends.env(home))
+	assert.NoError(t, nodeCont.Run(newTestNodeParams("node1")))
+
+	size, _ = backends.api.IncomingSize(node.Id(), "certs")
+	assert.Equal(t, 0, size)
+
+	nodeCont, _ = NewNode(backends.env(home))
+	nodes, err := nodeCont.List(newTestNodeParams(""))
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+}
+
+func TestEnrolmentUnknownPairingKey(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	_, err := nodeCont.CreateLocalNode("node1", "unknown", "unknown")
+	assert.NoError(t, err)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	err = env.controllers.org.RunEnv(newTestOrgParams("test", "admin"))
+	assert.True(t, IsNotFound(err))
+}
+
+func TestAdminInvite(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	adminCont, _ := NewAdmin(backends.env(home))
+	invite, err := adminCont.Invite(newTestAdminParams("admin2"))
+	assert.NoError(t, err)
+
+	home2 := NewMemoryFs()
+	params := newTestAdminParams("admin2")
+	params.InviteId = stringPtr(invite[0])
+	params.InviteKey = stringPtr(invite[1])
+	adminCont, _ = NewAdmin(backends.env(home2))
+	assert.NoError(t, adminCont.New(params))
+
+	adminCont, _ = NewAdmin(backends.env(home))
+	assert.NoError(t, adminCont.Run(newTestAdminParams("")))
+
+	adminCont, _ = NewAdmin(backends.env(home2))
+	assert.NoError(t, adminCont.Complete(params))
+
+	caCont, _ := NewCA(backends.env(home))
+	_, err = caCont.New(newTestCAParams("ca"))
+	assert.NoError(t, err)
+
+	caCont, _ = NewCA(backends.env(home2))
+	cas, err := caCont.List(newTestCAParams(""))
+	assert.NoError(t, err)
+	assert.Len(t, cas, 1)
+
+	adminCont, _ = NewAdmin(backends.env(home2))
+	admins, err := adminCont.List(newTestAdminParams(""))
+	assert.NoError(t, err)
+	assert.Len(t, admins, 2)
+}
+
+func TestAdminInviteWrongKey(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	adminCont, _ := NewAdmin(backends.env(home))
+	invite, err := adminCont.Invite(newTestAdminParams("admin2"))
+	assert.NoError(t, err)
+
+	params := newTestAdminParams("admin2")
+	params.InviteId = stringPtr(invite[0])
+	params.InviteKey = stringPtr("wrong")
+	adminCont, _ = NewAdmin(backends.env(NewMemoryFs()))
+	assert.NoError(t, adminCont.New(params))
+
+	adminCont, _ = NewAdmin(backends.env(home))
+	err = adminCont.Run(newTestAdminParams(""))
+	assert.True(t, IsVerificationFailed(err))
+}
+
+func TestEnrolmentBatch(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	caParams := newTestCAParams("web-ca")
+	caParams.Tags = stringPtr("web")
+	_, err := caCont.New(caParams)
+	assert.NoError(t, err)
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	names := []string{"node1", "node2", "node3", "node4", "node5"}
+	for _, name := range names {
+		env := backends.env(home)
+		nodeCont, _ := NewNode(env)
+		assert.NoError(t, env.LoadAdminEnv())
+		_, err := nodeCont.CreateLocalNode(name, pairingId, pairingKey)
+		assert.NoError(t, err)
+	}
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	_, err = nodeCont.CreateLocalNode("bad", "unknown", "unknown")
+	assert.NoError(t, err)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	params := newTestOrgParams("test", "admin")
+	params.Workers = intPtr(3)
+	err = env.controllers.org.RunEnv(params)
+
+	regErr, ok := err.(*RegistrationError)
+	assert.True(t, ok)
+	assert.Len(t, regErr.Results, len(names)+1)
+	assert.Len(t, regErr.Failed(), 1)
+	assert.True(t, IsNotFound(err))
+
+	nodeCont, _ = NewNode(backends.env(home))
+	nodes, err := nodeCont.List(newTestNodeParams(""))
+	assert.NoError(t, err)
+	assert.Len(t, nodes, len(names))
+
+	// The failed registration is left for the next run
+	size, _ := backends.api.IncomingSize(env.controllers.org.OrgId(), "registration")
+	assert.Equal(t, 1, size)
+}
+
+func TestEnrolmentProfiles(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	_, err := caCont.New(newTestCAParams("ca"))
+	assert.NoError(t, err)
+
+	profileCont, _ := NewProfile(backends.env(home))
+	params := NewProfileParams()
+	params.Name = stringPtr("server")
+	params.Expiry = intPtr(30)
+	params.DNSNames = stringPtr("{{.Name}}.{{.Tags.env}}.example.com")
+	params.ExtKeyUsages = stringPtr("server")
+	_, err = profileCont.New(params)
+	assert.NoError(t, err)
+
+	params = NewProfileParams()
+	params.Name = stringPtr("client")
+	params.ExtKeyUsages = stringPtr("client")
+	_, err = profileCont.New(params)
+	assert.NoError(t, err)
+
+	for tag, name := range map[string]string{"web": "server", "mtls": "client"} {
+		params := NewProfileParams()
+		params.Name = stringPtr(name)
+		params.Tag = stringPtr(tag)
+		params.CA = stringPtr("ca")
+		profileCont, _ = NewProfile(backends.env(home))
+		_, err = profileCont.Bind(params)
+		assert.NoError(t, err)
+	}
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web, mtls, env=prod"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	node, err := nodeCont.CreateLocalNode("node1", pairingId, pairingKey)
+	assert.NoError(t, err)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	assert.NoError(t, env.controllers.org.RunEnv(newTestOrgParams("test", "admin")))
+
+	size, _ := backends.api.IncomingSize(node.Id(), "certs")
+	assert.Equal(t, 2, size)
+
+	usages := make(map[stdx509.ExtKeyUsage][]string)
+	for i := 0; i < size; i++ {
+		containerJson, err := backends.api.PopIncoming(node.Id(), "certs")
+		assert.NoError(t, err)
+		container, err := document.NewContainer(containerJson)
+		assert.NoError(t, err)
+		cert, err := x509.NewCertificate(container.Data.Body)
+		assert.NoError(t, err)
+		decoded, err := x509.PemDecodeX509Certificate([]byte(cert.Data.Body.Certificate))
+		assert.NoError(t, err)
+		assert.Equal(t, "node1", decoded.Subject.CommonName)
+		usages[decoded.ExtKeyUsage[0]] = decoded.DNSNames
+	}
+
+	assert.Equal(t, []string{"node1.prod.example.com"}, usages[stdx509.ExtKeyUsageServerAuth])
+	assert.Contains(t, usages, stdx509.ExtKeyUsageClientAuth)
+}
+
+func TestReconcile(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	node, err := nodeCont.CreateLocalNode("node1", pairingId, pairingKey)
+	assert.NoError(t, err)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	assert.NoError(t, env.controllers.org.RunEnv(newTestOrgParams("test", "admin")))
+	size, _ := backends.api.IncomingSize(node.Id(), "certs")
+	assert.Equal(t, 0, size)
+
+	// A CA created after the node registered issues to it on the next run
+	caCont, _ := NewCA(backends.env(home))
+	caParams := newTestCAParams("web-ca")
+	caParams.Tags = stringPtr("web")
+	_, err = caCont.New(caParams)
+	assert.NoError(t, err)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	report, err := env.controllers.org.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, report.Issued, 1)
+	size, _ = backends.api.IncomingSize(node.Id(), "certs")
+	assert.Equal(t, 1, size)
+
+	// It's only issued once
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	report, err = env.controllers.org.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, report.Issued, 0)
+
+	// Without CSRs the certificate is deferred and issued once the node
+	// refills its pool
+	for {
+		if _, err := backends.api.PopOutgoing(node.Id(), "csrs"); err != nil {
+			break
+		}
+	}
+
+	caCont, _ = NewCA(backends.env(home))
+	caParams = newTestCAParams("web-ca2")
+	caParams.Tags = stringPtr("web")
+	_, err = caCont.New(caParams)
+	assert.NoError(t, err)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	report, err = env.controllers.org.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, report.Issued, 0)
+	assert.Len(t, report.Deferred, 1)
+
+	nodeParams := newTestNodeParams("node1")
+	nodeParams.CSRPoolSize = intPtr(2)
+	nodeCont, _ = NewNode(backends.env(home))
+	assert.NoError(t, nodeCont.Run(nodeParams))
+	size, _ = backends.api.OutgoingSize(node.Id(), "csrs")
+	assert.Equal(t, 2, size)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	report, err = env.controllers.org.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, report.Issued, 1)
+	assert.Len(t, report.Deferred, 0)
+
+	log, _, err := env.controllers.org.GetIssuanceLog()
+	assert.NoError(t, err)
+	assert.Len(t, log.Pending, 0)
+}
+
+func TestEnrolmentDefersWithoutCSRs(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	for _, name := range []string{"ca1", "ca2", "ca3"} {
+		caCont, _ := NewCA(backends.env(home))
+		caParams := newTestCAParams(name)
+		caParams.Tags = stringPtr("web")
+		_, err := caCont.New(caParams)
+		assert.NoError(t, err)
+	}
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	nodeParams := newTestNodeParams("node1")
+	nodeParams.CSRPoolSize = intPtr(2)
+	nodeParams.PairingId = stringPtr(pairingId)
+	nodeParams.PairingKey = stringPtr(pairingKey)
+	nodeCont, _ := NewNode(backends.env(home))
+	node, err := nodeCont.New(nodeParams)
+	assert.NoError(t, err)
+
+	size, _ := backends.api.OutgoingSize(node.Id(), "csrs")
+	assert.Equal(t, 2, size)
+
+	env := backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	results, err := env.controllers.org.RegisterNodesBatch(1)
+	assert.NoError(t, err)
+	assert.Len(t, results[0].CertIds, 2)
+	assert.Equal(t, 1, results[0].Deferred)
+
+	log, _, err := env.controllers.org.GetIssuanceLog()
+	assert.NoError(t, err)
+	assert.Len(t, log.Issued, 2)
+	assert.Len(t, log.Pending, 1)
+}
+
+func TestEnrolmentIndexSaveFails(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	caParams := newTestCAParams("web-ca")
+	caParams.Tags = stringPtr("web")
+	_, err := caCont.New(caParams)
+	assert.NoError(t, err)
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	_, err = nodeCont.CreateLocalNode("node1", pairingId, pairingKey)
+	assert.NoError(t, err)
+
+	env = NewEnvironmentWithOptions(&EnvironmentOptions{
+		API:   &failingAPI{MemoryAPI: backends.api, failSwaps: true},
+		Local: backends.local,
+		Home:  home,
+	})
+	assert.NoError(t, env.LoadAdminEnv())
+	_, err = env.controllers.org.RegisterNodesBatch(1)
+	assert.True(t, errors.Is(err, errTestSend))
+
+	// The registration is left for the next run
+	orgId := env.controllers.org.OrgId()
+	size, _ := backends.api.IncomingSize(orgId, "registration")
+	assert.Equal(t, 1, size)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	results, err := env.controllers.org.RegisterNodesBatch(1)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "node1", results[0].NodeName)
+}
+
+func TestEnrolmentDefersAfterSigningFails(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caIds := make([]string, 0)
+	for _, name := range []string{"ca1", "ca2"} {
+		caCont, _ := NewCA(backends.env(home))
+		caParams := newTestCAParams(name)
+		caParams.Tags = stringPtr("web")
+		ca, err := caCont.New(caParams)
+		assert.NoError(t, err)
+		caIds = append(caIds, ca.Data.Body.Id)
+	}
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	_, err = nodeCont.CreateLocalNode("node1", pairingId, pairingKey)
+	assert.NoError(t, err)
+
+	orgId := env.controllers.org.OrgId()
+	assert.NoError(t, backends.api.DeletePrivate(orgId, caIds[0]))
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	results, err := env.controllers.org.RegisterNodesBatch(1)
+	assert.Error(t, err)
+	// Nothing is dropped, whichever CA the node is issued from first
+	assert.NotZero(t, results[0].Deferred)
+	assert.Equal(t, 2, len(results[0].CertIds)+results[0].Deferred)
+
+	log, _, err := env.controllers.org.GetIssuanceLog()
+	assert.NoError(t, err)
+	assert.Len(t, log.Pending, results[0].Deferred)
+}
+
+func TestEnrolmentDefersWhenPoolSizeFails(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	caParams := newTestCAParams("web-ca")
+	caParams.Tags = stringPtr("web")
+	_, err := caCont.New(caParams)
+	assert.NoError(t, err)
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	_, err = nodeCont.CreateLocalNode("node1", pairingId, pairingKey)
+	assert.NoError(t, err)
+
+	env = NewEnvironmentWithOptions(&EnvironmentOptions{
+		API:   &failingAPI{MemoryAPI: backends.api, failSizes: true},
+		Local: backends.local,
+		Home:  home,
+	})
+	assert.NoError(t, env.LoadAdminEnv())
+	results, err := env.controllers.org.RegisterNodesBatch(1)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(results[0].Err, errTestSend))
+	assert.Equal(t, 1, results[0].Deferred)
+
+	// The node is registered and its certificate is left for reconciling
+	orgIndex, err := env.controllers.org.GetIndex()
+	assert.NoError(t, err)
+	_, err = orgIndex.GetNode("node1")
+	assert.NoError(t, err)
+
+	log, _, err := env.controllers.org.GetIssuanceLog()
+	assert.NoError(t, err)
+	assert.Len(t, log.Pending, 1)
+}
+
+func TestReconcileUpgradedOrg(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	caParams := newTestCAParams("web-ca")
+	caParams.Tags = stringPtr("web")
+	_, err := caCont.New(caParams)
+	assert.NoError(t, err)
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	node, err := nodeCont.CreateLocalNode("node1", pairingId, pairingKey)
+	assert.NoError(t, err)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	_, err = env.controllers.org.RegisterNodesBatch(1)
+	assert.NoError(t, err)
+
+	// An org from before the issuance log, where a CA gained the node's tag
+	// after the node registered
+	orgId := env.controllers.org.OrgId()
+	assert.NoError(t, backends.api.DeletePrivate(orgId, IssuanceLogDocument))
+
+	caCont, _ = NewCA(backends.env(home))
+	caParams = newTestCAParams("web-ca2")
+	caParams.Tags = stringPtr("web")
+	ca2, err := caCont.New(caParams)
+	assert.NoError(t, err)
+
+	// Reconciling without a log would issue node1 a duplicate from web-ca
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	_, err = env.controllers.org.Reconcile()
+	assert.True(t, IsNotFound(err))
+
+	params := newTestOrgParams("test", "admin")
+	params.Reissue = stringPtr("web-ca2")
+	orgCont, _ := NewOrg(backends.env(home))
+	seeded, err := orgCont.BootstrapIssuanceLog(params)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, seeded)
+
+	orgCont, _ = NewOrg(backends.env(home))
+	_, err = orgCont.BootstrapIssuanceLog(params)
+	assert.True(t, IsAlreadyExists(err))
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	report, err := env.controllers.org.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, report.Issued, 1)
+	assert.Equal(t, ca2.Data.Body.Id, report.Issued[0].CAId)
+
+	log, _, err := env.controllers.org.GetIssuanceLog()
+	assert.NoError(t, err)
+	assert.True(t, log.Has(node.Id(), ca2.Data.Body.Id, ""))
+	assert.Len(t, log.Issued, 2)
+	assert.Len(t, log.Pending, 0)
+}
+
+func TestReconcileSkipsClaimed(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	node, err := nodeCont.CreateLocalNode("node1", pairingId, pairingKey)
+	assert.NoError(t, err)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	_, err = env.controllers.org.RegisterNodesBatch(1)
+	assert.NoError(t, err)
+
+	caCont, _ := NewCA(backends.env(home))
+	caParams := newTestCAParams("web-ca")
+	caParams.Tags = stringPtr("web")
+	ca, err := caCont.New(caParams)
+	assert.NoError(t, err)
+
+	// Another run has claimed the certificate
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	iss := &issuance{caId: ca.Data.Body.Id, tag: "web"}
+	err = env.controllers.org.UpdateIssuanceLog(func(log *IssuanceLog) error {
+		log.Claim("other", env.Now(), iss.pending(node.Id(), "being issued", env.Now()))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	report, err := env.controllers.org.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, report.Issued, 0)
+	size, _ := backends.api.IncomingSize(node.Id(), "certs")
+	assert.Equal(t, 0, size)
+}
+
+func TestEnrolmentPolicyKeepsCSRs(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	caParams := newTestCAParams("web-ca")
+	caParams.Tags = stringPtr("web")
+	_, err := caCont.New(caParams)
+	assert.NoError(t, err)
+
+	// Nodes make RSA CSRs by default
+	profileCont, _ := NewProfile(backends.env(home))
+	params := NewProfileParams()
+	params.Tag = stringPtr("web")
+	params.KeySpecs = stringPtr(KeySpecP256)
+	_, err = profileCont.SetPolicy(params)
+	assert.NoError(t, err)
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	pairingId, pairingKey, err := pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	nodeCont, _ := NewNode(env)
+	assert.NoError(t, env.LoadAdminEnv())
+	node, err := nodeCont.CreateLocalNode("node1", pairingId, pairingKey)
+	assert.NoError(t, err)
+
+	env = backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	results, err := env.controllers.org.RegisterNodesBatch(1)
+	assert.True(t, IsPolicyViolation(err))
+	assert.Equal(t, 1, results[0].Deferred)
+
+	// The rejected CSR isn't used up
+	size, _ := backends.api.OutgoingSize(node.Id(), "csrs")
+	assert.Equal(t, MinCSRs, size)
+	size, _ = backends.api.IncomingSize(node.Id(), "certs")
+	assert.Equal(t, 0, size)
+}
@@ -4,15 +4,54 @@ package controller
 import (
 	"github.com/pki-io/core/api"
 	"github.com/pki-io/core/fs"
+	"github.com/pki-io/core/x509"
 	"os"
+	"time"
 )
 
+// LocalFs is the storage for org and node config, normally the directory
+// given by PKIIO_LOCAL.
+type LocalFs interface {
+	Exists(name string) (bool, error)
+	Read(name string) (string, error)
+	Write(name, content string) error
+	CreateDirectory(dir string) error
+	ChangeToDirectory(dir string) error
+}
+
+// HomeFs is the storage for admin config and private entities, normally the
+// directory given by PKIIO_HOME.
+type HomeFs interface {
+	Exists(name string) (bool, error)
+	Read(name string) (string, error)
+	Write(name, content string) error
+}
+
+// Clock returns the current time.
+type Clock func() time.Time
+
+// IDGenerator returns a new document ID.
+type IDGenerator func() string
+
+// EnvironmentOptions replace the backends that an Environment otherwise
+// builds from the PKIIO_LOCAL and PKIIO_HOME env variables. Nil fields keep
+// the default behaviour.
+type EnvironmentOptions struct {
+	API   api.Apier
+	Local LocalFs
+	Home  HomeFs
+	Clock Clock
+	NewID IDGenerator
+}
+
 type Environment struct {
-	fs struct {
-		local *fs.Local
-		home  *fs.Home
+	options EnvironmentOptions
+	fs      struct {
+		local LocalFs
+		home  HomeFs
 	}
 	api         api.Apier
+	sessions    int
 	controllers struct {
 		org   *OrgController
 		admin *AdminController
@@ -25,6 +64,69 @@ func NewEnvironment() *Environment {
 	return env
 }
 
+// NewEnvironmentWithOptions returns an environment that uses the given
+// backends instead of the defaults.
+func NewEnvironmentWithOptions(opts *EnvironmentOptions) *Environment {
+	env := NewEnvironment()
+	if opts != nil {
+		env.options = *opts
+	}
+	return env
+}
+
+// Now returns the current time from the environment's clock.
+func (env *Environment) Now() time.Time {
+	if env.options.Clock != nil {
+		return env.options.Clock()
+	}
+	return time.Now()
+}
+
+// NewID returns a new document ID from the environment's ID generator.
+func (env *Environment) NewID() string {
+	if env.options.NewID != nil {
+		return env.options.NewID()
+	}
+	return x509.NewID()
+}
+
+// StartSession loads the admin environment and keeps it loaded until the
+// matching EndSession, so that controller methods don't load it again. While
+// in a session the org controller caches the decrypted index and CAs. Sessions
+// can be nested.
+func (env *Environment) StartSession() error {
+	logger.Debug("starting session")
+
+	if env.sessions == 0 {
+		if err := env.LoadAdminEnv(); err != nil {
+			return err
+		}
+	}
+
+	env.sessions++
+	return nil
+}
+
+// EndSession ends a session and drops the cached documents once the outermost
+// session has ended.
+func (env *Environment) EndSession() {
+	logger.Debug("ending session")
+
+	if env.sessions == 0 {
+		return
+	}
+
+	env.sessions--
+	if env.sessions == 0 && env.controllers.org != nil {
+		env.controllers.org.ClearCache()
+	}
+}
+
+// InSession returns whether the environment is in a session.
+func (env *Environment) InSession() bool {
+	return env.sessions > 0
+}
+
 func (env *Environment) Fatal(err error) {
 	logger.Critical(err)
 	os.Exit(1)
@@ -32,28 +134,77 @@ func (env *Environment) Fatal(err error) {
 
 func (env *Environment) LoadLocalFs() error {
 	logger.Debug("loading local file system")
-	var err error
-	env.fs.local, err = fs.NewLocal(os.Getenv("PKIIO_LOCAL"))
+	if env.options.Local != nil {
+		env.fs.local = env.options.Local
+		return nil
+	}
+
+	local, err := fs.NewLocal(os.Getenv("PKIIO_LOCAL"))
 	if err != nil {
-		return err
+		return wrapError(err, "loading local file system")
 	}
+	env.fs.local = local
 	return nil
 }
 
 func (env *Environment) LoadHomeFs() error {
 	logger.Debug("loading home file system")
-	var err error
-	if env.fs.home, err = fs.NewHome(os.Getenv("PKIIO_HOME")); err != nil {
-		return err
+	if env.options.Home != nil {
+		env.fs.home = env.options.Home
+		return nil
 	}
+
+	home, err := fs.NewHome(os.Getenv("PKIIO_HOME"))
+	if err != nil {
+		return wrapError(err, "loading home file system")
+	}
+	env.fs.home = home
 	return nil
 }
 
 func (env *Environment) LoadAPI() error {
 	logger.Debug("loading API")
-	var err error
-	if env.api, err = fs.NewAPI(env.fs.local.Path); err != nil {
-		return err
+	if env.options.API != nil {
+		env.api = env.options.API
+		return nil
+	}
+
+	conf, err := LoadAPIConfig(env.fs.local)
+	if err != nil {
+		return wrapError(err, "loading API")
+	}
+
+	if conf.Type == APITypeHTTP {
+		logger.Debugf("using remote API at '%s'", conf.URL)
+		if env.api, err = NewRemoteAPI(conf.URL, conf.Token); err != nil {
+			return wrapError(err, "loading API")
+		}
+		return nil
+	}
+
+	if conf.Type == APITypeGit && conf.Path != "" {
+		logger.Debugf("using git API at '%s'", conf.Path)
+		if env.api, err = NewGitAPI(conf.Path); err != nil {
+			return wrapError(err, "loading API")
+		}
+		return nil
+	}
+
+	local, ok := env.fs.local.(*fs.Local)
+	if !ok {
+		return newError(ErrInvalidParams, nil, "loading API: local file system of type %T has no path", env.fs.local)
+	}
+
+	if conf.Type == APITypeGit {
+		logger.Debugf("using git API at '%s'", local.Path)
+		if env.api, err = NewGitAPI(local.Path); err != nil {
+			return wrapError(err, "loading API")
+		}
+		return nil
+	}
+
+	if env.api, err = fs.NewAPI(local.Path); err != nil {
+		return wrapError(err, "loading API")
 	}
 	return nil
 }
@@ -162,6 +313,11 @@ func (env *Environment) LoadAdmin() error {
 func (env *Environment) LoadAdminEnv() error {
 	logger.Debug("loading admin environment")
 
+	if env.InSession() {
+		logger.Debug("using admin environment loaded by session")
+		return nil
+	}
+
 	if err := env.LoadLocalFs(); err != nil {
 		return err
 	}
@@ -1,8 +1,12 @@
 package controller
 
 import (
+	"github.com/pki-io/core/fs"
+	"github.com/pki-io/core/x509"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestNewEnvironment(t *testing.T) {
@@ -30,3 +34,115 @@ func TestLoadAPI(t *testing.T) {
 	err := env.LoadAPI()
 	assert.NoError(t, err)
 }
+
+func TestNewEnvironmentWithOptions(t *testing.T) {
+	now := time.Unix(1000, 0)
+	env := NewEnvironmentWithOptions(&EnvironmentOptions{
+		Clock: func() time.Time { return now },
+		NewID: func() string { return "test-id" },
+	})
+	assert.Equal(t, now, env.Now())
+	assert.Equal(t, "test-id", env.NewID())
+
+	pkCont, _ := NewPairingKey(env)
+	id, key := pkCont.GeneratePairingKey()
+	assert.Equal(t, "test-id", id)
+	assert.Equal(t, "test-id", key)
+}
+
+func TestGenerateRootCAClock(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ca, _ := x509.NewCA(nil)
+	ca.Data.Body.Name = "ca"
+	ca.Data.Body.CAExpiry = 10
+	assert.NoError(t, GenerateRootCA(ca, KeySpecP256, now))
+
+	cert, err := x509.PemDecodeX509Certificate([]byte(ca.Data.Body.Certificate))
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-5*time.Minute), cert.NotBefore)
+	assert.Equal(t, now.AddDate(0, 0, 10), cert.NotAfter)
+}
+
+func TestLoadLocalFsOption(t *testing.T) {
+	local, _ := fs.NewLocal(os.TempDir())
+	env := NewEnvironmentWithOptions(&EnvironmentOptions{Local: local})
+	err := env.LoadLocalFs()
+	assert.NoError(t, err)
+	assert.Equal(t, local, env.fs.local)
+}
+
+func TestLoadHomeFsOption(t *testing.T) {
+	home, _ := fs.NewHome(os.TempDir())
+	env := NewEnvironmentWithOptions(&EnvironmentOptions{Home: home})
+	err := env.LoadHomeFs()
+	assert.NoError(t, err)
+	assert.Equal(t, home, env.fs.home)
+}
+
+// countingAPI counts fetches of private documents.
+type countingAPI struct {
+	*MemoryAPI
+	gets int
+}
+
+func (c *countingAPI) GetPrivate(dstId, name string) (string, error) {
+	c.gets++
+	return c.MemoryAPI.GetPrivate(dstId, name)
+}
+
+func TestSessionCachesIndex(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+	api := &countingAPI{MemoryAPI: backends.api}
+	env := NewEnvironmentWithOptions(&EnvironmentOptions{API: api, Local: backends.local, Home: home})
+
+	assert.NoError(t, env.StartSession())
+	assert.NoError(t, env.StartSession())
+	assert.True(t, env.InSession())
+
+	first, err := env.controllers.org.GetIndex()
+	assert.NoError(t, err)
+	gets := api.gets
+
+	second, err := env.controllers.org.GetIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, gets, api.gets)
+	assert.False(t, first == second)
+
+	// Still loaded, so no fetches
+	assert.NoError(t, env.LoadAdminEnv())
+	assert.Equal(t, gets, api.gets)
+
+	env.EndSession()
+	assert.True(t, env.InSession())
+	env.EndSession()
+	assert.False(t, env.InSession())
+
+	_, err = env.controllers.org.GetIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, gets+1, api.gets)
+}
+
+func TestSessionStaleIndex(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	env := backends.env(home)
+	assert.NoError(t, env.StartSession())
+	defer env.EndSession()
+
+	_, err := env.controllers.org.GetIndex()
+	assert.NoError(t, err)
+
+	// Changed outside of the session
+	pkCont, _ := NewPairingKey(backends.env(home))
+	_, _, err = pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	caCont, _ := NewCA(env)
+	_, err = caCont.New(newTestCAParams("ca"))
+	assert.NoError(t, err)
+
+	orgIndex, err := env.controllers.org.GetIndex()
+	assert.NoError(t, err)
+	assert.Len(t, orgIndex.Data.Body.PairingKeys, 1)
+	assert.Len(t, orgIndex.GetCAs(), 1)
+}
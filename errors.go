@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of error returned by the controllers. Errors returned from controller
+// methods wrap one of these where the kind of failure is known, so callers can
+// map them to exit codes or status codes with ErrorKind or the Is* helpers.
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrAlreadyExists      = errors.New("already exists")
+	ErrVerificationFailed = errors.New("verification failed")
+	ErrDecryptionFailed   = errors.New("decryption failed")
+	ErrPolicyViolation    = errors.New("policy violation")
+	ErrNotImplemented     = errors.New("not implemented")
+	ErrInvalidParams      = errors.New("invalid parameters")
+	ErrConflict           = errors.New("conflict")
+)
+
+// ErrCSRPoolEmpty is wrapped by the ErrNotFound errors returned when a node
+// has no CSRs left for the org to sign. Issuance is deferred until the node
+// refills its pool.
+var ErrCSRPoolEmpty = errors.New("CSR pool is empty")
+
+var errorKinds = []error{
+	ErrNotFound,
+	ErrAlreadyExists,
+	ErrVerificationFailed,
+	ErrDecryptionFailed,
+	ErrPolicyViolation,
+	ErrNotImplemented,
+	ErrInvalidParams,
+	ErrConflict,
+}
+
+// Error adds context and an optional kind to an underlying error.
+type Error struct {
+	Kind    error
+	Context string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	msg := e.Context
+	if e.Kind != nil {
+		msg = msg + ": " + e.Kind.Error()
+	}
+	if e.Err != nil {
+		msg = msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of this error, so that errors.Is
+// works with the Err* values.
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+func newError(kind, err error, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Context: fmt.Sprintf(format, a...), Err: err}
+}
+
+func wrapError(err error, format string, a ...interface{}) error {
+	return &Error{Context: fmt.Sprintf(format, a...), Err: err}
+}
+
+// ErrorKind returns the first Err* kind found in the chain of wrapped
+// errors, or nil if there isn't one.
+func ErrorKind(err error) error {
+	for err != nil {
+		for _, kind := range errorKinds {
+			if err == kind {
+				return kind
+			}
+		}
+
+		if e, ok := err.(*Error); ok && e.Kind != nil {
+			return e.Kind
+		}
+
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil
+		}
+		err = wrapper.Unwrap()
+	}
+	return nil
+}
+
+func IsNotFound(err error) bool           { return ErrorKind(err) == ErrNotFound }
+func IsAlreadyExists(err error) bool      { return ErrorKind(err) == ErrAlreadyExists }
+func IsVerificationFailed(err error) bool { return ErrorKind(err) == ErrVerificationFailed }
+func IsDecryptionFailed(err error) bool   { return ErrorKind(err) == ErrDecryptionFailed }
+func IsPolicyViolation(err error) bool    { return ErrorKind(err) == ErrPolicyViolation }
+func IsNotImplemented(err error) bool     { return ErrorKind(err) == ErrNotImplemented }
+func IsInvalidParams(err error) bool      { return ErrorKind(err) == ErrInvalidParams }
+func IsConflict(err error) bool           { return ErrorKind(err) == ErrConflict }
@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestErrorKind(t *testing.T) {
+	err := newError(ErrNotFound, fmt.Errorf("missing"), "getting CA '%s'", "test")
+	assert.Equal(t, ErrNotFound, ErrorKind(err))
+	assert.True(t, IsNotFound(err))
+	assert.False(t, IsAlreadyExists(err))
+	assert.Equal(t, "getting CA 'test': not found: missing", err.Error())
+}
+
+func TestErrorKindWrapped(t *testing.T) {
+	err := wrapError(newError(ErrDecryptionFailed, nil, "decrypting index"), "listing CAs")
+	assert.True(t, IsDecryptionFailed(err))
+	assert.Equal(t, "listing CAs: decrypting index: decryption failed", err.Error())
+}
+
+func TestErrorKindSentinel(t *testing.T) {
+	assert.True(t, IsNotImplemented(ErrNotImplemented))
+	assert.True(t, IsConflict(ErrConflict))
+}
+
+func TestErrorKindUnknown(t *testing.T) {
+	assert.Nil(t, ErrorKind(nil))
+	assert.Nil(t, ErrorKind(fmt.Errorf("plain")))
+	assert.Nil(t, ErrorKind(wrapError(fmt.Errorf("plain"), "context")))
+}
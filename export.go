@@ -0,0 +1,148 @@
+package controller
+
+import (
+	stdcrypto "crypto"
+	stdx509 "crypto/x509"
+	"encoding/pem"
+	"strings"
+	"time"
+)
+
+// Export formats for certificates and CAs.
+const (
+	// ExportPEM is the certificate, then its chain, then the private key if
+	// it's exported, concatenated as PEM
+	ExportPEM string = "pem"
+	// ExportPKCS12 is a password protected PKCS #12 file
+	ExportPKCS12 string = "pkcs12"
+	// ExportJKS is a password protected Java KeyStore
+	ExportJKS string = "jks"
+)
+
+var exportFormats = []string{ExportPEM, ExportPKCS12, ExportJKS}
+
+// ValidateExportFormat checks that an export format is known.
+func ValidateExportFormat(format string) error {
+	for _, f := range exportFormats {
+		if format == f {
+			return nil
+		}
+	}
+	return newError(ErrInvalidParams, nil, "unknown export format '%s', must be one of %s", format, strings.Join(exportFormats, ", "))
+}
+
+// Bundle is a certificate with its chain and optionally its private key, all
+// PEM encoded, for exporting.
+type Bundle struct {
+	Name        string
+	Certificate string
+	Chain       string
+	PrivateKey  string
+	// Created is the creation date of JKS entries
+	Created time.Time
+}
+
+// PEM returns the bundle as concatenated PEM.
+func (bundle *Bundle) PEM() []byte {
+	var out []byte
+	for _, p := range []string{bundle.Certificate, bundle.Chain, bundle.PrivateKey} {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			out = append(out, p...)
+			out = append(out, '\n')
+		}
+	}
+	return out
+}
+
+// decode returns the bundle's certificate, chain and key, which is nil if the
+// bundle doesn't have one.
+func (bundle *Bundle) decode() (*stdx509.Certificate, []*stdx509.Certificate, stdcrypto.Signer, error) {
+	certs, err := pemDecodeCertificates([]byte(bundle.Certificate))
+	if err != nil {
+		return nil, nil, nil, wrapError(err, "decoding certificate '%s'", bundle.Name)
+	}
+
+	if len(certs) == 0 {
+		return nil, nil, nil, newError(ErrInvalidParams, nil, "certificate '%s' has no PEM data", bundle.Name)
+	}
+
+	chain, err := pemDecodeCertificates([]byte(bundle.Chain))
+	if err != nil {
+		return nil, nil, nil, wrapError(err, "decoding chain for certificate '%s'", bundle.Name)
+	}
+
+	var key stdcrypto.Signer
+	if bundle.PrivateKey != "" {
+		key, err = PemDecodePrivateKey([]byte(bundle.PrivateKey))
+		if err != nil {
+			return nil, nil, nil, wrapError(err, "decoding private key for certificate '%s'", bundle.Name)
+		}
+	}
+
+	return certs[0], chain, key, nil
+}
+
+// Encode returns the bundle in the export format. PKCS #12 and JKS files are
+// protected with the password.
+func (bundle *Bundle) Encode(format, password string) ([]byte, error) {
+	if err := ValidateExportFormat(format); err != nil {
+		return nil, err
+	}
+
+	if format == ExportPEM {
+		return bundle.PEM(), nil
+	}
+
+	cert, chain, key, err := bundle.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	if format == ExportPKCS12 {
+		return EncodePKCS12(bundle.Name, key, cert, chain, password)
+	}
+	return EncodeJKS(bundle.Name, key, cert, chain, password, bundle.Created)
+}
+
+// pemDecodeCertificates decodes the certificates in PEM data, skipping other
+// blocks.
+func pemDecodeCertificates(in []byte) ([]*stdx509.Certificate, error) {
+	certs := make([]*stdx509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, in = pem.Decode(in)
+		if block == nil {
+			return certs, nil
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := stdx509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, newError(ErrInvalidParams, err, "parsing certificate")
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// validateExportParams checks an export format and its password.
+func validateExportParams(export, password *string, required bool) error {
+	if export == nil || *export == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "export format cannot be empty")
+		}
+		return nil
+	}
+
+	if err := ValidateExportFormat(*export); err != nil {
+		return err
+	}
+
+	if *export != ExportPEM && (password == nil || *password == "") {
+		return newError(ErrInvalidParams, nil, "password is required to export %s", *export)
+	}
+	return nil
+}
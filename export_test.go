@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pbkdf2"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBundleCerts(t *testing.T, spec string) (*stdx509.Certificate, *stdx509.Certificate, stdcrypto.Signer) {
+	caKey, err := GenerateKey(KeySpecP256)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	caTemplate := &stdx509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             now,
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              stdx509.KeyUsageCertSign,
+	}
+	der, err := stdx509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	assert.NoError(t, err)
+	caCert, _ := stdx509.ParseCertificate(der)
+
+	key, err := GenerateKey(spec)
+	assert.NoError(t, err)
+
+	template := &stdx509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "leaf"}, NotBefore: now, NotAfter: now.Add(time.Hour)}
+	der, err = stdx509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	assert.NoError(t, err)
+	cert, _ := stdx509.ParseCertificate(der)
+
+	return cert, caCert, key
+}
+
+func TestValidateExportParams(t *testing.T) {
+	assert.NoError(t, validateExportParams(nil, nil, false))
+	assert.True(t, IsInvalidParams(validateExportParams(nil, nil, true)))
+	assert.NoError(t, validateExportParams(stringPtr(ExportPEM), nil, true))
+	assert.True(t, IsInvalidParams(validateExportParams(stringPtr("der"), nil, true)))
+	assert.True(t, IsInvalidParams(validateExportParams(stringPtr(ExportPKCS12), stringPtr(""), true)))
+	assert.NoError(t, validateExportParams(stringPtr(ExportJKS), stringPtr("secret"), true))
+}
+
+func TestBundlePEM(t *testing.T) {
+	bundle := &Bundle{Name: "leaf", Certificate: "cert\n", Chain: "chain", PrivateKey: ""}
+	assert.Equal(t, "cert\nchain\n", string(bundle.PEM()))
+
+	bundle.PrivateKey = "key\n"
+	assert.Equal(t, "cert\nchain\nkey\n", string(bundle.PEM()))
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	cert, caCert, key := newTestBundleCerts(t, KeySpecP384)
+
+	_, err := EncodePKCS12("leaf", key, cert, nil, "")
+	assert.True(t, IsInvalidParams(err))
+
+	der, err := EncodePKCS12("leaf", key, cert, []*stdx509.Certificate{caCert}, "secret")
+	assert.NoError(t, err)
+
+	var pfx pkcs12PFX
+	_, err = asn1.Unmarshal(der, &pfx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pfx.Version)
+	assert.Equal(t, PKCS12Iterations, pfx.MacData.Iterations)
+
+	var authSafe []byte
+	_, err = asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe)
+	assert.NoError(t, err)
+
+	macKey := pkcs12KDF(sha256.New, bmpString("secret", true), pfx.MacData.Salt, 3, pfx.MacData.Iterations, sha256.Size)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(authSafe)
+	assert.Equal(t, mac.Sum(nil), pfx.MacData.Mac.Digest)
+
+	var contents []pkcs12ContentInfo
+	_, err = asn1.Unmarshal(authSafe, &contents)
+	assert.NoError(t, err)
+	assert.Len(t, contents, 2)
+
+	// The key bag decrypts to the key with the password
+	var keyContents []byte
+	asn1.Unmarshal(contents[1].Content.Bytes, &keyContents)
+	var bags []pkcs12SafeBag
+	_, err = asn1.Unmarshal(keyContents, &bags)
+	assert.NoError(t, err)
+	assert.Equal(t, oidShroudedKeyBag, bags[0].Id)
+
+	var info pkcs12EncryptedPrivateKeyInfo
+	_, err = asn1.Unmarshal(bags[0].Value.Bytes, &info)
+	assert.NoError(t, err)
+
+	var params pbes2Params
+	asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+	var kdf pbkdf2Params
+	asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	var iv []byte
+	asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+
+	block, _ := aes.NewCipher(pbkdf2.Key([]byte("secret"), kdf.Salt, kdf.Iterations, 32, sha256.New))
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+	plaintext = plaintext[:len(plaintext)-int(plaintext[len(plaintext)-1])]
+
+	decrypted, err := stdx509.ParsePKCS8PrivateKey(plaintext)
+	assert.NoError(t, err)
+	spec, _ := KeySpecOf(decrypted)
+	assert.Equal(t, KeySpecP384, spec)
+}
+
+// runTool runs an external tool on a file holding data, skipping the test if
+// the tool isn't installed.
+func runTool(t *testing.T, data []byte, name string, args ...string) []byte {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		t.Skipf("%s isn't installed", name)
+	}
+
+	dir, err := ioutil.TempDir("", "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "store")
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, arg := range args {
+		if arg == "{}" {
+			args[i] = file
+		}
+	}
+
+	out, err := exec.Command(path, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s failed: %s\n%s", name, err, out)
+	}
+	return out
+}
+
+func TestEncodePKCS12OpenSSL(t *testing.T) {
+	for _, spec := range []string{KeySpecRSA2048, KeySpecP384} {
+		cert, caCert, key := newTestBundleCerts(t, spec)
+		der, err := EncodePKCS12("leaf", key, cert, []*stdx509.Certificate{caCert}, "secret")
+		assert.NoError(t, err)
+
+		out := runTool(t, der, "openssl", "pkcs12", "-in", "{}", "-passin", "pass:secret", "-nodes")
+		imported, err := ParseCertificateData(out, "")
+		assert.NoError(t, err, spec)
+		assert.Equal(t, cert.Raw, imported.Certificate.Raw, spec)
+		assert.Len(t, imported.Chain, 1, spec)
+
+		parsedKey, err := ParsePrivateKeyData(out, "")
+		assert.NoError(t, err, spec)
+		assert.NoError(t, CheckKeyMatches(parsedKey, cert.PublicKey), spec)
+	}
+}
+
+func TestEncodeJKSKeytool(t *testing.T) {
+	cert, caCert, key := newTestBundleCerts(t, KeySpecRSA2048)
+	out, err := EncodeJKS("leaf", key, cert, []*stdx509.Certificate{caCert}, "secret", time.Now())
+	assert.NoError(t, err)
+
+	listed := runTool(t, out, "keytool", "-list", "-rfc", "-keystore", "{}", "-storetype", "JKS", "-storepass", "secret")
+	assert.Contains(t, string(listed), "Alias name: leaf")
+	assert.Contains(t, string(listed), "PrivateKeyEntry")
+	assert.Contains(t, string(listed), "Certificate chain length: 2")
+
+	imported, err := ParseCertificateData(listed, "")
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Raw, imported.Certificate.Raw)
+}
+
+func TestEncodeJKS(t *testing.T) {
+	cert, caCert, key := newTestBundleCerts(t, KeySpecRSA2048)
+
+	out, err := EncodeJKS("Leaf", key, cert, []*stdx509.Certificate{caCert}, "secret", time.Now())
+	assert.NoError(t, err)
+
+	// The store ends with a SHA-1 of the password, whitener and contents
+	body, digest := out[:len(out)-sha1.Size], out[len(out)-sha1.Size:]
+	hash := sha1.New()
+	hash.Write(bmpString("secret", false))
+	hash.Write([]byte(jksWhitener))
+	hash.Write(body)
+	assert.Equal(t, hash.Sum(nil), digest)
+
+	r := bytes.NewReader(body)
+	var header struct{ Magic, Version, Count, Tag uint32 }
+	binary.Read(r, binary.BigEndian, &header)
+	assert.Equal(t, jksMagic, header.Magic)
+	assert.Equal(t, uint32(1), header.Count)
+	assert.Equal(t, jksPrivateKeyTag, header.Tag)
+
+	var aliasLen uint16
+	binary.Read(r, binary.BigEndian, &aliasLen)
+	alias := make([]byte, aliasLen)
+	r.Read(alias)
+	assert.Equal(t, "leaf", string(alias))
+
+	var timestamp uint64
+	var keyLen uint32
+	binary.Read(r, binary.BigEndian, &timestamp)
+	binary.Read(r, binary.BigEndian, &keyLen)
+	protected := make([]byte, keyLen)
+	r.Read(protected)
+
+	// Unprotecting the key reverses the XOR with the hash chain
+	var info pkcs12EncryptedPrivateKeyInfo
+	_, err = asn1.Unmarshal(protected, &info)
+	assert.NoError(t, err)
+	assert.Equal(t, oidJKSKeyProtector, info.Algorithm.Algorithm)
+
+	data := info.EncryptedData
+	salt, encrypted := data[:sha1.Size], data[sha1.Size:len(data)-sha1.Size]
+	password := bmpString("secret", false)
+	plaintext := make([]byte, len(encrypted))
+	chain := salt
+	for i := 0; i < len(encrypted); i += sha1.Size {
+		sum := sha1.Sum(append(append([]byte{}, password...), chain...))
+		chain = sum[:]
+		for j := 0; j < sha1.Size && i+j < len(encrypted); j++ {
+			plaintext[i+j] = encrypted[i+j] ^ chain[j]
+		}
+	}
+
+	decrypted, err := stdx509.ParsePKCS8PrivateKey(plaintext)
+	assert.NoError(t, err)
+	spec, _ := KeySpecOf(decrypted)
+	assert.Equal(t, KeySpecRSA2048, spec)
+
+	var chainLen uint32
+	binary.Read(r, binary.BigEndian, &chainLen)
+	assert.Equal(t, uint32(2), chainLen)
+
+	_, err = EncodeJKS("leaf", key, cert, nil, "", time.Now())
+	assert.True(t, IsInvalidParams(err))
+}
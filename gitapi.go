@@ -0,0 +1,569 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pki-io/core/api"
+	"github.com/pki-io/core/x509"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// APITypeGit stores documents and queues in a git repository.
+	APITypeGit string = "git"
+	// GitRemote is the remote that a GitAPI syncs with, if it exists.
+	GitRemote string = "origin"
+	// GitPushAttempts is how many times a change is merged and pushed again
+	// after the remote moved on.
+	GitPushAttempts int = 5
+)
+
+// GitAPI is an api.Apier that keeps documents and queues in a git working
+// tree and commits every change, pushing to GitRemote if there is one.
+//
+// Documents are stored at <public|private>/<id>/<name> and each queue item is
+// a separate file under <incoming|outgoing>/<id>/<queue>/, named so that
+// sorting gives the push order. Items pushed from different clones therefore
+// never touch the same file. Pops are only kept if they can be pushed on top
+// of the remote, so an item can't be popped from two clones.
+type GitAPI struct {
+	dir    string
+	remote string
+	branch string
+	synced bool
+	now    func() time.Time
+	lock   sync.Mutex
+}
+
+var _ api.Apier = (*GitAPI)(nil)
+var _ PrivateSwapper = (*GitAPI)(nil)
+
+// NewGitAPI uses the git repository at dir, initialising one if needed.
+func NewGitAPI(dir string) (*GitAPI, error) {
+	g := new(GitAPI)
+	g.dir = dir
+	g.now = time.Now
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, wrapError(err, "creating git directory '%s'", dir)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if _, err := g.git("init", "-q"); err != nil {
+			return nil, err
+		}
+	}
+
+	branch, err := g.git("symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	g.branch = branch
+
+	remotes, err := g.git("remote")
+	if err != nil {
+		return nil, err
+	}
+	for _, remote := range strings.Fields(remotes) {
+		if remote == GitRemote {
+			g.remote = GitRemote
+		}
+	}
+
+	return g, nil
+}
+
+func (g *GitAPI) git(args ...string) (string, error) {
+	// Don't depend on a global git identity
+	args = append([]string{"-c", "user.name=pki.io", "-c", "user.email=pki.io@localhost"}, args...)
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.dir
+	// Push rejections are recognised by git's untranslated messages
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", wrapError(fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String())), "running git %s", args[4])
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (g *GitAPI) hasCommits() bool {
+	_, err := g.git("rev-parse", "--verify", "-q", "HEAD")
+	return err == nil
+}
+
+// head returns the current commit, or "" if there isn't one yet.
+func (g *GitAPI) head() string {
+	head, err := g.git("rev-parse", "--verify", "-q", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return head
+}
+
+// commitMessage is structured so that the history can be read by tools.
+func commitMessage(operation, dstId, name string) string {
+	return fmt.Sprintf("%s %s/%s\n\nPkiio-Operation: %s\nPkiio-Destination: %s\nPkiio-Name: %s\n",
+		operation, dstId, name, operation, dstId, name)
+}
+
+// commit commits the given paths and reports whether there was anything to
+// commit.
+func (g *GitAPI) commit(message string, paths ...string) (bool, error) {
+	args := append([]string{"add", "-A", "--"}, paths...)
+	if _, err := g.git(args...); err != nil {
+		return false, err
+	}
+
+	args = append([]string{"status", "--porcelain", "--"}, paths...)
+	if status, err := g.git(args...); err != nil {
+		return false, err
+	} else if status == "" {
+		// Unchanged, e.g. a document sent again with the same content
+		return false, nil
+	}
+
+	args = append([]string{"commit", "-q", "-m", message, "--"}, paths...)
+	if _, err := g.git(args...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Sync fetches the remote and merges it. Conflicts on queue items are
+// resolved in favour of the item being gone, as either side popping it means
+// it was processed. Conflicts on documents can't be merged, so the merge is
+// aborted and ErrConflict returned.
+func (g *GitAPI) Sync() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.sync()
+}
+
+func (g *GitAPI) sync() error {
+	if g.remote == "" {
+		g.synced = true
+		return nil
+	}
+
+	logger.Debugf("syncing git repository '%s'", g.dir)
+	if _, err := g.git("fetch", "-q", g.remote); err != nil {
+		return err
+	}
+
+	remoteBranch := g.remote + "/" + g.branch
+	if _, err := g.git("rev-parse", "--verify", "-q", remoteBranch); err != nil {
+		// Nothing has been pushed yet
+		g.synced = true
+		return nil
+	}
+
+	if !g.hasCommits() {
+		if _, err := g.git("reset", "-q", "--hard", remoteBranch); err != nil {
+			return err
+		}
+		g.synced = true
+		return nil
+	}
+
+	if _, err := g.git("merge", "-q", "--no-edit", remoteBranch); err != nil {
+		if err := g.resolveConflicts(); err != nil {
+			return err
+		}
+	}
+
+	g.synced = true
+	return nil
+}
+
+func (g *GitAPI) resolveConflicts() error {
+	conflicts, err := g.git("diff", "--name-only", "--diff-filter=U")
+	if err != nil {
+		return err
+	}
+
+	if conflicts == "" {
+		return wrapError(fmt.Errorf("merge failed without conflicts"), "syncing git repository")
+	}
+
+	files := strings.Split(conflicts, "\n")
+	for _, file := range files {
+		if !strings.HasPrefix(file, "incoming/") && !strings.HasPrefix(file, "outgoing/") {
+			g.git("merge", "--abort")
+			return newError(ErrConflict, nil, "document '%s' was changed in another clone", file)
+		}
+	}
+
+	for _, file := range files {
+		logger.Infof("resolving conflict on queue item '%s'", file)
+		if _, err := g.git("rm", "-q", "--cached", "--ignore-unmatch", "--", file); err != nil {
+			return err
+		}
+		os.Remove(filepath.Join(g.dir, file))
+	}
+
+	if _, err := g.git("commit", "-q", "--no-edit"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// change commits a change made by apply and pushes it. If the remote moved on,
+// the change is dropped, the remote merged and the change applied again.
+// Documents aren't written again if the remote changed them, as that would
+// lose the other change, and ErrConflict is returned instead. If the push
+// fails for another reason, e.g. the remote can't be reached, the change is
+// dropped and the error returned.
+func (g *GitAPI) change(message string, document bool, apply func() ([]string, error)) error {
+	if !g.synced {
+		if err := g.sync(); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; attempt < GitPushAttempts; attempt++ {
+		base := g.head()
+
+		paths, err := apply()
+		if err != nil {
+			return err
+		}
+
+		committed, err := g.commit(message, paths...)
+		if err != nil {
+			return err
+		}
+
+		if !committed || g.remote == "" {
+			return nil
+		}
+
+		err = g.pushBranch()
+		if err == nil {
+			return nil
+		}
+
+		if err := g.undo(base, paths); err != nil {
+			return err
+		}
+
+		if !IsConflict(err) {
+			return err
+		}
+
+		logger.Debug("remote has changed, retrying")
+		if err := g.sync(); err != nil {
+			return err
+		}
+
+		if document {
+			changed, err := g.changedSince(base, paths)
+			if err != nil {
+				return err
+			} else if changed != "" {
+				return newError(ErrConflict, nil, "document '%s' was changed in another clone", changed)
+			}
+		}
+	}
+
+	return newError(ErrConflict, nil, "pushing '%s' after %d attempts", strings.SplitN(message, "\n", 2)[0], GitPushAttempts)
+}
+
+// pushBranch pushes the branch. Only rejections because the remote has moved
+// on are ErrConflict.
+func (g *GitAPI) pushBranch() error {
+	_, err := g.git("push", "-q", g.remote, g.branch)
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, "[rejected]") && (strings.Contains(msg, "(fetch first)") || strings.Contains(msg, "(non-fast-forward)")) {
+		return newError(ErrConflict, err, "pushing to '%s'", g.remote)
+	}
+	return wrapError(err, "pushing to '%s'", g.remote)
+}
+
+// undo drops the commit of the paths, going back to base, which is "" if
+// there were no commits before.
+func (g *GitAPI) undo(base string, paths []string) error {
+	if base != "" {
+		_, err := g.git("reset", "-q", "--hard", base)
+		return err
+	}
+
+	if _, err := g.git("update-ref", "-d", "HEAD"); err != nil {
+		return err
+	}
+
+	args := append([]string{"rm", "-r", "-q", "-f", "--ignore-unmatch", "--"}, paths...)
+	_, err := g.git(args...)
+	return err
+}
+
+// changedSince returns the paths that changed between base and the current
+// commit, or that exist now if base is "".
+func (g *GitAPI) changedSince(base string, paths []string) (string, error) {
+	if base == "" {
+		return g.git(append([]string{"ls-files", "--"}, paths...)...)
+	}
+	return g.git(append([]string{"diff", "--name-only", base, "HEAD", "--"}, paths...)...)
+}
+
+func (g *GitAPI) read(path string) (string, error) {
+	if !g.synced {
+		if err := g.sync(); err != nil {
+			return "", err
+		}
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(g.dir, path))
+	if os.IsNotExist(err) {
+		return "", newError(ErrNotFound, nil, "document '%s'", path)
+	} else if err != nil {
+		return "", wrapError(err, "reading '%s'", path)
+	}
+	return string(content), nil
+}
+
+func (g *GitAPI) write(path, content string) error {
+	full := filepath.Join(g.dir, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0700); err != nil {
+		return wrapError(err, "creating directory for '%s'", path)
+	}
+
+	if err := ioutil.WriteFile(full, []byte(content), 0600); err != nil {
+		return wrapError(err, "writing '%s'", path)
+	}
+	return nil
+}
+
+func (g *GitAPI) send(kind, dstId, name, content string) error {
+	if err := validateDocumentPath(dstId, name); err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	path := filepath.Join(kind, dstId, name)
+	return g.change(commitMessage("send-"+kind, dstId, name), true, func() ([]string, error) {
+		return []string{path}, g.write(path, content)
+	})
+}
+
+func (g *GitAPI) get(kind, dstId, name string) (string, error) {
+	if err := validateDocumentPath(dstId, name); err != nil {
+		return "", err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.read(filepath.Join(kind, dstId, name))
+}
+
+// queueItems returns the item files of a queue, oldest first.
+func (g *GitAPI) queueItems(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(g.dir, dir))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, wrapError(err, "reading queue '%s'", dir)
+	}
+
+	items := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() {
+			items = append(items, info.Name())
+		}
+	}
+	sort.Strings(items)
+	return items, nil
+}
+
+func (g *GitAPI) push(direction, dstId, queue, content string) error {
+	if err := validateDocumentPath(dstId, queue); err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	dir := filepath.Join(direction, dstId, queue)
+	return g.change(commitMessage("push-"+direction, dstId, queue), false, func() ([]string, error) {
+		// The random suffix keeps items from different clones apart
+		item := fmt.Sprintf("%020d-%s", g.now().UnixNano(), x509.NewID())
+		path := filepath.Join(dir, item)
+		return []string{path}, g.write(path, content)
+	})
+}
+
+func (g *GitAPI) pop(direction, dstId, queue string) (string, error) {
+	if err := validateDocumentPath(dstId, queue); err != nil {
+		return "", err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	// Pops always work on the latest remote
+	if err := g.sync(); err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(direction, dstId, queue)
+	var content string
+	err := g.change(commitMessage("pop-"+direction, dstId, queue), false, func() ([]string, error) {
+		items, err := g.queueItems(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(items) == 0 {
+			return nil, newError(ErrNotFound, nil, "queue '%s' is empty", dir)
+		}
+
+		path := filepath.Join(dir, items[0])
+		if content, err = g.read(path); err != nil {
+			return nil, err
+		}
+
+		if err := os.Remove(filepath.Join(g.dir, path)); err != nil {
+			return nil, wrapError(err, "removing '%s'", path)
+		}
+		return []string{path}, nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+	return content, nil
+}
+
+func (g *GitAPI) size(direction, dstId, queue string) (int, error) {
+	if err := validateDocumentPath(dstId, queue); err != nil {
+		return 0, err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if !g.synced {
+		if err := g.sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	items, err := g.queueItems(filepath.Join(direction, dstId, queue))
+	if err != nil {
+		return 0, err
+	}
+	return len(items), nil
+}
+
+func (g *GitAPI) Connect() error {
+	return g.Sync()
+}
+
+func (g *GitAPI) Authenticate() error {
+	return nil
+}
+
+func (g *GitAPI) SendPublic(dstId, name, content string) error {
+	return g.send("public", dstId, name, content)
+}
+
+func (g *GitAPI) GetPublic(dstId, name string) (string, error) {
+	return g.get("public", dstId, name)
+}
+
+func (g *GitAPI) SendPrivate(dstId, name, content string) error {
+	return g.send("private", dstId, name, content)
+}
+
+// SwapPrivate replaces a private document if it has the given ETag in the
+// latest version of the repository.
+func (g *GitAPI) SwapPrivate(dstId, name, content, etag string) error {
+	if err := validateDocumentPath(dstId, name); err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if err := g.sync(); err != nil {
+		return err
+	}
+
+	path := filepath.Join("private", dstId, name)
+	current, err := g.read(path)
+	if err != nil {
+		return err
+	}
+
+	if ETag(current) != etag {
+		return newError(ErrConflict, nil, "document '%s' has changed", path)
+	}
+
+	return g.change(commitMessage("send-private", dstId, name), true, func() ([]string, error) {
+		return []string{path}, g.write(path, content)
+	})
+}
+
+func (g *GitAPI) GetPrivate(dstId, name string) (string, error) {
+	return g.get("private", dstId, name)
+}
+
+func (g *GitAPI) DeletePrivate(dstId, name string) error {
+	if err := validateDocumentPath(dstId, name); err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	path := filepath.Join("private", dstId, name)
+	return g.change(commitMessage("delete-private", dstId, name), true, func() ([]string, error) {
+		if err := os.Remove(filepath.Join(g.dir, path)); os.IsNotExist(err) {
+			return nil, newError(ErrNotFound, nil, "document '%s'", path)
+		} else if err != nil {
+			return nil, wrapError(err, "removing '%s'", path)
+		}
+		return []string{path}, nil
+	})
+}
+
+func (g *GitAPI) PushIncoming(dstId, queue, content string) error {
+	return g.push("incoming", dstId, queue, content)
+}
+
+func (g *GitAPI) PopIncoming(dstId, queue string) (string, error) {
+	return g.pop("incoming", dstId, queue)
+}
+
+func (g *GitAPI) PushOutgoing(dstId, queue, content string) error {
+	return g.push("outgoing", dstId, queue, content)
+}
+
+func (g *GitAPI) PopOutgoing(dstId, queue string) (string, error) {
+	return g.pop("outgoing", dstId, queue)
+}
+
+func (g *GitAPI) IncomingSize(dstId, queue string) (int, error) {
+	return g.size("incoming", dstId, queue)
+}
+
+func (g *GitAPI) OutgoingSize(dstId, queue string) (int, error) {
+	return g.size("outgoing", dstId, queue)
+}
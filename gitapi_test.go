@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestGitClones creates a bare repository and returns GitAPIs for two
+// clones of it.
+func newTestGitClones(t *testing.T) (*GitAPI, *GitAPI, func()) {
+	dir, err := ioutil.TempDir("", "pkiio-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bare := filepath.Join(dir, "bare.git")
+	for _, args := range [][]string{
+		{"init", "-q", "--bare", "-b", "master", bare},
+		{"clone", "-q", bare, filepath.Join(dir, "a")},
+		{"clone", "-q", bare, filepath.Join(dir, "b")},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s: %s", args[0], err, out)
+		}
+	}
+
+	a, err := NewGitAPI(filepath.Join(dir, "a"))
+	assert.NoError(t, err)
+	b, err := NewGitAPI(filepath.Join(dir, "b"))
+	assert.NoError(t, err)
+
+	return a, b, func() { os.RemoveAll(dir) }
+}
+
+func TestGitAPIDocuments(t *testing.T) {
+	a, b, cleanup := newTestGitClones(t)
+	defer cleanup()
+
+	assert.NoError(t, a.SendPublic("org", "index", "public"))
+	assert.NoError(t, a.SendPrivate("org", "index", "private"))
+
+	content, err := b.GetPrivate("org", "index")
+	assert.NoError(t, err)
+	assert.Equal(t, "private", content)
+
+	assert.NoError(t, b.DeletePrivate("org", "index"))
+	assert.NoError(t, a.Sync())
+	_, err = a.GetPrivate("org", "index")
+	assert.True(t, IsNotFound(err))
+
+	log, err := a.git("log", "-1", "--format=%B")
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(log, "Pkiio-Operation: delete-private"))
+}
+
+func TestGitAPIQueues(t *testing.T) {
+	a, b, cleanup := newTestGitClones(t)
+	defer cleanup()
+
+	// Pushes from both clones merge without conflicts
+	assert.NoError(t, a.PushIncoming("org", "registration", "one"))
+	assert.NoError(t, b.PushIncoming("org", "registration", "two"))
+	assert.NoError(t, a.Sync())
+
+	size, err := a.IncomingSize("org", "registration")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	// Each item is only popped once, whichever clone pops it
+	first, err := a.PopIncoming("org", "registration")
+	assert.NoError(t, err)
+	second, err := b.PopIncoming("org", "registration")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", first)
+	assert.Equal(t, "two", second)
+
+	_, err = a.PopIncoming("org", "registration")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestGitAPIDocumentConflict(t *testing.T) {
+	a, b, cleanup := newTestGitClones(t)
+	defer cleanup()
+
+	assert.NoError(t, a.SendPrivate("org", "index", "base"))
+	assert.NoError(t, b.Sync())
+
+	assert.NoError(t, a.SendPrivate("org", "index", "from a"))
+	err := b.SendPrivate("org", "index", "from b")
+	assert.True(t, IsConflict(err))
+
+	// The other clone's change is kept
+	content, err := b.GetPrivate("org", "index")
+	assert.NoError(t, err)
+	assert.Equal(t, "from a", content)
+}
+
+func TestGitAPIWithoutRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkiio-git")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	g, err := NewGitAPI(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, g.PushOutgoing("node", "csrs", "csr"))
+	content, err := g.PopOutgoing("node", "csrs")
+	assert.NoError(t, err)
+	assert.Equal(t, "csr", content)
+}
+
+func TestGitAPISwapPrivate(t *testing.T) {
+	a, b, cleanup := newTestGitClones(t)
+	defer cleanup()
+
+	assert.NoError(t, a.SendPrivate("org", "index", "v1"))
+	assert.NoError(t, b.SwapPrivate("org", "index", "v2", ETag("v1")))
+	err := a.SwapPrivate("org", "index", "v3", ETag("v1"))
+	assert.True(t, IsConflict(err))
+}
+
+func TestGitAPIFirstCommitRejected(t *testing.T) {
+	a, b, cleanup := newTestGitClones(t)
+	defer cleanup()
+
+	// b has no commits of its own when its first push is rejected
+	assert.NoError(t, b.Sync())
+	assert.NoError(t, a.SendPrivate("org", "one", "from a"))
+	assert.NoError(t, b.SendPrivate("org", "two", "from b"))
+
+	assert.NoError(t, a.Sync())
+	content, err := a.GetPrivate("org", "two")
+	assert.NoError(t, err)
+	assert.Equal(t, "from b", content)
+}
+
+func TestGitAPIPushFailure(t *testing.T) {
+	a, _, cleanup := newTestGitClones(t)
+	defer cleanup()
+
+	assert.NoError(t, a.SendPrivate("org", "index", "v1"))
+
+	bare := filepath.Join(filepath.Dir(a.dir), "bare.git")
+	assert.NoError(t, os.Rename(bare, bare+".gone"))
+
+	// Failing to reach the remote isn't a conflict, and the change is dropped
+	err := a.SendPrivate("org", "index", "v2")
+	assert.Error(t, err)
+	assert.False(t, IsConflict(err))
+
+	content, err := a.GetPrivate("org", "index")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", content)
+}
+
+func TestGitAPIInvalidPaths(t *testing.T) {
+	a, _, cleanup := newTestGitClones(t)
+	defer cleanup()
+
+	assert.True(t, IsInvalidParams(a.SendPrivate("..", "x", "content")))
+	assert.True(t, IsInvalidParams(a.SendPublic("org", "../../x", "content")))
+	assert.True(t, IsInvalidParams(a.PushIncoming("org", "..", "content")))
+	_, err := a.GetPrivate("org", "a/../../b")
+	assert.True(t, IsInvalidParams(err))
+}
@@ -4,10 +4,24 @@ import (
 	"strings"
 )
 
+// ParseTags splits a comma separated list of tags and normalizes each one
+// with NormalizeTag.
 func ParseTags(tagString string) []string {
 	tags := strings.Split(tagString, ",")
 	for i, e := range tags {
-		tags[i] = strings.TrimSpace(strings.ToLower(e))
+		tags[i] = NormalizeTag(e)
 	}
 	return tags
 }
+
+// splitList splits a comma separated list, trimming space and dropping empty
+// entries. Unlike ParseTags it keeps case, for templates and addresses.
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
@@ -0,0 +1,450 @@
+package controller
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/pki-io/core/crypto"
+	"github.com/pki-io/core/fs"
+	"github.com/pki-io/core/x509"
+	"strings"
+	"time"
+)
+
+// Formats of imported certificate, key and CSR files, see DetectFormat.
+const (
+	FormatPEM    string = "pem"
+	FormatDER    string = "der"
+	FormatPKCS12 string = "pkcs12"
+)
+
+// DetectFormat returns the format of certificate, key or CSR file data.
+func DetectFormat(data []byte) string {
+	if bytes.Contains(data, []byte("-----BEGIN ")) {
+		return FormatPEM
+	}
+
+	if isPKCS12(data) {
+		return FormatPKCS12
+	}
+	return FormatDER
+}
+
+// ImportedCert is a certificate with its chain and private key, if any, read
+// from import files.
+type ImportedCert struct {
+	Certificate *stdx509.Certificate
+	Chain       []*stdx509.Certificate
+	Key         stdcrypto.Signer
+}
+
+// newImportedCert picks the certificate for the key, or the first one if
+// there isn't a key, leaving the rest as the chain.
+func newImportedCert(certs []*stdx509.Certificate, key stdcrypto.Signer) (*ImportedCert, error) {
+	if len(certs) == 0 {
+		return nil, newError(ErrInvalidParams, nil, "no certificates found")
+	}
+
+	leaf := 0
+	if key != nil {
+		for i, cert := range certs {
+			if CheckKeyMatches(key, cert.PublicKey) == nil {
+				leaf = i
+				break
+			}
+		}
+	}
+
+	imported := &ImportedCert{Certificate: certs[leaf], Key: key}
+	for i, cert := range certs {
+		if i != leaf {
+			imported.Chain = append(imported.Chain, cert)
+		}
+	}
+	return imported, nil
+}
+
+// CertificatePEM returns the certificate PEM encoded.
+func (imported *ImportedCert) CertificatePEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: imported.Certificate.Raw}))
+}
+
+// ChainPEM returns the chain as concatenated PEM, or an empty string if there
+// isn't one.
+func (imported *ImportedCert) ChainPEM() string {
+	var out []byte
+	for _, cert := range imported.Chain {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return string(out)
+}
+
+// KeyPEM returns the private key PEM encoded and its key type.
+func (imported *ImportedCert) KeyPEM() (string, crypto.KeyType, error) {
+	keyType, err := KeyTypeOf(imported.Key)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyPem, err := PemEncodePrivateKey(imported.Key)
+	if err != nil {
+		return "", "", err
+	}
+	return keyPem, keyType, nil
+}
+
+// CheckKeyMatches returns ErrVerificationFailed if the private key isn't the
+// key for the public key.
+func CheckKeyMatches(key stdcrypto.Signer, pub interface{}) error {
+	public, ok := key.Public().(interface {
+		Equal(stdcrypto.PublicKey) bool
+	})
+	if !ok || !public.Equal(pub) {
+		return newError(ErrVerificationFailed, nil, "private key doesn't match public key")
+	}
+	return nil
+}
+
+// isPrivateKeyBlock reports whether a PEM block holds a private key.
+func isPrivateKeyBlock(block *pem.Block) bool {
+	return strings.HasSuffix(block.Type, "PRIVATE KEY")
+}
+
+// parsePrivateKeyBlock decodes a PEM block holding a PKCS #1, SEC 1, PKCS #8
+// or encrypted PKCS #8 private key. Keys encrypted with the legacy OpenSSL
+// PEM encryption aren't supported, as it's a weak, non-standard scheme.
+func parsePrivateKeyBlock(block *pem.Block, password string) (stdcrypto.Signer, error) {
+	if block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+		return nil, newError(ErrNotImplemented, nil, "legacy encrypted PEM private key, convert it to encrypted PKCS #8 with 'openssl pkcs8 -topk8'")
+	}
+
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		if password == "" {
+			return nil, newError(ErrInvalidParams, nil, "password is required for encrypted private key")
+		}
+		return DecryptPKCS8(block.Bytes, password)
+	}
+	return PemDecodePrivateKey(pem.EncodeToMemory(block))
+}
+
+// ParseCertificateData reads certificates and any private key from PEM, DER
+// or PKCS #12 data. PEM data may hold a chain and a key, and DER data may be
+// several concatenated certificates.
+func ParseCertificateData(data []byte, password string) (*ImportedCert, error) {
+	var key stdcrypto.Signer
+	var certs []*stdx509.Certificate
+
+	switch DetectFormat(data) {
+	case FormatPEM:
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+
+			switch {
+			case block.Type == "CERTIFICATE":
+				cert, err := stdx509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, newError(ErrInvalidParams, err, "parsing certificate")
+				}
+				certs = append(certs, cert)
+			case isPrivateKeyBlock(block) && key == nil:
+				var err error
+				if key, err = parsePrivateKeyBlock(block, password); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case FormatPKCS12:
+		var err error
+		if key, certs, err = DecodePKCS12(data, password); err != nil {
+			return nil, err
+		}
+	default:
+		var err error
+		if certs, err = stdx509.ParseCertificates(data); err != nil {
+			return nil, newError(ErrInvalidParams, err, "parsing DER certificate")
+		}
+	}
+
+	return newImportedCert(certs, key)
+}
+
+// ParsePrivateKeyData reads a private key from PEM, DER or PKCS #12 data.
+// Keys may be PKCS #1, SEC 1, PKCS #8 or encrypted PKCS #8.
+func ParsePrivateKeyData(data []byte, password string) (stdcrypto.Signer, error) {
+	switch DetectFormat(data) {
+	case FormatPEM:
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				return nil, newError(ErrInvalidParams, nil, "no private key found")
+			}
+
+			if isPrivateKeyBlock(block) {
+				return parsePrivateKeyBlock(block, password)
+			}
+		}
+	case FormatPKCS12:
+		key, _, err := DecodePKCS12(data, password)
+		if err != nil {
+			return nil, err
+		}
+
+		if key == nil {
+			return nil, newError(ErrInvalidParams, nil, "no private key found")
+		}
+		return key, nil
+	}
+
+	if key, err := stdx509.ParsePKCS8PrivateKey(data); err == nil {
+		if signer, ok := key.(stdcrypto.Signer); ok {
+			return signer, nil
+		}
+	}
+
+	if key, err := stdx509.ParsePKCS1PrivateKey(data); err == nil {
+		return key, nil
+	}
+
+	if key, err := stdx509.ParseECPrivateKey(data); err == nil {
+		return key, nil
+	}
+
+	if password != "" {
+		return DecryptPKCS8(data, password)
+	}
+	return nil, newError(ErrInvalidParams, nil, "unrecognised private key, or it's encrypted and needs a password")
+}
+
+// ParseCSRData reads a CSR from PEM or DER data.
+func ParseCSRData(data []byte) (*stdx509.CertificateRequest, error) {
+	if DetectFormat(data) == FormatPEM {
+		block, _ := pem.Decode(data)
+		if block == nil || !strings.HasSuffix(block.Type, "CERTIFICATE REQUEST") {
+			return nil, newError(ErrInvalidParams, nil, "no CSR found")
+		}
+		data = block.Bytes
+	}
+
+	csr, err := stdx509.ParseCertificateRequest(data)
+	if err != nil {
+		return nil, newError(ErrInvalidParams, err, "parsing CSR")
+	}
+	return csr, nil
+}
+
+// readImportFile reads a file to import, returning ErrNotFound if it doesn't
+// exist. kind names the file in errors.
+func readImportFile(path, kind string) ([]byte, error) {
+	ok, err := fs.Exists(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, newError(ErrNotFound, nil, "%s '%s'", kind, path)
+	}
+
+	logger.Debugf("reading %s '%s'", kind, path)
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+// importCSRFile reads a PEM or DER CSR file.
+func importCSRFile(path string) (*stdx509.CertificateRequest, error) {
+	data, err := readImportFile(path, "CSR file")
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := ParseCSRData(data)
+	if err != nil {
+		return nil, wrapError(err, "decoding CSR file '%s'", path)
+	}
+	return request, nil
+}
+
+// importCSRKeyFile reads a key file for a CSR, checking that it's the CSR's
+// key, and returns it PEM encoded with its key type.
+func importCSRKeyFile(path, password string, request *stdx509.CertificateRequest) (string, crypto.KeyType, error) {
+	data, err := readImportFile(path, "key file")
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err := ParsePrivateKeyData(data, password)
+	if err != nil {
+		return "", "", wrapError(err, "decoding key file '%s'", path)
+	}
+
+	if err := CheckKeyMatches(key, request.PublicKey); err != nil {
+		return "", "", wrapError(err, "importing key file '%s'", path)
+	}
+
+	return (&ImportedCert{Key: key}).KeyPEM()
+}
+
+// pemEncodeCSR returns a parsed CSR PEM encoded.
+func pemEncodeCSR(request *stdx509.CertificateRequest) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: request.Raw}))
+}
+
+// importCertificateFiles reads a certificate file and a key file, either of
+// which may be empty. A key in the key file replaces any in the certificate
+// file, and must match the certificate.
+func importCertificateFiles(certFile, keyFile, password string) (*ImportedCert, error) {
+	imported := new(ImportedCert)
+	if certFile != "" {
+		data, err := readImportFile(certFile, "certificate file")
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Debugf("decoding %s certificate file", DetectFormat(data))
+		if imported, err = ParseCertificateData(data, password); err != nil {
+			return nil, wrapError(err, "decoding certificate file '%s'", certFile)
+		}
+	}
+
+	if keyFile != "" {
+		data, err := readImportFile(keyFile, "key file")
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Debugf("decoding %s key file", DetectFormat(data))
+		key, err := ParsePrivateKeyData(data, password)
+		if err != nil {
+			return nil, wrapError(err, "decoding key file '%s'", keyFile)
+		}
+
+		if imported.Certificate != nil {
+			certs := append([]*stdx509.Certificate{imported.Certificate}, imported.Chain...)
+			if imported, err = newImportedCert(certs, key); err != nil {
+				return nil, err
+			}
+		}
+		imported.Key = key
+	}
+
+	if imported.Certificate != nil && imported.Key != nil {
+		logger.Debug("checking private key matches certificate")
+		if err := CheckKeyMatches(imported.Key, imported.Certificate.PublicKey); err != nil {
+			return nil, wrapError(err, "importing certificate '%s'", imported.Certificate.Subject.CommonName)
+		}
+	}
+
+	return imported, nil
+}
+
+// checkStoredKeyMatches checks that a PEM encoded key, or a key reference,
+// matches a PEM encoded certificate, if both are set, after one of them is
+// replaced.
+func checkStoredKeyMatches(certPem, keyPem string) error {
+	if certPem == "" || keyPem == "" {
+		return nil
+	}
+
+	certs, err := pemDecodeCertificates([]byte(certPem))
+	if err != nil {
+		return err
+	}
+
+	if len(certs) == 0 {
+		return newError(ErrInvalidParams, nil, "no certificate found")
+	}
+
+	key, err := decodeStoredKey(keyPem)
+	if err != nil {
+		return err
+	}
+
+	return CheckKeyMatches(key, certs[0].PublicKey)
+}
+
+// checkStoredCSRKeyMatches checks that a PEM encoded key matches a PEM
+// encoded CSR after the CSR is replaced.
+func checkStoredCSRKeyMatches(csrPem, keyPem string) error {
+	request, err := ParseCSRData([]byte(csrPem))
+	if err != nil {
+		return err
+	}
+
+	key, err := PemDecodePrivateKey([]byte(keyPem))
+	if err != nil {
+		return err
+	}
+
+	return CheckKeyMatches(key, request.PublicKey)
+}
+
+// ValidateCACertificate checks that an imported certificate can be used as a
+// CA: it must have the CA basic constraint and the keyCertSign key usage, must
+// not have expired, and its subject must be within the CA's DN scope. Failures
+// are ErrVerificationFailed.
+func ValidateCACertificate(cert *stdx509.Certificate, scope x509.DNScope, now time.Time) error {
+	name := cert.Subject.CommonName
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return newError(ErrVerificationFailed, nil, "certificate '%s' is not a CA, it doesn't have the CA basic constraint", name)
+	}
+
+	if cert.KeyUsage&stdx509.KeyUsageCertSign == 0 {
+		return newError(ErrVerificationFailed, nil, "certificate '%s' can't sign certificates, it doesn't have the keyCertSign key usage", name)
+	}
+
+	if now.After(cert.NotAfter) {
+		return newError(ErrVerificationFailed, nil, "certificate '%s' expired on %s", name, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return checkDNScope("certificate '"+name+"'", cert.Subject, scope)
+}
+
+// checkDNScope checks that each field set in the CA's DN scope is one of the
+// subject's values for it. Failures are ErrVerificationFailed.
+func checkDNScope(what string, subject pkix.Name, scope x509.DNScope) error {
+	scopes := []struct {
+		field, want string
+		got         []string
+	}{
+		{"country", scope.Country, subject.Country},
+		{"organisation", scope.Organization, subject.Organization},
+		{"organisational unit", scope.OrganizationalUnit, subject.OrganizationalUnit},
+		{"locality", scope.Locality, subject.Locality},
+		{"state", scope.Province, subject.Province},
+		{"street address", scope.StreetAddress, subject.StreetAddress},
+		{"postal code", scope.PostalCode, subject.PostalCode},
+	}
+	for _, s := range scopes {
+		if s.want == "" {
+			continue
+		}
+
+		found := false
+		for _, got := range s.got {
+			found = found || got == s.want
+		}
+
+		if !found {
+			return newError(ErrVerificationFailed, nil, "%s has DN %s '%s', outside the CA's DN scope '%s'", what, s.field, strings.Join(s.got, ", "), s.want)
+		}
+	}
+
+	return nil
+}
+
+// paramPassword returns the password param, which may be nil.
+func paramPassword(password *string) string {
+	if password == nil {
+		return ""
+	}
+	return *password
+}
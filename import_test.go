@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"crypto/sha256"
+	stdx509 "crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"github.com/pki-io/core/x509"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func pemCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestDetectFormat(t *testing.T) {
+	cert, caCert, key := newTestBundleCerts(t, KeySpecP256)
+
+	assert.Equal(t, FormatPEM, DetectFormat(pemCert(cert.Raw)))
+	assert.Equal(t, FormatDER, DetectFormat(cert.Raw))
+
+	p12, err := EncodePKCS12("leaf", key, cert, nil, "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatPKCS12, DetectFormat(p12))
+
+	// A chain of DER certificates isn't PKCS #12
+	assert.Equal(t, FormatDER, DetectFormat(append(append([]byte{}, caCert.Raw...), cert.Raw...)))
+}
+
+func TestParseCertificateData(t *testing.T) {
+	cert, caCert, key := newTestBundleCerts(t, KeySpecP256)
+	keyPem, err := PemEncodePrivateKey(key)
+	assert.NoError(t, err)
+
+	// The leaf is the certificate for the key, wherever it is in the file
+	data := append(append(pemCert(caCert.Raw), pemCert(cert.Raw)...), []byte(keyPem)...)
+	imported, err := ParseCertificateData(data, "")
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Raw, imported.Certificate.Raw)
+	assert.Len(t, imported.Chain, 1)
+	assert.Equal(t, string(pemCert(caCert.Raw)), imported.ChainPEM())
+	assert.NotNil(t, imported.Key)
+
+	imported, err = ParseCertificateData(append(append([]byte{}, cert.Raw...), caCert.Raw...), "")
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Raw, imported.Certificate.Raw)
+	assert.Nil(t, imported.Key)
+
+	_, err = ParseCertificateData([]byte(keyPem), "")
+	assert.True(t, IsInvalidParams(err))
+}
+
+func TestParsePKCS12(t *testing.T) {
+	cert, caCert, key := newTestBundleCerts(t, KeySpecRSA2048)
+
+	p12, err := EncodePKCS12("leaf", key, cert, []*stdx509.Certificate{caCert}, "secret")
+	assert.NoError(t, err)
+
+	_, err = ParseCertificateData(p12, "wrong")
+	assert.True(t, IsDecryptionFailed(err))
+
+	imported, err := ParseCertificateData(p12, "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Raw, imported.Certificate.Raw)
+	assert.Len(t, imported.Chain, 1)
+	assert.NoError(t, CheckKeyMatches(imported.Key, cert.PublicKey))
+
+	parsedKey, err := ParsePrivateKeyData(p12, "secret")
+	assert.NoError(t, err)
+	assert.NoError(t, CheckKeyMatches(parsedKey, cert.PublicKey))
+
+	// Trusted certificate stores have no key
+	p12, err = EncodePKCS12("ca", nil, caCert, nil, "secret")
+	assert.NoError(t, err)
+	imported, err = ParseCertificateData(p12, "secret")
+	assert.NoError(t, err)
+	assert.Nil(t, imported.Key)
+}
+
+// Fingerprints of the certificates in testdata, see testdata/README
+const (
+	fixtureLeafSHA256 = "b1ca71138807c2ea5709e8d6ce7d8ecdf4b39bd47591c6f3d30d8afafc0338a8"
+	fixtureCASHA256   = "de235a24f0cdc78ec9220628262701d320625262184eb9d674ee1cbbb78838ac"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func fingerprint(cert *stdx509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseOpenSSLPKCS12(t *testing.T) {
+	for _, name := range []string{"openssl-aes.p12", "openssl-legacy.p12"} {
+		p12 := readFixture(t, name)
+		assert.Equal(t, FormatPKCS12, DetectFormat(p12), name)
+
+		_, err := ParseCertificateData(p12, "wrong")
+		assert.True(t, IsDecryptionFailed(err), name)
+
+		imported, err := ParseCertificateData(p12, "fixture")
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		assert.Equal(t, fixtureLeafSHA256, fingerprint(imported.Certificate), name)
+		assert.Equal(t, "fixture-leaf", imported.Certificate.Subject.CommonName, name)
+		assert.Len(t, imported.Chain, 1, name)
+		assert.Equal(t, fixtureCASHA256, fingerprint(imported.Chain[0]), name)
+		assert.NoError(t, CheckKeyMatches(imported.Key, imported.Certificate.PublicKey), name)
+
+		spec, _ := KeySpecOf(imported.Key)
+		assert.Equal(t, KeySpecRSA2048, spec, name)
+	}
+}
+
+func TestParseOpenSSLPKCS8(t *testing.T) {
+	leaf, err := ParseCertificateData(readFixture(t, "leaf.pem"), "")
+	assert.NoError(t, err)
+	assert.Equal(t, fixtureLeafSHA256, fingerprint(leaf.Certificate))
+
+	data := readFixture(t, "leaf-pkcs8.pem")
+	_, err = ParsePrivateKeyData(data, "wrong")
+	assert.True(t, IsDecryptionFailed(err))
+
+	key, err := ParsePrivateKeyData(data, "fixture")
+	assert.NoError(t, err)
+	assert.NoError(t, CheckKeyMatches(key, leaf.Certificate.PublicKey))
+}
+
+func TestParseLegacyEncryptedPEM(t *testing.T) {
+	data := readFixture(t, "legacy-encrypted.pem")
+
+	_, err := ParsePrivateKeyData(data, "fixture")
+	assert.True(t, IsNotImplemented(err))
+	assert.Contains(t, err.Error(), "PKCS #8")
+
+	_, err = ParseCertificateData(append(readFixture(t, "ca.pem"), data...), "fixture")
+	assert.True(t, IsNotImplemented(err))
+}
+
+func TestPBEIterationLimit(t *testing.T) {
+	params, err := asn1.Marshal(pkcs12PBEParams{Salt: []byte("saltsalt"), Iterations: MaxPBEIterations + 1})
+	assert.NoError(t, err)
+	algorithm := pkcs12AlgorithmIdentifier{Algorithm: oidPBEWithSHAAnd3DES, Parameters: asn1.RawValue{FullBytes: params}}
+	_, err = decryptPBE(algorithm, make([]byte, 8), "secret")
+	assert.True(t, IsInvalidParams(err))
+
+	_, _, key := newTestBundleCerts(t, KeySpecP256)
+	pkcs8, _ := stdx509.MarshalPKCS8PrivateKey(key)
+	pbes2, encrypted, err := encryptPBES2(pkcs8, "secret", 1000)
+	assert.NoError(t, err)
+
+	// Raise the PBKDF2 iterations in the parameters
+	var pbes2Parsed pbes2Params
+	asn1.Unmarshal(pbes2.Parameters.FullBytes, &pbes2Parsed)
+	var kdf pbkdf2Params
+	asn1.Unmarshal(pbes2Parsed.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+	kdf.Iterations = MaxPBEIterations + 1
+	kdfBytes, _ := asn1.Marshal(kdf)
+	pbes2Parsed.KeyDerivationFunc.Parameters = asn1.RawValue{FullBytes: kdfBytes}
+	paramBytes, _ := asn1.Marshal(pbes2Parsed)
+	pbes2.Parameters = asn1.RawValue{FullBytes: paramBytes}
+
+	_, err = decryptPBE(*pbes2, encrypted, "secret")
+	assert.True(t, IsInvalidParams(err))
+
+	macData := &pkcs12MacData{Mac: pkcs12DigestInfo{Algorithm: pkcs12AlgorithmIdentifier{Algorithm: oidSHA256}}, Iterations: MaxPBEIterations + 1}
+	assert.True(t, IsInvalidParams(pkcs12VerifyMAC(macData, []byte("content"), "secret")))
+}
+
+func TestParseEncryptedPKCS8(t *testing.T) {
+	_, _, key := newTestBundleCerts(t, KeySpecP384)
+	pkcs8, err := stdx509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	algorithm, encrypted, err := encryptPBES2(pkcs8, "secret", 1000)
+	assert.NoError(t, err)
+	der, err := asn1.Marshal(pkcs12EncryptedPrivateKeyInfo{Algorithm: *algorithm, EncryptedData: encrypted})
+	assert.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der})
+
+	_, err = ParsePrivateKeyData(data, "")
+	assert.True(t, IsInvalidParams(err))
+
+	_, err = ParsePrivateKeyData(data, "wrong")
+	assert.True(t, IsDecryptionFailed(err))
+
+	parsed, err := ParsePrivateKeyData(data, "secret")
+	assert.NoError(t, err)
+	assert.NoError(t, CheckKeyMatches(parsed, key.Public()))
+
+	// And as DER
+	parsed, err = ParsePrivateKeyData(der, "secret")
+	assert.NoError(t, err)
+	assert.NoError(t, CheckKeyMatches(parsed, key.Public()))
+}
+
+func TestCheckKeyMatches(t *testing.T) {
+	cert, caCert, key := newTestBundleCerts(t, KeySpecP256)
+
+	assert.NoError(t, CheckKeyMatches(key, cert.PublicKey))
+	assert.True(t, IsVerificationFailed(CheckKeyMatches(key, caCert.PublicKey)))
+
+	keyPem, _ := PemEncodePrivateKey(key)
+	assert.True(t, IsVerificationFailed(checkStoredKeyMatches(string(pemCert(caCert.Raw)), keyPem)))
+	assert.NoError(t, checkStoredKeyMatches(string(pemCert(cert.Raw)), keyPem))
+}
+
+func TestRC2(t *testing.T) {
+	// RFC 2268 section 5 test vectors
+	tests := []struct {
+		key, plain, cipher string
+		bits               int
+	}{
+		{"ffffffffffffffff", "ffffffffffffffff", "278b27e42e2f0d49", 64},
+		{"88bca90e90875a7f0f79c384627bafb2", "0000000000000000", "2269552ab0f85ca6", 128},
+		{"0000000000000000", "0000000000000000", "ebb773f993278eff", 63},
+	}
+
+	for _, test := range tests {
+		key, _ := hex.DecodeString(test.key)
+		plain, _ := hex.DecodeString(test.plain)
+		block := newRC2Cipher(key, test.bits)
+
+		out := make([]byte, rc2BlockSize)
+		block.Encrypt(out, plain)
+		assert.Equal(t, test.cipher, hex.EncodeToString(out))
+
+		block.Decrypt(out, out)
+		assert.Equal(t, plain, out)
+	}
+}
+
+func TestValidateCACertificate(t *testing.T) {
+	cert, caCert, _ := newTestBundleCerts(t, KeySpecP256)
+	now := time.Now()
+
+	assert.NoError(t, ValidateCACertificate(caCert, x509.DNScope{}, now))
+	assert.True(t, IsVerificationFailed(ValidateCACertificate(cert, x509.DNScope{}, now)))
+	assert.True(t, IsVerificationFailed(ValidateCACertificate(caCert, x509.DNScope{}, caCert.NotAfter.Add(time.Second))))
+	assert.True(t, IsVerificationFailed(ValidateCACertificate(caCert, x509.DNScope{Organization: "pki.io"}, now)))
+
+	noCertSign := *caCert
+	noCertSign.KeyUsage = stdx509.KeyUsageDigitalSignature
+	assert.True(t, IsVerificationFailed(ValidateCACertificate(&noCertSign, x509.DNScope{}, now)))
+
+	scoped := *caCert
+	scoped.Subject.Organization = []string{"pki.io"}
+	assert.NoError(t, ValidateCACertificate(&scoped, x509.DNScope{Organization: "pki.io"}, now))
+}
@@ -0,0 +1,605 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pki-io/core/index"
+	"sort"
+	"time"
+)
+
+// IssuanceLogDocument is the name of the org's private document recording
+// the certificates issued to nodes.
+const IssuanceLogDocument string = "certificate-issuances"
+
+// IssuanceClaimTimeout is how long a reconcile run's claim on a certificate
+// stops other runs issuing it. Claims left by runs that stopped part way
+// through expire after it.
+const IssuanceClaimTimeout time.Duration = 10 * time.Minute
+
+// IssuedCert records a certificate issued to a node by a CA, with a profile
+// or with the CA's defaults if Profile is empty.
+type IssuedCert struct {
+	NodeId  string `json:"node-id"`
+	CAId    string `json:"ca-id"`
+	Profile string `json:"profile"`
+	Tag     string `json:"tag"`
+	CertId  string `json:"cert-id"`
+}
+
+// PendingIssuance is a certificate whose issue was deferred, e.g. because the
+// node's CSR pool was empty. Reconciling retries it.
+type PendingIssuance struct {
+	NodeId   string `json:"node-id"`
+	CAId     string `json:"ca-id"`
+	Profile  string `json:"profile"`
+	Tag      string `json:"tag"`
+	Reason   string `json:"reason"`
+	Attempts int    `json:"attempts"`
+	// Since is when the certificate was first deferred, in RFC 3339 format
+	Since string `json:"since"`
+	// ClaimedBy is the reconcile run issuing the certificate, if any, and
+	// ClaimedAt when it claimed it, in RFC 3339 format
+	ClaimedBy string `json:"claimed-by,omitempty"`
+	ClaimedAt string `json:"claimed-at,omitempty"`
+}
+
+// IssuanceLog is the org's record of issued node certificates, which
+// reconciling compares with the certificates nodes should have, and of the
+// certificates waiting to be issued.
+type IssuanceLog struct {
+	Issued  []*IssuedCert      `json:"issued"`
+	Pending []*PendingIssuance `json:"pending"`
+}
+
+func NewIssuanceLog() *IssuanceLog {
+	return &IssuanceLog{
+		Issued:  make([]*IssuedCert, 0),
+		Pending: make([]*PendingIssuance, 0),
+	}
+}
+
+func issuanceKey(nodeId, caId, profile string) string {
+	return nodeId + "/" + caId + "/" + profile
+}
+
+// Has reports whether the node has been issued a certificate by the CA with
+// the profile.
+func (log *IssuanceLog) Has(nodeId, caId, profile string) bool {
+	for _, issued := range log.Issued {
+		if issued.NodeId == nodeId && issued.CAId == caId && issued.Profile == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// Add records issued certificates, skipping any the log already has, and
+// removes them from the pending certificates.
+func (log *IssuanceLog) Add(issued ...*IssuedCert) {
+	done := make(map[string]bool)
+	for _, i := range issued {
+		done[issuanceKey(i.NodeId, i.CAId, i.Profile)] = true
+		if !log.Has(i.NodeId, i.CAId, i.Profile) {
+			log.Issued = append(log.Issued, i)
+		}
+	}
+
+	log.prunePending(func(p *PendingIssuance) bool {
+		return !done[issuanceKey(p.NodeId, p.CAId, p.Profile)]
+	})
+}
+
+// Defer records pending certificates. A certificate that's already pending
+// has its attempts counted and its reason updated.
+func (log *IssuanceLog) Defer(pending ...*PendingIssuance) {
+	for _, p := range pending {
+		found := false
+		for _, existing := range log.Pending {
+			if existing.NodeId == p.NodeId && existing.CAId == p.CAId && existing.Profile == p.Profile {
+				existing.Attempts++
+				existing.Reason = p.Reason
+				existing.ClaimedBy = ""
+				existing.ClaimedAt = ""
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			log.Pending = append(log.Pending, p)
+		}
+	}
+}
+
+// claimedByOther reports whether a run other than runId has a claim on the
+// certificate that hasn't expired at now.
+func (log *IssuanceLog) claimedByOther(nodeId, caId, profile, runId string, now time.Time) bool {
+	for _, p := range log.Pending {
+		if p.NodeId != nodeId || p.CAId != caId || p.Profile != profile {
+			continue
+		}
+
+		if p.ClaimedBy == "" || p.ClaimedBy == runId {
+			return false
+		}
+
+		claimedAt, err := time.Parse(time.RFC3339, p.ClaimedAt)
+		return err == nil && now.Before(claimedAt.Add(IssuanceClaimTimeout))
+	}
+	return false
+}
+
+// Claim records that the run runId is issuing the certificates, adding them
+// to the pending certificates if they aren't already.
+func (log *IssuanceLog) Claim(runId string, now time.Time, claims ...*PendingIssuance) {
+	for _, c := range claims {
+		var claimed *PendingIssuance
+		for _, existing := range log.Pending {
+			if existing.NodeId == c.NodeId && existing.CAId == c.CAId && existing.Profile == c.Profile {
+				claimed = existing
+				break
+			}
+		}
+
+		if claimed == nil {
+			claimed = c
+			// Not deferred yet, Defer counts the first attempt
+			claimed.Attempts = 0
+			log.Pending = append(log.Pending, claimed)
+		}
+
+		claimed.ClaimedBy = runId
+		claimed.ClaimedAt = now.UTC().Format(time.RFC3339)
+	}
+}
+
+// Release drops the run's remaining claims. Certificates that were only
+// pending because of the claim are removed.
+func (log *IssuanceLog) Release(runId string) {
+	log.prunePending(func(p *PendingIssuance) bool {
+		return p.ClaimedBy != runId || p.Attempts > 0
+	})
+
+	for _, p := range log.Pending {
+		if p.ClaimedBy == runId {
+			p.ClaimedBy = ""
+			p.ClaimedAt = ""
+		}
+	}
+}
+
+// prunePending keeps the pending certificates that keep returns true for.
+func (log *IssuanceLog) prunePending(keep func(*PendingIssuance) bool) {
+	pending := make([]*PendingIssuance, 0, len(log.Pending))
+	for _, p := range log.Pending {
+		if keep(p) {
+			pending = append(pending, p)
+		}
+	}
+	log.Pending = pending
+}
+
+func (iss *issuance) profileName() string {
+	if iss.profile == nil {
+		return ""
+	}
+	return iss.profile.Name
+}
+
+// issued returns the log entry for the issuance.
+func (iss *issuance) issued(nodeId, certId string) *IssuedCert {
+	return &IssuedCert{
+		NodeId:  nodeId,
+		CAId:    iss.caId,
+		Profile: iss.profileName(),
+		Tag:     iss.tag,
+		CertId:  certId,
+	}
+}
+
+// pending returns a pending record for the issuance, deferred at now.
+func (iss *issuance) pending(nodeId, reason string, now time.Time) *PendingIssuance {
+	return &PendingIssuance{
+		NodeId:   nodeId,
+		CAId:     iss.caId,
+		Profile:  iss.profileName(),
+		Tag:      iss.tag,
+		Reason:   reason,
+		Attempts: 1,
+		Since:    now.UTC().Format(time.RFC3339),
+	}
+}
+
+// csrPoolSize returns how many CSRs the node has for the org to sign.
+func (cont *OrgController) csrPoolSize(nodeId string) (int, error) {
+	var size int
+	err := cont.withAPI(func() error {
+		var err error
+		size, err = cont.env.api.OutgoingSize(nodeId, "csrs")
+		return err
+	})
+	if err != nil {
+		return 0, wrapError(err, "getting CSR queue size for node '%s'", nodeId)
+	}
+	return size, nil
+}
+
+// GetIssuanceLog returns the issuance log and its ETag. New orgs start with
+// an empty log. Orgs from before the log don't have one, and ErrNotFound is
+// returned until BootstrapIssuanceLog creates it, as reconciling with an empty
+// log would issue every node duplicates of the certificates it already has.
+func (cont *OrgController) GetIssuanceLog() (*IssuanceLog, string, error) {
+	logger.Debug("getting issuance log")
+
+	log := NewIssuanceLog()
+	etag, err := cont.GetDocument(IssuanceLogDocument, log)
+	if IsNotFound(err) {
+		return nil, "", newError(ErrNotFound, err, "getting issuance log, orgs from before the log must bootstrap it first")
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	logger.Trace("returning issuance log")
+	return log, etag, nil
+}
+
+// BootstrapIssuanceLog creates the issuance log for an org from before the
+// log. Those orgs don't record which certificates their nodes were issued, so
+// every certificate a node should have from its tags now is recorded as
+// issued, except those from the CAs in params.Reissue, e.g. CAs that gained
+// tags after nodes registered, which are left for reconciling to issue. It
+// returns how many certificates were recorded.
+func (cont *OrgController) BootstrapIssuanceLog(params *OrgParams) (int, error) {
+	logger.Debug("bootstrapping issuance log")
+	logger.Tracef("received params: %s", params)
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return 0, err
+	}
+
+	org := cont.env.controllers.org
+	if _, _, err := org.GetIssuanceLog(); err == nil {
+		return 0, newError(ErrAlreadyExists, nil, "issuance log for org '%s'", org.OrgId())
+	} else if !IsNotFound(err) {
+		return 0, err
+	}
+
+	orgIndex, err := org.GetIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	reissue := make(map[string]bool)
+	for _, name := range params.reissue() {
+		caId, err := orgIndex.GetCA(name)
+		if err != nil {
+			return 0, newError(ErrNotFound, err, "getting CA '%s' to reissue", name)
+		}
+		reissue[caId] = true
+	}
+
+	profileCont, _ := NewProfile(cont.env)
+	profiles, _, err := profileCont.GetProfiles()
+	if err != nil {
+		return 0, err
+	}
+
+	log := NewIssuanceLog()
+	for _, nodeId := range orgIndex.GetNodes() {
+		tags := orgIndex.Data.Body.Tags.EntityReverse[nodeId]
+		for _, iss := range issuancesFor(orgIndex, profiles, tags) {
+			if !reissue[iss.caId] {
+				// The certificate's ID isn't known
+				log.Add(iss.issued(nodeId, ""))
+			}
+		}
+	}
+
+	// Another bootstrap saving in the meantime records the same certificates
+	if err := org.SaveDocument(IssuanceLogDocument, log, ""); err != nil {
+		return 0, err
+	}
+
+	logger.Infof("bootstrapped issuance log with %d certificates", len(log.Issued))
+	return len(log.Issued), nil
+}
+
+// UpdateIssuanceLog applies update to the latest issuance log and saves it,
+// retrying if someone else saved it in the meantime.
+func (cont *OrgController) UpdateIssuanceLog(update func(*IssuanceLog) error) error {
+	logger.Debug("updating issuance log")
+
+	for attempt := 0; attempt < IndexUpdateAttempts; attempt++ {
+		log, etag, err := cont.GetIssuanceLog()
+		if err != nil {
+			return err
+		}
+
+		if err := update(log); err != nil {
+			return err
+		}
+
+		err = cont.SaveDocument(IssuanceLogDocument, log, etag)
+		if !IsConflict(err) {
+			return err
+		}
+
+		logger.Info("issuance log changed while updating, retrying")
+	}
+
+	return newError(ErrConflict, nil, "updating issuance log after %d attempts", IndexUpdateAttempts)
+}
+
+// Unsatisfied is a certificate a node should have that couldn't be issued.
+type Unsatisfied struct {
+	NodeName string
+	NodeId   string
+	CAId     string
+	Profile  string
+	Tag      string
+	Err      error
+}
+
+// ReconcileReport is the outcome of reconciling node certificates.
+// Certificates are deferred rather than unsatisfied when the node's CSR pool
+// is empty.
+type ReconcileReport struct {
+	Issued      []*IssuedCert
+	Deferred    []*PendingIssuance
+	Unsatisfied []*Unsatisfied
+}
+
+// ReconcileError is returned when some certificates couldn't be issued. The
+// others were issued and logged.
+type ReconcileError struct {
+	Unsatisfied []*Unsatisfied
+}
+
+func (e *ReconcileError) Error() string {
+	if len(e.Unsatisfied) == 0 {
+		return "no node certificates unsatisfied"
+	}
+	first := e.Unsatisfied[0]
+	return fmt.Sprintf("unable to issue %d node certificates, first for node '%s' from CA '%s': %s", len(e.Unsatisfied), first.NodeName, first.CAId, first.Err)
+}
+
+// Unwrap returns the error of the first unsatisfied certificate.
+func (e *ReconcileError) Unwrap() error {
+	if len(e.Unsatisfied) == 0 {
+		return nil
+	}
+	return e.Unsatisfied[0].Err
+}
+
+// issuanceClaims is the work a reconcile run has claimed.
+type issuanceClaims struct {
+	// work is the certificates to issue by node name
+	work map[string][]*issuance
+	// desired is the issuance keys of every certificate nodes should have
+	desired map[string]bool
+	// stale is whether the log has pending certificates that aren't desired
+	stale bool
+}
+
+// claimIssuances finds the certificates the nodes in the index should have
+// that haven't been issued or claimed by another run, and claims them for
+// runId in the issuance log, retrying if someone else saved the log in the
+// meantime.
+func (cont *OrgController) claimIssuances(orgIndex *index.OrgIndex, profiles *Profiles, runId string) (*issuanceClaims, error) {
+	logger.Debug("claiming certificates to issue")
+
+	nodeIds := orgIndex.GetNodes()
+	for attempt := 0; attempt < IndexUpdateAttempts; attempt++ {
+		log, etag, err := cont.GetIssuanceLog()
+		if err != nil {
+			return nil, err
+		}
+
+		now := cont.env.Now()
+		claims := &issuanceClaims{
+			work:    make(map[string][]*issuance),
+			desired: make(map[string]bool),
+		}
+		pending := make([]*PendingIssuance, 0)
+		for name, nodeId := range nodeIds {
+			tags := orgIndex.Data.Body.Tags.EntityReverse[nodeId]
+			for _, iss := range issuancesFor(orgIndex, profiles, tags) {
+				claims.desired[issuanceKey(nodeId, iss.caId, iss.profileName())] = true
+				if log.Has(nodeId, iss.caId, iss.profileName()) {
+					continue
+				}
+
+				if log.claimedByOther(nodeId, iss.caId, iss.profileName(), runId, now) {
+					logger.Debugf("certificate from CA '%s' to node '%s' is being issued by another run", iss.caId, name)
+					continue
+				}
+
+				claims.work[name] = append(claims.work[name], iss)
+				pending = append(pending, iss.pending(nodeId, "being issued", now))
+			}
+		}
+
+		for _, p := range log.Pending {
+			if !claims.desired[issuanceKey(p.NodeId, p.CAId, p.Profile)] {
+				claims.stale = true
+			}
+		}
+
+		if len(pending) == 0 {
+			return claims, nil
+		}
+
+		// Only a PrivateSwapper API makes this atomic
+		log.Claim(runId, now, pending...)
+		err = cont.SaveDocument(IssuanceLogDocument, log, etag)
+		if !IsConflict(err) {
+			return claims, err
+		}
+
+		logger.Info("issuance log changed while claiming, retrying")
+	}
+
+	return nil, newError(ErrConflict, nil, "claiming certificates to issue after %d attempts", IndexUpdateAttempts)
+}
+
+// Reconcile issues the certificates that registered nodes should have, from
+// their tags and the CAs' tags and profile bindings, but haven't been issued,
+// e.g. because a CA gained a tag after the nodes registered. Each is signed
+// from one of the node's outstanding CSRs. When a node's CSR pool is empty its
+// certificates are deferred and recorded as pending in the issuance log until
+// a later run. Certificates that can't be issued for other reasons are
+// reported in a *ReconcileError. The certificates a run issues are claimed in
+// the issuance log first, so runs in other processes don't issue them too.
+func (cont *OrgController) Reconcile() (*ReconcileReport, error) {
+	logger.Debug("reconciling node certificates")
+
+	orgIndex, err := cont.GetIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	profileCont, _ := NewProfile(cont.env)
+	profiles, _, err := profileCont.GetProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	runId := cont.env.NewID()
+	claims, err := cont.claimIssuances(orgIndex, profiles, runId)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeIds := orgIndex.GetNodes()
+	names := make([]string, 0, len(nodeIds))
+	for name := range nodeIds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nodeCont, _ := NewNode(cont.env)
+	report := &ReconcileReport{
+		Issued:      make([]*IssuedCert, 0),
+		Deferred:    make([]*PendingIssuance, 0),
+		Unsatisfied: make([]*Unsatisfied, 0),
+	}
+	certTags := make(map[string][]string)
+	for _, name := range names {
+		nodeId := nodeIds[name]
+		tags := orgIndex.Data.Body.Tags.EntityReverse[nodeId]
+
+		pending := claims.work[name]
+		if len(pending) == 0 {
+			continue
+		}
+
+		logger.Debugf("issuing %d certificates to node '%s'", len(pending), name)
+		unsatisfied := func(iss *issuance, err error) {
+			logger.Warnf("unable to issue certificate from CA '%s' to node '%s': %s", iss.caId, name, err)
+			report.Unsatisfied = append(report.Unsatisfied, &Unsatisfied{
+				NodeName: name,
+				NodeId:   nodeId,
+				CAId:     iss.caId,
+				Profile:  iss.profileName(),
+				Tag:      iss.tag,
+				Err:      err,
+			})
+		}
+
+		deferred := func(iss *issuance) {
+			logger.Infof("deferring certificate from CA '%s' to node '%s' until it has CSRs", iss.caId, name)
+			report.Deferred = append(report.Deferred, iss.pending(nodeId, ErrCSRPoolEmpty.Error(), cont.env.Now()))
+		}
+
+		available, err := cont.csrPoolSize(nodeId)
+		if err != nil {
+			for _, iss := range pending {
+				unsatisfied(iss, err)
+			}
+			continue
+		}
+
+		if available == 0 {
+			for _, iss := range pending {
+				deferred(iss)
+			}
+			continue
+		}
+
+		node, err := nodeCont.GetNodeById(nodeId)
+		if err != nil {
+			for _, iss := range pending {
+				unsatisfied(iss, err)
+			}
+			continue
+		}
+
+		data := NewProfileData(name, nodeId, tags)
+		for i, iss := range pending {
+			if i >= available {
+				deferred(iss)
+				continue
+			}
+
+			ca, err := cont.GetCA(iss.caId)
+			if err != nil {
+				unsatisfied(iss, err)
+				continue
+			}
+
+			cert, err := cont.signNodeCSR(node, ca, iss.tag, iss.profile, data, profiles.PoliciesFor(tags))
+			if errors.Is(err, ErrCSRPoolEmpty) {
+				deferred(iss)
+				continue
+			} else if err != nil {
+				unsatisfied(iss, err)
+				continue
+			}
+
+			certTags[cert.Data.Body.Id] = cert.Data.Body.Tags
+			report.Issued = append(report.Issued, iss.issued(nodeId, cert.Data.Body.Id))
+		}
+	}
+
+	if len(report.Issued) > 0 {
+		logger.Debug("saving issued certificates")
+		err := cont.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+			for certId, tags := range certTags {
+				if err := orgIndex.AddCertTags(certId, tags); err != nil {
+					return wrapError(err, "tagging certificate '%s'", certId)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			// The claims expire, after which the certificates are issued again
+			return report, err
+		}
+	}
+
+	if len(claims.work) > 0 || claims.stale {
+		logger.Debug("saving issuance log")
+		err := cont.UpdateIssuanceLog(func(log *IssuanceLog) error {
+			log.Add(report.Issued...)
+			log.Defer(report.Deferred...)
+			// Unsatisfied certificates are left for the next run
+			log.Release(runId)
+			// Drop pending certificates nodes shouldn't have any more
+			log.prunePending(func(p *PendingIssuance) bool {
+				return claims.desired[issuanceKey(p.NodeId, p.CAId, p.Profile)]
+			})
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if len(report.Unsatisfied) > 0 {
+		return report, &ReconcileError{Unsatisfied: report.Unsatisfied}
+	}
+
+	logger.Trace("returning reconcile report")
+	return report, nil
+}
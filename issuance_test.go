@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestIssuanceLog(t *testing.T) {
+	log := NewIssuanceLog()
+	assert.False(t, log.Has("node", "ca", ""))
+
+	log.Add(&IssuedCert{NodeId: "node", CAId: "ca", CertId: "1"})
+	log.Add(&IssuedCert{NodeId: "node", CAId: "ca", CertId: "2"})
+	log.Add(&IssuedCert{NodeId: "node", CAId: "ca", Profile: "server", CertId: "3"})
+
+	assert.Len(t, log.Issued, 2)
+	assert.Equal(t, "1", log.Issued[0].CertId)
+	assert.True(t, log.Has("node", "ca", ""))
+	assert.True(t, log.Has("node", "ca", "server"))
+	assert.False(t, log.Has("node", "ca", "client"))
+}
+
+func TestIssuanceIssued(t *testing.T) {
+	iss := &issuance{caId: "ca", tag: "web", profile: &CertProfile{Name: "server"}}
+	assert.Equal(t, &IssuedCert{NodeId: "node", CAId: "ca", Profile: "server", Tag: "web", CertId: "1"}, iss.issued("node", "1"))
+
+	iss = &issuance{caId: "ca", tag: "web"}
+	assert.Equal(t, "", iss.issued("node", "1").Profile)
+}
+
+func TestReconcileError(t *testing.T) {
+	err := &ReconcileError{Unsatisfied: []*Unsatisfied{{NodeName: "node1", CAId: "ca", Err: newError(ErrNotFound, nil, "popping CSR")}}}
+	assert.True(t, IsNotFound(err))
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Contains(t, err.Error(), "node1")
+}
+
+func TestIssuanceLogPending(t *testing.T) {
+	log := NewIssuanceLog()
+	iss := &issuance{caId: "ca", tag: "web"}
+
+	log.Defer(iss.pending("node", "CSR pool is empty", time.Now()))
+	log.Defer(iss.pending("node", "still empty", time.Now()))
+	assert.Len(t, log.Pending, 1)
+	assert.Equal(t, 2, log.Pending[0].Attempts)
+	assert.Equal(t, "still empty", log.Pending[0].Reason)
+
+	// Issuing the certificate clears it
+	log.Add(iss.issued("node", "1"))
+	assert.Len(t, log.Pending, 0)
+	assert.True(t, log.Has("node", "ca", ""))
+}
+
+func TestIssuanceLogClaims(t *testing.T) {
+	log := NewIssuanceLog()
+	iss := &issuance{caId: "ca", tag: "web"}
+	now := time.Now()
+
+	log.Claim("run1", now, iss.pending("node", "being issued", now))
+	assert.Len(t, log.Pending, 1)
+	assert.Equal(t, 0, log.Pending[0].Attempts)
+	assert.True(t, log.claimedByOther("node", "ca", "", "run2", now))
+	assert.False(t, log.claimedByOther("node", "ca", "", "run1", now))
+
+	// Claims expire
+	assert.False(t, log.claimedByOther("node", "ca", "", "run2", now.Add(IssuanceClaimTimeout+time.Second)))
+
+	// Releasing drops certificates that were only pending for the claim
+	log.Release("run1")
+	assert.Len(t, log.Pending, 0)
+
+	// Deferring keeps the certificate pending but drops the claim
+	log.Claim("run1", now, iss.pending("node", "being issued", now))
+	log.Defer(iss.pending("node", ErrCSRPoolEmpty.Error(), now))
+	log.Release("run1")
+	assert.Len(t, log.Pending, 1)
+	assert.Equal(t, 1, log.Pending[0].Attempts)
+	assert.False(t, log.claimedByOther("node", "ca", "", "run2", now))
+
+	// A pending certificate that's claimed and released stays pending
+	log.Claim("run2", now, iss.pending("node", "being issued", now))
+	log.Release("run2")
+	assert.Len(t, log.Pending, 1)
+	assert.Empty(t, log.Pending[0].ClaimedBy)
+}
@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/sha1"
+	stdx509 "crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	jksMagic   uint32 = 0xfeedfeed
+	jksVersion uint32 = 2
+	// jksPrivateKeyTag and jksTrustedCertTag mark the kinds of JKS entries
+	jksPrivateKeyTag  uint32 = 1
+	jksTrustedCertTag uint32 = 2
+	// jksWhitener is mixed into the JKS integrity hash
+	jksWhitener string = "Mighty Aphrodite"
+)
+
+// oidJKSKeyProtector is Sun's proprietary key protection algorithm, the only
+// one JKS key entries use.
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// jksProtectKey encrypts a PKCS #8 key with Sun's key protector: the key is
+// XORed with a chain of SHA-1 hashes of the password and a random salt, and
+// followed by a SHA-1 check of the password and key.
+func jksProtectKey(pkcs8 []byte, password []byte) ([]byte, error) {
+	salt, err := randomBytes(sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, len(pkcs8))
+	digest := salt
+	for i := 0; i < len(pkcs8); i += sha1.Size {
+		sum := sha1.Sum(append(append([]byte{}, password...), digest...))
+		digest = sum[:]
+		for j := 0; j < sha1.Size && i+j < len(pkcs8); j++ {
+			encrypted[i+j] = pkcs8[i+j] ^ digest[j]
+		}
+	}
+
+	check := sha1.Sum(append(append([]byte{}, password...), pkcs8...))
+
+	protected := append(append(salt, encrypted...), check[:]...)
+	return asn1.Marshal(pkcs12EncryptedPrivateKeyInfo{
+		Algorithm:     pkcs12AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1NULL},
+		EncryptedData: protected,
+	})
+}
+
+type jksWriter struct {
+	bytes.Buffer
+}
+
+func (w *jksWriter) uint32(n uint32) {
+	binary.Write(w, binary.BigEndian, n)
+}
+
+// utf writes s in Java's modified UTF-8 with a length prefix. Aliases and
+// certificate types are ASCII, for which it's plain UTF-8.
+func (w *jksWriter) utf(s string) {
+	binary.Write(w, binary.BigEndian, uint16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *jksWriter) certificate(cert *stdx509.Certificate) {
+	w.utf("X.509")
+	w.uint32(uint32(len(cert.Raw)))
+	w.Write(cert.Raw)
+}
+
+// EncodeJKS encodes a key, its certificate and the chain as a Java KeyStore,
+// with the key protected by the password and the store's integrity checked
+// with it. The key entry is under the alias. Without a key the certificates
+// are exported as trusted certificate entries, under the alias and the alias
+// with "-<n>" for the rest of the chain.
+func EncodeJKS(alias string, key stdcrypto.Signer, cert *stdx509.Certificate, chain []*stdx509.Certificate, password string, created time.Time) ([]byte, error) {
+	if password == "" {
+		return nil, newError(ErrInvalidParams, nil, "keystore password cannot be empty")
+	}
+
+	// JKS aliases are case insensitive and stored lower case
+	alias = strings.ToLower(alias)
+	// JKS hashes passwords as UTF-16 without a terminator
+	passwordBytes := bmpString(password, false)
+	timestamp := uint64(created.UnixNano() / int64(time.Millisecond))
+	certs := append([]*stdx509.Certificate{cert}, chain...)
+
+	w := new(jksWriter)
+	w.uint32(jksMagic)
+	w.uint32(jksVersion)
+
+	if key != nil {
+		pkcs8, err := stdx509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, wrapError(err, "encoding private key")
+		}
+
+		protected, err := jksProtectKey(pkcs8, passwordBytes)
+		if err != nil {
+			return nil, wrapError(err, "protecting private key")
+		}
+
+		w.uint32(1)
+		w.uint32(jksPrivateKeyTag)
+		w.utf(alias)
+		binary.Write(w, binary.BigEndian, timestamp)
+		w.uint32(uint32(len(protected)))
+		w.Write(protected)
+		w.uint32(uint32(len(certs)))
+		for _, c := range certs {
+			w.certificate(c)
+		}
+	} else {
+		w.uint32(uint32(len(certs)))
+		for i, c := range certs {
+			w.uint32(jksTrustedCertTag)
+			if i == 0 {
+				w.utf(alias)
+			} else {
+				w.utf(alias + "-" + strconv.Itoa(i))
+			}
+			binary.Write(w, binary.BigEndian, timestamp)
+			w.certificate(c)
+		}
+	}
+
+	hash := sha1.New()
+	hash.Write(passwordBytes)
+	hash.Write([]byte(jksWhitener))
+	hash.Write(w.Bytes())
+	w.Write(hash.Sum(nil))
+
+	return w.Bytes(), nil
+}
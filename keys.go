@@ -0,0 +1,425 @@
+package controller
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/pki-io/core/crypto"
+	"github.com/pki-io/core/x509"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// KeyTypeEd25519 is the key type of Ed25519 keys, which core's key types
+// don't include.
+const KeyTypeEd25519 crypto.KeyType = "ed25519"
+
+// Key specs name a key type and size, e.g. "rsa-4096", "ec-p256" or
+// "ed25519".
+const (
+	KeySpecRSA2048 string = "rsa-2048"
+	KeySpecRSA3072 string = "rsa-3072"
+	KeySpecRSA4096 string = "rsa-4096"
+	KeySpecP256    string = "ec-p256"
+	KeySpecP384    string = "ec-p384"
+	KeySpecP521    string = "ec-p521"
+	KeySpecEd25519 string = "ed25519"
+)
+
+var keySpecs = []string{
+	KeySpecRSA2048,
+	KeySpecRSA3072,
+	KeySpecRSA4096,
+	KeySpecP256,
+	KeySpecP384,
+	KeySpecP521,
+	KeySpecEd25519,
+}
+
+// ValidateKeySpec checks that a key spec is known.
+func ValidateKeySpec(spec string) error {
+	for _, s := range keySpecs {
+		if spec == s {
+			return nil
+		}
+	}
+	return newError(ErrInvalidParams, nil, "unknown key spec '%s', must be one of %s", spec, strings.Join(keySpecs, ", "))
+}
+
+// GenerateKey generates a private key to a key spec.
+func GenerateKey(spec string) (stdcrypto.Signer, error) {
+	switch spec {
+	case KeySpecRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeySpecRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeySpecRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeySpecP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeySpecP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeySpecP521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case KeySpecEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, ValidateKeySpec(spec)
+}
+
+// KeySpecOf returns the key spec of a public or private key.
+func KeySpecOf(key interface{}) (string, error) {
+	if signer, ok := key.(stdcrypto.Signer); ok {
+		key = signer.Public()
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa-%d", k.N.BitLen()), nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeySpecP256, nil
+		case elliptic.P384():
+			return KeySpecP384, nil
+		case elliptic.P521():
+			return KeySpecP521, nil
+		}
+		return "", newError(ErrInvalidParams, nil, "unsupported curve %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return KeySpecEd25519, nil
+	}
+	return "", newError(ErrInvalidParams, nil, "unsupported key type %T", key)
+}
+
+// defaultKeySpecs are the key specs of the keys core generates for its key
+// types.
+var defaultKeySpecs = map[string]string{
+	string(crypto.KeyTypeRSA): KeySpecRSA2048,
+	string(crypto.KeyTypeEC):  KeySpecP256,
+}
+
+// isCoreKeyType reports whether core generates keys of the key type itself.
+func isCoreKeyType(keyType string) bool {
+	return keyType == string(crypto.KeyTypeRSA) || keyType == string(crypto.KeyTypeEC)
+}
+
+// ValidateKeyType checks a key type param, which is one of core's key types,
+// "ed25519" or a key spec for a specific size or curve.
+func ValidateKeyType(keyType string) error {
+	if isCoreKeyType(keyType) || ValidateKeySpec(keyType) == nil {
+		return nil
+	}
+	return newError(ErrInvalidParams, nil, "unknown key type '%s', must be %s, %s or one of %s", keyType, crypto.KeyTypeRSA, crypto.KeyTypeEC, strings.Join(keySpecs, ", "))
+}
+
+// keySpecForType returns the key spec to generate keys of a key type param
+// with, or an empty string if core generates them.
+func keySpecForType(keyType string) string {
+	if isCoreKeyType(keyType) {
+		return ""
+	}
+	return keyType
+}
+
+// KeyTypeOfSpec returns the key type of a key spec.
+func KeyTypeOfSpec(spec string) crypto.KeyType {
+	switch {
+	case strings.HasPrefix(spec, "rsa-"):
+		return crypto.KeyTypeRSA
+	case strings.HasPrefix(spec, "ec-"):
+		return crypto.KeyTypeEC
+	}
+	return KeyTypeEd25519
+}
+
+// KeyTypeOf returns the key type of a public or private key. Unlike core's
+// GetKeyType it knows Ed25519 keys.
+func KeyTypeOf(key interface{}) (crypto.KeyType, error) {
+	spec, err := KeySpecOf(key)
+	if err != nil {
+		return "", err
+	}
+	return KeyTypeOfSpec(spec), nil
+}
+
+// PemDecodePrivateKey decodes a PEM encoded PKCS #1, SEC 1 or PKCS #8
+// private key.
+func PemDecodePrivateKey(in []byte) (stdcrypto.Signer, error) {
+	block, _ := pem.Decode(in)
+	if block == nil {
+		return nil, newError(ErrInvalidParams, nil, "no PEM data found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return stdx509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return stdx509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := stdx509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, ok := key.(stdcrypto.Signer)
+		if !ok {
+			return nil, newError(ErrInvalidParams, nil, "unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	return nil, newError(ErrInvalidParams, nil, "unsupported PEM block type '%s'", block.Type)
+}
+
+// PemEncodePrivateKey encodes a private key as PEM. RSA and EC keys use their
+// traditional formats, which core decodes, and other keys use PKCS #8.
+func PemEncodePrivateKey(key stdcrypto.Signer) (string, error) {
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: stdx509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		der, err := stdx509.MarshalECPrivateKey(k)
+		if err != nil {
+			return "", err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		der, err := stdx509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return "", wrapError(err, "encoding private key")
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// CSRRequest is what a node asks for in the CSRs it generates.
+type CSRRequest struct {
+	KeySpec     string
+	Subject     pkix.Name
+	DNSNames    []string
+	IPAddresses []string
+}
+
+// GenerateCSR generates a key and a PEM encoded CSR for it, returning the CSR,
+// the PEM encoded key and the key type.
+func GenerateCSR(req *CSRRequest) (string, string, crypto.KeyType, error) {
+	key, err := GenerateKey(req.KeySpec)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	template := &stdx509.CertificateRequest{
+		Subject:  req.Subject,
+		DNSNames: req.DNSNames,
+	}
+
+	for _, addr := range req.IPAddresses {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return "", "", "", newError(ErrInvalidParams, nil, "IP address '%s' is invalid", addr)
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+
+	der, err := stdx509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return "", "", "", wrapError(err, "creating CSR")
+	}
+
+	keyPem, err := PemEncodePrivateKey(key)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	csrPem := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	return csrPem, keyPem, KeyTypeOfSpec(req.KeySpec), nil
+}
+
+// caSubject returns the subject fields of the CA's DN scope, without a
+// common name.
+func caSubject(ca *x509.CA) pkix.Name {
+	dn := ca.Data.Body.DNScope
+	return pkix.Name{
+		Country:            nonEmpty(dn.Country),
+		Organization:       nonEmpty(dn.Organization),
+		OrganizationalUnit: nonEmpty(dn.OrganizationalUnit),
+		Locality:           nonEmpty(dn.Locality),
+		Province:           nonEmpty(dn.Province),
+		StreetAddress:      nonEmpty(dn.StreetAddress),
+		PostalCode:         nonEmpty(dn.PostalCode),
+	}
+}
+
+// caSigner returns the CA's certificate and private key, which may be held
+// by an external signer.
+func caSigner(ca *x509.CA) (*stdx509.Certificate, stdcrypto.Signer, error) {
+	caCert, err := x509.PemDecodeX509Certificate([]byte(ca.Data.Body.Certificate))
+	if err != nil {
+		return nil, nil, wrapError(err, "decoding certificate for CA '%s'", ca.Data.Body.Id)
+	}
+
+	if ca.Data.Body.PrivateKey == "" {
+		return nil, nil, newError(ErrInvalidParams, nil, "CA '%s' has no private key", ca.Data.Body.Id)
+	}
+
+	caKey, err := decodeStoredKey(ca.Data.Body.PrivateKey)
+	if err != nil {
+		return nil, nil, wrapError(err, "loading private key for CA '%s'", ca.Data.Body.Id)
+	}
+
+	return caCert, caKey, nil
+}
+
+// issueCertificate gives the template a random serial number, signs it with
+// the parent's key and returns it PEM encoded.
+func issueCertificate(template, parent *stdx509.Certificate, pub interface{}, signer stdcrypto.Signer) (string, error) {
+	var err error
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", wrapError(err, "generating serial number")
+	}
+
+	der, err := stdx509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return "", wrapError(err, "creating certificate")
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+// GenerateRootCA generates a key to the key spec and a self-signed
+// certificate for the CA from its name, DN scope and CA expiry, for keys core
+// can't generate.
+func GenerateRootCA(ca *x509.CA, spec string, now time.Time) error {
+	logger.Debugf("generating root CA with key spec '%s'", spec)
+	key, err := GenerateKey(spec)
+	if err != nil {
+		return err
+	}
+
+	keyPem, err := PemEncodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := selfSignCA(ca, key, now); err != nil {
+		return err
+	}
+
+	ca.Data.Body.PrivateKey = keyPem
+	return nil
+}
+
+// GenerateRootCAWithKeyRef self-signs a certificate for the CA with a key
+// held by an external signer, which the CA keeps a reference to.
+func GenerateRootCAWithKeyRef(ca *x509.CA, ref string, now time.Time) error {
+	logger.Debug("generating root CA with key reference")
+	signer, err := OpenKeyRef(ref)
+	if err != nil {
+		return err
+	}
+
+	if err := selfSignCA(ca, signer, now); err != nil {
+		return err
+	}
+
+	ca.Data.Body.PrivateKey = ref
+	return nil
+}
+
+// selfSignCA gives the CA a self-signed certificate for the key from its
+// name, DN scope and CA expiry.
+func selfSignCA(ca *x509.CA, key stdcrypto.Signer, now time.Time) error {
+	keyType, err := KeyTypeOf(key.Public())
+	if err != nil {
+		return err
+	}
+
+	subject := caSubject(ca)
+	subject.CommonName = ca.Data.Body.Name
+
+	template := &stdx509.Certificate{
+		Subject:               subject,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.AddDate(0, 0, ca.Data.Body.CAExpiry),
+		KeyUsage:              stdx509.KeyUsageCertSign | stdx509.KeyUsageCRLSign | stdx509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	certPem, err := issueCertificate(template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+
+	ca.Data.Body.Certificate = certPem
+	ca.Data.Body.KeyType = string(keyType)
+	return nil
+}
+
+// GenerateCertificate generates a key to the key spec and a certificate for
+// it with the subject and the certificate's expiry, signed by the CA or
+// self-signed if the CA is nil, for keys core can't generate.
+func GenerateCertificate(cert *x509.Certificate, ca *x509.CA, spec string, subject pkix.Name, now time.Time) error {
+	logger.Debugf("generating certificate with key spec '%s'", spec)
+	key, err := GenerateKey(spec)
+	if err != nil {
+		return err
+	}
+
+	keyType := KeyTypeOfSpec(spec)
+	template := &stdx509.Certificate{
+		Subject:               subject,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.AddDate(0, 0, cert.Data.Body.Expiry),
+		KeyUsage:              stdx509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth, stdx509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	if keyType == crypto.KeyTypeRSA {
+		template.KeyUsage |= stdx509.KeyUsageKeyEncipherment
+	}
+
+	parent, signer := template, stdcrypto.Signer(key)
+	if ca != nil {
+		parent, signer, err = caSigner(ca)
+		if err != nil {
+			return err
+		}
+		cert.Data.Body.CACertificate = ca.Data.Body.Certificate
+	}
+
+	certPem, err := issueCertificate(template, parent, key.Public(), signer)
+	if err != nil {
+		return err
+	}
+
+	keyPem, err := PemEncodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	cert.Data.Body.Certificate = certPem
+	cert.Data.Body.PrivateKey = keyPem
+	cert.Data.Body.KeyType = string(keyType)
+	return nil
+}
+
+// signCSR signs the CSR with the CA's defaults, which are the default
+// profile's.
+func signCSR(ca *x509.CA, csr *x509.CSR, keepSubject bool, now time.Time) (*x509.Certificate, error) {
+	return signRequest(ca, csr, &CertProfile{Name: DefaultProfileName}, NewProfileData(csr.Data.Body.Name, csr.Data.Body.Id, nil), keepSubject, now)
+}
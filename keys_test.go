@@ -0,0 +1,144 @@
+package controller
+
+import (
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/pki-io/core/crypto"
+	"github.com/pki-io/core/x509"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestKeySpecs(t *testing.T) {
+	for _, spec := range []string{KeySpecRSA2048, KeySpecP256, KeySpecP384, KeySpecP521, KeySpecEd25519} {
+		key, err := GenerateKey(spec)
+		assert.NoError(t, err, spec)
+
+		got, err := KeySpecOf(key)
+		assert.NoError(t, err)
+		assert.Equal(t, spec, got)
+
+		got, err = KeySpecOf(key.Public())
+		assert.NoError(t, err)
+		assert.Equal(t, spec, got)
+	}
+
+	_, err := GenerateKey("dsa-1024")
+	assert.True(t, IsInvalidParams(err))
+	assert.True(t, IsInvalidParams(ValidateKeySpec("ec-p224")))
+}
+
+func TestGenerateCSR(t *testing.T) {
+	req := &CSRRequest{
+		KeySpec:     KeySpecP256,
+		Subject:     pkix.Name{CommonName: "node1", Organization: []string{"org"}},
+		DNSNames:    []string{"node1.example.com"},
+		IPAddresses: []string{"10.0.0.1"},
+	}
+
+	csrPem, keyPem, keyType, err := GenerateCSR(req)
+	assert.NoError(t, err)
+	assert.Equal(t, crypto.KeyTypeEC, keyType)
+
+	block, _ := pem.Decode([]byte(csrPem))
+	request, err := stdx509.ParseCertificateRequest(block.Bytes)
+	assert.NoError(t, err)
+	assert.NoError(t, request.CheckSignature())
+	assert.Equal(t, "node1", request.Subject.CommonName)
+	assert.Equal(t, []string{"node1.example.com"}, request.DNSNames)
+	assert.Equal(t, "10.0.0.1", request.IPAddresses[0].String())
+
+	block, _ = pem.Decode([]byte(keyPem))
+	assert.Equal(t, "EC PRIVATE KEY", block.Type)
+
+	req.IPAddresses = []string{"10.0.0"}
+	_, _, _, err = GenerateCSR(req)
+	assert.True(t, IsInvalidParams(err))
+}
+
+func TestValidateKeyType(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ec", "ed25519", "ec-p384", "ec-p521", "rsa-4096"} {
+		assert.NoError(t, ValidateKeyType(keyType), keyType)
+	}
+	assert.True(t, IsInvalidParams(ValidateKeyType("dsa")))
+
+	params := newTestCAParams("ca")
+	params.KeyType = stringPtr("")
+	assert.True(t, IsInvalidParams(params.ValidateKeyType(true)))
+	assert.NoError(t, params.ValidateKeyType(false))
+}
+
+func TestPemDecodePrivateKey(t *testing.T) {
+	for _, spec := range []string{KeySpecRSA2048, KeySpecP384, KeySpecEd25519} {
+		key, _ := GenerateKey(spec)
+		keyPem, err := PemEncodePrivateKey(key)
+		assert.NoError(t, err)
+
+		decoded, err := PemDecodePrivateKey([]byte(keyPem))
+		assert.NoError(t, err)
+		got, _ := KeySpecOf(decoded)
+		assert.Equal(t, spec, got)
+	}
+
+	_, err := PemDecodePrivateKey([]byte("not a key"))
+	assert.True(t, IsInvalidParams(err))
+}
+
+func TestKeyTypesRoundTrip(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	for _, keyType := range []string{"ed25519", "ec-p384", "ec-p521"} {
+		caCont, _ := NewCA(backends.env(home))
+		caParams := newTestCAParams("ca-" + keyType)
+		caParams.KeyType = stringPtr(keyType)
+		ca, err := caCont.New(caParams)
+		if !assert.NoError(t, err, keyType) {
+			continue
+		}
+
+		caCont, _ = NewCA(backends.env(home))
+		ca, err = caCont.GetCA(ca.Data.Body.Id)
+		assert.NoError(t, err)
+		assert.Equal(t, string(KeyTypeOfSpec(keyType)), ca.Data.Body.KeyType)
+
+		key, err := PemDecodePrivateKey([]byte(ca.Data.Body.PrivateKey))
+		assert.NoError(t, err)
+		spec, _ := KeySpecOf(key)
+		assert.Equal(t, keyType, spec)
+
+		caCert, err := x509.PemDecodeX509Certificate([]byte(ca.Data.Body.Certificate))
+		assert.NoError(t, err)
+		assert.True(t, caCert.IsCA)
+
+		csrCont, _ := NewCSR(backends.env(home))
+		csrParams := newTestCSRParams("csr-" + keyType)
+		csrParams.KeyType = stringPtr(keyType)
+		_, err = csrCont.New(csrParams)
+		assert.NoError(t, err)
+
+		csrParams.Ca = stringPtr("ca-" + keyType)
+		csrCont, _ = NewCSR(backends.env(home))
+		cert, err := csrCont.Sign(csrParams)
+		if !assert.NoError(t, err, keyType) {
+			continue
+		}
+
+		leaf, err := x509.PemDecodeX509Certificate([]byte(cert.Data.Body.Certificate))
+		assert.NoError(t, err)
+		assert.NoError(t, leaf.CheckSignatureFrom(caCert))
+		spec, _ = KeySpecOf(leaf.PublicKey)
+		assert.Equal(t, keyType, spec)
+
+		certCont, _ := NewCertificate(backends.env(home))
+		certParams := newTestCertificateParams("cert-" + keyType)
+		certParams.KeyType = stringPtr(keyType)
+		certParams.Ca = stringPtr("ca-" + keyType)
+		cert, _, err = certCont.New(certParams)
+		assert.NoError(t, err, keyType)
+
+		leaf, err = x509.PemDecodeX509Certificate([]byte(cert.Data.Body.Certificate))
+		assert.NoError(t, err)
+		assert.NoError(t, leaf.CheckSignatureFrom(caCert))
+	}
+}
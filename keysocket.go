@@ -0,0 +1,170 @@
+package controller
+
+import (
+	stdcrypto "crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	stdx509 "crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// KeySocketTimeout is how long a key socket request may take.
+const KeySocketTimeout time.Duration = 30 * time.Second
+
+// Key sockets serve one JSON request per connection, asking for a key's
+// public key or a signature of a digest.
+const (
+	keySocketPublic string = "public"
+	keySocketSign   string = "sign"
+)
+
+type keySocketRequest struct {
+	Op     string `json:"op"`
+	Id     string `json:"id"`
+	Hash   uint   `json:"hash,omitempty"`
+	Digest []byte `json:"digest,omitempty"`
+}
+
+type keySocketResponse struct {
+	// Public is the PKIX DER public key
+	Public    []byte `json:"public,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// socketSigner signs with a key held by a KeyAgent, referenced as
+// "socket:<path>?id=<id>".
+type socketSigner struct {
+	path   string
+	id     string
+	public stdcrypto.PublicKey
+}
+
+func openSocketKey(ref *KeyRef) (stdcrypto.Signer, error) {
+	if ref.Path == "" {
+		return nil, newError(ErrInvalidParams, nil, "socket key reference needs a socket path")
+	}
+
+	signer := &socketSigner{path: ref.Path, id: ref.Attrs["id"]}
+	response, err := signer.call(&keySocketRequest{Op: keySocketPublic, Id: signer.id})
+	if err != nil {
+		return nil, err
+	}
+
+	signer.public, err = stdx509.ParsePKIXPublicKey(response.Public)
+	if err != nil {
+		return nil, wrapError(err, "parsing public key '%s' from key socket", signer.id)
+	}
+	return signer, nil
+}
+
+func (signer *socketSigner) call(request *keySocketRequest) (*keySocketResponse, error) {
+	conn, err := net.DialTimeout("unix", signer.path, KeySocketTimeout)
+	if err != nil {
+		return nil, wrapError(err, "connecting to key socket '%s'", signer.path)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(KeySocketTimeout))
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, wrapError(err, "sending to key socket '%s'", signer.path)
+	}
+
+	response := new(keySocketResponse)
+	if err := json.NewDecoder(conn).Decode(response); err != nil {
+		return nil, wrapError(err, "reading from key socket '%s'", signer.path)
+	}
+
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+func (signer *socketSigner) Public() stdcrypto.PublicKey {
+	return signer.public
+}
+
+func (signer *socketSigner) Sign(rand io.Reader, digest []byte, opts stdcrypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, newError(ErrNotImplemented, nil, "RSA-PSS signatures over a key socket")
+	}
+
+	request := &keySocketRequest{Op: keySocketSign, Id: signer.id, Hash: uint(opts.HashFunc()), Digest: digest}
+	response, err := signer.call(request)
+	if err != nil {
+		return nil, err
+	}
+	return response.Signature, nil
+}
+
+// KeyAgent serves keys to the socket key provider, as ssh-agent does, so
+// the processes signing with them never hold them.
+type KeyAgent struct {
+	// Keys returns the key with an id
+	Keys func(id string) (stdcrypto.Signer, error)
+}
+
+// NewKeyAgent returns an agent serving the keys in a soft token.
+func NewKeyAgent(token *SoftToken) *KeyAgent {
+	return &KeyAgent{Keys: token.Signer}
+}
+
+// Serve handles connections until the listener is closed.
+func (agent *KeyAgent) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go agent.handle(conn)
+	}
+}
+
+func (agent *KeyAgent) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(KeySocketTimeout))
+
+	request := new(keySocketRequest)
+	if err := json.NewDecoder(conn).Decode(request); err != nil {
+		logger.Warnf("unable to read key socket request: %s", err)
+		return
+	}
+
+	response, err := agent.respond(request)
+	if err != nil {
+		response = &keySocketResponse{Error: err.Error()}
+	}
+
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		logger.Warnf("unable to send key socket response: %s", err)
+	}
+}
+
+func (agent *KeyAgent) respond(request *keySocketRequest) (*keySocketResponse, error) {
+	key, err := agent.Keys(request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch request.Op {
+	case keySocketPublic:
+		der, err := stdx509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		return &keySocketResponse{Public: der}, nil
+	case keySocketSign:
+		logger.Debugf("signing with key '%s' for key socket", request.Id)
+		signature, err := key.Sign(rand.Reader, request.Digest, stdcrypto.Hash(request.Hash))
+		if err != nil {
+			return nil, err
+		}
+		return &keySocketResponse{Signature: signature}, nil
+	}
+	return nil, newError(ErrInvalidParams, nil, "unknown key socket operation '%s'", request.Op)
+}
@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// ListOptions filter and page the entries of a list. The zero value lists
+// everything.
+type ListOptions struct {
+	// Name is a shell pattern that entry names must match
+	Name string
+	// Tags that entries must all match, see Tag.Matches
+	Tags []string
+	// Offset is how many matching entries to skip
+	Offset int
+	// Limit is the most entries to return, or 0 for no limit
+	Limit int
+	// IndexOnly returns entries from the index without loading documents
+	IndexOnly bool
+}
+
+// NewListOptions builds list options from params fields, any of which can be
+// nil.
+func NewListOptions(name, tags *string, offset, limit *int, indexOnly *bool) (*ListOptions, error) {
+	opts := new(ListOptions)
+
+	if name != nil {
+		if _, err := path.Match(*name, ""); err != nil {
+			return nil, newError(ErrInvalidParams, err, "name pattern '%s'", *name)
+		}
+		opts.Name = *name
+	}
+
+	if tags != nil {
+		for _, tag := range ParseTags(*tags) {
+			if tag != "" {
+				opts.Tags = append(opts.Tags, tag)
+			}
+		}
+	}
+
+	if offset != nil {
+		if *offset < 0 {
+			return nil, newError(ErrInvalidParams, nil, "offset cannot be negative")
+		}
+		opts.Offset = *offset
+	}
+
+	if limit != nil {
+		if *limit < 0 {
+			return nil, newError(ErrInvalidParams, nil, "limit cannot be negative")
+		}
+		opts.Limit = *limit
+	}
+
+	if indexOnly != nil {
+		opts.IndexOnly = *indexOnly
+	}
+
+	return opts, nil
+}
+
+// ListEntry is an item in a list, from the index. Err is set if the item's
+// document couldn't be loaded.
+type ListEntry struct {
+	Name string
+	Id   string
+	Tags []string
+	Err  error
+}
+
+// ListError is returned with partial results when some items in a list
+// couldn't be loaded.
+type ListError struct {
+	Failed []*ListEntry
+}
+
+func (e *ListError) Error() string {
+	if len(e.Failed) == 0 {
+		return "no list items failed"
+	}
+	return fmt.Sprintf("unable to load %d list items, first '%s': %s", len(e.Failed), e.Failed[0].Name, e.Failed[0].Err)
+}
+
+// Unwrap returns the error of the first item that failed.
+func (e *ListError) Unwrap() error {
+	if len(e.Failed) == 0 {
+		return nil
+	}
+	return e.Failed[0].Err
+}
+
+// listError returns a *ListError for the failed entries, or nil if there
+// aren't any.
+func listError(entries []*ListEntry) error {
+	failed := make([]*ListEntry, 0)
+	for _, entry := range entries {
+		if entry.Err != nil {
+			logger.Warnf("unable to load '%s': %s", entry.Name, entry.Err)
+			failed = append(failed, entry)
+		}
+	}
+
+	if len(failed) > 0 {
+		return &ListError{Failed: failed}
+	}
+	return nil
+}
+
+func hasTags(tags, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, tag := range tags {
+			if MatchTag(r, tag) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// listIndex returns the entries matching opts from an index name to ID map
+// and ID to tags map, sorted by name.
+func listIndex(ids map[string]string, tags map[string][]string, opts *ListOptions) []*ListEntry {
+	names := make([]string, 0, len(ids))
+	for name := range ids {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]*ListEntry, 0)
+	skipped := 0
+	for _, name := range names {
+		if opts.Name != "" {
+			if matched, _ := path.Match(opts.Name, name); !matched {
+				continue
+			}
+		}
+
+		id := ids[name]
+		if !hasTags(tags[id], opts.Tags) {
+			continue
+		}
+
+		if skipped < opts.Offset {
+			skipped++
+			continue
+		}
+
+		if opts.Limit > 0 && len(entries) == opts.Limit {
+			break
+		}
+
+		entries = append(entries, &ListEntry{Name: name, Id: id, Tags: tags[id]})
+	}
+
+	return entries
+}
@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestListIndex(t *testing.T) {
+	ids := map[string]string{"web1": "1", "web2": "2", "db1": "3", "web3": "4"}
+	tags := map[string][]string{"1": {"web", "prod"}, "2": {"web"}, "3": {"db", "prod"}, "4": {"web", "prod"}}
+
+	entries := listIndex(ids, tags, &ListOptions{})
+	assert.Len(t, entries, 4)
+	assert.Equal(t, "db1", entries[0].Name)
+
+	entries = listIndex(ids, tags, &ListOptions{Name: "web*", Tags: []string{"prod"}})
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "web1", entries[0].Name)
+	assert.Equal(t, "web3", entries[1].Name)
+
+	entries = listIndex(ids, tags, &ListOptions{Name: "web*", Offset: 1, Limit: 1})
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "web2", entries[0].Name)
+	assert.Equal(t, "2", entries[0].Id)
+}
+
+func TestNewListOptions(t *testing.T) {
+	opts, err := NewListOptions(nil, nil, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &ListOptions{}, opts)
+
+	opts, err = NewListOptions(stringPtr("web*"), stringPtr("a,b"), intPtr(2), intPtr(5), boolPtr(true))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, opts.Tags)
+	assert.True(t, opts.IndexOnly)
+
+	_, err = NewListOptions(stringPtr("[web"), nil, nil, nil, nil)
+	assert.True(t, IsInvalidParams(err))
+
+	_, err = NewListOptions(nil, nil, intPtr(-1), nil, nil)
+	assert.True(t, IsInvalidParams(err))
+}
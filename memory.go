@@ -0,0 +1,223 @@
+package controller
+
+import (
+	"github.com/pki-io/core/api"
+	"path"
+	"sync"
+)
+
+// MemoryAPI is an api.Apier that keeps all documents and queues in memory.
+// It's used by the tests and by services that embed the controllers without
+// a shared file system.
+type MemoryAPI struct {
+	lock     sync.Mutex
+	public   map[string]map[string]string
+	private  map[string]map[string]string
+	incoming map[string]map[string][]string
+	outgoing map[string]map[string][]string
+}
+
+var _ api.Apier = (*MemoryAPI)(nil)
+var _ PrivateSwapper = (*MemoryAPI)(nil)
+
+func NewMemoryAPI() *MemoryAPI {
+	m := new(MemoryAPI)
+	m.public = make(map[string]map[string]string)
+	m.private = make(map[string]map[string]string)
+	m.incoming = make(map[string]map[string][]string)
+	m.outgoing = make(map[string]map[string][]string)
+	return m
+}
+
+func (m *MemoryAPI) Connect() error      { return nil }
+func (m *MemoryAPI) Authenticate() error { return nil }
+
+func (m *MemoryAPI) SendPublic(dstId, name, content string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return sendDocument(m.public, dstId, name, content)
+}
+
+func (m *MemoryAPI) GetPublic(dstId, name string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return getDocument(m.public, dstId, name)
+}
+
+func (m *MemoryAPI) SendPrivate(dstId, name, content string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return sendDocument(m.private, dstId, name, content)
+}
+
+func (m *MemoryAPI) GetPrivate(dstId, name string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return getDocument(m.private, dstId, name)
+}
+
+func (m *MemoryAPI) SwapPrivate(dstId, name, content, etag string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	current, err := getDocument(m.private, dstId, name)
+	if err != nil {
+		return err
+	}
+
+	if ETag(current) != etag {
+		return newError(ErrConflict, nil, "private document '%s/%s' has changed", dstId, name)
+	}
+	return sendDocument(m.private, dstId, name, content)
+}
+
+func (m *MemoryAPI) DeletePrivate(dstId, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.private[dstId][name]; !ok {
+		return newError(ErrNotFound, nil, "private document '%s/%s'", dstId, name)
+	}
+	delete(m.private[dstId], name)
+	return nil
+}
+
+func (m *MemoryAPI) PushIncoming(dstId, queue, content string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return pushQueue(m.incoming, dstId, queue, content)
+}
+
+func (m *MemoryAPI) PopIncoming(dstId, queue string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return popQueue(m.incoming, dstId, queue)
+}
+
+func (m *MemoryAPI) PushOutgoing(dstId, queue, content string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return pushQueue(m.outgoing, dstId, queue, content)
+}
+
+func (m *MemoryAPI) PopOutgoing(dstId, queue string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return popQueue(m.outgoing, dstId, queue)
+}
+
+func (m *MemoryAPI) IncomingSize(dstId, queue string) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.incoming[dstId][queue]), nil
+}
+
+func (m *MemoryAPI) OutgoingSize(dstId, queue string) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.outgoing[dstId][queue]), nil
+}
+
+func sendDocument(docs map[string]map[string]string, dstId, name, content string) error {
+	if _, ok := docs[dstId]; !ok {
+		docs[dstId] = make(map[string]string)
+	}
+	docs[dstId][name] = content
+	return nil
+}
+
+func getDocument(docs map[string]map[string]string, dstId, name string) (string, error) {
+	content, ok := docs[dstId][name]
+	if !ok {
+		return "", newError(ErrNotFound, nil, "document '%s/%s'", dstId, name)
+	}
+	return content, nil
+}
+
+func pushQueue(queues map[string]map[string][]string, dstId, queue, content string) error {
+	if _, ok := queues[dstId]; !ok {
+		queues[dstId] = make(map[string][]string)
+	}
+	queues[dstId][queue] = append(queues[dstId][queue], content)
+	return nil
+}
+
+func popQueue(queues map[string]map[string][]string, dstId, queue string) (string, error) {
+	items := queues[dstId][queue]
+	if len(items) == 0 {
+		return "", newError(ErrNotFound, nil, "queue '%s/%s' is empty", dstId, queue)
+	}
+	queues[dstId][queue] = items[1:]
+	return items[0], nil
+}
+
+// MemoryFs is an in-memory LocalFs and HomeFs.
+type MemoryFs struct {
+	lock  sync.Mutex
+	cwd   string
+	dirs  map[string]bool
+	files map[string]string
+}
+
+var _ LocalFs = (*MemoryFs)(nil)
+var _ HomeFs = (*MemoryFs)(nil)
+
+func NewMemoryFs() *MemoryFs {
+	m := new(MemoryFs)
+	m.cwd = "/"
+	m.dirs = map[string]bool{"/": true}
+	m.files = make(map[string]string)
+	return m
+}
+
+func (m *MemoryFs) path(name string) string {
+	return path.Join(m.cwd, name)
+}
+
+func (m *MemoryFs) Exists(name string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p := m.path(name)
+	_, isFile := m.files[p]
+	return isFile || m.dirs[p], nil
+}
+
+func (m *MemoryFs) Read(name string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	content, ok := m.files[m.path(name)]
+	if !ok {
+		return "", newError(ErrNotFound, nil, "file '%s'", name)
+	}
+	return content, nil
+}
+
+func (m *MemoryFs) Write(name, content string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.files[m.path(name)] = content
+	return nil
+}
+
+func (m *MemoryFs) CreateDirectory(dir string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.dirs[m.path(dir)] = true
+	return nil
+}
+
+func (m *MemoryFs) ChangeToDirectory(dir string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p := m.path(dir)
+	if !m.dirs[p] {
+		return newError(ErrNotFound, nil, "directory '%s'", dir)
+	}
+	m.cwd = p
+	return nil
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMemoryAPIDocuments(t *testing.T) {
+	m := NewMemoryAPI()
+
+	_, err := m.GetPrivate("org", "doc")
+	assert.True(t, IsNotFound(err))
+
+	assert.NoError(t, m.SendPrivate("org", "doc", "content"))
+	content, err := m.GetPrivate("org", "doc")
+	assert.NoError(t, err)
+	assert.Equal(t, "content", content)
+
+	assert.NoError(t, m.DeletePrivate("org", "doc"))
+	_, err = m.GetPrivate("org", "doc")
+	assert.True(t, IsNotFound(err))
+
+	assert.NoError(t, m.SendPublic("admin", "admin", "public"))
+	content, err = m.GetPublic("admin", "admin")
+	assert.NoError(t, err)
+	assert.Equal(t, "public", content)
+}
+
+func TestMemoryAPISwapPrivate(t *testing.T) {
+	m := NewMemoryAPI()
+	assert.NoError(t, m.SendPrivate("org", "index", "v1"))
+
+	assert.NoError(t, m.SwapPrivate("org", "index", "v2", ETag("v1")))
+	err := m.SwapPrivate("org", "index", "v3", ETag("v1"))
+	assert.True(t, IsConflict(err))
+
+	content, _ := m.GetPrivate("org", "index")
+	assert.Equal(t, "v2", content)
+}
+
+func TestMemoryAPIQueues(t *testing.T) {
+	m := NewMemoryAPI()
+
+	assert.NoError(t, m.PushIncoming("org", "registration", "first"))
+	assert.NoError(t, m.PushIncoming("org", "registration", "second"))
+	size, _ := m.IncomingSize("org", "registration")
+	assert.Equal(t, 2, size)
+
+	item, err := m.PopIncoming("org", "registration")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", item)
+
+	assert.NoError(t, m.PushOutgoing("node", "csrs", "csr"))
+	item, err = m.PopOutgoing("node", "csrs")
+	assert.NoError(t, err)
+	assert.Equal(t, "csr", item)
+
+	_, err = m.PopOutgoing("node", "csrs")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestMemoryFs(t *testing.T) {
+	m := NewMemoryFs()
+
+	assert.NoError(t, m.CreateDirectory("org"))
+	assert.NoError(t, m.ChangeToDirectory("org"))
+	assert.NoError(t, m.Write("org.conf", "config"))
+
+	exists, _ := m.Exists("org.conf")
+	assert.True(t, exists)
+
+	content, err := m.Read("org.conf")
+	assert.NoError(t, err)
+	assert.Equal(t, "config", content)
+
+	err = m.ChangeToDirectory("missing")
+	assert.True(t, IsNotFound(err))
+}
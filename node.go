@@ -3,7 +3,6 @@ package controller
 import (
 	"bytes"
 	"crypto/x509/pkix"
-	"fmt"
 	"github.com/pki-io/core/config"
 	"github.com/pki-io/core/document"
 	"github.com/pki-io/core/index"
@@ -17,7 +16,8 @@ import (
 
 const (
 	NodeConfigFile string = "node.conf"
-	MinCSRs        int    = 5
+	// MinCSRs is the default CSR pool size, see NodeSettings
+	MinCSRs int = 5
 )
 
 type NodeController struct {
@@ -39,7 +39,7 @@ func (cont *NodeController) CreateNode(name string) (*node.Node, error) {
 	}
 
 	node.Data.Body.Name = name
-	node.Data.Body.Id = x509.NewID()
+	node.Data.Body.Id = cont.env.NewID()
 
 	logger.Debug("Generating node keys")
 	if err := node.GenerateKeys(); err != nil {
@@ -65,7 +65,7 @@ func (cont *NodeController) SecureSendStringToOrg(json, id, key string) error {
 
 	logger.Debug("pushing container to org with id '%s'", org.Id())
 	if err := cont.env.api.PushIncoming(org.Id(), "registration", container.Dump()); err != nil {
-		return err
+		return wrapError(err, "pushing registration to org '%s'", org.Id())
 	}
 
 	logger.Trace("returning nil error")
@@ -80,7 +80,7 @@ func (cont *NodeController) CreateIndex() (*index.NodeIndex, error) {
 		return nil, err
 	}
 
-	index.Data.Body.Id = x509.NewID()
+	index.Data.Body.Id = cont.env.NewID()
 	logger.Debugf("created index with id '%s'", index.Id())
 
 	logger.Trace("returning index")
@@ -100,7 +100,7 @@ func (cont *NodeController) SaveIndex(index *index.NodeIndex) error {
 
 	logger.Debug("sending index")
 	if err := cont.env.api.SendPrivate(cont.node.Id(), index.Data.Body.Id, encryptedIndexContainer.Dump()); err != nil {
-		return err
+		return wrapError(err, "sending node index '%s'", index.Data.Body.Id)
 	}
 
 	logger.Trace("returning nil error")
@@ -163,8 +163,6 @@ func (cont *NodeController) GetNode(name string) (*node.Node, error) {
 	logger.Debug("getting node")
 	logger.Tracef("received name '%s'", name)
 
-	org := cont.env.controllers.org.org
-
 	index, err := cont.env.controllers.org.GetIndex()
 	if err != nil {
 		return nil, err
@@ -172,31 +170,45 @@ func (cont *NodeController) GetNode(name string) (*node.Node, error) {
 
 	nodeId, err := index.GetNode(name)
 	if err != nil {
-		return nil, err
+		return nil, newError(ErrNotFound, err, "getting node '%s'", name)
 	}
 
+	return cont.GetNodeById(nodeId)
+}
+
+func (cont *NodeController) GetNodeById(nodeId string) (*node.Node, error) {
+	logger.Debug("getting node by id")
+	logger.Tracef("received id '%s'", nodeId)
+
+	org := cont.env.controllers.org.org
+
 	logger.Debugf("getting node '%s' from org", nodeId)
 	nodeContainerJson, err := cont.env.api.GetPrivate(org.Id(), nodeId)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "getting node '%s'", nodeId)
 	}
 
 	logger.Debug("creating new node container")
 	nodeContainer, err := document.NewContainer(nodeContainerJson)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "loading node container '%s'", nodeId)
+	}
+
+	logger.Debug("verifying node container")
+	if err := org.Verify(nodeContainer); err != nil {
+		return nil, newError(ErrVerificationFailed, err, "verifying node '%s'", nodeId)
 	}
 
-	logger.Debug("verifying and decrypting node container")
-	nodeJson, err := org.VerifyThenDecrypt(nodeContainer)
+	logger.Debug("decrypting node container")
+	nodeJson, err := org.Decrypt(nodeContainer)
 	if err != nil {
-		return nil, err
+		return nil, newError(ErrDecryptionFailed, err, "decrypting node '%s'", nodeId)
 	}
 
 	logger.Debug("creating new node struct")
 	n, err := node.New(nodeJson)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err, "loading node '%s'", nodeId)
 	}
 
 	logger.Trace("returning node")
@@ -221,52 +233,57 @@ func (cont *NodeController) ProcessNextCert() error {
 	logger.Debug("getting next incoming certificate JSON")
 	certContainerJson, err := cont.env.api.PopIncoming(cont.node.Data.Body.Id, "certs")
 	if err != nil {
-		return err
+		return wrapError(err, "popping certificate for node '%s'", cont.node.Id())
 	}
 
 	logger.Debug("creating certificate container from JSON")
 	certContainer, err := document.NewContainer(certContainerJson)
 	if err != nil {
-		return err
+		return wrapError(err, "loading certificate container for node '%s'", cont.node.Id())
 	}
 
 	logger.Debug("verifying container is signed by org")
 	if err := cont.env.controllers.org.org.Verify(certContainer); err != nil {
-		return err
+		return newError(ErrVerificationFailed, err, "verifying certificate for node '%s'", cont.node.Id())
 	}
 
 	logger.Debug("creating new certificate struct")
 	cert, err := x509.NewCertificate(certContainer.Data.Body)
 	if err != nil {
-		return err
+		return wrapError(err, "loading certificate for node '%s'", cont.node.Id())
 	}
 
 	logger.Debugf("getting matching CSR for id '%s'", cert.Data.Body.Id)
 	csrContainerJson, err := cont.env.api.GetPrivate(cont.node.Data.Body.Id, cert.Data.Body.Id)
 	if err != nil {
-		return err
+		return newError(ErrNotFound, err, "getting CSR '%s' for node '%s'", cert.Data.Body.Id, cont.node.Id())
 	}
 
 	logger.Debug("creating CSR container")
 	csrContainer, err := document.NewContainer(csrContainerJson)
 	if err != nil {
-		return err
+		return wrapError(err, "loading CSR container '%s'", cert.Data.Body.Id)
 	}
 
-	logger.Debug("verifying and decryping CSR container")
-	csrJson, err := cont.node.VerifyThenDecrypt(csrContainer)
+	logger.Debug("verifying CSR container")
+	if err := cont.node.Verify(csrContainer); err != nil {
+		return newError(ErrVerificationFailed, err, "verifying CSR '%s'", cert.Data.Body.Id)
+	}
+
+	logger.Debug("decrypting CSR container")
+	csrJson, err := cont.node.Decrypt(csrContainer)
 	if err != nil {
-		return err
+		return newError(ErrDecryptionFailed, err, "decrypting CSR '%s'", cert.Data.Body.Id)
 	}
 
 	logger.Debug("creating CSR struct from JSON")
 	csr, err := x509.NewCSR(csrJson)
 	if err != nil {
-		return err
+		return wrapError(err, "loading CSR '%s'", cert.Data.Body.Id)
 	}
 
 	logger.Debug("setting new ID for certificate")
-	cert.Data.Body.Id = x509.NewID()
+	cert.Data.Body.Id = cont.env.NewID()
 
 	logger.Debug("setting certificate private key from CSR")
 	cert.Data.Body.PrivateKey = csr.Data.Body.PrivateKey
@@ -279,7 +296,7 @@ func (cont *NodeController) ProcessNextCert() error {
 
 	logger.Debug("saving encrypted certificate for node")
 	if err := cont.env.api.SendPrivate(cont.node.Data.Body.Id, cert.Data.Body.Id, updatedCertContainer.Dump()); err != nil {
-		return err
+		return wrapError(err, "saving certificate '%s' for node '%s'", cert.Data.Body.Id, cont.node.Id())
 	}
 
 	logger.Trace("returning nil error")
@@ -293,7 +310,7 @@ func (cont *NodeController) ProcessCerts() error {
 		logger.Debug("getting number of incoming certificates")
 		size, err := cont.env.api.IncomingSize(cont.node.Data.Body.Id, "certs")
 		if err != nil {
-			return err
+			return wrapError(err, "getting certificate queue size for node '%s'", cont.node.Id())
 		}
 		logger.Debugf("found %d certificates to process", size)
 
@@ -310,17 +327,79 @@ func (cont *NodeController) ProcessCerts() error {
 	return nil
 }
 
+// SaveSettings saves the settings given in params, if any, for the named node.
+func (cont *NodeController) SaveSettings(name string, params *NodeParams) error {
+	if params.CSRPoolSize == nil && params.KeySpec == nil && !params.subjectSet() && params.DNSNames == nil && params.IPAddresses == nil {
+		return nil
+	}
+
+	logger.Debug("saving node settings")
+	settings, err := LoadNodeSettings(cont.env.fs.local, name)
+	if err != nil {
+		return err
+	}
+
+	if params.CSRPoolSize != nil {
+		settings.CSRPoolSize = *params.CSRPoolSize
+	}
+
+	if params.KeySpec != nil {
+		settings.KeySpec = *params.KeySpec
+	}
+
+	if params.subjectSet() {
+		subject := new(NodeSubject)
+		if settings.Subject != nil {
+			*subject = *settings.Subject
+		}
+
+		setField := func(field *string, value *string) {
+			if value != nil {
+				*field = *value
+			}
+		}
+		setField(&subject.Locality, params.DnLocality)
+		setField(&subject.Province, params.DnState)
+		setField(&subject.Organization, params.DnOrg)
+		setField(&subject.OrganizationalUnit, params.DnOrgUnit)
+		setField(&subject.Country, params.DnCountry)
+		setField(&subject.StreetAddress, params.DnStreet)
+		setField(&subject.PostalCode, params.DnPostal)
+		settings.Subject = subject
+	}
+
+	if params.DNSNames != nil {
+		settings.DNSNames = splitList(*params.DNSNames)
+	}
+
+	if params.IPAddresses != nil {
+		settings.IPAddresses = splitList(*params.IPAddresses)
+	}
+
+	if err := SaveNodeSettings(cont.env.fs.local, name, settings); err != nil {
+		return wrapError(err, "saving settings for node '%s'", name)
+	}
+
+	return nil
+}
+
 func (cont *NodeController) CreateCSRs() error {
 	logger.Debug("creating CSRs")
 
 	logger.Debug("getting number of outgoing CSRs")
 	numCSRs, err := cont.env.api.OutgoingSize(cont.node.Data.Body.Id, "csrs")
 	if err != nil {
-		return err
+		return wrapError(err, "getting CSR queue size for node '%s'", cont.node.Id())
 	}
 	logger.Debugf("found '%d' CSRs", numCSRs)
 
-	for i := 0; i < MinCSRs-numCSRs; i++ {
+	settings, err := LoadNodeSettings(cont.env.fs.local, cont.node.Data.Body.Name)
+	if err != nil {
+		return err
+	}
+
+	logger.Debugf("filling CSR pool of size '%d'", settings.CSRPoolSize)
+	for i := 0; i < settings.CSRPoolSize-numCSRs; i++ {
 		if err := cont.NewCSR(); err != nil {
 			return err
 		}
@@ -338,10 +417,31 @@ func (cont *NodeController) NewCSR() error {
 		return err
 	}
 
-	csr.Data.Body.Id = x509.NewID()
+	csr.Data.Body.Id = cont.env.NewID()
 	csr.Data.Body.Name = cont.node.Data.Body.Name
-	subject := pkix.Name{CommonName: csr.Data.Body.Name}
-	csr.Generate(&subject)
+
+	settings, err := LoadNodeSettings(cont.env.fs.local, cont.node.Data.Body.Name)
+	if err != nil {
+		return err
+	}
+
+	if settings.CustomCSRs() {
+		req := settings.CSRRequest(csr.Data.Body.Name)
+		logger.Debugf("generating CSR with key spec '%s'", req.KeySpec)
+		csrPem, keyPem, keyType, err := GenerateCSR(req)
+		if err != nil {
+			return wrapError(err, "generating CSR for node '%s'", cont.node.Id())
+		}
+
+		csr.Data.Body.CSR = csrPem
+		csr.Data.Body.PrivateKey = keyPem
+		csr.Data.Body.KeyType = string(keyType)
+	} else {
+		subject := pkix.Name{CommonName: csr.Data.Body.Name}
+		if err := csr.Generate(&subject); err != nil {
+			return wrapError(err, "generating CSR for node '%s'", cont.node.Id())
+		}
+	}
 
 	logger.Debug("creating encrypted CSR container")
 	csrContainer, err := cont.node.EncryptThenSignString(csr.Dump(), nil)
@@ -351,7 +451,7 @@ func (cont *NodeController) NewCSR() error {
 
 	logger.Debug("saving node CSR")
 	if err := cont.env.api.SendPrivate(cont.node.Data.Body.Id, csr.Data.Body.Id, csrContainer.Dump()); err != nil {
-		return err
+		return wrapError(err, "saving CSR '%s' for node '%s'", csr.Data.Body.Id, cont.node.Id())
 	}
 
 	logger.Debug("getting public CSR")
@@ -368,7 +468,7 @@ func (cont *NodeController) NewCSR() error {
 
 	logger.Debug("putting public CSR in outgoing queue")
 	if err := cont.env.api.PushOutgoing(cont.node.Data.Body.Id, "csrs", csrPublicContainer.Dump()); err != nil {
-		return err
+		return wrapError(err, "pushing CSR '%s' for node '%s'", csr.Data.Body.Id, cont.node.Id())
 	}
 
 	logger.Trace("returning nil error")
@@ -387,6 +487,18 @@ func (cont *NodeController) Init(params *NodeParams) (*document.Container, error
 		return nil, err
 	}
 
+	if err := params.ValidateCSRPoolSize(false); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateKeySpec(false); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateIPAddresses(false); err != nil {
+		return nil, err
+	}
+
 	if err := cont.env.LoadLocalFs(); err != nil {
 		return nil, err
 	}
@@ -402,7 +514,7 @@ func (cont *NodeController) Init(params *NodeParams) (*document.Container, error
 	}
 
 	if exists {
-		return nil, fmt.Errorf("org directory '%s' already exists", *params.OrgId)
+		return nil, newError(ErrAlreadyExists, nil, "org directory '%s'", *params.OrgId)
 	}
 
 	if err := cont.LoadConfig(); err != nil {
@@ -410,7 +522,7 @@ func (cont *NodeController) Init(params *NodeParams) (*document.Container, error
 	}
 
 	if cont.config.OrgExists(*params.OrgId) {
-		return nil, fmt.Errorf("org already exists: %s", *params.OrgId)
+		return nil, newError(ErrAlreadyExists, nil, "org '%s'", *params.OrgId)
 	}
 
 	logger.Debugf("creating org directory '%s'", *params.OrgId)
@@ -448,6 +560,10 @@ func (cont *NodeController) Init(params *NodeParams) (*document.Container, error
 		return nil, err
 	}
 
+	if err := cont.SaveSettings(*params.Name, params); err != nil {
+		return nil, err
+	}
+
 	if err := cont.CreateCSRs(); err != nil {
 		return nil, err
 	}
@@ -562,6 +678,22 @@ func (cont *NodeController) New(params *NodeParams) (*node.Node, error) {
 			return nil, err
 		}
 
+		if err := params.ValidateCSRPoolSize(false); err != nil {
+			return nil, err
+		}
+
+		if err := params.ValidateKeySpec(false); err != nil {
+			return nil, err
+		}
+
+		if err := params.ValidateIPAddresses(false); err != nil {
+			return nil, err
+		}
+
+		if err := cont.SaveSettings(*params.Name, params); err != nil {
+			return nil, err
+		}
+
 		return cont.CreateLocalNode(*params.Name, *params.PairingId, *params.PairingKey)
 	} else {
 
@@ -592,6 +724,18 @@ func (cont *NodeController) Run(params *NodeParams) error {
 		return err
 	}
 
+	if err := params.ValidateCSRPoolSize(false); err != nil {
+		return err
+	}
+
+	if err := params.ValidateKeySpec(false); err != nil {
+		return err
+	}
+
+	if err := params.ValidateIPAddresses(false); err != nil {
+		return err
+	}
+
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return err
 	}
@@ -605,6 +749,15 @@ func (cont *NodeController) Run(params *NodeParams) error {
 		return err
 	}
 
+	if err := cont.SaveSettings(*params.Name, params); err != nil {
+		return err
+	}
+
+	// Refill the pool the org signed from
+	if err := cont.CreateCSRs(); err != nil {
+		return err
+	}
+
 	logger.Trace("returning nil error")
 	return nil
 }
@@ -612,12 +765,27 @@ func (cont *NodeController) Run(params *NodeParams) error {
 func (cont *NodeController) Cert(params *NodeParams) error {
 	logger.Debug("getting certificates for node")
 	logger.Tracef("received params: %s", params)
-	return fmt.Errorf("not implemented")
+	return newError(ErrNotImplemented, nil, "getting certificates for node")
 }
 
-func (cont *NodeController) List(params *NodeParams) ([]*node.Node, error) {
-	logger.Debug("listing nodes")
-	logger.Tracef("received params: %s", params)
+// NodeListEntry is a node in a list. Node is nil when listing the index only
+// or if the node couldn't be loaded, in which case Err is set.
+type NodeListEntry struct {
+	*ListEntry
+	Node *node.Node
+}
+
+// ListEntries lists the nodes whose names match the name pattern and that have
+// all the tags in params. Items that can't be loaded are returned with their
+// error rather than failing the list.
+func (cont *NodeController) ListEntries(params *NodeParams) ([]*NodeListEntry, error) {
+	logger.Debug("listing nodes entries")
+	logger.Trace("received params [NOT LOGGED]")
+
+	opts, err := NewListOptions(params.Name, params.Tags, params.Offset, params.Limit, params.IndexOnly)
+	if err != nil {
+		return nil, err
+	}
 
 	if err := cont.env.LoadAdminEnv(); err != nil {
 		return nil, err
@@ -628,17 +796,41 @@ func (cont *NodeController) List(params *NodeParams) ([]*node.Node, error) {
 		return nil, err
 	}
 
+	entries := make([]*NodeListEntry, 0)
+	for _, entry := range listIndex(index.GetNodes(), index.Data.Body.Tags.EntityReverse, opts) {
+		nodeEntry := &NodeListEntry{ListEntry: entry}
+		if !opts.IndexOnly {
+			nodeEntry.Node, entry.Err = cont.GetNodeById(entry.Id)
+		}
+		entries = append(entries, nodeEntry)
+	}
+
+	logger.Trace("returning nodes entries")
+	return entries, nil
+}
+
+// List returns the nodes that could be loaded. If some couldn't, they're
+// reported with a *ListError.
+func (cont *NodeController) List(params *NodeParams) ([]*node.Node, error) {
+	logger.Debug("listing nodes")
+	logger.Trace("received params [NOT LOGGED]")
+
+	entries, err := cont.ListEntries(params)
+	if err != nil {
+		return nil, err
+	}
+
 	nodes := make([]*node.Node, 0)
-	for name, _ := range index.GetNodes() {
-		node, err := cont.GetNode(name)
-		if err != nil {
-			return nil, err
+	listEntries := make([]*ListEntry, 0)
+	for _, entry := range entries {
+		listEntries = append(listEntries, entry.ListEntry)
+		if entry.Node != nil {
+			nodes = append(nodes, entry.Node)
 		}
-		nodes = append(nodes, node)
 	}
 
-	logger.Trace("returning nodes")
-	return nodes, nil
+	logger.Trace("returning nodes list")
+	return nodes, listError(listEntries)
 }
 
 func (cont *NodeController) Show(params *NodeParams) (*node.Node, error) {
@@ -666,5 +858,5 @@ func (cont *NodeController) Show(params *NodeParams) (*node.Node, error) {
 func (cont *NodeController) Delete(params *NodeParams) error {
 	logger.Debug("deleting node")
 	logger.Tracef("received params: %s", params)
-	return fmt.Errorf("Not implemented")
+	return newError(ErrNotImplemented, nil, "deleting node")
 }
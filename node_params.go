@@ -1,9 +1,5 @@
 package controller
 
-import (
-	"fmt"
-)
-
 type NodeParams struct {
 	Name          *string
 	Host          *string
@@ -17,6 +13,27 @@ type NodeParams struct {
 	ConfirmDelete *string
 	Export        *string
 	Private       *bool
+	// CSRPoolSize is how many CSRs the node keeps for the org to sign
+	CSRPoolSize *int
+	// KeySpec is the key type and size of the node's CSRs, see GenerateKey
+	KeySpec *string
+	// The Dn fields are the subject of the node's CSRs besides the common
+	// name, which is always the node name
+	DnLocality *string
+	DnState    *string
+	DnOrg      *string
+	DnOrgUnit  *string
+	DnCountry  *string
+	DnStreet   *string
+	DnPostal   *string
+	// DNSNames and IPAddresses are comma separated SANs to request in the
+	// node's CSRs, which the org only grants if its key policy allows them
+	DNSNames    *string
+	IPAddresses *string
+	// Offset, Limit and IndexOnly apply to listing
+	Offset    *int
+	Limit     *int
+	IndexOnly *bool
 }
 
 func NewNodeParams() *NodeParams {
@@ -25,14 +42,17 @@ func NewNodeParams() *NodeParams {
 
 func (params *NodeParams) ValidateName(required bool) error {
 	if required && *params.Name == "" {
-		return fmt.Errorf("name cannot be empty")
+		return newError(ErrInvalidParams, nil, "name cannot be empty")
 	}
 	return nil
 }
 
-func (params *NodeParams) ValidateHost(required bool) error          { return nil }
-func (params *NodeParams) ValidateOrgId(required bool) error         { return nil }
-func (params *NodeParams) ValidateTags(required bool) error          { return nil }
+func (params *NodeParams) ValidateHost(required bool) error  { return nil }
+func (params *NodeParams) ValidateOrgId(required bool) error { return nil }
+func (params *NodeParams) ValidateTags(required bool) error {
+	return validateTagsParam(params.Tags, required)
+}
+
 func (params *NodeParams) ValidateConfirmDelete(required bool) error { return nil }
 func (params *NodeParams) ValidateExport(required bool) error        { return nil }
 func (params *NodeParams) ValidatePrivate(required bool) error       { return nil }
@@ -41,3 +61,51 @@ func (params *NodeParams) ValidatePairingKey(required bool) error    { return ni
 func (params *NodeParams) ValidateAgentFile(required bool) error     { return nil }
 func (params *NodeParams) ValidateInstallFile(required bool) error   { return nil }
 func (params *NodeParams) ValidateSSHOptions(required bool) error    { return nil }
+func (params *NodeParams) ValidateDnLocality(required bool) error    { return nil }
+func (params *NodeParams) ValidateDnState(required bool) error       { return nil }
+func (params *NodeParams) ValidateDnOrg(required bool) error         { return nil }
+func (params *NodeParams) ValidateDnOrgUnit(required bool) error     { return nil }
+func (params *NodeParams) ValidateDnCountry(required bool) error     { return nil }
+func (params *NodeParams) ValidateDnStreet(required bool) error      { return nil }
+func (params *NodeParams) ValidateDnPostal(required bool) error      { return nil }
+func (params *NodeParams) ValidateDNSNames(required bool) error      { return nil }
+
+func (params *NodeParams) ValidateCSRPoolSize(required bool) error {
+	if params.CSRPoolSize == nil {
+		if required {
+			return newError(ErrInvalidParams, nil, "CSR pool size must be set")
+		}
+		return nil
+	}
+	return (&NodeSettings{CSRPoolSize: *params.CSRPoolSize}).Validate()
+}
+
+func (params *NodeParams) ValidateKeySpec(required bool) error {
+	if params.KeySpec == nil || *params.KeySpec == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "key spec cannot be empty")
+		}
+		return nil
+	}
+	return ValidateKeySpec(*params.KeySpec)
+}
+
+func (params *NodeParams) ValidateIPAddresses(required bool) error {
+	if params.IPAddresses == nil || *params.IPAddresses == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "IP addresses cannot be empty")
+		}
+		return nil
+	}
+	return (&NodeSettings{CSRPoolSize: MinCSRs, IPAddresses: splitList(*params.IPAddresses)}).Validate()
+}
+
+// subjectSet reports whether any of the subject fields are set.
+func (params *NodeParams) subjectSet() bool {
+	for _, field := range []*string{params.DnLocality, params.DnState, params.DnOrg, params.DnOrgUnit, params.DnCountry, params.DnStreet, params.DnPostal} {
+		if field != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package controller
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net"
+)
+
+const (
+	NodeSettingsFile string = "node-settings.conf"
+	// MaxCSRPoolSize limits how many CSRs a node keeps in its pool
+	MaxCSRPoolSize int = 100
+)
+
+// NodeSettings are a node's local settings that aren't part of the node
+// config. The node config is core's config.NodeConfig, which only keeps the
+// fields core knows about and is rewritten by core, so the settings live in
+// their own file next to it. They're set with NodeParams.
+type NodeSettings struct {
+	// CSRPoolSize is how many pre-generated CSRs the node keeps in its
+	// outgoing queue for the org to sign. A node needs one for each
+	// certificate it's issued.
+	CSRPoolSize int `json:"csr-pool-size"`
+	// KeySpec is the key type and size for CSRs, see GenerateKey. If it's
+	// empty, CSRs use core's default key type.
+	KeySpec string `json:"key-spec"`
+	// Subject fields for CSRs. The common name is always the node name.
+	Subject *NodeSubject `json:"subject"`
+	// DNSNames and IPAddresses are SANs to request in CSRs, which the org
+	// only grants if its key policy allows them
+	DNSNames    []string `json:"dns-names"`
+	IPAddresses []string `json:"ip-addresses"`
+}
+
+// NodeSubject holds the subject fields of a node's CSRs.
+type NodeSubject struct {
+	Organization       string `json:"organization"`
+	OrganizationalUnit string `json:"organizational-unit"`
+	Country            string `json:"country"`
+	Province           string `json:"province"`
+	Locality           string `json:"locality"`
+	StreetAddress      string `json:"street-address"`
+	PostalCode         string `json:"postal-code"`
+}
+
+// nodeSettingsFile holds the default settings for nodes in the local fs and
+// the settings of each node by name. Fields that are zero aren't set.
+type nodeSettingsFile struct {
+	Defaults *NodeSettings            `json:"defaults"`
+	Nodes    map[string]*NodeSettings `json:"nodes"`
+}
+
+func DefaultNodeSettings() *NodeSettings {
+	return &NodeSettings{CSRPoolSize: MinCSRs}
+}
+
+// Validate checks the settings.
+func (settings *NodeSettings) Validate() error {
+	if settings.CSRPoolSize < 1 || settings.CSRPoolSize > MaxCSRPoolSize {
+		return newError(ErrInvalidParams, nil, "CSR pool size must be between 1 and %d", MaxCSRPoolSize)
+	}
+
+	if settings.KeySpec != "" {
+		if err := ValidateKeySpec(settings.KeySpec); err != nil {
+			return err
+		}
+	}
+
+	for _, addr := range settings.IPAddresses {
+		if net.ParseIP(addr) == nil {
+			return newError(ErrInvalidParams, nil, "IP address '%s' is invalid", addr)
+		}
+	}
+	return nil
+}
+
+// CustomCSRs reports whether the settings change the CSRs core would
+// generate.
+func (settings *NodeSettings) CustomCSRs() bool {
+	return settings.KeySpec != "" || settings.Subject != nil || len(settings.DNSNames) > 0 || len(settings.IPAddresses) > 0
+}
+
+// CSRRequest returns the request for the named node's CSRs. Without a key
+// spec, CSRs use RSA 2048 keys like core's default.
+func (settings *NodeSettings) CSRRequest(name string) *CSRRequest {
+	req := &CSRRequest{
+		KeySpec:     settings.KeySpec,
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    settings.DNSNames,
+		IPAddresses: settings.IPAddresses,
+	}
+
+	if req.KeySpec == "" {
+		req.KeySpec = KeySpecRSA2048
+	}
+
+	if s := settings.Subject; s != nil {
+		req.Subject.Organization = nonEmpty(s.Organization)
+		req.Subject.OrganizationalUnit = nonEmpty(s.OrganizationalUnit)
+		req.Subject.Country = nonEmpty(s.Country)
+		req.Subject.Province = nonEmpty(s.Province)
+		req.Subject.Locality = nonEmpty(s.Locality)
+		req.Subject.StreetAddress = nonEmpty(s.StreetAddress)
+		req.Subject.PostalCode = nonEmpty(s.PostalCode)
+	}
+
+	return req
+}
+
+// merge sets the fields of settings that are set in other.
+func (settings *NodeSettings) merge(other *NodeSettings) {
+	if other == nil {
+		return
+	}
+
+	if other.CSRPoolSize != 0 {
+		settings.CSRPoolSize = other.CSRPoolSize
+	}
+
+	if other.KeySpec != "" {
+		settings.KeySpec = other.KeySpec
+	}
+
+	if other.Subject != nil {
+		settings.Subject = other.Subject
+	}
+
+	if other.DNSNames != nil {
+		settings.DNSNames = other.DNSNames
+	}
+
+	if other.IPAddresses != nil {
+		settings.IPAddresses = other.IPAddresses
+	}
+}
+
+func readNodeSettingsFile(local LocalFs) (*nodeSettingsFile, error) {
+	file := &nodeSettingsFile{Nodes: make(map[string]*NodeSettings)}
+
+	exists, err := local.Exists(NodeSettingsFile)
+	if err != nil {
+		return nil, wrapError(err, "checking for node settings")
+	}
+
+	if exists {
+		content, err := local.Read(NodeSettingsFile)
+		if err != nil {
+			return nil, wrapError(err, "reading node settings")
+		}
+
+		if err := json.Unmarshal([]byte(content), file); err != nil {
+			return nil, newError(ErrInvalidParams, err, "parsing node settings")
+		}
+
+		if file.Nodes == nil {
+			file.Nodes = make(map[string]*NodeSettings)
+		}
+	}
+
+	return file, nil
+}
+
+// LoadNodeSettings returns the settings for the named node from the local fs,
+// applied over the defaults in the file and DefaultNodeSettings.
+func LoadNodeSettings(local LocalFs, name string) (*NodeSettings, error) {
+	file, err := readNodeSettingsFile(local)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := DefaultNodeSettings()
+	settings.merge(file.Defaults)
+	settings.merge(file.Nodes[name])
+
+	if err := settings.Validate(); err != nil {
+		return nil, wrapError(err, "loading settings for node '%s'", name)
+	}
+
+	return settings, nil
+}
+
+// SaveNodeSettings saves the settings for the named node to the local fs.
+func SaveNodeSettings(local LocalFs, name string, settings *NodeSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	file, err := readNodeSettingsFile(local)
+	if err != nil {
+		return err
+	}
+
+	file.Nodes[name] = settings
+
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return wrapError(err, "dumping node settings")
+	}
+
+	if err := local.Write(NodeSettingsFile, string(content)); err != nil {
+		return wrapError(err, "writing node settings")
+	}
+
+	return nil
+}
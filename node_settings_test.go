@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNodeSettings(t *testing.T) {
+	local := NewMemoryFs()
+
+	settings, err := LoadNodeSettings(local, "node1")
+	assert.NoError(t, err)
+	assert.Equal(t, MinCSRs, settings.CSRPoolSize)
+
+	assert.NoError(t, SaveNodeSettings(local, "node1", &NodeSettings{CSRPoolSize: 20}))
+	settings, err = LoadNodeSettings(local, "node1")
+	assert.NoError(t, err)
+	assert.Equal(t, 20, settings.CSRPoolSize)
+
+	// Other nodes keep the defaults
+	settings, err = LoadNodeSettings(local, "node2")
+	assert.NoError(t, err)
+	assert.Equal(t, MinCSRs, settings.CSRPoolSize)
+
+	assert.NoError(t, local.Write(NodeSettingsFile, `{"defaults": {"csr-pool-size": 8}, "nodes": {"node1": {"csr-pool-size": 20}}}`))
+	settings, _ = LoadNodeSettings(local, "node2")
+	assert.Equal(t, 8, settings.CSRPoolSize)
+	settings, _ = LoadNodeSettings(local, "node1")
+	assert.Equal(t, 20, settings.CSRPoolSize)
+}
+
+func TestNodeSettingsValidate(t *testing.T) {
+	assert.True(t, IsInvalidParams(SaveNodeSettings(NewMemoryFs(), "node1", &NodeSettings{CSRPoolSize: 0})))
+	assert.True(t, IsInvalidParams((&NodeSettings{CSRPoolSize: MaxCSRPoolSize + 1}).Validate()))
+
+	params := NewNodeParams()
+	assert.NoError(t, params.ValidateCSRPoolSize(false))
+	assert.True(t, IsInvalidParams(params.ValidateCSRPoolSize(true)))
+	params.CSRPoolSize = intPtr(-1)
+	assert.True(t, IsInvalidParams(params.ValidateCSRPoolSize(false)))
+
+	local := NewMemoryFs()
+	assert.NoError(t, local.Write(NodeSettingsFile, `{"defaults": {"csr-pool-size": 1000}}`))
+	_, err := LoadNodeSettings(local, "node1")
+	assert.True(t, IsInvalidParams(err))
+}
+
+func TestNodeSettingsCSRRequest(t *testing.T) {
+	settings := DefaultNodeSettings()
+	assert.False(t, settings.CustomCSRs())
+	assert.Equal(t, KeySpecRSA2048, settings.CSRRequest("node1").KeySpec)
+
+	local := NewMemoryFs()
+	assert.NoError(t, local.Write(NodeSettingsFile, `{"defaults": {"key-spec": "ec-p256", "subject": {"organization": "org"}}, "nodes": {"node1": {"dns-names": ["node1.example.com"]}}}`))
+	settings, err := LoadNodeSettings(local, "node1")
+	assert.NoError(t, err)
+	assert.True(t, settings.CustomCSRs())
+
+	req := settings.CSRRequest("node1")
+	assert.Equal(t, KeySpecP256, req.KeySpec)
+	assert.Equal(t, "node1", req.Subject.CommonName)
+	assert.Equal(t, []string{"org"}, req.Subject.Organization)
+	assert.Equal(t, []string{"node1.example.com"}, req.DNSNames)
+
+	assert.True(t, IsInvalidParams((&NodeSettings{CSRPoolSize: 1, KeySpec: "rsa-512"}).Validate()))
+	assert.True(t, IsInvalidParams((&NodeSettings{CSRPoolSize: 1, IPAddresses: []string{"node1"}}).Validate()))
+
+	params := NewNodeParams()
+	assert.NoError(t, params.ValidateKeySpec(false))
+	assert.True(t, IsInvalidParams(params.ValidateKeySpec(true)))
+	params.KeySpec = stringPtr("ec-p256")
+	assert.NoError(t, params.ValidateKeySpec(true))
+	params.KeySpec = stringPtr("ec-p224")
+	assert.True(t, IsInvalidParams(params.ValidateKeySpec(false)))
+}
+
+func TestNodeRunValidatesFirst(t *testing.T) {
+	// Invalid params are reported before the admin environment is loaded
+	nodeCont, _ := NewNode(newMemoryBackends().env(NewMemoryFs()))
+	params := newTestNodeParams("node1")
+	params.CSRPoolSize = intPtr(-1)
+	assert.True(t, IsInvalidParams(nodeCont.Run(params)))
+
+	params = newTestNodeParams("node1")
+	params.KeySpec = stringPtr("ec-p224")
+	assert.True(t, IsInvalidParams(nodeCont.Run(params)))
+}
+
+func TestNodeSaveSettingsParams(t *testing.T) {
+	env := newMemoryBackends().env(NewMemoryFs())
+	assert.NoError(t, env.LoadLocalFs())
+	nodeCont, _ := NewNode(env)
+
+	params := newTestNodeParams("node1")
+	params.DnOrg = stringPtr("org")
+	params.DnCountry = stringPtr("GB")
+	params.DNSNames = stringPtr("node1.example.com, node1")
+	params.IPAddresses = stringPtr("10.0.0.1")
+	assert.NoError(t, nodeCont.SaveSettings("node1", params))
+
+	settings, err := LoadNodeSettings(env.fs.local, "node1")
+	assert.NoError(t, err)
+	assert.True(t, settings.CustomCSRs())
+	req := settings.CSRRequest("node1")
+	assert.Equal(t, []string{"org"}, req.Subject.Organization)
+	assert.Equal(t, []string{"GB"}, req.Subject.Country)
+	assert.Equal(t, []string{"node1.example.com", "node1"}, req.DNSNames)
+	assert.Equal(t, []string{"10.0.0.1"}, req.IPAddresses)
+
+	// Subject fields that aren't given are kept
+	params = newTestNodeParams("node1")
+	params.DnOrgUnit = stringPtr("web")
+	assert.NoError(t, nodeCont.SaveSettings("node1", params))
+	settings, _ = LoadNodeSettings(env.fs.local, "node1")
+	req = settings.CSRRequest("node1")
+	assert.Equal(t, []string{"org"}, req.Subject.Organization)
+	assert.Equal(t, []string{"web"}, req.Subject.OrganizationalUnit)
+	assert.Equal(t, []string{"10.0.0.1"}, req.IPAddresses)
+
+	params.IPAddresses = stringPtr("node1")
+	assert.True(t, IsInvalidParams(params.ValidateIPAddresses(false)))
+	assert.True(t, IsInvalidParams(nodeCont.Run(params)))
+}
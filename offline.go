@@ -0,0 +1,358 @@
+package controller
+
+import (
+	"bytes"
+	stdx509 "crypto/x509"
+	"encoding/json"
+	"github.com/pki-io/core/document"
+	"github.com/pki-io/core/entity"
+	"github.com/pki-io/core/x509"
+	"time"
+)
+
+const (
+	// CARequestType and CAResponseType identify the signed files exchanged
+	// with an offline CA.
+	CARequestType  string = "ca-request"
+	CAResponseType string = "ca-response"
+	// CARequestsDocument is the name of the org's private document holding
+	// the certificate of the CA each exported CA request asked to sign it, by
+	// CSR id, which the response must be issued by.
+	CARequestsDocument string = "ca-requests"
+)
+
+// CARequest asks an offline CA to sign a CSR as an intermediate CA. It's
+// exported by the online org, which keeps the CSR's key, and signed by it.
+type CARequest struct {
+	Type string `json:"type"`
+	// Id is the id of the CSR in the requesting org
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	CSR      string `json:"csr"`
+	CAExpiry int    `json:"ca-expiry"`
+	// Issuer is the certificate of the CA asked to sign the CSR
+	Issuer  string `json:"issuer"`
+	OrgId   string `json:"org-id"`
+	Created string `json:"created"`
+}
+
+// CAResponse is an intermediate CA certificate issued by an offline CA for a
+// CARequest, signed by the offline org. It holds certificates only.
+type CAResponse struct {
+	Type string `json:"type"`
+	// RequestId is the CARequest's Id
+	RequestId   string `json:"request-id"`
+	Name        string `json:"name"`
+	Certificate string `json:"certificate"`
+	// Chain is the issuing CA's certificate
+	Chain   string `json:"chain"`
+	OrgId   string `json:"org-id"`
+	Created string `json:"created"`
+}
+
+// signTransferFile signs v as JSON with the org for handing to another
+// environment.
+func signTransferFile(org *entity.Entity, v interface{}) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	container, err := document.NewContainer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	container.Data.Options.Source = org.Id()
+	container.Data.Body = string(body)
+
+	logger.Debug("signing container with org")
+	if err := org.Sign(container); err != nil {
+		return nil, err
+	}
+
+	return []byte(container.Dump()), nil
+}
+
+// readTransferFile reads a file signed by another org into v and returns the
+// id of the org that signed it. The org must be pinned, i.e. its public org
+// must already be in the home directory, see OrgController.PinOrg.
+func readTransferFile(env *Environment, file, kind string, v interface{}) (string, error) {
+	data, err := readImportFile(file, kind)
+	if err != nil {
+		return "", err
+	}
+
+	container, err := document.NewContainer(string(data))
+	if err != nil {
+		return "", newError(ErrInvalidParams, err, "loading %s '%s'", kind, file)
+	}
+
+	orgId := container.Data.Options.Source
+	org, err := pinnedPublicOrg(env, orgId)
+	if err != nil {
+		return "", wrapError(err, "verifying %s '%s'", kind, file)
+	}
+
+	if err := org.Verify(container); err != nil {
+		return "", newError(ErrVerificationFailed, err, "verifying %s '%s'", kind, file)
+	}
+
+	if err := json.Unmarshal([]byte(container.Data.Body), v); err != nil {
+		return "", newError(ErrInvalidParams, err, "loading %s '%s'", kind, file)
+	}
+
+	return orgId, nil
+}
+
+// readCACertFile reads the certificate of the CA a CA request is for.
+func readCACertFile(file string) (*stdx509.Certificate, error) {
+	data, err := readImportFile(file, "CA certificate")
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := pemDecodeCertificates(data)
+	if err != nil {
+		return nil, newError(ErrInvalidParams, err, "loading CA certificate '%s'", file)
+	}
+
+	if len(certs) != 1 || !certs[0].IsCA {
+		return nil, newError(ErrInvalidParams, nil, "'%s' must hold one CA certificate", file)
+	}
+
+	return certs[0], nil
+}
+
+// pinnedPublicOrg loads another org's public org from the home directory.
+func pinnedPublicOrg(env *Environment, orgId string) (*entity.Entity, error) {
+	if orgId == "" {
+		return nil, newError(ErrVerificationFailed, nil, "no signing org")
+	}
+
+	exists, err := env.fs.home.Exists(orgId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, newError(ErrVerificationFailed, nil, "org '%s' isn't trusted, its public org hasn't been pinned", orgId)
+	}
+
+	orgJson, err := env.fs.home.Read(orgId)
+	if err != nil {
+		return nil, wrapError(err, "reading public org '%s'", orgId)
+	}
+
+	org, err := entity.New(orgJson)
+	if err != nil {
+		return nil, wrapError(err, "loading public org '%s'", orgId)
+	}
+
+	if org.Id() != orgId {
+		return nil, newError(ErrVerificationFailed, nil, "public org '%s' has id '%s'", orgId, org.Id())
+	}
+
+	return org, nil
+}
+
+// signIntermediateCA issues an intermediate CA certificate for the request,
+// keeping the request's subject, which must be within the CA's DN scope. The
+// certificate doesn't outlive the CA and has a path length of 0, so it can
+// only issue end entity certificates.
+func signIntermediateCA(ca *x509.CA, request *stdx509.CertificateRequest, expiry int, now time.Time) (string, error) {
+	caCert, signer, err := caSigner(ca)
+	if err != nil {
+		return "", err
+	}
+
+	if err := request.CheckSignature(); err != nil {
+		return "", newError(ErrVerificationFailed, err, "checking CSR signature")
+	}
+
+	if caCert.BasicConstraintsValid && caCert.MaxPathLen == 0 && caCert.MaxPathLenZero {
+		return "", newError(ErrPolicyViolation, nil, "CA '%s' has a path length of 0 and can't sign intermediate CAs", ca.Data.Body.Name)
+	}
+
+	if err := checkDNScope("CA request '"+request.Subject.CommonName+"'", request.Subject, ca.Data.Body.DNScope); err != nil {
+		return "", err
+	}
+
+	notAfter := now.AddDate(0, 0, expiry)
+	if notAfter.After(caCert.NotAfter) {
+		logger.Warnf("limiting intermediate CA expiry to CA '%s' expiry", ca.Data.Body.Name)
+		notAfter = caCert.NotAfter
+	}
+
+	template := &stdx509.Certificate{
+		Subject:               request.Subject,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              stdx509.KeyUsageCertSign | stdx509.KeyUsageCRLSign | stdx509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            0,
+		MaxPathLenZero:        true,
+	}
+
+	return issueCertificate(template, caCert, request.PublicKey, signer)
+}
+
+// checkCAResponse checks the response's certificate is for the CSR's key and
+// was issued by issuer, the CA the request asked to sign it, returning the
+// certificate and chain. The chain must start with issuer, and the rest of it
+// must be the issuer's own chain.
+func checkCAResponse(response *CAResponse, csr *x509.CSR, issuer *stdx509.Certificate, now time.Time) (*stdx509.Certificate, []*stdx509.Certificate, error) {
+	certs, err := pemDecodeCertificates([]byte(response.Certificate))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chain, err := pemDecodeCertificates([]byte(response.Chain))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if csr.Data.Body.PrivateKey == "" {
+		return nil, nil, newError(ErrInvalidParams, nil, "CSR '%s' has no private key for the CA", csr.Data.Body.Name)
+	}
+
+	if len(certs) != 1 || len(chain) == 0 {
+		return nil, nil, newError(ErrInvalidParams, nil, "CA response '%s' needs a certificate and its issuer", response.RequestId)
+	}
+
+	if err := checkStoredKeyMatches(response.Certificate, csr.Data.Body.PrivateKey); err != nil {
+		return nil, nil, wrapError(err, "checking CA response '%s' is for CSR '%s'", response.RequestId, csr.Data.Body.Name)
+	}
+
+	if !bytes.Equal(chain[0].Raw, issuer.Raw) {
+		return nil, nil, newError(ErrVerificationFailed, nil, "CA response '%s' is from CA '%s', not the CA requested", response.RequestId, chain[0].Subject.CommonName)
+	}
+
+	for i, cert := range chain[:len(chain)-1] {
+		if err := cert.CheckSignatureFrom(chain[i+1]); err != nil {
+			return nil, nil, newError(ErrVerificationFailed, err, "verifying CA response '%s' chain", response.RequestId)
+		}
+	}
+
+	roots := stdx509.NewCertPool()
+	roots.AddCert(issuer)
+
+	opts := stdx509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: now,
+		KeyUsages:   []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageAny},
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return nil, nil, newError(ErrVerificationFailed, err, "verifying CA response '%s' certificate", response.RequestId)
+	}
+
+	return certs[0], chain, nil
+}
+
+// GetCARequests returns the certificates of the CAs exported CA requests
+// asked to sign them, by CSR id, and the document's ETag.
+func (cont *OrgController) GetCARequests() (map[string]string, string, error) {
+	logger.Debug("getting CA requests")
+
+	requests := make(map[string]string)
+	etag, err := cont.GetDocument(CARequestsDocument, &requests)
+	if IsNotFound(err) {
+		logger.Debug("no CA requests yet")
+		return requests, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	logger.Trace("returning CA requests")
+	return requests, etag, nil
+}
+
+// UpdateCARequests applies update to the latest CA requests and saves them,
+// retrying if someone else saved them in the meantime.
+func (cont *OrgController) UpdateCARequests(update func(map[string]string) error) error {
+	logger.Debug("updating CA requests")
+
+	for attempt := 0; attempt < IndexUpdateAttempts; attempt++ {
+		requests, etag, err := cont.GetCARequests()
+		if err != nil {
+			return err
+		}
+
+		if err := update(requests); err != nil {
+			return err
+		}
+
+		err = cont.SaveDocument(CARequestsDocument, requests, etag)
+		if !IsConflict(err) {
+			return err
+		}
+
+		logger.Info("CA requests changed while updating, retrying")
+	}
+
+	return newError(ErrConflict, nil, "updating CA requests after %d attempts", IndexUpdateAttempts)
+}
+
+// PinOrg trusts another org, e.g. an offline CA's org, by saving its public
+// org from params.PublicOrgFile to the home directory. The file is what the
+// other org's admin gets from Show and DumpPublic, and it's only pinned if it
+// has params.Fingerprint, which must be checked with that admin out of band.
+func (cont *OrgController) PinOrg(params *OrgParams) (*entity.Entity, error) {
+	logger.Debug("pinning org")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidatePublicOrgFile(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateFingerprint(true); err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.LoadHomeFs(); err != nil {
+		return nil, err
+	}
+
+	data, err := readImportFile(*params.PublicOrgFile, "public org")
+	if err != nil {
+		return nil, err
+	}
+
+	org, err := entity.New(string(data))
+	if err != nil {
+		return nil, newError(ErrInvalidParams, err, "loading public org '%s'", *params.PublicOrgFile)
+	}
+
+	if org.Id() == "" {
+		return nil, newError(ErrInvalidParams, nil, "public org '%s' has no id", *params.PublicOrgFile)
+	}
+
+	if OrgFingerprint(org) != params.fingerprint() {
+		return nil, newError(ErrVerificationFailed, nil, "public org '%s' doesn't have fingerprint '%s'", org.Id(), params.fingerprint())
+	}
+
+	exists, err := cont.env.fs.home.Exists(org.Id())
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		pinned, err := pinnedPublicOrg(cont.env, org.Id())
+		if err != nil {
+			return nil, err
+		}
+
+		if pinned.DumpPublic() != org.DumpPublic() {
+			return nil, newError(ErrAlreadyExists, nil, "a different public org '%s'", org.Id())
+		}
+	}
+
+	logger.Infof("pinning public org '%s'", org.Id())
+	if err := cont.env.fs.home.Write(org.Id(), org.DumpPublic()); err != nil {
+		return nil, wrapError(err, "writing public org '%s'", org.Id())
+	}
+
+	logger.Trace("returning org")
+	return org, nil
+}
@@ -0,0 +1,199 @@
+package controller
+
+import (
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/pki-io/core/x509"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignIntermediateCA(t *testing.T) {
+	now := time.Now()
+	root, rootKey := newTestImportCert(t, "root", 1, true, now.Add(24*time.Hour), nil, nil)
+	other, _ := newTestImportCert(t, "other", 2, true, now.Add(24*time.Hour), nil, nil)
+
+	ca, _ := x509.NewCA(nil)
+	ca.Data.Body.Name = "root"
+	ca.Data.Body.Certificate = string(pemCert(root.Raw))
+	ca.Data.Body.PrivateKey, _ = PemEncodePrivateKey(rootKey)
+
+	csrPem, keyPem, _, err := GenerateCSR(&CSRRequest{KeySpec: KeySpecP256, Subject: pkix.Name{CommonName: "inter"}})
+	assert.NoError(t, err)
+	request, err := ParseCSRData([]byte(csrPem))
+	assert.NoError(t, err)
+
+	// The intermediate can't outlive the root
+	certPem, err := signIntermediateCA(ca, request, 3650, now)
+	assert.NoError(t, err)
+
+	csr, _ := x509.NewCSR(nil)
+	csr.Data.Body.Name = "inter"
+	csr.Data.Body.CSR = csrPem
+	csr.Data.Body.PrivateKey = keyPem
+
+	response := &CAResponse{RequestId: "1", Certificate: certPem, Chain: string(pemCert(root.Raw))}
+	cert, chain, err := checkCAResponse(response, csr, root, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "inter", cert.Subject.CommonName)
+	assert.Equal(t, root.NotAfter, cert.NotAfter)
+	assert.Equal(t, []*stdx509.Certificate{root}, chain)
+	assert.NoError(t, ValidateCACertificate(cert, x509.DNScope{}, now))
+	assert.Equal(t, 0, cert.MaxPathLen)
+	assert.True(t, cert.MaxPathLenZero)
+
+	// The intermediate can't sign further intermediates
+	interCA, _ := x509.NewCA(nil)
+	interCA.Data.Body.Name = "inter"
+	interCA.Data.Body.Certificate = certPem
+	interCA.Data.Body.PrivateKey = keyPem
+	_, err = signIntermediateCA(interCA, request, 365, now)
+	assert.True(t, IsPolicyViolation(err))
+
+	// Requests must be within the CA's DN scope
+	ca.Data.Body.DNScope.Organization = "pki.io"
+	_, err = signIntermediateCA(ca, request, 365, now)
+	assert.True(t, IsVerificationFailed(err))
+	ca.Data.Body.DNScope.Organization = ""
+
+	// The response must come from the CA that was requested, whatever its
+	// chain says
+	response.Chain = string(pemCert(other.Raw))
+	_, _, err = checkCAResponse(response, csr, root, now)
+	assert.True(t, IsVerificationFailed(err))
+	_, _, err = checkCAResponse(response, csr, other, now)
+	assert.True(t, IsVerificationFailed(err))
+
+	response.Chain = string(pemCert(root.Raw))
+	_, _, err = checkCAResponse(response, csr, other, now)
+	assert.True(t, IsVerificationFailed(err))
+
+	_, otherKeyPem, _, _ := GenerateCSR(&CSRRequest{KeySpec: KeySpecP256, Subject: pkix.Name{CommonName: "inter"}})
+	csr.Data.Body.PrivateKey = otherKeyPem
+	_, _, err = checkCAResponse(response, csr, root, now)
+	assert.True(t, IsVerificationFailed(err))
+}
+
+// pinOrg pins the org's public org in another home directory, as an admin
+// does to trust it.
+func pinOrg(t *testing.T, backends *memoryBackends, home, to *MemoryFs, dir string) {
+	env := backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	org := env.controllers.org.org
+
+	file := path.Join(dir, org.Id()+".org")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(org.DumpPublic()), 0600))
+
+	params := NewOrgParams()
+	params.PublicOrgFile = stringPtr(file)
+	params.Fingerprint = stringPtr(strings.Repeat("0", 64))
+
+	// The fingerprint is checked out of band
+	orgCont, _ := NewOrg(newMemoryBackends().env(to))
+	_, err := orgCont.PinOrg(params)
+	assert.True(t, IsVerificationFailed(err))
+
+	params.Fingerprint = stringPtr(OrgFingerprint(org))
+	orgCont, _ = NewOrg(newMemoryBackends().env(to))
+	pinned, err := orgCont.PinOrg(params)
+	assert.NoError(t, err)
+	assert.Equal(t, org.Id(), pinned.Id())
+}
+
+func TestOfflineRootCA(t *testing.T) {
+	online, onlineHome := initMemoryOrg(t)
+	offline, offlineHome := initMemoryOrg(t)
+
+	dir, err := ioutil.TempDir("", "pkiio-offline")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	requestFile := path.Join(dir, "inter.request")
+	responseFile := path.Join(dir, "inter.response")
+
+	rootCertFile := path.Join(dir, "root.pem")
+
+	for _, name := range []string{"root", "other"} {
+		caCont, _ := NewCA(offline.env(offlineHome))
+		_, err = caCont.New(newTestCAParams(name))
+		assert.NoError(t, err)
+	}
+
+	exportParams := newTestCAParams("root")
+	exportParams.Export = stringPtr(ExportPEM)
+	caCont, _ := NewCA(offline.env(offlineHome))
+	rootCert, err := caCont.Export(exportParams)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(rootCertFile, rootCert, 0600))
+
+	csrCont, _ := NewCSR(online.env(onlineHome))
+	_, err = csrCont.New(newTestCSRParams("inter"))
+	assert.NoError(t, err)
+
+	requestParams := newTestCSRParams("inter")
+	csrCont, _ = NewCSR(online.env(onlineHome))
+	_, err = csrCont.ExportCARequest(requestParams)
+	assert.True(t, IsInvalidParams(err))
+
+	requestParams.CaCertFile = stringPtr(rootCertFile)
+	csrCont, _ = NewCSR(online.env(onlineHome))
+	requestData, err := csrCont.ExportCARequest(requestParams)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(requestFile, requestData, 0600))
+
+	signParams := newTestCAParams("root")
+	signParams.CaExpiry = intPtr(0)
+	signParams.RequestFile = stringPtr(requestFile)
+
+	// Requests are only signed for pinned orgs
+	caCont, _ = NewCA(offline.env(offlineHome))
+	_, err = caCont.SignRequest(signParams)
+	assert.True(t, IsVerificationFailed(err))
+
+	pinOrg(t, online, onlineHome, offlineHome, dir)
+
+	// Requests are only signed by the CA they're for
+	otherParams := newTestCAParams("other")
+	otherParams.CaExpiry = intPtr(0)
+	otherParams.RequestFile = stringPtr(requestFile)
+	caCont, _ = NewCA(offline.env(offlineHome))
+	_, err = caCont.SignRequest(otherParams)
+	assert.True(t, IsVerificationFailed(err))
+
+	caCont, _ = NewCA(offline.env(offlineHome))
+	responseData, err := caCont.SignRequest(signParams)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(responseFile, responseData, 0600))
+
+	updateParams := newTestCAParams("inter")
+	updateParams.ResponseFile = stringPtr(responseFile)
+
+	caCont, _ = NewCA(online.env(onlineHome))
+	assert.True(t, IsVerificationFailed(caCont.Update(updateParams)))
+
+	pinOrg(t, offline, offlineHome, onlineHome, dir)
+	caCont, _ = NewCA(online.env(onlineHome))
+	assert.NoError(t, caCont.Update(updateParams))
+
+	caCont, _ = NewCA(online.env(onlineHome))
+	ca, err := caCont.Show(newTestCAParams("inter"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, ca.Data.Body.PrivateKey)
+	assert.NoError(t, checkStoredKeyMatches(ca.Data.Body.Certificate, ca.Data.Body.PrivateKey))
+
+	// The CSR and its copy of the key are gone, so the response can't be
+	// imported again
+	csrCont, _ = NewCSR(online.env(onlineHome))
+	_, err = csrCont.Show(newTestCSRParams("inter"))
+	assert.True(t, IsNotFound(err))
+
+	caCont, _ = NewCA(online.env(onlineHome))
+	assert.True(t, IsNotFound(caCont.Update(updateParams)))
+
+	// The root's key never leaves the offline org
+	assert.NotContains(t, string(responseData), "PRIVATE KEY")
+}
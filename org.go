@@ -2,23 +2,67 @@
 package controller
 
 import (
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"github.com/pki-io/core/config"
 	"github.com/pki-io/core/document"
 	"github.com/pki-io/core/entity"
 	"github.com/pki-io/core/index"
-	"github.com/pki-io/core/node"
 	"github.com/pki-io/core/x509"
+	"os"
+	"strings"
+	"sync"
 )
 
 const (
 	OrgConfigFile string = "org.conf"
+	// IndexUpdateAttempts is how many times UpdateIndex applies a change to
+	// the latest index when someone else saved it in the meantime.
+	IndexUpdateAttempts int = 5
 )
 
+// PrivateSwapper is implemented by APIs that can replace a private document
+// only if it's unchanged, which makes saving the org index atomic. Other APIs,
+// such as core's fs API, fall back to checking the stored index just before
+// saving. That isn't atomic: it narrows the window for lost updates, but
+// another process can still save in between.
+type PrivateSwapper interface {
+	SwapPrivate(dstId, name, content, etag string) error
+}
+
+// ETag identifies the version of a stored document.
+func ETag(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+// OrgFingerprint identifies an org's public signing key, so a public org can
+// be checked against one given out of band before it's trusted.
+func OrgFingerprint(org *entity.Entity) string {
+	hash := sha256.Sum256([]byte(org.Data.Body.PublicSigningKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// normalizeFingerprint lower cases a fingerprint and drops the colons and
+// spaces it may be written with.
+func normalizeFingerprint(fingerprint string) string {
+	return strings.NewReplacer(":", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(fingerprint)))
+}
+
 type OrgController struct {
 	env    *Environment
 	config *config.OrgConfig
 	org    *entity.Entity
+	// Serialises API calls made by registration workers
+	apiLock sync.Mutex
+	// Decrypted documents, kept while the environment is in a session
+	cache struct {
+		indexJson string
+		indexETag string
+		cas       map[string]string
+	}
 }
 
 func NewOrg(env *Environment) (*OrgController, error) {
@@ -28,6 +72,19 @@ func NewOrg(env *Environment) (*OrgController, error) {
 	return cont, nil
 }
 
+// ClearCache drops the cached index and CAs.
+func (cont *OrgController) ClearCache() {
+	logger.Debug("clearing org cache")
+	cont.cache.indexJson = ""
+	cont.cache.indexETag = ""
+	cont.cache.cas = nil
+}
+
+// UncacheCA drops a CA from the cache, e.g. after it has been changed.
+func (cont *OrgController) UncacheCA(id string) {
+	delete(cont.cache.cas, id)
+}
+
 func (cont *OrgController) OrgId() string {
 	logger.Trace("returning org id")
 	return cont.org.Id()
@@ -91,7 +148,7 @@ func (cont *OrgController) CreateOrg(name string) error {
 		return err
 	}
 
-	cont.org.Data.Body.Id = x509.NewID()
+	cont.org.Data.Body.Id = cont.env.NewID()
 	cont.org.Data.Body.Name = name
 
 	logger.Debug("generating keys")
@@ -137,13 +194,13 @@ func (cont *OrgController) LoadPublicOrg() error {
 	logger.Debugf("reading org with id '%s'", orgId)
 	orgPublicJson, err := cont.env.fs.home.Read(orgId)
 	if err != nil {
-		return err
+		return wrapError(err, "reading public org '%s'", orgId)
 	}
 
 	logger.Debug("creating new org struct from JSON")
 	cont.org, err = entity.New(orgPublicJson)
 	if err != nil {
-		return err
+		return wrapError(err, "loading public org '%s'", orgId)
 	}
 
 	logger.Trace("returning nil error")
@@ -178,7 +235,7 @@ func (cont *OrgController) SavePrivateOrg() error {
 
 	logger.Debug("sending encrypted org")
 	if err := cont.env.api.SendPrivate(cont.org.Id(), cont.org.Id(), container.Dump()); err != nil {
-		return err
+		return wrapError(err, "sending private org '%s'", cont.org.Id())
 	}
 
 	logger.Trace("returning nil error")
@@ -193,31 +250,31 @@ func (cont *OrgController) LoadPrivateOrg() error {
 	logger.Debugf("loading private org with id '%s'", orgId)
 	orgEntity, err := cont.env.api.GetPrivate(orgId, orgId)
 	if err != nil {
-		return err
+		return wrapError(err, "getting private org '%s'", orgId)
 	}
 
 	logger.Debug("creating new org container")
 	container, err := document.NewContainer(orgEntity)
 	if err != nil {
-		return err
+		return wrapError(err, "loading private org container '%s'", orgId)
 	}
 
 	logger.Debug("verifying container")
 	err = cont.org.Verify(container)
 	if err != nil {
-		return err
+		return newError(ErrVerificationFailed, err, "verifying private org '%s'", orgId)
 	}
 
 	logger.Debug("decrypting container")
 	decryptedOrgJson, err := cont.env.controllers.admin.admin.Decrypt(container)
 	if err != nil {
-		return err
+		return newError(ErrDecryptionFailed, err, "decrypting private org '%s'", orgId)
 	}
 
 	logger.Debug("creating org struct")
 	cont.org, err = entity.New(decryptedOrgJson)
 	if err != nil {
-		return err
+		return wrapError(err, "loading private org '%s'", orgId)
 	}
 
 	logger.Trace("returning nil error")
@@ -232,7 +289,7 @@ func (cont *OrgController) CreateIndex() (*index.OrgIndex, error) {
 		return nil, err
 	}
 
-	index.Data.Body.Id = x509.NewID()
+	index.Data.Body.Id = cont.env.NewID()
 	index.Data.Body.ParentId = cont.org.Id()
 
 	logger.Trace("returning index")
@@ -240,44 +297,69 @@ func (cont *OrgController) CreateIndex() (*index.OrgIndex, error) {
 }
 
 func (cont *OrgController) GetIndex() (*index.OrgIndex, error) {
+	index, _, err := cont.GetIndexWithETag()
+	return index, err
+}
+
+// GetIndexWithETag returns the org index and the ETag of the stored index it
+// was loaded from, for saving it with SaveIndex.
+func (cont *OrgController) GetIndexWithETag() (*index.OrgIndex, string, error) {
 	logger.Debug("getting org index")
 
+	if cont.env.InSession() && cont.cache.indexJson != "" {
+		logger.Debug("using cached org index")
+		// Each caller gets its own copy to change
+		index, err := index.NewOrg(cont.cache.indexJson)
+		if err != nil {
+			return nil, "", wrapError(err, "loading cached org index")
+		}
+		return index, cont.cache.indexETag, nil
+	}
+
 	orgIndexId := cont.config.Data.Index
 	logger.Debugf("getting org index with id '%s'", orgIndexId)
 	indexJson, err := cont.env.api.GetPrivate(cont.org.Id(), orgIndexId)
 	if err != nil {
-		return nil, err
+		return nil, "", wrapError(err, "getting org index '%s'", orgIndexId)
 	}
 
 	logger.Debug("creating container for index")
 	indexContainer, err := document.NewContainer(indexJson)
 	if err != nil {
-		return nil, err
+		return nil, "", wrapError(err, "loading org index container '%s'", orgIndexId)
 	}
 
 	logger.Debug("verifying container")
 	err = cont.org.Verify(indexContainer)
 	if err != nil {
-		return nil, err
+		return nil, "", newError(ErrVerificationFailed, err, "verifying org index '%s'", orgIndexId)
 	}
 
 	logger.Debug("decrypting container")
 	decryptedIndexJson, err := cont.org.Decrypt(indexContainer)
 	if err != nil {
-		return nil, err
+		return nil, "", newError(ErrDecryptionFailed, err, "decrypting org index '%s'", orgIndexId)
 	}
 
 	logger.Debug("creating new index struct from JSON")
 	index, err := index.NewOrg(decryptedIndexJson)
 	if err != nil {
-		return nil, err
+		return nil, "", wrapError(err, "loading org index '%s'", orgIndexId)
+	}
+
+	if cont.env.InSession() {
+		cont.cache.indexJson = decryptedIndexJson
+		cont.cache.indexETag = ETag(indexJson)
 	}
 
 	logger.Trace("returning index")
-	return index, nil
+	return index, ETag(indexJson), nil
 }
 
-func (cont *OrgController) SaveIndex(index *index.OrgIndex) error {
+// SaveIndex saves the index. If etag isn't empty and the stored index no
+// longer has that ETag, e.g. because someone else saved it since it was got
+// with GetIndexWithETag, nothing is saved and ErrConflict is returned.
+func (cont *OrgController) SaveIndex(index *index.OrgIndex, etag string) error {
 	logger.Debug("saving org index")
 	logger.Tracef("received index with id '%s'", index.Id())
 
@@ -287,240 +369,192 @@ func (cont *OrgController) SaveIndex(index *index.OrgIndex) error {
 		return err
 	}
 
+	indexId := index.Data.Body.Id
+	content := encryptedIndexContainer.Dump()
+
 	logger.Debug("sending encrypted index to org")
-	err = cont.env.api.SendPrivate(cont.org.Id(), index.Data.Body.Id, encryptedIndexContainer.Dump())
-	if err != nil {
-		return err
+	if err := cont.sendPrivate(indexId, content, etag); err != nil {
+		if IsConflict(err) {
+			// The cached index may be the stale one
+			cont.ClearCache()
+		}
+		return wrapError(err, "sending org index '%s'", indexId)
+	}
+
+	if cont.env.InSession() {
+		cont.cache.indexJson = index.Dump()
+		cont.cache.indexETag = ETag(content)
 	}
 
 	logger.Trace("returning nil error")
 	return nil
 }
 
-func (cont *OrgController) GetCA(id string) (*x509.CA, error) {
-	logger.Debug("getting CA")
-	logger.Tracef("received CA id '%s'", id)
-
-	org := cont.env.controllers.org.org
-	caContainerJson, err := cont.env.api.GetPrivate(org.Id(), id)
-	if err != nil {
-		return nil, err
+// sendPrivate sends a private org document. If etag isn't empty, the document
+// is only replaced if the stored one has that ETag, otherwise ErrConflict is
+// returned. Without a PrivateSwapper API the check isn't atomic, see
+// PrivateSwapper.
+func (cont *OrgController) sendPrivate(name, content, etag string) error {
+	orgId := cont.org.Id()
+	if etag == "" {
+		return cont.env.api.SendPrivate(orgId, name, content)
 	}
 
-	logger.Debug("creating CA container")
-	caContainer, err := document.NewContainer(caContainerJson)
-	if err != nil {
-		return nil, err
+	if swapper, ok := cont.env.api.(PrivateSwapper); ok {
+		logger.Debugf("swapping document '%s' with etag '%s'", name, etag)
+		return swapper.SwapPrivate(orgId, name, content, etag)
 	}
 
-	logger.Debug("verifying and decrypting CA container")
-	caJson, err := org.VerifyThenDecrypt(caContainer)
+	logger.Debugf("checking stored document '%s' is unchanged", name)
+	current, err := cont.env.api.GetPrivate(orgId, name)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	logger.Debug("creating new CA from JSON")
-	ca, err := x509.NewCA(caJson)
-	if err != nil {
-		return nil, err
+	if ETag(current) != etag {
+		return newError(ErrConflict, nil, "private document '%s' was changed by someone else", name)
 	}
 
-	logger.Trace("returning CA")
-	return ca, nil
+	return cont.env.api.SendPrivate(orgId, name, content)
 }
 
-func (cont *OrgController) SignCSR(node *node.Node, caId, tag string) error {
-	logger.Debug("signing CSR for node")
-	logger.Tracef("received node with id '%s', ca id '%s' and tag '%s'", node.Id(), caId, tag)
+// GetDocument loads a private org document that holds JSON into v and
+// returns its ETag. ErrNotFound is returned if there isn't one.
+func (cont *OrgController) GetDocument(name string, v interface{}) (string, error) {
+	logger.Debugf("getting org document '%s'", name)
 
-	logger.Debugf("popping outgoing CSr from node '%s'", node.Id())
-	csrContainerJson, err := cont.env.api.PopOutgoing(node.Data.Body.Id, "csrs")
-	if err != nil {
-		return err
+	documentJson, err := cont.env.api.GetPrivate(cont.org.Id(), name)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", newError(ErrNotFound, err, "getting org document '%s'", name)
+	} else if err != nil {
+		return "", wrapError(err, "getting org document '%s'", name)
 	}
 
-	logger.Debug("creating new CSR container")
-	csrContainer, err := document.NewContainer(csrContainerJson)
+	container, err := document.NewContainer(documentJson)
 	if err != nil {
-		return err
+		return "", wrapError(err, "loading org document container '%s'", name)
 	}
 
-	logger.Debug("verifying CSR container with node")
-	if err := node.Verify(csrContainer); err != nil {
-		return err
+	if err := cont.org.Verify(container); err != nil {
+		return "", newError(ErrVerificationFailed, err, "verifying org document '%s'", name)
 	}
 
-	logger.Debug("creating CSR from JSON")
-	csrJson := csrContainer.Data.Body
-	csr, err := x509.NewCSR(csrJson)
+	decryptedJson, err := cont.org.Decrypt(container)
 	if err != nil {
-		return err
+		return "", newError(ErrDecryptionFailed, err, "decrypting org document '%s'", name)
 	}
 
-	csr.Data.Body.Name = node.Data.Body.Name
-
-	ca, err := cont.GetCA(caId)
-	if err != nil {
-		return err
+	if err := json.Unmarshal([]byte(decryptedJson), v); err != nil {
+		return "", wrapError(err, "loading org document '%s'", name)
 	}
 
-	logger.Debugf("Signing CSR with ca '%s'", caId)
-	cert, err := ca.Sign(csr, false)
-	if err != nil {
-		return err
-	}
+	logger.Trace("returning etag")
+	return ETag(documentJson), nil
+}
 
-	logger.Debug("tagging certificate")
-	cert.Data.Body.Tags = append(cert.Data.Body.Tags, tag)
+// SaveDocument encrypts v as JSON for the org and saves it as a private org
+// document. If etag isn't empty, ErrConflict is returned if the stored
+// document has changed since it was loaded.
+func (cont *OrgController) SaveDocument(name string, v interface{}, etag string) error {
+	logger.Debugf("saving org document '%s'", name)
 
-	logger.Debug("creating certificate container")
-	certContainer, err := document.NewContainer(nil)
+	documentJson, err := json.Marshal(v)
 	if err != nil {
-		return err
-	}
-
-	org := cont.env.controllers.org.org
-	certContainer.Data.Options.Source = org.Id()
-	certContainer.Data.Body = cert.Dump()
-
-	logger.Debug("signing certificate container with org")
-	if err := org.Sign(certContainer); err != nil {
-		return err
+		return wrapError(err, "dumping org document '%s'", name)
 	}
 
-	logger.Debug("pushing certificate to node")
-	if err := cont.env.api.PushIncoming(node.Data.Body.Id, "certs", certContainer.Dump()); err != nil {
-		return err
-	}
-
-	index, err := cont.GetIndex()
+	container, err := cont.org.EncryptThenSignString(string(documentJson), nil)
 	if err != nil {
 		return err
 	}
 
-	if err := index.AddCertTags(cert.Data.Body.Id, cert.Data.Body.Tags); err != nil {
-		return err
-	}
-
-	if err := cont.SaveIndex(index); err != nil {
-		return err
+	if err := cont.sendPrivate(name, container.Dump(), etag); err != nil {
+		return wrapError(err, "sending org document '%s'", name)
 	}
 
 	logger.Trace("returning nil error")
 	return nil
 }
 
-func (cont *OrgController) RegisterNextNode() error {
-	logger.Debug("registering next node")
+// UpdateIndex applies update to the latest index and saves it. If someone
+// else saved the index in the meantime, update is applied again to their
+// version, so changes that don't depend on each other are merged. Errors from
+// update, e.g. adding a name that now exists, are returned as they are.
+func (cont *OrgController) UpdateIndex(update func(*index.OrgIndex) error) error {
+	logger.Debug("updating org index")
 
-	org := cont.env.controllers.org.org
-
-	logger.Debug("popping next registration from org")
-	regJson, err := cont.env.api.PopIncoming(org.Id(), "registration")
-	if err != nil {
-		return err
-	}
+	for attempt := 0; attempt < IndexUpdateAttempts; attempt++ {
+		index, etag, err := cont.GetIndexWithETag()
+		if err != nil {
+			return err
+		}
 
-	logger.Debug("creating new registration container")
-	container, err := document.NewContainer(regJson)
-	if err != nil {
-		logger.Warn("unable to create container from registration json. Pushing back to incoming registration queue")
-		cont.env.api.PushIncoming(org.Id(), "registration", regJson)
-		return err
-	}
+		if err := update(index); err != nil {
+			return err
+		}
 
-	pairingId := container.Data.Options.SignatureInputs["key-id"]
-	logger.Debugf("reading pairing key for '%s'", pairingId)
+		err = cont.SaveIndex(index, etag)
+		if !IsConflict(err) {
+			return err
+		}
 
-	index, err := cont.GetIndex()
-	if err != nil {
-		return err
+		logger.Info("org index changed while updating, retrying")
 	}
 
-	pairingKey, ok := index.Data.Body.PairingKeys[pairingId]
-	if !ok {
-		logger.Warn("unable to find pairing key. Pushing back to incoming registration queue")
-		cont.env.api.PushIncoming(org.Id(), "registration", regJson)
-		logger.Trace("returning nil error")
-		return nil
-	}
+	return newError(ErrConflict, nil, "updating org index after %d attempts", IndexUpdateAttempts)
+}
 
-	logger.Debug("verifying and decrypting node registration")
-	nodeJson, err := org.VerifyAuthenticationThenDecrypt(container, pairingKey.Key)
-	if err != nil {
-		logger.Warn("unable to decrypt node registration. Pushing back to incoming registration queue")
-		cont.env.api.PushIncoming(org.Id(), "registration", regJson)
-		return err
+func (cont *OrgController) GetCA(id string) (*x509.CA, error) {
+	logger.Debug("getting CA")
+	logger.Tracef("received CA id '%s'", id)
+
+	if caJson, ok := cont.cache.cas[id]; ok && cont.env.InSession() {
+		logger.Debugf("using cached CA '%s'", id)
+		ca, err := x509.NewCA(caJson)
+		if err != nil {
+			return nil, wrapError(err, "loading cached CA '%s'", id)
+		}
+		return ca, nil
 	}
 
-	logger.Debug("creating new node from JSON")
-	node, err := node.New(nodeJson)
+	org := cont.env.controllers.org.org
+	caContainerJson, err := cont.env.api.GetPrivate(org.Id(), id)
 	if err != nil {
-		logger.Warn("unable to create node. Pushing back to incoming registration queue")
-		cont.env.api.PushIncoming(org.Id(), "registration", regJson)
-		return err
+		return nil, wrapError(err, "getting CA '%s'", id)
 	}
 
-	index.AddEntityTags(node.Data.Body.Id, pairingKey.Tags)
-	index.AddNode(node.Data.Body.Name, node.Data.Body.Id)
-
-	logger.Debug("encrypting and signing node for org")
-	nodeContainer, err := org.EncryptThenSignString(node.Dump(), nil)
+	logger.Debug("creating CA container")
+	caContainer, err := document.NewContainer(caContainerJson)
 	if err != nil {
-		logger.Warn("unable to encrypt node for org. Pushing back to incoming registration queue")
-		cont.env.api.PushIncoming(org.Id(), "registration", regJson)
-		return err
+		return nil, wrapError(err, "loading CA container '%s'", id)
 	}
 
-	logger.Debug("sending node to org")
-	if err := cont.env.api.SendPrivate(org.Id(), node.Data.Body.Id, nodeContainer.Dump()); err != nil {
-		logger.Warn("Unable to send node to org. Pushing back to incoming registration queue")
-		cont.env.api.PushIncoming(org.Id(), "registration", regJson)
-		return err
+	logger.Debug("verifying CA container")
+	if err := org.Verify(caContainer); err != nil {
+		return nil, newError(ErrVerificationFailed, err, "verifying CA '%s'", id)
 	}
 
-	for _, tag := range pairingKey.Tags {
-		logger.Debugf("looking for CAs for tag '%s'", tag)
-		for _, caId := range index.Data.Body.Tags.CAForward[tag] {
-			logger.Debugf("found CA '%s'", caId)
-			if err := cont.SignCSR(node, caId, tag); err != nil {
-				return err
-			}
-		}
+	logger.Debug("decrypting CA container")
+	caJson, err := org.Decrypt(caContainer)
+	if err != nil {
+		return nil, newError(ErrDecryptionFailed, err, "decrypting CA '%s'", id)
 	}
 
-	if err := cont.SaveIndex(index); err != nil {
-		return err
+	logger.Debug("creating new CA from JSON")
+	ca, err := x509.NewCA(caJson)
+	if err != nil {
+		return nil, wrapError(err, "loading CA '%s'", id)
 	}
 
-	logger.Trace("returning nil error")
-	return nil
-}
-
-func (cont *OrgController) RegisterNodes() error {
-	logger.Debug("registering nodes")
-
-	org := cont.env.controllers.org.org
-
-	for {
-		size, err := cont.env.api.IncomingSize(org.Id(), "registration")
-		if err != nil {
-			return err
-		}
-
-		logger.Debugf("found '%d' nodes to register", size)
-
-		if size > 0 {
-			if err := cont.RegisterNextNode(); err != nil {
-				return err
-			}
-		} else {
-			break
+	if cont.env.InSession() {
+		if cont.cache.cas == nil {
+			cont.cache.cas = make(map[string]string)
 		}
+		cont.cache.cas[id] = caJson
 	}
 
-	logger.Trace("returning nil error")
-	return nil
+	logger.Trace("returning CA")
+	return ca, nil
 }
 
 func (cont *OrgController) Init(params *OrgParams) error {
@@ -549,9 +583,7 @@ func (cont *OrgController) Init(params *OrgParams) error {
 	}
 
 	if exists {
-		logger.Warnf("org directory '%s' already exists", *params.Org)
-		logger.Trace("returning nil error")
-		return nil
+		return newError(ErrAlreadyExists, nil, "org directory '%s'", *params.Org)
 	}
 
 	cont.env.controllers.admin, err = NewAdmin(cont.env)
@@ -564,9 +596,7 @@ func (cont *OrgController) Init(params *OrgParams) error {
 	}
 
 	if cont.env.controllers.admin.config.OrgExists(*params.Org) {
-		logger.Warnf("org already exists: %s", *params.Org)
-		logger.Trace("returnin nil error")
-		return nil
+		return newError(ErrAlreadyExists, nil, "org '%s'", *params.Org)
 	}
 
 	logger.Debugf("creating org directory '%s' *params.Org")
@@ -581,7 +611,7 @@ func (cont *OrgController) Init(params *OrgParams) error {
 	}
 
 	if err := cont.env.LoadAPI(); err != nil {
-		return nil
+		return err
 	}
 
 	if err := cont.env.controllers.admin.CreateAdmin(*params.Admin); err != nil {
@@ -609,7 +639,11 @@ func (cont *OrgController) Init(params *OrgParams) error {
 
 	orgIndex.AddAdmin(admin.Data.Body.Name, admin.Data.Body.Id)
 
-	if err := cont.SaveIndex(orgIndex); err != nil {
+	if err := cont.SaveIndex(orgIndex, ""); err != nil {
+		return err
+	}
+
+	if err := cont.SaveDocument(IssuanceLogDocument, NewIssuanceLog(), ""); err != nil {
 		return err
 	}
 
@@ -694,21 +728,38 @@ func (cont *OrgController) RunEnv(params *OrgParams) error {
 	logger.Debug("running org tasks")
 	logger.Tracef("received params: %s", params)
 
-	if err := cont.RegisterNodes(); err != nil {
+	if err := params.ValidateWorkers(); err != nil {
 		return err
 	}
 
-	logger.Trace("returning nil error")
-	return nil
+	workers := 1
+	if params.Workers != nil && *params.Workers > 0 {
+		workers = *params.Workers
+	}
+
+	// Registration failures don't stop already registered nodes getting
+	// their certificates
+	_, regErr := cont.RegisterNodesBatch(workers)
+	if _, err := cont.Reconcile(); err != nil {
+		if regErr != nil {
+			logger.Warnf("unable to reconcile node certificates: %s", err)
+			return regErr
+		}
+		return err
+	}
+
+	logger.Trace("returning registration error")
+	return regErr
 }
 
 func (cont *OrgController) Run(params *OrgParams) error {
 	logger.Debug("running org tasks")
 	logger.Tracef("received params: %s", params)
 
-	if err := cont.env.LoadAdminEnv(); err != nil {
+	if err := cont.env.StartSession(); err != nil {
 		return err
 	}
+	defer cont.env.EndSession()
 
 	// LoadAdminEnv has actually loaded a fresh new org controller
 	// inside our current env, so all further actions need to be relative
@@ -721,9 +772,75 @@ func (cont *OrgController) Run(params *OrgParams) error {
 	return nil
 }
 
+// MigrateTags rewrites flat tags from before tags had values, such as
+// "env-prod", as tags with values, "env=prod", for each of the keys in
+// params. Tags in the index, on pairing keys and in profile bindings are
+// migrated. It returns how many tagged items changed.
+func (cont *OrgController) MigrateTags(params *OrgParams) (int, error) {
+	logger.Debug("migrating tags")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateTagKeys(true); err != nil {
+		return 0, err
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return 0, err
+	}
+
+	keys := params.tagKeys()
+	org := cont.env.controllers.org
+
+	changed := 0
+	err := org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		changed = 0
+		tags := &orgIndex.Data.Body.Tags
+
+		var n int
+		tags.CAForward, tags.CAReverse, n = migrateTagMaps(tags.CAReverse, keys)
+		changed += n
+		tags.CertForward, tags.CertReverse, n = migrateTagMaps(tags.CertReverse, keys)
+		changed += n
+		tags.CSRForward, tags.CSRReverse, n = migrateTagMaps(tags.CSRReverse, keys)
+		changed += n
+		tags.EntityForward, tags.EntityReverse, n = migrateTagMaps(tags.EntityReverse, keys)
+		changed += n
+
+		for _, pairingKey := range orgIndex.Data.Body.PairingKeys {
+			var ok bool
+			if pairingKey.Tags, ok = migrateTags(pairingKey.Tags, keys); ok {
+				changed++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	bindings := 0
+	profileCont, _ := NewProfile(cont.env)
+	err = profileCont.UpdateProfiles(func(profiles *Profiles) error {
+		bindings = 0
+		for _, binding := range profiles.Bindings {
+			if migrated := MigrateTag(binding.Tag, keys); migrated != binding.Tag {
+				binding.Tag = migrated
+				bindings++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return changed, err
+	}
+
+	logger.Infof("migrated tags on %d items and %d profile bindings", changed, bindings)
+	return changed + bindings, nil
+}
+
 func (cont *OrgController) Delete(params *OrgParams) error {
 	logger.Debug("deleting org")
 	logger.Tracef("received params: %s", params)
 
-	return fmt.Errorf("Not implemented")
+	return newError(ErrNotImplemented, nil, "deleting org")
 }
@@ -1,14 +1,31 @@
 package controller
 
 import (
-	"fmt"
+	"regexp"
+	"strings"
 )
 
+var fingerprintRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
 type OrgParams struct {
 	Org           *string
 	Admin         *string
 	ConfirmDelete *string
 	Private       *bool
+	// Workers is how many registrations RunEnv processes at once
+	Workers *int
+	// BackupFile is the archive Backup writes and Restore reads
+	BackupFile *string
+	// Fingerprint is an org's OrgFingerprint, for trusting an org whose
+	// public org isn't in the home directory
+	Fingerprint *string
+	// PublicOrgFile is another org's public org for PinOrg
+	PublicOrgFile *string
+	// TagKeys is a comma separated list of the keys MigrateTags looks for
+	TagKeys *string
+	// Reissue is a comma separated list of the names of CAs whose
+	// certificates BootstrapIssuanceLog leaves for reconciling to issue
+	Reissue *string
 }
 
 func NewOrgParams() *OrgParams {
@@ -17,14 +34,103 @@ func NewOrgParams() *OrgParams {
 
 func (params *OrgParams) ValidateOrg() error {
 	if *params.Org == "" {
-		return fmt.Errorf("invalid org: Cannot be empty")
+		return newError(ErrInvalidParams, nil, "org cannot be empty")
 	}
 	return nil
 }
 
 func (params *OrgParams) ValidateAdmin() error {
 	if *params.Admin == "" {
-		return fmt.Errorf("invalid admin: Cannot be empty")
+		return newError(ErrInvalidParams, nil, "admin cannot be empty")
+	}
+	return nil
+}
+
+func (params *OrgParams) ValidateWorkers() error {
+	if params.Workers != nil && *params.Workers < 0 {
+		return newError(ErrInvalidParams, nil, "workers cannot be negative")
+	}
+	return nil
+}
+
+func (params *OrgParams) ValidateTagKeys(required bool) error {
+	if params.TagKeys == nil || strings.TrimSpace(*params.TagKeys) == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "tag keys cannot be empty")
+		}
+		return nil
+	}
+
+	for _, key := range params.tagKeys() {
+		if !tagKeyRegexp.MatchString(key) {
+			return newError(ErrInvalidParams, nil, "tag key '%s' is invalid, keys must start with a letter or digit and contain only letters, digits and ._/-", key)
+		}
+	}
+	return nil
+}
+
+// tagKeys returns the tag keys, normalized like tags.
+func (params *OrgParams) tagKeys() []string {
+	keys := make([]string, 0)
+	if params.TagKeys == nil {
+		return keys
+	}
+
+	for _, key := range ParseTags(*params.TagKeys) {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (params *OrgParams) ValidateBackupFile() error {
+	if params.BackupFile == nil || *params.BackupFile == "" {
+		return newError(ErrInvalidParams, nil, "backup file cannot be empty")
+	}
+	return nil
+}
+
+// reissue returns the CA names in Reissue.
+func (params *OrgParams) reissue() []string {
+	names := make([]string, 0)
+	if params.Reissue == nil {
+		return names
+	}
+
+	for _, name := range strings.Split(*params.Reissue, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (params *OrgParams) ValidateFingerprint(required bool) error {
+	if params.Fingerprint == nil || *params.Fingerprint == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "fingerprint cannot be empty")
+		}
+		return nil
+	}
+
+	if !fingerprintRegexp.MatchString(normalizeFingerprint(*params.Fingerprint)) {
+		return newError(ErrInvalidParams, nil, "fingerprint '%s' isn't a SHA-256 hex digest", *params.Fingerprint)
+	}
+	return nil
+}
+
+// fingerprint returns the normalized fingerprint, or an empty string.
+func (params *OrgParams) fingerprint() string {
+	if params.Fingerprint == nil {
+		return ""
+	}
+	return normalizeFingerprint(*params.Fingerprint)
+}
+
+func (params *OrgParams) ValidatePublicOrgFile(required bool) error {
+	if required && (params.PublicOrgFile == nil || *params.PublicOrgFile == "") {
+		return newError(ErrInvalidParams, nil, "public org file cannot be empty")
 	}
 	return nil
 }
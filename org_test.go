@@ -1,7 +1,9 @@
 package controller
 
 import (
+	"github.com/pki-io/core/index"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -11,3 +13,112 @@ func TestNewOrg(t *testing.T) {
 	assert.NotNil(t, org)
 	assert.NoError(t, err)
 }
+
+func TestOrgInitExisting(t *testing.T) {
+	setupOrg(t)
+	defer teardown()
+
+	org, _ := NewOrg(NewEnvironment())
+	params := NewOrgParams()
+	params.Org = stringPtr("test")
+	params.Admin = stringPtr("admin")
+	err := org.Init(params)
+	assert.True(t, IsAlreadyExists(err))
+}
+
+func TestOrgSaveIndexConflict(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	envA := backends.env(home)
+	assert.NoError(t, envA.LoadAdminEnv())
+	indexA, etagA, err := envA.controllers.org.GetIndexWithETag()
+	assert.NoError(t, err)
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	_, _, err = pkCont.New(newTestPairingKeyParams("web"))
+	assert.NoError(t, err)
+
+	// Saving the stale index would lose the pairing key
+	assert.NoError(t, indexA.AddCATags("ca", []string{"web"}))
+	err = envA.controllers.org.SaveIndex(indexA, etagA)
+	assert.True(t, IsConflict(err))
+}
+
+func TestOrgUpdateIndexMerges(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	envA := backends.env(home)
+	assert.NoError(t, envA.LoadAdminEnv())
+
+	pkCont, _ := NewPairingKey(backends.env(home))
+	first := true
+	err := envA.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if first {
+			// Someone else saves the index between our load and save
+			first = false
+			_, _, err := pkCont.New(newTestPairingKeyParams("web"))
+			assert.NoError(t, err)
+		}
+		return orgIndex.AddCATags("ca", []string{"web"})
+	})
+	assert.NoError(t, err)
+
+	orgIndex, err := envA.controllers.org.GetIndex()
+	assert.NoError(t, err)
+	assert.Len(t, orgIndex.Data.Body.PairingKeys, 1)
+	assert.Equal(t, []string{"ca"}, orgIndex.Data.Body.Tags.CAForward["web"])
+}
+
+func TestOrgInitLoadAPIFails(t *testing.T) {
+	// The fs API needs a local file system with a path
+	env := NewEnvironmentWithOptions(&EnvironmentOptions{Local: NewMemoryFs(), Home: NewMemoryFs()})
+	org, _ := NewOrg(env)
+	err := org.Init(newTestOrgParams("test", "admin"))
+	assert.True(t, IsInvalidParams(err))
+}
+
+func TestOrgMigrateTags(t *testing.T) {
+	backends, home := initMemoryOrg(t)
+
+	caCont, _ := NewCA(backends.env(home))
+	caParams := newTestCAParams("ca1")
+	caParams.Tags = stringPtr("env-prod, web")
+	_, err := caCont.New(caParams)
+	assert.NoError(t, err)
+
+	orgCont, _ := NewOrg(backends.env(home))
+	params := NewOrgParams()
+	_, err = orgCont.MigrateTags(params)
+	assert.True(t, IsInvalidParams(err))
+
+	params.TagKeys = stringPtr("env")
+	changed, err := orgCont.MigrateTags(params)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, changed)
+
+	caCont, _ = NewCA(backends.env(home))
+	listParams := newTestCAParams("")
+	listParams.Tags = stringPtr("env=prod")
+	cas, err := caCont.List(listParams)
+	assert.NoError(t, err)
+	assert.Len(t, cas, 1)
+
+	// Migrating again changes nothing
+	orgCont, _ = NewOrg(backends.env(home))
+	changed, err = orgCont.MigrateTags(params)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, changed)
+}
+
+func TestOrgParamsValidateFingerprint(t *testing.T) {
+	params := NewOrgParams()
+	assert.NoError(t, params.ValidateFingerprint(false))
+	assert.True(t, IsInvalidParams(params.ValidateFingerprint(true)))
+
+	params.Fingerprint = stringPtr("AB:" + strings.Repeat("0", 62))
+	assert.NoError(t, params.ValidateFingerprint(true))
+	assert.Equal(t, "ab"+strings.Repeat("0", 62), params.fingerprint())
+
+	params.Fingerprint = stringPtr("abc")
+	assert.True(t, IsInvalidParams(params.ValidateFingerprint(true)))
+}
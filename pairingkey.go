@@ -2,7 +2,7 @@
 package controller
 
 import (
-	"github.com/pki-io/core/x509"
+	"github.com/pki-io/core/index"
 	"strings"
 )
 
@@ -18,8 +18,8 @@ func NewPairingKey(env *Environment) (*PairingKeyController, error) {
 
 func (cont *PairingKeyController) GeneratePairingKey() (string, string) {
 	logger.Debug("generating pairing key")
-	id := x509.NewID()
-	key := x509.NewID()
+	id := cont.env.NewID()
+	key := cont.env.NewID()
 
 	logger.Trace("returning pairing key")
 	return id, key
@@ -29,16 +29,12 @@ func (cont *PairingKeyController) AddPairingKeyToOrgIndex(id, key, tags string)
 	logger.Debug("adding pairing key to org index")
 	logger.Tracef("received id '%s', key [NOT LOGGED], and tags '%s'", id, tags)
 
-	orgIndex, err := cont.env.controllers.org.GetIndex()
-	if err != nil {
-		return err
-	}
-
-	if err := orgIndex.AddPairingKey(id, key, ParseTags(tags)); err != nil {
-		return err
-	}
-
-	err = cont.env.controllers.org.SaveIndex(orgIndex)
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.AddPairingKey(id, key, ParseTags(tags)); err != nil {
+			return newError(ErrAlreadyExists, err, "adding pairing key '%s' to org index", id)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -113,7 +109,7 @@ func (cont *PairingKeyController) Show(params *PairingKeyParams) (string, string
 
 	pk, err := index.GetPairingKey(*params.Id)
 	if err != nil {
-		return "", "", "", err
+		return "", "", "", newError(ErrNotFound, err, "getting pairing key '%s'", *params.Id)
 	}
 
 	logger.Trace("returning pairing key")
@@ -136,16 +132,12 @@ func (cont *PairingKeyController) Delete(params *PairingKeyParams) error {
 		return err
 	}
 
-	index, err := cont.env.controllers.org.GetIndex()
-	if err != nil {
-		return err
-	}
-
-	if err := index.RemovePairingKey(*params.Id); err != nil {
-		return err
-	}
-
-	err = cont.env.controllers.org.SaveIndex(index)
+	err := cont.env.controllers.org.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		if err := orgIndex.RemovePairingKey(*params.Id); err != nil {
+			return newError(ErrNotFound, err, "removing pairing key '%s'", *params.Id)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
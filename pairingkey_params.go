@@ -1,9 +1,5 @@
 package controller
 
-import (
-	"fmt"
-)
-
 type PairingKeyParams struct {
 	Id            *string
 	Tags          *string
@@ -17,11 +13,14 @@ func NewPairingKeyParams() *PairingKeyParams {
 
 func (params *PairingKeyParams) ValidateID(required bool) error {
 	if required && *params.Id == "" {
-		return fmt.Errorf("id cannot be empty")
+		return newError(ErrInvalidParams, nil, "id cannot be empty")
 	}
 	return nil
 }
 
-func (params *PairingKeyParams) ValidateTags(required bool) error          { return nil }
+func (params *PairingKeyParams) ValidateTags(required bool) error {
+	return validateTagsParam(params.Tags, required)
+}
+
 func (params *PairingKeyParams) ValidatePrivate(required bool) error       { return nil }
 func (params *PairingKeyParams) ValidateConfirmDelete(required bool) error { return nil }
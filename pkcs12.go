@@ -0,0 +1,732 @@
+package controller
+
+import (
+	stdcrypto "crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	stdx509 "crypto/x509"
+	"encoding/asn1"
+	"golang.org/x/crypto/pbkdf2"
+	"hash"
+	"math/big"
+	"unicode/utf16"
+)
+
+// PKCS12Iterations is the PBKDF2 and MAC iteration count for PKCS #12 files.
+const PKCS12Iterations int = 10000
+
+// MaxPBEIterations is the most key derivation iterations accepted when
+// decrypting or checking the MAC of a file, so that a crafted file can't keep
+// the CPU busy for hours. Tools use a few thousand.
+const MaxPBEIterations int = 1000000
+
+// checkIterations checks an iteration count read from a file.
+func checkIterations(iterations int, what string) error {
+	if iterations < 1 || iterations > MaxPBEIterations {
+		return newError(ErrInvalidParams, nil, "%s iteration count %d must be between 1 and %d", what, iterations, MaxPBEIterations)
+	}
+	return nil
+}
+
+var (
+	oidData                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidX509Certificate     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyId          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+	oidAnyExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+	oidPBES2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	asn1NULL               = asn1.RawValue{Tag: asn1.TagNull}
+)
+
+const pkcs12Version int = 3
+
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pkcs12Attribute struct {
+	Id     asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type pkcs12SafeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12CertBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkcs12AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	Salt       []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type pkcs12PFX struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData `asn1:"optional"`
+}
+
+type pkcs12AlgorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pkcs12EncryptedPrivateKeyInfo struct {
+	Algorithm     pkcs12AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                       `asn1:"optional"`
+	PRF        pkcs12AlgorithmIdentifier `asn1:"optional"`
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkcs12AlgorithmIdentifier
+	EncryptionScheme  pkcs12AlgorithmIdentifier
+}
+
+// bmpString encodes s as a big-endian UCS-2 string, as PKCS #12 uses for
+// passwords and friendly names. Passwords are NUL terminated.
+func bmpString(s string, terminate bool) []byte {
+	units := utf16.Encode([]rune(s))
+	if terminate {
+		units = append(units, 0)
+	}
+
+	out := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		out = append(out, byte(u>>8), byte(u))
+	}
+	return out
+}
+
+// pkcs12KDF derives key material from a password as in RFC 7292 appendix B.
+// id is 1 for keys, 2 for IVs and 3 for MAC keys.
+func pkcs12KDF(hashFunc func() hash.Hash, password, salt []byte, id byte, iterations, size int) []byte {
+	v := hashFunc().BlockSize()
+
+	fill := func(in []byte) []byte {
+		if len(in) == 0 {
+			return nil
+		}
+		n := v * ((len(in) + v - 1) / v)
+		out := make([]byte, n)
+		for i := range out {
+			out[i] = in[i%len(in)]
+		}
+		return out
+	}
+
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+	i := append(fill(salt), fill(password)...)
+
+	out := make([]byte, 0, size)
+	for len(out) < size {
+		h := hashFunc()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for n := 1; n < iterations; n++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(nil)
+		}
+		out = append(out, a...)
+
+		// I_j = (I_j + B + 1) mod 2^(v*8) for each v byte block of I
+		b := new(big.Int).SetBytes(fill(a)[:v])
+		b.Add(b, big.NewInt(1))
+		for j := 0; j < len(i); j += v {
+			block := new(big.Int).SetBytes(i[j : j+v])
+			block.Add(block, b)
+			bytes := block.Bytes()
+			if len(bytes) > v {
+				bytes = bytes[len(bytes)-v:]
+			}
+			copy(i[j:j+v], make([]byte, v))
+			copy(i[j+v-len(bytes):j+v], bytes)
+		}
+	}
+	return out[:size]
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, wrapError(err, "generating random bytes")
+	}
+	return b, nil
+}
+
+// encryptPBES2 encrypts data with AES-256-CBC and a PBKDF2-HMAC-SHA256 key,
+// returning the algorithm identifier and ciphertext.
+func encryptPBES2(data []byte, password string, iterations int) (*pkcs12AlgorithmIdentifier, []byte, error) {
+	salt, err := randomBytes(16)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv, err := randomBytes(aes.BlockSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	plaintext := append(append([]byte{}, data...), make([]byte, padding)...)
+	for i := len(data); i < len(plaintext); i++ {
+		plaintext[i] = byte(padding)
+	}
+
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: iterations,
+		KeyLength:  32,
+		PRF:        pkcs12AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1NULL},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkcs12AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkcs12AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &pkcs12AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}}, ciphertext, nil
+}
+
+func pkcs12Attributes(name string, localKeyId []byte, trusted bool) ([]pkcs12Attribute, error) {
+	attributes := make([]pkcs12Attribute, 0, 3)
+	add := func(id asn1.ObjectIdentifier, value interface{}) error {
+		der, err := asn1.Marshal(value)
+		if err != nil {
+			return err
+		}
+		attributes = append(attributes, pkcs12Attribute{Id: id, Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der}})
+		return nil
+	}
+
+	if name != "" {
+		// BMPString has no Go type, so it's encoded by hand
+		friendlyName := asn1.RawValue{Class: asn1.ClassUniversal, Tag: 30, Bytes: bmpString(name, false)}
+		if err := add(oidFriendlyName, friendlyName); err != nil {
+			return nil, err
+		}
+	}
+
+	if localKeyId != nil {
+		if err := add(oidLocalKeyId, localKeyId); err != nil {
+			return nil, err
+		}
+	}
+
+	if trusted {
+		// Java only loads certificates without keys as trusted entries with
+		// this attribute
+		if err := add(oidJavaTrustedKeyUsage, oidAnyExtendedKeyUsage); err != nil {
+			return nil, err
+		}
+	}
+
+	return attributes, nil
+}
+
+// explicitTag wraps DER in an explicit [0] tag. encoding/asn1 ignores field
+// tags on raw values, so they're tagged by hand.
+func explicitTag(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+func pkcs12DataContentInfo(content []byte) (pkcs12ContentInfo, error) {
+	octets, err := asn1.Marshal(content)
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+	return pkcs12ContentInfo{ContentType: oidData, Content: explicitTag(octets)}, nil
+}
+
+// EncodePKCS12 encodes a key, its certificate and the chain as a password
+// protected PKCS #12 file. The key is encrypted with PBES2 using AES-256-CBC
+// and PBKDF2-HMAC-SHA256, and the file has a SHA-256 MAC, which Java 12+,
+// Windows and OpenSSL 1.1+ read. Without a key the certificates are exported
+// as trusted certificates.
+func EncodePKCS12(name string, key stdcrypto.Signer, cert *stdx509.Certificate, chain []*stdx509.Certificate, password string) ([]byte, error) {
+	if password == "" {
+		return nil, newError(ErrInvalidParams, nil, "PKCS #12 password cannot be empty")
+	}
+
+	var localKeyId []byte
+	if key != nil {
+		sum := sha256.Sum256(cert.Raw)
+		localKeyId = sum[:20]
+	}
+
+	bags := make([]pkcs12SafeBag, 0, len(chain)+2)
+	for i, c := range append([]*stdx509.Certificate{cert}, chain...) {
+		der, err := asn1.Marshal(pkcs12CertBag{Id: oidX509Certificate, Data: c.Raw})
+		if err != nil {
+			return nil, err
+		}
+
+		bagName, bagKeyId := "", []byte(nil)
+		if i == 0 {
+			bagName, bagKeyId = name, localKeyId
+		}
+
+		attributes, err := pkcs12Attributes(bagName, bagKeyId, key == nil)
+		if err != nil {
+			return nil, err
+		}
+
+		bags = append(bags, pkcs12SafeBag{Id: oidCertBag, Value: explicitTag(der), Attributes: attributes})
+	}
+
+	certContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return nil, wrapError(err, "encoding PKCS #12 certificates")
+	}
+
+	certInfo, err := pkcs12DataContentInfo(certContents)
+	if err != nil {
+		return nil, err
+	}
+	authSafe := []pkcs12ContentInfo{certInfo}
+
+	if key != nil {
+		pkcs8, err := stdx509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, wrapError(err, "encoding private key")
+		}
+
+		algorithm, encrypted, err := encryptPBES2(pkcs8, password, PKCS12Iterations)
+		if err != nil {
+			return nil, wrapError(err, "encrypting private key")
+		}
+
+		der, err := asn1.Marshal(pkcs12EncryptedPrivateKeyInfo{Algorithm: *algorithm, EncryptedData: encrypted})
+		if err != nil {
+			return nil, err
+		}
+
+		attributes, err := pkcs12Attributes(name, localKeyId, false)
+		if err != nil {
+			return nil, err
+		}
+
+		keyContents, err := asn1.Marshal([]pkcs12SafeBag{{Id: oidShroudedKeyBag, Value: explicitTag(der), Attributes: attributes}})
+		if err != nil {
+			return nil, wrapError(err, "encoding PKCS #12 key")
+		}
+
+		keyInfo, err := pkcs12DataContentInfo(keyContents)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, keyInfo)
+	}
+
+	authSafeContents, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+
+	macKey := pkcs12KDF(sha256.New, bmpString(password, true), salt, 3, PKCS12Iterations, sha256.Size)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(authSafeContents)
+
+	authSafeInfo, err := pkcs12DataContentInfo(authSafeContents)
+	if err != nil {
+		return nil, err
+	}
+
+	pfx := pkcs12PFX{
+		Version:  pkcs12Version,
+		AuthSafe: authSafeInfo,
+		MacData: pkcs12MacData{
+			Mac: pkcs12DigestInfo{
+				Algorithm: pkcs12AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1NULL},
+				Digest:    mac.Sum(nil),
+			},
+			Salt:       salt,
+			Iterations: PKCS12Iterations,
+		},
+	}
+
+	der, err := asn1.Marshal(pfx)
+	if err != nil {
+		return nil, wrapError(err, "encoding PKCS #12 file")
+	}
+	return der, nil
+}
+
+var (
+	oidEncryptedData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidSHA1                   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA384                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidHMACWithSHA1           = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA384         = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512         = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidDESEDE3CBC             = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidPBEWithSHAAnd3DES      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHAAnd128BitRC2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 5}
+	oidPBEWithSHAAnd40BitRC2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+)
+
+type pkcs12EncryptedData struct {
+	Version              int
+	EncryptedContentInfo struct {
+		ContentType                asn1.ObjectIdentifier
+		ContentEncryptionAlgorithm pkcs12AlgorithmIdentifier
+		EncryptedContent           []byte `asn1:"tag:0,optional"`
+	}
+}
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// hashForOID returns the hash for a digest or HMAC algorithm.
+func hashForOID(oid asn1.ObjectIdentifier) (func() hash.Hash, bool) {
+	switch {
+	case oid.Equal(oidSHA1), oid.Equal(oidHMACWithSHA1):
+		return sha1.New, true
+	case oid.Equal(oidSHA256), oid.Equal(oidHMACWithSHA256):
+		return sha256.New, true
+	case oid.Equal(oidSHA384), oid.Equal(oidHMACWithSHA384):
+		return sha512.New384, true
+	case oid.Equal(oidSHA512), oid.Equal(oidHMACWithSHA512):
+		return sha512.New, true
+	}
+	return nil, false
+}
+
+// decryptPBE decrypts data encrypted with PBES2 or one of the PKCS #12 PBE
+// algorithms. A wrong password returns ErrDecryptionFailed.
+func decryptPBE(algorithm pkcs12AlgorithmIdentifier, data []byte, password string) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+
+	switch {
+	case algorithm.Algorithm.Equal(oidPBES2):
+		var params pbes2Params
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, newError(ErrInvalidParams, err, "parsing PBES2 parameters")
+		}
+
+		if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+			return nil, newError(ErrNotImplemented, nil, "PBES2 key derivation function %s", params.KeyDerivationFunc.Algorithm)
+		}
+
+		var kdf pbkdf2Params
+		if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+			return nil, newError(ErrInvalidParams, err, "parsing PBKDF2 parameters")
+		}
+
+		prf := sha1.New
+		if kdf.PRF.Algorithm != nil {
+			var ok bool
+			if prf, ok = hashForOID(kdf.PRF.Algorithm); !ok {
+				return nil, newError(ErrNotImplemented, nil, "PBKDF2 PRF %s", kdf.PRF.Algorithm)
+			}
+		}
+
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+			return nil, newError(ErrInvalidParams, err, "parsing PBES2 IV")
+		}
+
+		var keyLen int
+		scheme := params.EncryptionScheme.Algorithm
+		switch {
+		case scheme.Equal(oidAES128CBC):
+			keyLen = 16
+		case scheme.Equal(oidAES192CBC):
+			keyLen = 24
+		case scheme.Equal(oidAES256CBC):
+			keyLen = 32
+		case scheme.Equal(oidDESEDE3CBC):
+			keyLen = 24
+		default:
+			return nil, newError(ErrNotImplemented, nil, "PBES2 encryption scheme %s", scheme)
+		}
+
+		if err := checkIterations(kdf.Iterations, "PBKDF2"); err != nil {
+			return nil, err
+		}
+
+		key := pbkdf2.Key([]byte(password), kdf.Salt, kdf.Iterations, keyLen, prf)
+		var err error
+		if scheme.Equal(oidDESEDE3CBC) {
+			block, err = des.NewTripleDESCipher(key)
+		} else {
+			block, err = aes.NewCipher(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+	case algorithm.Algorithm.Equal(oidPBEWithSHAAnd3DES),
+		algorithm.Algorithm.Equal(oidPBEWithSHAAnd128BitRC2),
+		algorithm.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2):
+		var params pkcs12PBEParams
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, newError(ErrInvalidParams, err, "parsing PBE parameters")
+		}
+
+		if err := checkIterations(params.Iterations, "PBE"); err != nil {
+			return nil, err
+		}
+
+		bmpPassword := bmpString(password, true)
+		kdf := func(id byte, size int) []byte {
+			return pkcs12KDF(sha1.New, bmpPassword, params.Salt, id, params.Iterations, size)
+		}
+
+		switch {
+		case algorithm.Algorithm.Equal(oidPBEWithSHAAnd3DES):
+			var err error
+			if block, err = des.NewTripleDESCipher(kdf(1, 24)); err != nil {
+				return nil, err
+			}
+		case algorithm.Algorithm.Equal(oidPBEWithSHAAnd128BitRC2):
+			block = newRC2Cipher(kdf(1, 16), 128)
+		default:
+			block = newRC2Cipher(kdf(1, 5), 40)
+		}
+		iv = kdf(2, block.BlockSize())
+
+	default:
+		return nil, newError(ErrNotImplemented, nil, "encryption algorithm %s", algorithm.Algorithm)
+	}
+
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, newError(ErrInvalidParams, nil, "encrypted data has the wrong length")
+	}
+
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, newError(ErrDecryptionFailed, nil, "wrong password")
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, newError(ErrDecryptionFailed, nil, "wrong password")
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// DecryptPKCS8 decrypts a DER encoded, encrypted PKCS #8 private key.
+func DecryptPKCS8(der []byte, password string) (stdcrypto.Signer, error) {
+	var info pkcs12EncryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, newError(ErrInvalidParams, err, "parsing encrypted private key")
+	}
+
+	pkcs8, err := decryptPBE(info.Algorithm, info.EncryptedData, password)
+	if err != nil {
+		return nil, wrapError(err, "decrypting private key")
+	}
+
+	return parsePKCS8(pkcs8)
+}
+
+func parsePKCS8(der []byte) (stdcrypto.Signer, error) {
+	key, err := stdx509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		// A wrong password can leave valid padding by chance
+		return nil, newError(ErrDecryptionFailed, err, "parsing private key")
+	}
+
+	signer, ok := key.(stdcrypto.Signer)
+	if !ok {
+		return nil, newError(ErrInvalidParams, nil, "unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// isPKCS12 reports whether DER data looks like a PKCS #12 file.
+func isPKCS12(der []byte) bool {
+	var pfx pkcs12PFX
+	rest, err := asn1.Unmarshal(der, &pfx)
+	return err == nil && len(rest) == 0 && pfx.Version == pkcs12Version && pfx.AuthSafe.ContentType != nil
+}
+
+// pkcs12VerifyMAC checks the file's MAC with the password. Empty passwords
+// are tried both as an empty string and as no password, as implementations
+// differ.
+func pkcs12VerifyMAC(macData *pkcs12MacData, content []byte, password string) error {
+	hashFunc, ok := hashForOID(macData.Mac.Algorithm.Algorithm)
+	if !ok {
+		return newError(ErrNotImplemented, nil, "PKCS #12 MAC algorithm %s", macData.Mac.Algorithm.Algorithm)
+	}
+
+	if err := checkIterations(macData.Iterations, "PKCS #12 MAC"); err != nil {
+		return err
+	}
+
+	passwords := [][]byte{bmpString(password, true)}
+	if password == "" {
+		passwords = append(passwords, nil)
+	}
+
+	for _, p := range passwords {
+		key := pkcs12KDF(hashFunc, p, macData.Salt, 3, macData.Iterations, hashFunc().Size())
+		mac := hmac.New(hashFunc, key)
+		mac.Write(content)
+		if hmac.Equal(mac.Sum(nil), macData.Mac.Digest) {
+			return nil
+		}
+	}
+	return newError(ErrDecryptionFailed, nil, "PKCS #12 MAC doesn't match, wrong password")
+}
+
+// DecodePKCS12 decodes a password protected PKCS #12 file, returning its
+// private key, which is nil if it doesn't have one, and its certificates.
+func DecodePKCS12(der []byte, password string) (stdcrypto.Signer, []*stdx509.Certificate, error) {
+	var pfx pkcs12PFX
+	if _, err := asn1.Unmarshal(der, &pfx); err != nil {
+		return nil, nil, newError(ErrInvalidParams, err, "parsing PKCS #12 file")
+	}
+
+	if !pfx.AuthSafe.ContentType.Equal(oidData) {
+		return nil, nil, newError(ErrNotImplemented, nil, "PKCS #12 files with public key integrity")
+	}
+
+	var content []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &content); err != nil {
+		return nil, nil, newError(ErrInvalidParams, err, "parsing PKCS #12 contents")
+	}
+
+	if pfx.MacData.Mac.Algorithm.Algorithm != nil {
+		if err := pkcs12VerifyMAC(&pfx.MacData, content, password); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var authSafe []pkcs12ContentInfo
+	if _, err := asn1.Unmarshal(content, &authSafe); err != nil {
+		return nil, nil, newError(ErrInvalidParams, err, "parsing PKCS #12 contents")
+	}
+
+	var key stdcrypto.Signer
+	certs := make([]*stdx509.Certificate, 0)
+	for _, info := range authSafe {
+		var safeContents []byte
+		switch {
+		case info.ContentType.Equal(oidData):
+			if _, err := asn1.Unmarshal(info.Content.Bytes, &safeContents); err != nil {
+				return nil, nil, newError(ErrInvalidParams, err, "parsing PKCS #12 safe contents")
+			}
+		case info.ContentType.Equal(oidEncryptedData):
+			var data pkcs12EncryptedData
+			if _, err := asn1.Unmarshal(info.Content.Bytes, &data); err != nil {
+				return nil, nil, newError(ErrInvalidParams, err, "parsing PKCS #12 encrypted data")
+			}
+
+			var err error
+			encrypted := data.EncryptedContentInfo
+			safeContents, err = decryptPBE(encrypted.ContentEncryptionAlgorithm, encrypted.EncryptedContent, password)
+			if err != nil {
+				return nil, nil, wrapError(err, "decrypting PKCS #12 safe contents")
+			}
+		default:
+			return nil, nil, newError(ErrNotImplemented, nil, "PKCS #12 content type %s", info.ContentType)
+		}
+
+		var bags []pkcs12SafeBag
+		if _, err := asn1.Unmarshal(safeContents, &bags); err != nil {
+			return nil, nil, newError(ErrInvalidParams, err, "parsing PKCS #12 safe bags")
+		}
+
+		for _, bag := range bags {
+			var err error
+			switch {
+			case bag.Id.Equal(oidCertBag):
+				var certBag pkcs12CertBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &certBag); err != nil {
+					return nil, nil, newError(ErrInvalidParams, err, "parsing PKCS #12 certificate bag")
+				}
+
+				if !certBag.Id.Equal(oidX509Certificate) {
+					continue
+				}
+
+				cert, err := stdx509.ParseCertificate(certBag.Data)
+				if err != nil {
+					return nil, nil, newError(ErrInvalidParams, err, "parsing PKCS #12 certificate")
+				}
+				certs = append(certs, cert)
+			case bag.Id.Equal(oidShroudedKeyBag):
+				if key, err = DecryptPKCS8(bag.Value.Bytes, password); err != nil {
+					return nil, nil, err
+				}
+			case bag.Id.Equal(oidKeyBag):
+				if key, err = parsePKCS8(bag.Value.Bytes); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	return key, certs, nil
+}
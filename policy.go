@@ -0,0 +1,204 @@
+package controller
+
+import (
+	stdx509 "crypto/x509"
+	"net"
+	"path"
+	"strings"
+)
+
+// KeyPolicy is the org's policy for the CSRs of nodes with a matching tag,
+// see Tag.Matches. A node's CSRs must satisfy every policy that applies to
+// it.
+type KeyPolicy struct {
+	Tag string `json:"tag"`
+	// KeySpecs are the allowed key specs, or empty for any
+	KeySpecs []string `json:"key-specs"`
+	// SANs are shell patterns for the DNS names and IP addresses nodes may
+	// request, which are then added to their certificates. A policy without
+	// any doesn't restrict the SANs other policies allow.
+	SANs []string `json:"sans"`
+}
+
+// Validate checks the policy's fields.
+func (policy *KeyPolicy) Validate() error {
+	if _, err := ParseTag(policy.Tag); err != nil {
+		return err
+	}
+
+	for _, spec := range policy.KeySpecs {
+		if err := ValidateKeySpec(spec); err != nil {
+			return err
+		}
+	}
+
+	for _, pattern := range policy.SANs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return newError(ErrInvalidParams, err, "SAN pattern '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+func (policy *KeyPolicy) allowsSAN(san string) bool {
+	for _, pattern := range policy.SANs {
+		if matched, _ := path.Match(pattern, san); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// PoliciesFor returns the key policies that apply to a node with the tags.
+func (p *Profiles) PoliciesFor(tags []string) []*KeyPolicy {
+	policies := make([]*KeyPolicy, 0)
+	for _, policy := range p.Policies {
+		for _, tag := range tags {
+			if MatchTag(policy.Tag, tag) {
+				policies = append(policies, policy)
+				break
+			}
+		}
+	}
+	return policies
+}
+
+// CheckCSR checks a node's CSR against the policies that apply to it and
+// returns the requested SANs, which are granted only if at least one policy
+// has SAN patterns and every SAN matches each policy's patterns. A CSR that
+// breaks a policy, including one requesting SANs that no policy allows,
+// returns ErrPolicyViolation. Without any policies the key can be anything.
+func CheckCSR(policies []*KeyPolicy, request *stdx509.CertificateRequest) ([]string, []net.IP, error) {
+	spec, err := KeySpecOf(request.PublicKey)
+	if err != nil {
+		return nil, nil, newError(ErrPolicyViolation, err, "checking CSR key")
+	}
+
+	for _, policy := range policies {
+		if len(policy.KeySpecs) == 0 {
+			continue
+		}
+
+		allowed := false
+		for _, s := range policy.KeySpecs {
+			if s == spec {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return nil, nil, newError(ErrPolicyViolation, nil, "key spec '%s' isn't allowed for tag '%s', must be one of %s", spec, policy.Tag, strings.Join(policy.KeySpecs, ", "))
+		}
+	}
+
+	if len(request.DNSNames) == 0 && len(request.IPAddresses) == 0 {
+		return nil, nil, nil
+	}
+
+	sanPolicies := make([]*KeyPolicy, 0)
+	for _, policy := range policies {
+		if len(policy.SANs) > 0 {
+			sanPolicies = append(sanPolicies, policy)
+		}
+	}
+
+	sans := append([]string{}, request.DNSNames...)
+	for _, ip := range request.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+
+	if len(sanPolicies) == 0 {
+		return nil, nil, newError(ErrPolicyViolation, nil, "CSR requests SANs %s but no key policy for the node allows SANs", strings.Join(sans, ", "))
+	}
+
+	for _, san := range sans {
+		for _, policy := range sanPolicies {
+			if !policy.allowsSAN(san) {
+				return nil, nil, newError(ErrPolicyViolation, nil, "SAN '%s' isn't allowed for tag '%s'", san, policy.Tag)
+			}
+		}
+	}
+
+	return request.DNSNames, request.IPAddresses, nil
+}
+
+// SetPolicy adds the key policy for a tag, replacing any existing one.
+func (cont *ProfileController) SetPolicy(params *ProfileParams) (*KeyPolicy, error) {
+	logger.Debug("setting key policy")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateTag(true); err != nil {
+		return nil, err
+	}
+
+	policy := &KeyPolicy{Tag: NormalizeTag(*params.Tag)}
+	if params.KeySpecs != nil {
+		policy.KeySpecs = splitList(strings.ToLower(*params.KeySpecs))
+	}
+	if params.SANs != nil {
+		policy.SANs = splitList(*params.SANs)
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return nil, err
+	}
+
+	err := cont.UpdateProfiles(func(profiles *Profiles) error {
+		policies := []*KeyPolicy{policy}
+		for _, p := range profiles.Policies {
+			if p.Tag != policy.Tag {
+				policies = append(policies, p)
+			}
+		}
+		profiles.Policies = policies
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Trace("returning key policy")
+	return policy, nil
+}
+
+// DeletePolicy removes the key policy for a tag.
+func (cont *ProfileController) DeletePolicy(params *ProfileParams) error {
+	logger.Debug("deleting key policy")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateTag(true); err != nil {
+		return err
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return err
+	}
+
+	tag := NormalizeTag(*params.Tag)
+	err := cont.UpdateProfiles(func(profiles *Profiles) error {
+		policies := make([]*KeyPolicy, 0)
+		for _, p := range profiles.Policies {
+			if p.Tag != tag {
+				policies = append(policies, p)
+			}
+		}
+
+		if len(policies) == len(profiles.Policies) {
+			return newError(ErrNotFound, nil, "key policy for tag '%s'", tag)
+		}
+
+		profiles.Policies = policies
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Trace("returning nil error")
+	return nil
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTestRequest(t *testing.T, spec string, dnsNames, ips []string) *stdx509.CertificateRequest {
+	csrPem, _, _, err := GenerateCSR(&CSRRequest{
+		KeySpec:     spec,
+		Subject:     pkix.Name{CommonName: "node1"},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+	})
+	assert.NoError(t, err)
+
+	block, _ := pem.Decode([]byte(csrPem))
+	request, err := stdx509.ParseCertificateRequest(block.Bytes)
+	assert.NoError(t, err)
+	return request
+}
+
+func TestKeyPolicyValidate(t *testing.T) {
+	assert.NoError(t, (&KeyPolicy{Tag: "env=prod", KeySpecs: []string{KeySpecP256}, SANs: []string{"*.example.com"}}).Validate())
+	assert.True(t, IsInvalidParams((&KeyPolicy{Tag: "env=prod", KeySpecs: []string{"rsa-512"}}).Validate()))
+	assert.True(t, IsInvalidParams((&KeyPolicy{Tag: "env=prod", SANs: []string{"[a"}}).Validate()))
+}
+
+func TestPoliciesFor(t *testing.T) {
+	profiles := NewProfiles()
+	profiles.Policies = []*KeyPolicy{{Tag: "compliance"}, {Tag: "env=prod"}}
+
+	assert.Len(t, profiles.PoliciesFor([]string{"compliance=pci", "env=dev"}), 1)
+	assert.Len(t, profiles.PoliciesFor([]string{"compliance=pci", "env=prod"}), 2)
+	assert.Empty(t, profiles.PoliciesFor(nil))
+}
+
+func TestCheckCSR(t *testing.T) {
+	policies := []*KeyPolicy{
+		{Tag: "compliance", KeySpecs: []string{KeySpecP256}, SANs: []string{"*.example.com", "10.0.0.*"}},
+	}
+
+	request := newTestRequest(t, KeySpecP256, []string{"node1.example.com"}, []string{"10.0.0.1"})
+	dnsNames, ips, err := CheckCSR(policies, request)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node1.example.com"}, dnsNames)
+	assert.Len(t, ips, 1)
+
+	_, _, err = CheckCSR(policies, newTestRequest(t, KeySpecRSA2048, nil, nil))
+	assert.True(t, IsPolicyViolation(err))
+
+	_, _, err = CheckCSR(policies, newTestRequest(t, KeySpecP256, []string{"node1.example.org"}, nil))
+	assert.True(t, IsPolicyViolation(err))
+
+	// Without policies any key is fine but SANs aren't allowed
+	_, _, err = CheckCSR(nil, newTestRequest(t, KeySpecRSA2048, nil, nil))
+	assert.NoError(t, err)
+	_, _, err = CheckCSR(nil, request)
+	assert.True(t, IsPolicyViolation(err))
+
+	// Policies without SAN patterns don't restrict SANs, but don't allow
+	// any by themselves
+	keyOnly := &KeyPolicy{Tag: "env=prod", KeySpecs: []string{KeySpecP256}}
+	_, _, err = CheckCSR([]*KeyPolicy{keyOnly}, request)
+	assert.True(t, IsPolicyViolation(err))
+	dnsNames, _, err = CheckCSR(append(policies, keyOnly), request)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node1.example.com"}, dnsNames)
+}
@@ -0,0 +1,590 @@
+package controller
+
+import (
+	"bytes"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/pki-io/core/crypto"
+	"github.com/pki-io/core/x509"
+	"net"
+	"sort"
+	"text/template"
+	"time"
+)
+
+// ProfilesDocument is the name of the org's private document holding the
+// certificate profiles and their bindings.
+const ProfilesDocument string = "certificate-profiles"
+
+// DefaultProfileCommonName is the common name template used when a profile
+// doesn't set one.
+const DefaultProfileCommonName string = "{{.Name}}"
+
+// DefaultProfileName names the implicit profile used to sign node CSRs that
+// the CA's defaults can't, e.g. with SANs or Ed25519 keys.
+const DefaultProfileName string = "default"
+
+var extKeyUsages = map[string]stdx509.ExtKeyUsage{
+	"server":        stdx509.ExtKeyUsageServerAuth,
+	"client":        stdx509.ExtKeyUsageClientAuth,
+	"code-signing":  stdx509.ExtKeyUsageCodeSigning,
+	"email":         stdx509.ExtKeyUsageEmailProtection,
+	"time-stamping": stdx509.ExtKeyUsageTimeStamping,
+	"ocsp-signing":  stdx509.ExtKeyUsageOCSPSigning,
+	"any":           stdx509.ExtKeyUsageAny,
+}
+
+// CertProfile is the shape of the certificates issued to nodes for a tag.
+// The common name and SANs are templates over ProfileData, e.g.
+// "{{.Name}}.{{.Tags.env}}.example.com".
+type CertProfile struct {
+	Name string `json:"name"`
+	// Expiry is the validity in days, or 0 for the CA's cert expiry
+	Expiry       int      `json:"expiry"`
+	CommonName   string   `json:"common-name"`
+	DNSNames     []string `json:"dns-names"`
+	IPAddresses  []string `json:"ip-addresses"`
+	ExtKeyUsages []string `json:"ext-key-usages"`
+	// KeyType is the key type the node's CSR must have, or empty for any
+	KeyType string `json:"key-type"`
+}
+
+// ProfileBinding issues certificates with a profile from a CA to nodes with a
+// matching tag, see Tag.Matches.
+type ProfileBinding struct {
+	Tag     string `json:"tag"`
+	CAId    string `json:"ca-id"`
+	Profile string `json:"profile"`
+}
+
+// Profiles is the org's profiles document.
+type Profiles struct {
+	Profiles map[string]*CertProfile `json:"profiles"`
+	Bindings []*ProfileBinding       `json:"bindings"`
+	Policies []*KeyPolicy            `json:"policies"`
+}
+
+// ProfileData is what profile templates are rendered with.
+type ProfileData struct {
+	Name string
+	Id   string
+	// Tags maps the node's tag keys to values, which are empty for tags
+	// with just a key
+	Tags map[string]string
+	// DNSNames and IPAddresses are the SANs the node requested that its
+	// key policies grant, which are added to the certificate
+	DNSNames    []string
+	IPAddresses []net.IP
+}
+
+// NewProfileData returns the template data for a node.
+func NewProfileData(name, id string, tags []string) *ProfileData {
+	data := &ProfileData{Name: name, Id: id, Tags: make(map[string]string)}
+	for _, t := range tags {
+		tag := splitTag(NormalizeTag(t))
+		if tag.Key != "" {
+			data.Tags[tag.Key] = tag.Value
+		}
+	}
+	return data
+}
+
+func NewProfiles() *Profiles {
+	return &Profiles{
+		Profiles: make(map[string]*CertProfile),
+		Bindings: make([]*ProfileBinding, 0),
+		Policies: make([]*KeyPolicy, 0),
+	}
+}
+
+// Bound returns the bindings whose tag matches the node tag.
+func (p *Profiles) Bound(tag string) []*ProfileBinding {
+	bindings := make([]*ProfileBinding, 0)
+	for _, binding := range p.Bindings {
+		if MatchTag(binding.Tag, tag) {
+			bindings = append(bindings, binding)
+		}
+	}
+	return bindings
+}
+
+// Validate checks the profile's fields and templates.
+func (profile *CertProfile) Validate() error {
+	if profile.Name == "" {
+		return newError(ErrInvalidParams, nil, "profile name cannot be empty")
+	}
+
+	if profile.Expiry < 0 {
+		return newError(ErrInvalidParams, nil, "profile '%s' expiry cannot be negative", profile.Name)
+	}
+
+	switch crypto.KeyType(profile.KeyType) {
+	case "", crypto.KeyTypeRSA, crypto.KeyTypeEC, KeyTypeEd25519:
+	default:
+		return newError(ErrInvalidParams, nil, "profile '%s' has unknown key type '%s'", profile.Name, profile.KeyType)
+	}
+
+	for _, usage := range profile.ExtKeyUsages {
+		if _, ok := extKeyUsages[usage]; !ok {
+			return newError(ErrInvalidParams, nil, "profile '%s' has unknown extended key usage '%s'", profile.Name, usage)
+		}
+	}
+
+	templates := append([]string{profile.CommonName}, profile.DNSNames...)
+	templates = append(templates, profile.IPAddresses...)
+	for _, text := range templates {
+		if _, err := template.New("").Parse(text); err != nil {
+			return newError(ErrInvalidParams, err, "profile '%s' template '%s'", profile.Name, text)
+		}
+	}
+
+	return nil
+}
+
+func renderProfileTemplate(text string, data *ProfileData) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Template returns the certificate template for a node, without the serial
+// number and keys. expiry is used if the profile doesn't set one.
+func (profile *CertProfile) Template(data *ProfileData, subject pkix.Name, expiry int, now time.Time) (*stdx509.Certificate, error) {
+	if profile.Expiry > 0 {
+		expiry = profile.Expiry
+	}
+
+	commonName := profile.CommonName
+	if commonName == "" {
+		commonName = DefaultProfileCommonName
+	}
+
+	var err error
+	subject.CommonName, err = renderProfileTemplate(commonName, data)
+	if err != nil {
+		return nil, newError(ErrInvalidParams, err, "rendering common name for profile '%s'", profile.Name)
+	}
+
+	template := &stdx509.Certificate{
+		Subject:               subject,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.AddDate(0, 0, expiry),
+		KeyUsage:              stdx509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	for _, text := range profile.DNSNames {
+		name, err := renderProfileTemplate(text, data)
+		if err != nil || name == "" {
+			return nil, newError(ErrInvalidParams, err, "rendering DNS name '%s' for profile '%s'", text, profile.Name)
+		}
+		template.DNSNames = append(template.DNSNames, name)
+	}
+
+	for _, text := range profile.IPAddresses {
+		addr, err := renderProfileTemplate(text, data)
+		if err != nil {
+			return nil, newError(ErrInvalidParams, err, "rendering IP address '%s' for profile '%s'", text, profile.Name)
+		}
+
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, newError(ErrInvalidParams, nil, "profile '%s' IP address '%s' is invalid", profile.Name, addr)
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+
+	template.DNSNames = append(template.DNSNames, data.DNSNames...)
+	template.IPAddresses = append(template.IPAddresses, data.IPAddresses...)
+
+	for _, usage := range profile.ExtKeyUsages {
+		template.ExtKeyUsage = append(template.ExtKeyUsage, extKeyUsages[usage])
+	}
+
+	return template, nil
+}
+
+// SignWithProfile signs a CSR with a CA, giving the certificate the profile's
+// shape rather than the CA's defaults.
+func SignWithProfile(ca *x509.CA, csr *x509.CSR, profile *CertProfile, data *ProfileData, now time.Time) (*x509.Certificate, error) {
+	return signRequest(ca, csr, profile, data, false, now)
+}
+
+// signRequest signs a CSR with a CA and profile, keeping the CSR's subject
+// rather than the CA's DN scope and profile's common name if keepSubject is
+// set.
+func signRequest(ca *x509.CA, csr *x509.CSR, profile *CertProfile, data *ProfileData, keepSubject bool, now time.Time) (*x509.Certificate, error) {
+	logger.Debugf("signing CSR with CA '%s' and profile '%s'", ca.Data.Body.Id, profile.Name)
+
+	caCert, signer, err := caSigner(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := x509.PemDecodeX509CSR([]byte(csr.Data.Body.CSR))
+	if err != nil {
+		return nil, wrapError(err, "decoding CSR '%s'", csr.Data.Body.Id)
+	}
+
+	if err := request.CheckSignature(); err != nil {
+		return nil, newError(ErrVerificationFailed, err, "checking CSR '%s' signature", csr.Data.Body.Id)
+	}
+
+	keyType, err := KeyTypeOf(request.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if profile.KeyType != "" && crypto.KeyType(profile.KeyType) != keyType {
+		return nil, newError(ErrPolicyViolation, nil, "profile '%s' requires a %s key but CSR '%s' has a %s key", profile.Name, profile.KeyType, csr.Data.Body.Id, keyType)
+	}
+
+	subject := caSubject(ca)
+	if keepSubject {
+		subject = request.Subject
+	}
+
+	expiry := ca.Data.Body.CertExpiry
+	if profile.Expiry > 0 {
+		expiry = profile.Expiry
+	}
+
+	template, err := profile.Template(data, subject, expiry, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if keepSubject {
+		template.Subject.CommonName = request.Subject.CommonName
+	}
+
+	if keyType == crypto.KeyTypeRSA {
+		template.KeyUsage |= stdx509.KeyUsageKeyEncipherment
+	}
+
+	certPem, err := issueCertificate(template, caCert, request.PublicKey, signer)
+	if err != nil {
+		return nil, wrapError(err, "signing CSR '%s' with CA '%s'", csr.Data.Body.Id, ca.Data.Body.Id)
+	}
+
+	cert, err := x509.NewCertificate(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Data.Body.Name = data.Name
+	cert.Data.Body.Expiry = expiry
+	cert.Data.Body.Certificate = certPem
+	cert.Data.Body.CACertificate = ca.Data.Body.Certificate
+	cert.Data.Body.KeyType = string(keyType)
+
+	return cert, nil
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+type ProfileController struct {
+	env *Environment
+}
+
+func NewProfile(env *Environment) (*ProfileController, error) {
+	cont := new(ProfileController)
+	cont.env = env
+	return cont, nil
+}
+
+// GetProfiles returns the org's profiles and the ETag of the stored document,
+// which is empty if there isn't one yet.
+func (cont *ProfileController) GetProfiles() (*Profiles, string, error) {
+	logger.Debug("getting certificate profiles")
+
+	profiles := NewProfiles()
+	etag, err := cont.env.controllers.org.GetDocument(ProfilesDocument, profiles)
+	if IsNotFound(err) {
+		logger.Debug("no certificate profiles yet")
+		return profiles, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	logger.Trace("returning certificate profiles")
+	return profiles, etag, nil
+}
+
+// UpdateProfiles applies update to the latest profiles and saves them,
+// retrying if someone else saved them in the meantime.
+func (cont *ProfileController) UpdateProfiles(update func(*Profiles) error) error {
+	logger.Debug("updating certificate profiles")
+
+	for attempt := 0; attempt < IndexUpdateAttempts; attempt++ {
+		profiles, etag, err := cont.GetProfiles()
+		if err != nil {
+			return err
+		}
+
+		if err := update(profiles); err != nil {
+			return err
+		}
+
+		err = cont.env.controllers.org.SaveDocument(ProfilesDocument, profiles, etag)
+		if !IsConflict(err) {
+			return err
+		}
+
+		logger.Info("certificate profiles changed while updating, retrying")
+	}
+
+	return newError(ErrConflict, nil, "updating certificate profiles after %d attempts", IndexUpdateAttempts)
+}
+
+func (cont *ProfileController) New(params *ProfileParams) (*CertProfile, error) {
+	logger.Debug("creating new certificate profile")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateName(true); err != nil {
+		return nil, err
+	}
+
+	profile := params.profile()
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return nil, err
+	}
+
+	err := cont.UpdateProfiles(func(profiles *Profiles) error {
+		if _, ok := profiles.Profiles[profile.Name]; ok {
+			return newError(ErrAlreadyExists, nil, "certificate profile '%s'", profile.Name)
+		}
+		profiles.Profiles[profile.Name] = profile
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Trace("returning certificate profile")
+	return profile, nil
+}
+
+func (cont *ProfileController) List(params *ProfileParams) ([]*CertProfile, error) {
+	logger.Debug("listing certificate profiles")
+	logger.Tracef("received params: %s", params)
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return nil, err
+	}
+
+	profiles, _, err := cont.GetProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(profiles.Profiles))
+	for name := range profiles.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]*CertProfile, 0, len(names))
+	for _, name := range names {
+		list = append(list, profiles.Profiles[name])
+	}
+
+	logger.Trace("returning certificate profiles")
+	return list, nil
+}
+
+// Show returns a profile and its bindings.
+func (cont *ProfileController) Show(params *ProfileParams) (*CertProfile, []*ProfileBinding, error) {
+	logger.Debug("showing certificate profile")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateName(true); err != nil {
+		return nil, nil, err
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return nil, nil, err
+	}
+
+	profiles, _, err := cont.GetProfiles()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	profile, ok := profiles.Profiles[*params.Name]
+	if !ok {
+		return nil, nil, newError(ErrNotFound, nil, "certificate profile '%s'", *params.Name)
+	}
+
+	bindings := make([]*ProfileBinding, 0)
+	for _, binding := range profiles.Bindings {
+		if binding.Profile == profile.Name {
+			bindings = append(bindings, binding)
+		}
+	}
+
+	logger.Trace("returning certificate profile")
+	return profile, bindings, nil
+}
+
+// Delete removes a profile and its bindings.
+func (cont *ProfileController) Delete(params *ProfileParams) error {
+	logger.Debug("deleting certificate profile")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateName(true); err != nil {
+		return err
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return err
+	}
+
+	err := cont.UpdateProfiles(func(profiles *Profiles) error {
+		if _, ok := profiles.Profiles[*params.Name]; !ok {
+			return newError(ErrNotFound, nil, "certificate profile '%s'", *params.Name)
+		}
+		delete(profiles.Profiles, *params.Name)
+
+		bindings := make([]*ProfileBinding, 0)
+		for _, binding := range profiles.Bindings {
+			if binding.Profile != *params.Name {
+				bindings = append(bindings, binding)
+			}
+		}
+		profiles.Bindings = bindings
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Trace("returning nil error")
+	return nil
+}
+
+// Bind issues certificates with the named profile from the CA to nodes with
+// the tag.
+func (cont *ProfileController) Bind(params *ProfileParams) (*ProfileBinding, error) {
+	logger.Debug("binding certificate profile")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateName(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateTag(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateCA(true); err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return nil, err
+	}
+
+	index, err := cont.env.controllers.org.GetIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	caId, err := index.GetCA(*params.CA)
+	if err != nil {
+		return nil, newError(ErrNotFound, err, "getting CA '%s'", *params.CA)
+	}
+
+	binding := &ProfileBinding{Tag: NormalizeTag(*params.Tag), CAId: caId, Profile: *params.Name}
+	err = cont.UpdateProfiles(func(profiles *Profiles) error {
+		if _, ok := profiles.Profiles[binding.Profile]; !ok {
+			return newError(ErrNotFound, nil, "certificate profile '%s'", binding.Profile)
+		}
+
+		for _, b := range profiles.Bindings {
+			if *b == *binding {
+				return newError(ErrAlreadyExists, nil, "binding of profile '%s' to tag '%s' and CA '%s'", binding.Profile, binding.Tag, *params.CA)
+			}
+		}
+
+		profiles.Bindings = append(profiles.Bindings, binding)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Trace("returning profile binding")
+	return binding, nil
+}
+
+// Unbind removes the binding of the named profile to the tag and CA.
+func (cont *ProfileController) Unbind(params *ProfileParams) error {
+	logger.Debug("unbinding certificate profile")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateName(true); err != nil {
+		return err
+	}
+
+	if err := params.ValidateTag(true); err != nil {
+		return err
+	}
+
+	if err := params.ValidateCA(true); err != nil {
+		return err
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return err
+	}
+
+	index, err := cont.env.controllers.org.GetIndex()
+	if err != nil {
+		return err
+	}
+
+	caId, err := index.GetCA(*params.CA)
+	if err != nil {
+		return newError(ErrNotFound, err, "getting CA '%s'", *params.CA)
+	}
+
+	binding := ProfileBinding{Tag: NormalizeTag(*params.Tag), CAId: caId, Profile: *params.Name}
+	err = cont.UpdateProfiles(func(profiles *Profiles) error {
+		bindings := make([]*ProfileBinding, 0)
+		for _, b := range profiles.Bindings {
+			if *b != binding {
+				bindings = append(bindings, b)
+			}
+		}
+
+		if len(bindings) == len(profiles.Bindings) {
+			return newError(ErrNotFound, nil, "binding of profile '%s' to tag '%s' and CA '%s'", binding.Profile, binding.Tag, *params.CA)
+		}
+
+		profiles.Bindings = bindings
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Trace("returning nil error")
+	return nil
+}
@@ -0,0 +1,80 @@
+package controller
+
+type ProfileParams struct {
+	Name   *string
+	Expiry *int
+	// CommonName, DNSNames and IPAddresses are templates, see CertProfile.
+	// DNSNames, IPAddresses and ExtKeyUsages are comma separated lists.
+	CommonName   *string
+	DNSNames     *string
+	IPAddresses  *string
+	ExtKeyUsages *string
+	KeyType      *string
+	// Tag and CA name a binding
+	Tag           *string
+	CA            *string
+	ConfirmDelete *string
+	// KeySpecs and SANs are comma separated lists for a key policy, see
+	// KeyPolicy
+	KeySpecs *string
+	SANs     *string
+}
+
+func NewProfileParams() *ProfileParams {
+	return new(ProfileParams)
+}
+
+func (params *ProfileParams) ValidateName(required bool) error {
+	if required && (params.Name == nil || *params.Name == "") {
+		return newError(ErrInvalidParams, nil, "name cannot be empty")
+	}
+	return nil
+}
+
+func (params *ProfileParams) ValidateTag(required bool) error {
+	if params.Tag == nil || *params.Tag == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "tag cannot be empty")
+		}
+		return nil
+	}
+
+	_, err := ParseTag(*params.Tag)
+	return err
+}
+
+func (params *ProfileParams) ValidateCA(required bool) error {
+	if required && (params.CA == nil || *params.CA == "") {
+		return newError(ErrInvalidParams, nil, "CA cannot be empty")
+	}
+	return nil
+}
+
+func (params *ProfileParams) ValidateConfirmDelete(required bool) error { return nil }
+
+// profile returns the profile described by the params.
+func (params *ProfileParams) profile() *CertProfile {
+	profile := new(CertProfile)
+	if params.Name != nil {
+		profile.Name = *params.Name
+	}
+	if params.Expiry != nil {
+		profile.Expiry = *params.Expiry
+	}
+	if params.CommonName != nil {
+		profile.CommonName = *params.CommonName
+	}
+	if params.DNSNames != nil {
+		profile.DNSNames = splitList(*params.DNSNames)
+	}
+	if params.IPAddresses != nil {
+		profile.IPAddresses = splitList(*params.IPAddresses)
+	}
+	if params.ExtKeyUsages != nil {
+		profile.ExtKeyUsages = splitList(*params.ExtKeyUsages)
+	}
+	if params.KeyType != nil {
+		profile.KeyType = *params.KeyType
+	}
+	return profile
+}
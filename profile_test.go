@@ -0,0 +1,96 @@
+package controller
+
+import (
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/pki-io/core/index"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCertProfileValidate(t *testing.T) {
+	profile := &CertProfile{Name: "web", ExtKeyUsages: []string{"server", "client"}, KeyType: "ec"}
+	assert.NoError(t, profile.Validate())
+
+	for _, bad := range []*CertProfile{
+		{},
+		{Name: "web", Expiry: -1},
+		{Name: "web", KeyType: "dsa"},
+		{Name: "web", ExtKeyUsages: []string{"serverauth"}},
+		{Name: "web", DNSNames: []string{"{{.Name"}},
+	} {
+		assert.True(t, IsInvalidParams(bad.Validate()), bad.Name)
+	}
+}
+
+func TestCertProfileTemplate(t *testing.T) {
+	profile := &CertProfile{
+		Name:         "web",
+		Expiry:       30,
+		CommonName:   "{{.Name}}.example.com",
+		DNSNames:     []string{"{{.Name}}.{{.Tags.env}}.example.com", "www.example.com"},
+		IPAddresses:  []string{"10.0.0.1"},
+		ExtKeyUsages: []string{"server"},
+	}
+
+	now := time.Now()
+	data := NewProfileData("node1", "1", []string{"web", "env=prod"})
+	template, err := profile.Template(data, pkix.Name{Organization: []string{"org"}}, 365, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "node1.example.com", template.Subject.CommonName)
+	assert.Equal(t, []string{"org"}, template.Subject.Organization)
+	assert.Equal(t, []string{"node1.prod.example.com", "www.example.com"}, template.DNSNames)
+	assert.Equal(t, "10.0.0.1", template.IPAddresses[0].String())
+	assert.Equal(t, []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth}, template.ExtKeyUsage)
+	assert.Equal(t, now.AddDate(0, 0, 30), template.NotAfter)
+
+	// The default common name is the node name and expiry comes from the CA
+	profile = &CertProfile{Name: "default"}
+	template, err = profile.Template(data, pkix.Name{}, 365, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "node1", template.Subject.CommonName)
+	assert.Equal(t, now.AddDate(0, 0, 365), template.NotAfter)
+
+	// Templates can't use tags the node doesn't have
+	profile = &CertProfile{Name: "web", DNSNames: []string{"{{.Tags.region}}.example.com"}}
+	_, err = profile.Template(data, pkix.Name{}, 365, now)
+	assert.True(t, IsInvalidParams(err))
+}
+
+func TestProfilesBound(t *testing.T) {
+	profiles := NewProfiles()
+	profiles.Bindings = []*ProfileBinding{
+		{Tag: "web", CAId: "1", Profile: "server"},
+		{Tag: "env", CAId: "1", Profile: "client"},
+		{Tag: "env=dev", CAId: "2", Profile: "client"},
+	}
+
+	assert.Len(t, profiles.Bound("web"), 1)
+	assert.Len(t, profiles.Bound("env=prod"), 1)
+	assert.Len(t, profiles.Bound("env=dev"), 2)
+	assert.Len(t, profiles.Bound("db"), 0)
+}
+
+func TestRegistrationIssuances(t *testing.T) {
+	orgIndex, _ := index.NewOrg(nil)
+	orgIndex.Data.Body.Tags.CAForward = map[string][]string{"web": {"1", "2"}, "mtls": {"1"}}
+
+	profiles := NewProfiles()
+	profiles.Profiles["server"] = &CertProfile{Name: "server"}
+	profiles.Profiles["client"] = &CertProfile{Name: "client"}
+	profiles.Bindings = []*ProfileBinding{
+		{Tag: "web", CAId: "1", Profile: "server"},
+		{Tag: "mtls", CAId: "1", Profile: "client"},
+		{Tag: "mtls", CAId: "1", Profile: "missing"},
+	}
+
+	batch := &registrationBatch{orgIndex: orgIndex, profiles: profiles}
+	issuances := batch.issuances([]string{"web", "mtls"})
+
+	// The bound CA issues with its profiles rather than its defaults
+	assert.Len(t, issuances, 3)
+	assert.Equal(t, &issuance{caId: "1", tag: "web", profile: profiles.Profiles["server"]}, issuances[0])
+	assert.Equal(t, &issuance{caId: "2", tag: "web"}, issuances[1])
+	assert.Equal(t, &issuance{caId: "1", tag: "mtls", profile: profiles.Profiles["client"]}, issuances[2])
+}
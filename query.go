@@ -0,0 +1,365 @@
+package controller
+
+import (
+	"sort"
+)
+
+// Query is a boolean expression over tags, e.g.
+//
+//	env=prod AND role=web AND NOT legacy
+//
+// Terms are tags, and a term with just a key matches that key with any value.
+// NOT binds tightest, then AND, then OR, and parentheses group. Keywords are
+// upper case, and terms are normalized like ParseTags stores tags. A term
+// written the legacy way, such as "env:prod", matches the flat tag and the tag
+// MigrateTags would rewrite it to, so queries work before and after migrating.
+type Query struct {
+	source string
+	root   queryNode
+}
+
+type queryNode interface {
+	// resolve returns the IDs in universe that match, using the tag to IDs map
+	resolve(forward map[string][]string, universe map[string]bool) map[string]bool
+	// match reports whether a set of tags matches
+	match(tags map[string]bool) bool
+}
+
+type queryTag struct {
+	// tags are the term and, for a legacy term, its migrated forms
+	tags []string
+}
+
+type queryNot struct {
+	operand queryNode
+}
+
+type queryAnd struct {
+	left, right queryNode
+}
+
+type queryOr struct {
+	left, right queryNode
+}
+
+func (q *queryTag) resolve(forward map[string][]string, universe map[string]bool) map[string]bool {
+	ids := make(map[string]bool)
+	for _, pattern := range q.tags {
+		for _, tag := range matchingTags(pattern, forward) {
+			for _, id := range forward[tag] {
+				if universe[id] {
+					ids[id] = true
+				}
+			}
+		}
+	}
+	return ids
+}
+
+func (q *queryTag) match(tags map[string]bool) bool {
+	for _, pattern := range q.tags {
+		for tag := range tags {
+			if MatchTag(pattern, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *queryNot) resolve(forward map[string][]string, universe map[string]bool) map[string]bool {
+	excluded := q.operand.resolve(forward, universe)
+	ids := make(map[string]bool)
+	for id := range universe {
+		if !excluded[id] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func (q *queryNot) match(tags map[string]bool) bool {
+	return !q.operand.match(tags)
+}
+
+func (q *queryAnd) resolve(forward map[string][]string, universe map[string]bool) map[string]bool {
+	left := q.left.resolve(forward, universe)
+	right := q.right.resolve(forward, left)
+	return right
+}
+
+func (q *queryAnd) match(tags map[string]bool) bool {
+	return q.left.match(tags) && q.right.match(tags)
+}
+
+func (q *queryOr) resolve(forward map[string][]string, universe map[string]bool) map[string]bool {
+	ids := q.left.resolve(forward, universe)
+	for id := range q.right.resolve(forward, universe) {
+		ids[id] = true
+	}
+	return ids
+}
+
+func (q *queryOr) match(tags map[string]bool) bool {
+	return q.left.match(tags) || q.right.match(tags)
+}
+
+// queryParser is a recursive descent parser for queries.
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+func tokenizeQuery(s string) []string {
+	tokens := make([]string, 0)
+	current := ""
+	flush := func() {
+		if current != "" {
+			tokens = append(tokens, current)
+			current = ""
+		}
+	}
+
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		default:
+			current += string(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "OR" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "AND" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseNot() (queryNode, error) {
+	if p.peek() == "NOT" {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNot{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	token := p.next()
+	switch token {
+	case "":
+		return nil, newError(ErrInvalidParams, nil, "query ended unexpectedly")
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, newError(ErrInvalidParams, nil, "query is missing ')'")
+		}
+		return node, nil
+	case ")", "AND", "OR", "NOT":
+		return nil, newError(ErrInvalidParams, nil, "unexpected '%s' in query", token)
+	}
+
+	term := &queryTag{tags: make([]string, 0)}
+	tag, err := ParseTag(token)
+	if err == nil {
+		term.tags = append(term.tags, tag.String())
+	}
+
+	if legacy := legacyTags(token); len(legacy) > 0 {
+		if err != nil {
+			// the flat tag as it's stored before migrating
+			term.tags = append(term.tags, NormalizeTag(token))
+		}
+		for _, t := range legacy {
+			term.tags = append(term.tags, t.String())
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return term, nil
+}
+
+// ParseQuery parses a tag query.
+func ParseQuery(s string) (*Query, error) {
+	p := &queryParser{tokens: tokenizeQuery(s)}
+	if len(p.tokens) == 0 {
+		return nil, newError(ErrInvalidParams, nil, "query cannot be empty")
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, wrapError(err, "parsing query '%s'", s)
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, newError(ErrInvalidParams, nil, "unexpected '%s' in query '%s'", p.peek(), s)
+	}
+
+	return &Query{source: s, root: root}, nil
+}
+
+func (q *Query) String() string {
+	return q.source
+}
+
+// Match reports whether a list of tags matches the query.
+func (q *Query) Match(tags []string) bool {
+	set := make(map[string]bool)
+	for _, tag := range tags {
+		set[tag] = true
+	}
+	return q.root.match(set)
+}
+
+// Resolve returns the entries of an index name to ID map whose IDs match the
+// query according to the forward (tag to IDs) map, sorted by name. The
+// reverse (ID to tags) map gives each entry's tags.
+func (q *Query) Resolve(ids map[string]string, forward, reverse map[string][]string) []*ListEntry {
+	universe := make(map[string]bool)
+	names := make(map[string]string)
+	for name, id := range ids {
+		universe[id] = true
+		names[id] = name
+	}
+
+	entries := make([]*ListEntry, 0)
+	for id := range q.root.resolve(forward, universe) {
+		entries = append(entries, &ListEntry{Name: names[id], Id: id, Tags: reverse[id]})
+	}
+
+	sort.Sort(entriesByName(entries))
+	return entries
+}
+
+type entriesByName []*ListEntry
+
+func (e entriesByName) Len() int           { return len(e) }
+func (e entriesByName) Less(i, j int) bool { return e[i].Name < e[j].Name }
+func (e entriesByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// Kinds of item that a query can return.
+const (
+	QueryCAs   string = "cas"
+	QueryCerts string = "certs"
+	QueryCSRs  string = "csrs"
+	QueryNodes string = "nodes"
+)
+
+// QueryResult holds the index entries matching a query, by kind.
+type QueryResult struct {
+	CAs   []*ListEntry
+	Certs []*ListEntry
+	CSRs  []*ListEntry
+	Nodes []*ListEntry
+}
+
+type QueryController struct {
+	env *Environment
+}
+
+func NewQuery(env *Environment) (*QueryController, error) {
+	cont := new(QueryController)
+	cont.env = env
+	return cont, nil
+}
+
+// Run resolves the query against the org index. Only the index is read, so
+// use the kind's controller to load the matching documents.
+func (cont *QueryController) Run(params *QueryParams) (*QueryResult, error) {
+	logger.Debug("running query")
+	logger.Tracef("received params: %s", params)
+
+	if err := params.ValidateQuery(true); err != nil {
+		return nil, err
+	}
+
+	if err := params.ValidateKinds(false); err != nil {
+		return nil, err
+	}
+
+	query, err := ParseQuery(*params.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cont.env.LoadAdminEnv(); err != nil {
+		return nil, err
+	}
+
+	index, err := cont.env.controllers.org.GetIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := index.Data.Body.Tags
+	result := new(QueryResult)
+	for _, kind := range params.kinds() {
+		switch kind {
+		case QueryCAs:
+			result.CAs = query.Resolve(index.GetCAs(), tags.CAForward, tags.CAReverse)
+		case QueryCerts:
+			result.Certs = query.Resolve(index.GetCerts(), tags.CertForward, tags.CertReverse)
+		case QueryCSRs:
+			result.CSRs = query.Resolve(index.GetCSRs(), tags.CSRForward, tags.CSRReverse)
+		case QueryNodes:
+			result.Nodes = query.Resolve(index.GetNodes(), tags.EntityForward, tags.EntityReverse)
+		}
+	}
+
+	logger.Trace("returning query result")
+	return result, nil
+}
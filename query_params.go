@@ -0,0 +1,44 @@
+package controller
+
+type QueryParams struct {
+	Query *string
+	// Kinds is a comma separated list of cas, certs, csrs and nodes
+	Kinds *string
+}
+
+func NewQueryParams() *QueryParams {
+	return new(QueryParams)
+}
+
+func (params *QueryParams) ValidateQuery(required bool) error {
+	if required && (params.Query == nil || *params.Query == "") {
+		return newError(ErrInvalidParams, nil, "query cannot be empty")
+	}
+	return nil
+}
+
+func (params *QueryParams) ValidateKinds(required bool) error {
+	if params.Kinds == nil || *params.Kinds == "" {
+		if required {
+			return newError(ErrInvalidParams, nil, "kinds cannot be empty")
+		}
+		return nil
+	}
+
+	for _, kind := range ParseTags(*params.Kinds) {
+		switch kind {
+		case QueryCAs, QueryCerts, QueryCSRs, QueryNodes:
+		default:
+			return newError(ErrInvalidParams, nil, "unknown kind '%s'", kind)
+		}
+	}
+	return nil
+}
+
+// kinds returns the kinds to query, defaulting to all of them.
+func (params *QueryParams) kinds() []string {
+	if params.Kinds == nil || *params.Kinds == "" {
+		return []string{QueryCAs, QueryCerts, QueryCSRs, QueryNodes}
+	}
+	return ParseTags(*params.Kinds)
+}
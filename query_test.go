@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestQueryMatch(t *testing.T) {
+	query, err := ParseQuery("env=prod AND role=web AND NOT legacy")
+	assert.NoError(t, err)
+
+	assert.True(t, query.Match([]string{"env=prod", "role=web"}))
+	assert.False(t, query.Match([]string{"env=prod", "role=web", "legacy"}))
+	assert.False(t, query.Match([]string{"env=dev", "role=web"}))
+}
+
+func TestQueryPrecedence(t *testing.T) {
+	// NOT binds tighter than AND, which binds tighter than OR
+	query, err := ParseQuery("a OR b AND NOT c")
+	assert.NoError(t, err)
+	assert.True(t, query.Match([]string{"a", "c"}))
+	assert.True(t, query.Match([]string{"b"}))
+	assert.False(t, query.Match([]string{"b", "c"}))
+
+	query, err = ParseQuery("(a OR b) AND NOT (c)")
+	assert.NoError(t, err)
+	assert.False(t, query.Match([]string{"a", "c"}))
+	assert.True(t, query.Match([]string{"b"}))
+}
+
+func TestQueryLowerCasesTags(t *testing.T) {
+	query, err := ParseQuery("Web")
+	assert.NoError(t, err)
+	assert.True(t, query.Match(ParseTags("WEB")))
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, s := range []string{"", "a AND", "(a OR b", "a b", "AND a", "a )", "NOT", "env:", ":prod", "env="} {
+		_, err := ParseQuery(s)
+		assert.True(t, IsInvalidParams(err), s)
+	}
+}
+
+func TestQueryResolve(t *testing.T) {
+	ids := map[string]string{"web1": "1", "web2": "2", "db1": "3"}
+	forward := map[string][]string{"web": {"1", "2"}, "legacy": {"2"}, "prod": {"1", "3", "9"}}
+	reverse := map[string][]string{"1": {"web", "prod"}, "2": {"web", "legacy"}, "3": {"prod"}}
+
+	query, _ := ParseQuery("web AND NOT legacy OR prod")
+	entries := query.Resolve(ids, forward, reverse)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "db1", entries[0].Name)
+	assert.Equal(t, "web1", entries[1].Name)
+	assert.Equal(t, []string{"web", "prod"}, entries[1].Tags)
+
+	// IDs that aren't in the index are ignored
+	query, _ = ParseQuery("NOT web")
+	entries = query.Resolve(ids, forward, reverse)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "3", entries[0].Id)
+}
+
+func TestQueryParamsValidateKinds(t *testing.T) {
+	params := NewQueryParams()
+	assert.NoError(t, params.ValidateKinds(false))
+	assert.Len(t, params.kinds(), 4)
+
+	params.Kinds = stringPtr("cas, nodes")
+	assert.NoError(t, params.ValidateKinds(true))
+	assert.Equal(t, []string{"cas", "nodes"}, params.kinds())
+
+	params.Kinds = stringPtr("keys")
+	assert.True(t, IsInvalidParams(params.ValidateKinds(true)))
+}
+
+func TestQueryKeyOnly(t *testing.T) {
+	query, err := ParseQuery("env AND NOT env=dev")
+	assert.NoError(t, err)
+	assert.True(t, query.Match([]string{"env=prod"}))
+	assert.False(t, query.Match([]string{"env=dev"}))
+
+	ids := map[string]string{"a": "1", "b": "2", "c": "3"}
+	forward := map[string][]string{"env=prod": {"1"}, "env=dev": {"2"}, "web": {"3"}}
+	entries := query.Resolve(ids, forward, nil)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "a", entries[0].Name)
+}
+
+func TestQueryLegacyTags(t *testing.T) {
+	query, err := ParseQuery("env:prod AND role:web AND NOT legacy")
+	assert.NoError(t, err)
+
+	// flat tags before migrating and tags with values after
+	assert.True(t, query.Match([]string{"env:prod", "role:web"}))
+	assert.True(t, query.Match([]string{"env=prod", "role=web"}))
+	assert.False(t, query.Match([]string{"env=prod", "role=web", "legacy"}))
+	assert.False(t, query.Match([]string{"env:dev", "role:web"}))
+
+	query, err = ParseQuery("env-prod")
+	assert.NoError(t, err)
+	assert.True(t, query.Match([]string{"env-prod"}))
+	assert.True(t, query.Match([]string{"env=prod"}))
+
+	ids := map[string]string{"web1": "1", "web2": "2"}
+	forward := map[string][]string{"env:prod": {"1"}, "env=prod": {"2"}}
+	reverse := map[string][]string{"1": {"env:prod"}, "2": {"env=prod"}}
+	query, _ = ParseQuery("env:prod")
+	assert.Len(t, query.Resolve(ids, forward, reverse), 2)
+}
@@ -0,0 +1,697 @@
+package controller
+
+import (
+	stdx509 "crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/pki-io/core/document"
+	"github.com/pki-io/core/index"
+	"github.com/pki-io/core/node"
+	"github.com/pki-io/core/x509"
+	"os"
+	"sync"
+)
+
+// RegistrationResult is the outcome of processing one node registration.
+type RegistrationResult struct {
+	PairingId string
+	NodeName  string
+	NodeId    string
+	CertIds   []string
+	// Deferred is how many certificates are pending until the node has CSRs
+	Deferred int
+	Err      error
+}
+
+// RegistrationError is returned when some registrations in a batch failed.
+// The other registrations were saved.
+type RegistrationError struct {
+	Results []*RegistrationResult
+}
+
+// Failed returns the results of the failed registrations.
+func (e *RegistrationError) Failed() []*RegistrationResult {
+	failed := make([]*RegistrationResult, 0)
+	for _, result := range e.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+func (e *RegistrationError) Error() string {
+	failed := e.Failed()
+	if len(failed) == 0 {
+		return "no node registrations failed"
+	}
+	return fmt.Sprintf("%d of %d node registrations failed, first: %s", len(failed), len(e.Results), failed[0].Err)
+}
+
+// Unwrap returns the error of the first failed registration.
+func (e *RegistrationError) Unwrap() error {
+	failed := e.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed[0].Err
+}
+
+// registration is a registration being processed.
+type registration struct {
+	json     string
+	result   *RegistrationResult
+	node     *node.Node
+	tags     []string
+	certs    []*x509.Certificate
+	issued   []*IssuedCert
+	deferred []*PendingIssuance
+	indexErr error
+}
+
+// registrationBatch holds what the workers share while processing registrations.
+type registrationBatch struct {
+	cont     *OrgController
+	orgIndex *index.OrgIndex
+	lock     sync.Mutex
+	profiles *Profiles
+	names    map[string]bool
+	cas      map[string]*x509.CA
+}
+
+// withAPI runs f with the API lock held, as the API and the org controller's
+// caches aren't safe for concurrent use.
+func (cont *OrgController) withAPI(f func() error) error {
+	cont.apiLock.Lock()
+	defer cont.apiLock.Unlock()
+	return f()
+}
+
+// SignCSR signs the node's next CSR with the CA and pushes the certificate to
+// the node. The caller adds the certificate's tags to the index.
+func (cont *OrgController) SignCSR(node *node.Node, caId, tag string) (*x509.Certificate, error) {
+	logger.Debug("signing CSR for node")
+	logger.Tracef("received node with id '%s', ca id '%s' and tag '%s'", node.Id(), caId, tag)
+
+	var ca *x509.CA
+	var orgIndex *index.OrgIndex
+	err := cont.withAPI(func() error {
+		var err error
+		if ca, err = cont.GetCA(caId); err != nil {
+			return err
+		}
+		orgIndex, err = cont.GetIndex()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	profileCont, _ := NewProfile(cont.env)
+	profiles, _, err := profileCont.GetProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := orgIndex.Data.Body.Tags.EntityReverse[node.Data.Body.Id]
+	data := NewProfileData(node.Data.Body.Name, node.Data.Body.Id, tags)
+	return cont.signNodeCSR(node, ca, tag, nil, data, profiles.PoliciesFor(tags))
+}
+
+// signNodeCSR signs the node's next CSR with the CA, using the profile if it
+// isn't nil and rendering the profile with data. The CSR must satisfy the
+// node's key policies, which also decide the SANs it's granted. A CSR that's
+// genuinely from the node but isn't signed, e.g. because it breaks a policy,
+// is returned to the node's pool rather than used up.
+func (cont *OrgController) signNodeCSR(node *node.Node, ca *x509.CA, tag string, profile *CertProfile, data *ProfileData, policies []*KeyPolicy) (*x509.Certificate, error) {
+	logger.Debugf("popping outgoing CSR from node '%s'", node.Id())
+	var csrContainerJson string
+	err := cont.withAPI(func() error {
+		var err error
+		csrContainerJson, err = cont.env.api.PopOutgoing(node.Data.Body.Id, "csrs")
+		return err
+	})
+	if IsNotFound(err) || errors.Is(err, os.ErrNotExist) {
+		return nil, newError(ErrNotFound, ErrCSRPoolEmpty, "popping CSR for node '%s'", node.Id())
+	} else if err != nil {
+		return nil, wrapError(err, "popping CSR for node '%s'", node.Id())
+	}
+
+	logger.Debug("creating new CSR container")
+	csrContainer, err := document.NewContainer(csrContainerJson)
+	if err != nil {
+		return nil, wrapError(err, "loading CSR container for node '%s'", node.Id())
+	}
+
+	logger.Debug("verifying CSR container with node")
+	if err := node.Verify(csrContainer); err != nil {
+		return nil, newError(ErrVerificationFailed, err, "verifying CSR from node '%s'", node.Id())
+	}
+
+	logger.Debug("creating CSR from JSON")
+	csrJson := csrContainer.Data.Body
+	csr, err := x509.NewCSR(csrJson)
+	if err != nil {
+		return nil, wrapError(err, "loading CSR from node '%s'", node.Id())
+	}
+
+	csr.Data.Body.Name = node.Data.Body.Name
+
+	logger.Debug("checking CSR against key policies")
+	request, err := x509.PemDecodeX509CSR([]byte(csr.Data.Body.CSR))
+	if err != nil {
+		return nil, wrapError(err, "decoding CSR from node '%s'", node.Id())
+	}
+
+	if err := request.CheckSignature(); err != nil {
+		return nil, newError(ErrVerificationFailed, err, "checking CSR signature from node '%s'", node.Id())
+	}
+
+	cert, err := cont.signVerifiedCSR(node, ca, csr, request, tag, profile, data, policies)
+	if err != nil {
+		logger.Warnf("returning unsigned CSR to node '%s'", node.Id())
+		pushErr := cont.withAPI(func() error {
+			return cont.env.api.PushOutgoing(node.Data.Body.Id, "csrs", csrContainerJson)
+		})
+		if pushErr != nil {
+			logger.Warnf("unable to return CSR to node '%s': %s", node.Id(), pushErr)
+		}
+		return nil, err
+	}
+
+	logger.Trace("returning certificate")
+	return cert, nil
+}
+
+// signVerifiedCSR does the work of signNodeCSR once the CSR has been verified.
+func (cont *OrgController) signVerifiedCSR(node *node.Node, ca *x509.CA, csr *x509.CSR, request *stdx509.CertificateRequest, tag string, profile *CertProfile, data *ProfileData, policies []*KeyPolicy) (*x509.Certificate, error) {
+	granted := *data
+	var err error
+	granted.DNSNames, granted.IPAddresses, err = CheckCSR(policies, request)
+	if err != nil {
+		return nil, wrapError(err, "checking CSR from node '%s'", node.Id())
+	}
+
+	signWith := profile
+	if signWith == nil {
+		signWith = &CertProfile{Name: DefaultProfileName}
+	}
+
+	cert, err := SignWithProfile(ca, csr, signWith, &granted, cont.env.Now())
+	if err != nil {
+		return nil, wrapError(err, "signing CSR for node '%s' with CA '%s'", node.Id(), ca.Data.Body.Id)
+	}
+
+	cert.Data.Body.Id = cont.env.NewID()
+
+	logger.Debug("tagging certificate")
+	cert.Data.Body.Tags = append(cert.Data.Body.Tags, tag)
+	if profile != nil {
+		cert.Data.Body.Tags = append(cert.Data.Body.Tags, "profile"+TagSeparator+profile.Name)
+	}
+
+	logger.Debug("creating certificate container")
+	certContainer, err := document.NewContainer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	org := cont.org
+	certContainer.Data.Options.Source = org.Id()
+	certContainer.Data.Body = cert.Dump()
+
+	logger.Debug("signing certificate container with org")
+	if err := org.Sign(certContainer); err != nil {
+		return nil, err
+	}
+
+	logger.Debug("pushing certificate to node")
+	err = cont.withAPI(func() error {
+		return cont.env.api.PushIncoming(node.Data.Body.Id, "certs", certContainer.Dump())
+	})
+	if err != nil {
+		return nil, wrapError(err, "pushing certificate to node '%s'", node.Id())
+	}
+
+	logger.Trace("returning certificate")
+	return cert, nil
+}
+
+func (batch *registrationBatch) getCA(id string) (*x509.CA, error) {
+	batch.lock.Lock()
+	ca, ok := batch.cas[id]
+	batch.lock.Unlock()
+
+	if ok {
+		return ca, nil
+	}
+
+	err := batch.cont.withAPI(func() error {
+		var err error
+		ca, err = batch.cont.GetCA(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	batch.lock.Lock()
+	batch.cas[id] = ca
+	batch.lock.Unlock()
+	return ca, nil
+}
+
+// issuance is a certificate to issue to a registering node.
+type issuance struct {
+	caId    string
+	tag     string
+	profile *CertProfile
+}
+
+// issuances returns the certificates to issue to a node with the tags.
+func (batch *registrationBatch) issuances(tags []string) []*issuance {
+	return issuancesFor(batch.orgIndex, batch.profiles, tags)
+}
+
+// issuancesFor returns the certificates a node with the tags should have.
+// Each tag issues a certificate for each profile bound to it, and a default
+// certificate from each CA with a matching tag that no profile for the tag
+// uses. CA and binding tags with just a key match node tags with that key and
+// any value, so a CA can match more than one tag, but it only issues once per
+// profile.
+func issuancesFor(orgIndex *index.OrgIndex, profiles *Profiles, tags []string) []*issuance {
+	issuances := make([]*issuance, 0)
+	issued := make(map[string]bool)
+	add := func(caId, tag string, profile *CertProfile) {
+		key := caId + "/"
+		if profile != nil {
+			key += profile.Name
+		}
+
+		if !issued[key] {
+			issued[key] = true
+			issuances = append(issuances, &issuance{caId: caId, tag: tag, profile: profile})
+		}
+	}
+
+	caForward := orgIndex.Data.Body.Tags.CAForward
+	for _, tag := range tags {
+		logger.Debugf("looking for profiles and CAs for tag '%s'", tag)
+		bound := make(map[string]bool)
+		for _, binding := range profiles.Bound(tag) {
+			profile, ok := profiles.Profiles[binding.Profile]
+			if !ok {
+				logger.Warnf("profile '%s' bound to tag '%s' doesn't exist", binding.Profile, binding.Tag)
+				continue
+			}
+
+			logger.Debugf("found profile '%s' with CA '%s'", profile.Name, binding.CAId)
+			bound[binding.CAId] = true
+			add(binding.CAId, tag, profile)
+		}
+
+		for _, caTag := range matchedTags(tag, caForward) {
+			for _, caId := range caForward[caTag] {
+				if !bound[caId] {
+					logger.Debugf("found CA '%s' with tag '%s'", caId, caTag)
+					add(caId, tag, nil)
+				}
+			}
+		}
+	}
+
+	return issuances
+}
+
+// reserveName stops two registrations in the batch using the same node name.
+func (batch *registrationBatch) reserveName(name string) bool {
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+
+	if batch.names[name] {
+		return false
+	}
+
+	if _, err := batch.orgIndex.GetNode(name); err == nil {
+		return false
+	}
+
+	batch.names[name] = true
+	return true
+}
+
+// pushBack returns a registration to the queue so it can be retried.
+func (batch *registrationBatch) pushBack(reg *registration, reason string) {
+	org := batch.cont.org
+	logger.Warnf("%s. Pushing back to incoming registration queue", reason)
+	batch.cont.withAPI(func() error {
+		return batch.cont.env.api.PushIncoming(org.Id(), "registration", reg.json)
+	})
+}
+
+// process verifies and decrypts a registration, stores the node and signs its
+// CSRs. It doesn't change the index.
+func (batch *registrationBatch) process(reg *registration) error {
+	cont := batch.cont
+	org := cont.org
+
+	logger.Debug("creating new registration container")
+	container, err := document.NewContainer(reg.json)
+	if err != nil {
+		batch.pushBack(reg, "unable to create container from registration json")
+		return wrapError(err, "loading registration container")
+	}
+
+	pairingId := container.Data.Options.SignatureInputs["key-id"]
+	reg.result.PairingId = pairingId
+	logger.Debugf("reading pairing key for '%s'", pairingId)
+
+	pairingKey, ok := batch.orgIndex.Data.Body.PairingKeys[pairingId]
+	if !ok {
+		batch.pushBack(reg, "unable to find pairing key")
+		return newError(ErrNotFound, nil, "pairing key '%s'", pairingId)
+	}
+
+	logger.Debug("verifying and decrypting node registration")
+	nodeJson, err := org.VerifyAuthenticationThenDecrypt(container, pairingKey.Key)
+	if err != nil {
+		batch.pushBack(reg, "unable to decrypt node registration")
+		return newError(ErrVerificationFailed, err, "verifying registration with pairing key '%s'", pairingId)
+	}
+
+	logger.Debug("creating new node from JSON")
+	node, err := node.New(nodeJson)
+	if err != nil {
+		batch.pushBack(reg, "unable to create node")
+		return wrapError(err, "loading node from registration with pairing key '%s'", pairingId)
+	}
+
+	reg.result.NodeName = node.Data.Body.Name
+	reg.result.NodeId = node.Data.Body.Id
+
+	if !batch.reserveName(node.Data.Body.Name) {
+		return newError(ErrAlreadyExists, nil, "adding node '%s' to org index", node.Data.Body.Name)
+	}
+
+	logger.Debug("encrypting and signing node for org")
+	nodeContainer, err := org.EncryptThenSignString(node.Dump(), nil)
+	if err != nil {
+		batch.pushBack(reg, "unable to encrypt node for org")
+		return err
+	}
+
+	logger.Debug("sending node to org")
+	err = cont.withAPI(func() error {
+		return cont.env.api.SendPrivate(org.Id(), node.Data.Body.Id, nodeContainer.Dump())
+	})
+	if err != nil {
+		batch.pushBack(reg, "unable to send node to org")
+		return wrapError(err, "sending node '%s' to org", node.Id())
+	}
+
+	reg.node = node
+	reg.tags = pairingKey.Tags
+
+	// After the first signing failure the remaining certificates are
+	// recorded as pending too, so reconciling issues them later
+	var signErr error
+
+	// Certificates beyond the node's CSR pool are deferred rather than
+	// failing the registration part way through. The node is stored, so if
+	// the pool can't be read all of them are.
+	available, err := cont.csrPoolSize(node.Data.Body.Id)
+	if err != nil {
+		signErr = err
+	}
+	data := NewProfileData(node.Data.Body.Name, node.Data.Body.Id, pairingKey.Tags)
+	for i, iss := range batch.issuances(pairingKey.Tags) {
+		if signErr != nil {
+			reg.deferred = append(reg.deferred, iss.pending(node.Data.Body.Id, signErr.Error(), cont.env.Now()))
+			continue
+		}
+
+		if i >= available {
+			reg.deferred = append(reg.deferred, iss.pending(node.Data.Body.Id, ErrCSRPoolEmpty.Error(), cont.env.Now()))
+			continue
+		}
+
+		ca, err := batch.getCA(iss.caId)
+		if err != nil {
+			signErr = err
+			reg.deferred = append(reg.deferred, iss.pending(node.Data.Body.Id, err.Error(), cont.env.Now()))
+			continue
+		}
+
+		cert, err := cont.signNodeCSR(node, ca, iss.tag, iss.profile, data, batch.profiles.PoliciesFor(pairingKey.Tags))
+		if errors.Is(err, ErrCSRPoolEmpty) {
+			reg.deferred = append(reg.deferred, iss.pending(node.Data.Body.Id, ErrCSRPoolEmpty.Error(), cont.env.Now()))
+			continue
+		} else if err != nil {
+			signErr = err
+			reg.deferred = append(reg.deferred, iss.pending(node.Data.Body.Id, err.Error(), cont.env.Now()))
+			continue
+		}
+
+		reg.certs = append(reg.certs, cert)
+		reg.issued = append(reg.issued, iss.issued(node.Data.Body.Id, cert.Data.Body.Id))
+		reg.result.CertIds = append(reg.result.CertIds, cert.Data.Body.Id)
+	}
+
+	if len(reg.deferred) > 0 {
+		logger.Infof("deferring %d certificates for node '%s' until it has CSRs", len(reg.deferred), node.Data.Body.Name)
+		reg.result.Deferred = len(reg.deferred)
+	}
+
+	return signErr
+}
+
+// apply adds a processed registration to the index.
+func (reg *registration) apply(orgIndex *index.OrgIndex) error {
+	name := reg.node.Data.Body.Name
+	if _, err := orgIndex.GetNode(name); err == nil {
+		return newError(ErrAlreadyExists, nil, "adding node '%s' to org index", name)
+	}
+
+	if err := orgIndex.AddNode(name, reg.node.Data.Body.Id); err != nil {
+		return newError(ErrAlreadyExists, err, "adding node '%s' to org index", name)
+	}
+
+	if err := orgIndex.AddEntityTags(reg.node.Data.Body.Id, reg.tags); err != nil {
+		return wrapError(err, "tagging node '%s'", name)
+	}
+
+	for _, cert := range reg.certs {
+		if err := orgIndex.AddCertTags(cert.Data.Body.Id, cert.Data.Body.Tags); err != nil {
+			return wrapError(err, "tagging certificate '%s'", cert.Data.Body.Id)
+		}
+	}
+	return nil
+}
+
+// processRegistrations processes registrations with up to workers at once
+// and then saves the index once for all of them. The returned error is only
+// for failures that affect the whole batch.
+func (cont *OrgController) processRegistrations(regJsons []string, workers int) ([]*RegistrationResult, error) {
+	logger.Debugf("processing %d registrations with %d workers", len(regJsons), workers)
+
+	// Pairing keys may have been added since the index was cached
+	if cont.env.InSession() {
+		cont.ClearCache()
+	}
+
+	orgIndex, err := cont.GetIndex()
+	if err != nil {
+		for _, regJson := range regJsons {
+			cont.env.api.PushIncoming(cont.org.Id(), "registration", regJson)
+		}
+		return nil, err
+	}
+
+	profileCont, _ := NewProfile(cont.env)
+	profiles, _, err := profileCont.GetProfiles()
+	if err != nil {
+		for _, regJson := range regJsons {
+			cont.env.api.PushIncoming(cont.org.Id(), "registration", regJson)
+		}
+		return nil, err
+	}
+
+	// Registering into an org without a log would leave its other nodes'
+	// certificates unrecorded, see GetIssuanceLog
+	if _, _, err := cont.GetIssuanceLog(); err != nil {
+		for _, regJson := range regJsons {
+			cont.env.api.PushIncoming(cont.org.Id(), "registration", regJson)
+		}
+		return nil, err
+	}
+
+	batch := &registrationBatch{
+		cont:     cont,
+		orgIndex: orgIndex,
+		profiles: profiles,
+		names:    make(map[string]bool),
+		cas:      make(map[string]*x509.CA),
+	}
+
+	regs := make([]*registration, len(regJsons))
+	results := make([]*RegistrationResult, len(regJsons))
+	for i, regJson := range regJsons {
+		results[i] = new(RegistrationResult)
+		regs[i] = &registration{json: regJson, result: results[i]}
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan *registration)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for reg := range jobs {
+				reg.result.Err = batch.process(reg)
+			}
+		}()
+	}
+
+	for _, reg := range regs {
+		jobs <- reg
+	}
+	close(jobs)
+	wg.Wait()
+
+	logger.Debug("saving registrations to org index")
+	err = cont.UpdateIndex(func(orgIndex *index.OrgIndex) error {
+		for _, reg := range regs {
+			// Nodes that were stored are added even if signing failed, as
+			// the node can't register again with the same name
+			if reg.node != nil {
+				reg.indexErr = reg.apply(orgIndex)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Nothing refers to the stored nodes and certificates yet, so the
+		// registrations are retried on the next run. Storing a node again
+		// replaces it, but the node may be pushed a certificate twice.
+		for _, reg := range regs {
+			if reg.node != nil {
+				batch.pushBack(reg, "unable to save org index")
+			}
+		}
+		return results, err
+	}
+
+	issued := make([]*IssuedCert, 0)
+	deferred := make([]*PendingIssuance, 0)
+	for _, reg := range regs {
+		if reg.indexErr != nil && reg.result.Err == nil {
+			reg.result.Err = reg.indexErr
+		}
+
+		if reg.node != nil && reg.indexErr == nil {
+			issued = append(issued, reg.issued...)
+			deferred = append(deferred, reg.deferred...)
+		}
+	}
+
+	logger.Debug("saving issued certificates to issuance log")
+	err = cont.UpdateIssuanceLog(func(log *IssuanceLog) error {
+		log.Add(issued...)
+		log.Defer(deferred...)
+		return nil
+	})
+	if err != nil {
+		// The nodes are in the index, so reconciling issues anything the
+		// log is missing
+		return results, wrapError(err, "logging certificates issued to registered nodes")
+	}
+
+	return results, nil
+}
+
+// RegisterNextNode registers the next node in the org's registration queue.
+func (cont *OrgController) RegisterNextNode() error {
+	logger.Debug("registering next node")
+
+	org := cont.org
+
+	logger.Debug("popping next registration from org")
+	regJson, err := cont.env.api.PopIncoming(org.Id(), "registration")
+	if err != nil {
+		return wrapError(err, "popping registration for org '%s'", org.Id())
+	}
+
+	results, err := cont.processRegistrations([]string{regJson}, 1)
+	if err != nil {
+		return err
+	}
+
+	logger.Trace("returning registration error")
+	return results[0].Err
+}
+
+// RegisterNodes registers every queued node one at a time.
+func (cont *OrgController) RegisterNodes() error {
+	_, err := cont.RegisterNodesBatch(1)
+	return err
+}
+
+// RegisterNodesBatch registers the nodes queued for the org when it's called.
+// Registrations are verified, decrypted and signed by up to workers goroutines
+// and the index is saved once. A failed registration doesn't stop the others;
+// each is reported in its result, and a *RegistrationError is returned if any
+// failed.
+func (cont *OrgController) RegisterNodesBatch(workers int) ([]*RegistrationResult, error) {
+	logger.Debug("registering nodes")
+
+	org := cont.org
+
+	size, err := cont.env.api.IncomingSize(org.Id(), "registration")
+	if err != nil {
+		return nil, wrapError(err, "getting registration queue size for org '%s'", org.Id())
+	}
+
+	logger.Debugf("found '%d' nodes to register", size)
+
+	// Registrations that are pushed back are left for the next run
+	regJsons := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		regJson, err := cont.env.api.PopIncoming(org.Id(), "registration")
+		if IsNotFound(err) {
+			break
+		} else if err != nil {
+			for _, regJson := range regJsons {
+				cont.env.api.PushIncoming(org.Id(), "registration", regJson)
+			}
+			return nil, wrapError(err, "popping registration for org '%s'", org.Id())
+		}
+		regJsons = append(regJsons, regJson)
+	}
+
+	if len(regJsons) == 0 {
+		return []*RegistrationResult{}, nil
+	}
+
+	results, err := cont.processRegistrations(regJsons, workers)
+	if err != nil {
+		return results, err
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			logger.Warnf("registration with pairing key '%s' failed: %s", result.PairingId, result.Err)
+		}
+	}
+
+	regErr := &RegistrationError{Results: results}
+	if len(regErr.Failed()) > 0 {
+		return results, regErr
+	}
+
+	logger.Trace("returning results")
+	return results, nil
+}
@@ -0,0 +1,408 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/pki-io/core/api"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// APIConfigFile in the local fs selects the API backend.
+	APIConfigFile string = "api.conf"
+	// APITypeFs stores documents and queues in the local fs.
+	APITypeFs string = "fs"
+	// APITypeHTTP talks to an APIServer.
+	APITypeHTTP string = "http"
+)
+
+// APIConfig is the content of APIConfigFile. The PKIIO_API_URL and
+// PKIIO_API_TOKEN env variables override the URL and token. Path is the git
+// repository for APITypeGit and defaults to the local directory.
+type APIConfig struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Token string `json:"token"`
+	Path  string `json:"path"`
+}
+
+// RemoteAPI is an api.Apier that stores documents and queues on an
+// APIServer over HTTP. The documents are signed and encrypted by the
+// entities themselves, so the server only has to be trusted to deliver them.
+type RemoteAPI struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+var _ api.Apier = (*RemoteAPI)(nil)
+var _ PrivateSwapper = (*RemoteAPI)(nil)
+
+func NewRemoteAPI(serverUrl, token string) (*RemoteAPI, error) {
+	if _, err := url.Parse(serverUrl); err != nil {
+		return nil, newError(ErrInvalidParams, err, "parsing API url '%s'", serverUrl)
+	}
+
+	remote := new(RemoteAPI)
+	remote.url = strings.TrimRight(serverUrl, "/")
+	remote.token = token
+	remote.client = http.DefaultClient
+	return remote, nil
+}
+
+func (remote *RemoteAPI) do(method string, body string, parts ...string) (string, error) {
+	return remote.doIfMatch(method, body, "", parts...)
+}
+
+// doIfMatch sends the request with an If-Match header when etag is set.
+func (remote *RemoteAPI) doIfMatch(method string, body string, etag string, parts ...string) (string, error) {
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	path := "/" + strings.Join(parts, "/")
+
+	req, err := http.NewRequest(method, remote.url+path, strings.NewReader(body))
+	if err != nil {
+		return "", wrapError(err, "creating request %s %s", method, path)
+	}
+
+	if remote.token != "" {
+		req.Header.Set("Authorization", "Bearer "+remote.token)
+	}
+
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+
+	resp, err := remote.client.Do(req)
+	if err != nil {
+		return "", wrapError(err, "%s %s", method, path)
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", wrapError(err, "reading response to %s %s", method, path)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return string(content), nil
+	case http.StatusNotFound:
+		return "", newError(ErrNotFound, nil, "%s %s", method, path)
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return "", newError(ErrInvalidParams, fmt.Errorf("%s", strings.TrimSpace(string(content))), "%s %s", method, path)
+	case http.StatusUnauthorized:
+		return "", newError(ErrVerificationFailed, nil, "%s %s", method, path)
+	case http.StatusPreconditionFailed:
+		return "", newError(ErrConflict, nil, "%s %s", method, path)
+	default:
+		return "", wrapError(fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(content))), "%s %s", method, path)
+	}
+}
+
+func (remote *RemoteAPI) Connect() error {
+	_, err := remote.do("GET", "", "ping")
+	return err
+}
+
+func (remote *RemoteAPI) Authenticate() error {
+	return nil
+}
+
+func (remote *RemoteAPI) SendPublic(dstId, name, content string) error {
+	_, err := remote.do("PUT", content, "public", dstId, name)
+	return err
+}
+
+func (remote *RemoteAPI) GetPublic(dstId, name string) (string, error) {
+	return remote.do("GET", "", "public", dstId, name)
+}
+
+func (remote *RemoteAPI) SendPrivate(dstId, name, content string) error {
+	_, err := remote.do("PUT", content, "private", dstId, name)
+	return err
+}
+
+func (remote *RemoteAPI) SwapPrivate(dstId, name, content, etag string) error {
+	_, err := remote.doIfMatch("PUT", content, etag, "private", dstId, name)
+	return err
+}
+
+func (remote *RemoteAPI) GetPrivate(dstId, name string) (string, error) {
+	return remote.do("GET", "", "private", dstId, name)
+}
+
+func (remote *RemoteAPI) DeletePrivate(dstId, name string) error {
+	_, err := remote.do("DELETE", "", "private", dstId, name)
+	return err
+}
+
+func (remote *RemoteAPI) PushIncoming(dstId, queue, content string) error {
+	_, err := remote.do("POST", content, "incoming", dstId, queue)
+	return err
+}
+
+func (remote *RemoteAPI) PopIncoming(dstId, queue string) (string, error) {
+	return remote.do("DELETE", "", "incoming", dstId, queue)
+}
+
+func (remote *RemoteAPI) PushOutgoing(dstId, queue, content string) error {
+	_, err := remote.do("POST", content, "outgoing", dstId, queue)
+	return err
+}
+
+func (remote *RemoteAPI) PopOutgoing(dstId, queue string) (string, error) {
+	return remote.do("DELETE", "", "outgoing", dstId, queue)
+}
+
+func (remote *RemoteAPI) size(direction, dstId, queue string) (int, error) {
+	content, err := remote.do("GET", "", direction, dstId, queue)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := strconv.Atoi(strings.TrimSpace(content))
+	if err != nil {
+		return 0, wrapError(err, "parsing %s queue size", direction)
+	}
+	return size, nil
+}
+
+func (remote *RemoteAPI) IncomingSize(dstId, queue string) (int, error) {
+	return remote.size("incoming", dstId, queue)
+}
+
+func (remote *RemoteAPI) OutgoingSize(dstId, queue string) (int, error) {
+	return remote.size("outgoing", dstId, queue)
+}
+
+// documentPathElement matches the ids, document names and queue names that
+// the APIs store. The fs and git APIs use them as path elements.
+var documentPathElement = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// validateDocumentPath checks that an id and a document or queue name can't
+// refer to anything outside the id's documents.
+func validateDocumentPath(dstId, name string) error {
+	for _, element := range []string{dstId, name} {
+		if !documentPathElement.MatchString(element) || strings.Contains(element, "..") {
+			return newError(ErrInvalidParams, nil, "invalid document path '%s/%s'", dstId, name)
+		}
+	}
+	return nil
+}
+
+// isLoopbackAddr reports whether a host:port address is only reachable from
+// the local host.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// APIServer serves an api.Apier to RemoteAPI clients. If a token is set,
+// clients must send it as a bearer token. Without one anyone who can connect
+// can read and replace documents, so only loopback clients are served.
+type APIServer struct {
+	api   api.Apier
+	token string
+	lock  sync.Mutex
+}
+
+func NewAPIServer(a api.Apier, token string) (*APIServer, error) {
+	server := new(APIServer)
+	server.api = a
+	server.token = token
+	return server, nil
+}
+
+// ListenAndServe serves the API on the TCP address. An empty token is only
+// allowed on a loopback address.
+func (server *APIServer) ListenAndServe(addr string) error {
+	if server.token == "" && !isLoopbackAddr(addr) {
+		return newError(ErrInvalidParams, nil, "API server on '%s' needs a token, only loopback addresses can be served without one", addr)
+	}
+
+	logger.Infof("serving API on '%s'", addr)
+	return http.ListenAndServe(addr, server)
+}
+
+func (server *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Debugf("received API request %s %s", r.Method, r.URL.Path)
+
+	if server.token == "" {
+		if !isLoopbackAddr(r.RemoteAddr) {
+			http.Error(w, "a token is required", http.StatusUnauthorized)
+			return
+		}
+	} else if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+server.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// Split before unescaping, so that escaped slashes end up in a path
+	// element and are rejected
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for i, part := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(part); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	body, status, err := readRequestBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	server.lock.Lock()
+	result, err := server.handle(r.Method, parts, string(body), r.Header.Get("If-Match"))
+	server.lock.Unlock()
+
+	if err != nil {
+		status = http.StatusInternalServerError
+		if IsNotFound(err) {
+			status = http.StatusNotFound
+		} else if IsNotImplemented(err) {
+			status = http.StatusNotImplemented
+		} else if IsConflict(err) {
+			status = http.StatusPreconditionFailed
+		} else if IsInvalidParams(err) {
+			status = http.StatusBadRequest
+		}
+		logger.Infof("API request failed with status %d: %s", status, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, result)
+}
+
+func (server *APIServer) handle(method string, parts []string, body, etag string) (string, error) {
+	if len(parts) == 1 && parts[0] == "ping" && method == "GET" {
+		return "", nil
+	}
+
+	if len(parts) != 3 {
+		return "", newError(ErrNotFound, nil, "path '%s'", strings.Join(parts, "/"))
+	}
+
+	kind, dstId, name := parts[0], parts[1], parts[2]
+	if err := validateDocumentPath(dstId, name); err != nil {
+		return "", err
+	}
+
+	switch kind + " " + method {
+	case "public PUT":
+		return "", server.api.SendPublic(dstId, name, body)
+	case "public GET":
+		return server.api.GetPublic(dstId, name)
+	case "private PUT":
+		if etag != "" {
+			return "", server.swapPrivate(dstId, name, body, etag)
+		}
+		return "", server.api.SendPrivate(dstId, name, body)
+	case "private GET":
+		return server.api.GetPrivate(dstId, name)
+	case "private DELETE":
+		return "", server.api.DeletePrivate(dstId, name)
+	case "incoming POST":
+		return "", server.api.PushIncoming(dstId, name, body)
+	case "incoming DELETE":
+		return server.api.PopIncoming(dstId, name)
+	case "incoming GET":
+		size, err := server.api.IncomingSize(dstId, name)
+		return strconv.Itoa(size), err
+	case "outgoing POST":
+		return "", server.api.PushOutgoing(dstId, name, body)
+	case "outgoing DELETE":
+		return server.api.PopOutgoing(dstId, name)
+	case "outgoing GET":
+		size, err := server.api.OutgoingSize(dstId, name)
+		return strconv.Itoa(size), err
+	}
+
+	return "", newError(ErrNotImplemented, nil, "%s on %s", method, kind)
+}
+
+// swapPrivate replaces a private document only if it has the given ETag. The
+// server lock makes this atomic for any api.Apier.
+func (server *APIServer) swapPrivate(dstId, name, content, etag string) error {
+	if swapper, ok := server.api.(PrivateSwapper); ok {
+		return swapper.SwapPrivate(dstId, name, content, etag)
+	}
+
+	current, err := server.api.GetPrivate(dstId, name)
+	if err != nil {
+		return err
+	}
+
+	if ETag(current) != etag {
+		return newError(ErrConflict, nil, "private document '%s/%s' has changed", dstId, name)
+	}
+	return server.api.SendPrivate(dstId, name, content)
+}
+
+// LoadAPIConfig reads the API config from the local fs, if there is one, and
+// applies the env variable overrides.
+func LoadAPIConfig(local LocalFs) (*APIConfig, error) {
+	conf := &APIConfig{Type: APITypeFs}
+
+	exists, err := local.Exists(APIConfigFile)
+	if err != nil {
+		return nil, wrapError(err, "checking for API config")
+	}
+
+	if exists {
+		content, err := local.Read(APIConfigFile)
+		if err != nil {
+			return nil, wrapError(err, "reading API config")
+		}
+
+		if err := json.Unmarshal([]byte(content), conf); err != nil {
+			return nil, newError(ErrInvalidParams, err, "parsing API config")
+		}
+	}
+
+	if apiUrl := os.Getenv("PKIIO_API_URL"); apiUrl != "" {
+		conf.Type = APITypeHTTP
+		conf.URL = apiUrl
+	}
+
+	if token := os.Getenv("PKIIO_API_TOKEN"); token != "" {
+		conf.Token = token
+	}
+
+	switch conf.Type {
+	case APITypeFs, APITypeGit:
+	case APITypeHTTP:
+		if conf.URL == "" {
+			return nil, newError(ErrInvalidParams, nil, "API url cannot be empty")
+		}
+	default:
+		return nil, newError(ErrInvalidParams, nil, "unknown API type '%s'", conf.Type)
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestRemoteAPI(t *testing.T, serverToken, clientToken string) (*RemoteAPI, *MemoryAPI, *httptest.Server) {
+	store := NewMemoryAPI()
+	server, err := NewAPIServer(store, serverToken)
+	assert.NoError(t, err)
+
+	ts := httptest.NewServer(server)
+	remote, err := NewRemoteAPI(ts.URL, clientToken)
+	assert.NoError(t, err)
+	return remote, store, ts
+}
+
+func TestRemoteAPIDocuments(t *testing.T) {
+	remote, store, ts := newTestRemoteAPI(t, "secret", "secret")
+	defer ts.Close()
+
+	assert.NoError(t, remote.Connect())
+	assert.NoError(t, remote.SendPublic("org", "index", "public"))
+	content, err := store.GetPublic("org", "index")
+	assert.NoError(t, err)
+	assert.Equal(t, "public", content)
+
+	assert.NoError(t, remote.SendPrivate("org", "doc", "private"))
+	content, err = remote.GetPrivate("org", "doc")
+	assert.NoError(t, err)
+	assert.Equal(t, "private", content)
+
+	assert.NoError(t, remote.DeletePrivate("org", "doc"))
+	_, err = remote.GetPrivate("org", "doc")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestRemoteAPIInvalidPaths(t *testing.T) {
+	remote, store, ts := newTestRemoteAPI(t, "", "")
+	defer ts.Close()
+
+	for _, name := range []string{"../../x", "..", "a/b", ".hidden", ""} {
+		err := remote.SendPrivate("org", name, "private")
+		assert.True(t, IsInvalidParams(err), name)
+		err = remote.SendPrivate(name, "doc", "private")
+		assert.True(t, IsInvalidParams(err), name)
+	}
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/private/..%2F..%2Fx/doc", strings.NewReader("private"))
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Empty(t, store.private)
+}
+
+func TestRemoteAPIRequestTooLarge(t *testing.T) {
+	remote, store, ts := newTestRemoteAPI(t, "", "")
+	defer ts.Close()
+
+	err := remote.SendPrivate("org", "doc", strings.Repeat("a", int(MaxRequestSize)+1))
+	assert.True(t, IsInvalidParams(err))
+	_, err = store.GetPrivate("org", "doc")
+	assert.Error(t, err)
+
+	assert.NoError(t, remote.SendPrivate("org", "doc", strings.Repeat("a", int(MaxRequestSize))))
+}
+
+func TestAPIServerWithoutToken(t *testing.T) {
+	server, _ := NewAPIServer(NewMemoryAPI(), "")
+	err := server.ListenAndServe("0.0.0.0:0")
+	assert.True(t, IsInvalidParams(err))
+	err = server.ListenAndServe(":8080")
+	assert.True(t, IsInvalidParams(err))
+
+	req := httptest.NewRequest("GET", "/ping", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req.RemoteAddr = "127.0.0.1:1234"
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRemoteAPISwapPrivate(t *testing.T) {
+	remote, _, ts := newTestRemoteAPI(t, "", "")
+	defer ts.Close()
+
+	assert.NoError(t, remote.SendPrivate("org", "index", "v1"))
+	assert.NoError(t, remote.SwapPrivate("org", "index", "v2", ETag("v1")))
+	err := remote.SwapPrivate("org", "index", "v3", ETag("v1"))
+	assert.True(t, IsConflict(err))
+}
+
+func TestRemoteAPIQueues(t *testing.T) {
+	remote, _, ts := newTestRemoteAPI(t, "", "")
+	defer ts.Close()
+
+	assert.NoError(t, remote.PushIncoming("org", "registration", "one"))
+	assert.NoError(t, remote.PushIncoming("org", "registration", "two"))
+	size, err := remote.IncomingSize("org", "registration")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	content, err := remote.PopIncoming("org", "registration")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", content)
+
+	assert.NoError(t, remote.PushOutgoing("node", "csrs", "csr"))
+	size, _ = remote.OutgoingSize("node", "csrs")
+	assert.Equal(t, 1, size)
+	content, _ = remote.PopOutgoing("node", "csrs")
+	assert.Equal(t, "csr", content)
+
+	_, err = remote.PopOutgoing("node", "csrs")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestRemoteAPIWrongToken(t *testing.T) {
+	remote, _, ts := newTestRemoteAPI(t, "secret", "wrong")
+	defer ts.Close()
+
+	err := remote.SendPublic("org", "index", "public")
+	assert.True(t, IsVerificationFailed(err))
+}
+
+func TestLoadAPIFromConfig(t *testing.T) {
+	os.Unsetenv("PKIIO_API_URL")
+	local := NewMemoryFs()
+	local.Write(APIConfigFile, `{"type": "http", "url": "http://localhost:8080"}`)
+
+	env := NewEnvironmentWithOptions(&EnvironmentOptions{Local: local})
+	assert.NoError(t, env.LoadLocalFs())
+	assert.NoError(t, env.LoadAPI())
+	_, ok := env.api.(*RemoteAPI)
+	assert.True(t, ok)
+}
+
+func TestLoadAPIConfigInvalid(t *testing.T) {
+	local := NewMemoryFs()
+	local.Write(APIConfigFile, `{"type": "ftp"}`)
+
+	_, err := LoadAPIConfig(local)
+	assert.True(t, IsInvalidParams(err))
+}
@@ -0,0 +1,768 @@
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pki-io/core/document"
+	"github.com/pki-io/core/entity"
+	"github.com/pki-io/core/node"
+	"github.com/pki-io/core/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AuthorizationScheme is the scheme used in the Authorization header of
+	// requests to the server.
+	AuthorizationScheme string = "PKIIO"
+	// DateHeader holds the time the request was signed.
+	DateHeader string = "X-Pkiio-Date"
+	// NonceHeader holds a random value that makes each signed request
+	// unique, so it can't be replayed.
+	NonceHeader string = "X-Pkiio-Nonce"
+	// MaxRequestSkew is how far the signed date can be from the server's time.
+	MaxRequestSkew = 5 * time.Minute
+	// MaxRequestSize limits the size of request bodies.
+	MaxRequestSize int64 = 1 << 20
+	// maxNonceLength limits the size of request nonces.
+	maxNonceLength int = 64
+)
+
+// Server exposes the controllers as an HTTP/JSON API. Every request must be
+// signed by one of the org's admins, see SignRequest. The server itself runs
+// as an admin of the org, using the environment built from its options.
+//
+// Nonces are remembered in memory, so servers behind a load balancer need
+// sticky sessions for replays to be caught.
+type Server struct {
+	options *EnvironmentOptions
+	lock    sync.Mutex
+	// nonces are the nonces of authenticated requests and when they can be
+	// forgotten, because the request date is out of range by then
+	nonces map[string]time.Time
+}
+
+func NewServer(opts *EnvironmentOptions) (*Server, error) {
+	server := new(Server)
+	server.options = opts
+	server.nonces = make(map[string]time.Time)
+	return server, nil
+}
+
+// requestString is what an admin signs to authenticate a request.
+func requestString(method, uri, date, nonce string, body []byte) string {
+	hash := sha256.Sum256(body)
+	return strings.Join([]string{method, uri, date, nonce, hex.EncodeToString(hash[:])}, "\n")
+}
+
+// SignRequest adds the date, nonce and authorization headers to a request,
+// signed by the given admin. The body must be the same bytes that are sent in
+// the request. A signed request can only be sent once.
+func SignRequest(r *http.Request, admin *entity.Entity, body []byte, now time.Time) error {
+	date := now.UTC().Format(time.RFC3339)
+
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return wrapError(err, "generating request nonce")
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+
+	container, err := document.NewContainer(nil)
+	if err != nil {
+		return err
+	}
+
+	container.Data.Options.Source = admin.Id()
+	container.Data.Body = requestString(r.Method, r.URL.RequestURI(), date, nonce, body)
+
+	if err := admin.Sign(container); err != nil {
+		return wrapError(err, "signing request")
+	}
+
+	r.Header.Set(DateHeader, date)
+	r.Header.Set(NonceHeader, nonce)
+	r.Header.Set("Authorization", AuthorizationScheme+" "+base64.StdEncoding.EncodeToString([]byte(container.Dump())))
+	return nil
+}
+
+func (server *Server) authenticate(env *Environment, r *http.Request, body []byte) error {
+	logger.Debug("authenticating request")
+
+	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 || auth[0] != AuthorizationScheme {
+		return newError(ErrVerificationFailed, nil, "missing authorization")
+	}
+
+	date := r.Header.Get(DateHeader)
+	signedAt, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return newError(ErrVerificationFailed, err, "parsing request date")
+	}
+
+	now := env.Now()
+	skew := now.Sub(signedAt)
+	if skew > MaxRequestSkew || skew < -MaxRequestSkew {
+		return newError(ErrVerificationFailed, nil, "request date '%s' is out of range", date)
+	}
+
+	nonce := r.Header.Get(NonceHeader)
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return newError(ErrVerificationFailed, nil, "missing or invalid request nonce")
+	}
+
+	containerJson, err := base64.StdEncoding.DecodeString(auth[1])
+	if err != nil {
+		return newError(ErrVerificationFailed, err, "decoding authorization")
+	}
+
+	container, err := document.NewContainer(string(containerJson))
+	if err != nil {
+		return newError(ErrVerificationFailed, err, "loading authorization container")
+	}
+
+	if container.Data.Body != requestString(r.Method, r.URL.RequestURI(), date, nonce, body) {
+		return newError(ErrVerificationFailed, nil, "signed request doesn't match request")
+	}
+
+	index, err := env.controllers.org.GetIndex()
+	if err != nil {
+		return err
+	}
+
+	adminIds, err := index.GetAdmins()
+	if err != nil {
+		return err
+	}
+
+	adminId := container.Data.Options.Source
+	isAdmin := false
+	for _, id := range adminIds {
+		if id == adminId {
+			isAdmin = true
+			break
+		}
+	}
+
+	if !isAdmin {
+		return newError(ErrVerificationFailed, nil, "'%s' is not an org admin", adminId)
+	}
+
+	admin, err := env.controllers.admin.GetAdmin(adminId)
+	if err != nil {
+		return err
+	}
+
+	if err := admin.Verify(container); err != nil {
+		return newError(ErrVerificationFailed, err, "verifying request from admin '%s'", adminId)
+	}
+
+	// Only signed nonces are remembered, so others can't fill the cache
+	if err := server.useNonce(nonce, signedAt, now); err != nil {
+		return err
+	}
+
+	logger.Debugf("authenticated request from admin '%s'", adminId)
+	return nil
+}
+
+// useNonce records a request's nonce, failing if it has been used before. It
+// forgets nonces whose requests are too old to be accepted again. The caller
+// must hold the server lock.
+func (server *Server) useNonce(nonce string, signedAt, now time.Time) error {
+	for seen, expires := range server.nonces {
+		if now.After(expires) {
+			delete(server.nonces, seen)
+		}
+	}
+
+	if _, ok := server.nonces[nonce]; ok {
+		return newError(ErrVerificationFailed, nil, "request nonce '%s' has already been used", nonce)
+	}
+
+	server.nonces[nonce] = signedAt.Add(MaxRequestSkew)
+	return nil
+}
+
+// StatusForError maps a controller error to an HTTP status code. Failed
+// verifications of the documents in a request, e.g. a CSR's signature or an
+// imported key, are unprocessable rather than unauthorized: only failing to
+// authenticate the request itself is a 401.
+func StatusForError(err error) int {
+	switch ErrorKind(err) {
+	case ErrInvalidParams:
+		return http.StatusBadRequest
+	case ErrVerificationFailed:
+		return http.StatusUnprocessableEntity
+	case ErrPolicyViolation:
+		return http.StatusForbidden
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrAlreadyExists, ErrConflict:
+		return http.StatusConflict
+	case ErrNotImplemented:
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warnf("unable to write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeErrorStatus(w, StatusForError(err), err)
+}
+
+func writeErrorStatus(w http.ResponseWriter, status int, err error) {
+	logger.Infof("request failed with status %d: %s", status, err)
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+// readRequestBody reads a request body of up to MaxRequestSize bytes,
+// returning the status to fail the request with if it can't. Larger bodies
+// are rejected rather than truncated.
+func readRequestBody(r *http.Request) ([]byte, int, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxRequestSize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, newError(ErrInvalidParams, err, "reading request body")
+	}
+
+	if int64(len(body)) > MaxRequestSize {
+		return nil, http.StatusRequestEntityTooLarge, newError(ErrInvalidParams, nil, "request body is larger than %d bytes", MaxRequestSize)
+	}
+	return body, http.StatusOK, nil
+}
+
+// fillParams sets any nil pointer fields in a params struct to point to zero
+// values, as the controllers expect every field to be set.
+func fillParams(params interface{}) {
+	v := reflect.ValueOf(params).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() == reflect.Ptr && f.IsNil() && f.CanSet() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+	}
+}
+
+// decodeParams loads the JSON request body, whose keys are the field names of
+// the params struct, and fills in the remaining fields.
+func decodeParams(body []byte, params interface{}) error {
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, params); err != nil {
+			return newError(ErrInvalidParams, err, "decoding request body")
+		}
+	}
+	fillParams(params)
+	return nil
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Debugf("received request %s %s", r.Method, r.URL.Path)
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	body, status, err := readRequestBody(r)
+	if err != nil {
+		writeErrorStatus(w, status, err)
+		return
+	}
+
+	// The controllers load the admin environment once per request
+	env := NewEnvironmentWithOptions(server.options)
+	if err := env.StartSession(); err != nil {
+		writeError(w, err)
+		return
+	}
+	defer env.EndSession()
+
+	if err := server.authenticate(env, r, body); err != nil {
+		if IsVerificationFailed(err) {
+			writeErrorStatus(w, http.StatusUnauthorized, err)
+		} else {
+			writeError(w, err)
+		}
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	private := r.URL.Query().Get("private") == "true"
+
+	var result interface{}
+	switch parts[0] {
+	case "org":
+		status, result, err = server.handleOrg(env, r.Method, parts[1:])
+	case "admins":
+		status, result, err = server.handleAdmins(env, r.Method, parts[1:], body)
+	case "cas":
+		status, result, err = server.handleCAs(env, r.Method, parts[1:], body, private)
+	case "certs":
+		status, result, err = server.handleCerts(env, r.Method, parts[1:], body, private)
+	case "csrs":
+		status, result, err = server.handleCSRs(env, r.Method, parts[1:], body, private)
+	case "nodes":
+		status, result, err = server.handleNodes(env, r.Method, parts[1:])
+	case "pairingkeys":
+		status, result, err = server.handlePairingKeys(env, r.Method, parts[1:], body)
+	default:
+		err = newError(ErrNotFound, nil, "path '%s'", r.URL.Path)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJson(w, status, result)
+}
+
+func methodError(method string, parts []string) error {
+	return newError(ErrNotImplemented, nil, "%s on '%s'", method, strings.Join(parts, "/"))
+}
+
+type entityView struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Error is set on list items that couldn't be loaded, which only have
+	// what the index has about them. The views below do the same.
+	Error string `json:"error,omitempty"`
+}
+
+// errorString returns the error's message, or "" if it's nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+type caView struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private-key,omitempty"`
+	KeyType     string `json:"key-type"`
+	CAExpiry    int    `json:"ca-expiry"`
+	CertExpiry  int    `json:"cert-expiry"`
+	Error       string `json:"error,omitempty"`
+}
+
+func newCAView(ca *x509.CA, private bool) *caView {
+	view := &caView{
+		Id:          ca.Data.Body.Id,
+		Name:        ca.Data.Body.Name,
+		Certificate: ca.Data.Body.Certificate,
+		KeyType:     ca.Data.Body.KeyType,
+		CAExpiry:    ca.Data.Body.CAExpiry,
+		CertExpiry:  ca.Data.Body.CertExpiry,
+	}
+	if private {
+		view.PrivateKey = ca.Data.Body.PrivateKey
+	}
+	return view
+}
+
+type certView struct {
+	Id            string   `json:"id"`
+	Name          string   `json:"name"`
+	Tags          []string `json:"tags"`
+	Certificate   string   `json:"certificate"`
+	CACertificate string   `json:"ca-certificate,omitempty"`
+	PrivateKey    string   `json:"private-key,omitempty"`
+	KeyType       string   `json:"key-type"`
+	Expiry        int      `json:"expiry"`
+	Error         string   `json:"error,omitempty"`
+}
+
+func newCertView(cert *x509.Certificate, private bool) *certView {
+	view := &certView{
+		Id:            cert.Data.Body.Id,
+		Name:          cert.Data.Body.Name,
+		Tags:          cert.Data.Body.Tags,
+		Certificate:   cert.Data.Body.Certificate,
+		CACertificate: cert.Data.Body.CACertificate,
+		KeyType:       cert.Data.Body.KeyType,
+		Expiry:        cert.Data.Body.Expiry,
+	}
+	if private {
+		view.PrivateKey = cert.Data.Body.PrivateKey
+	}
+	return view
+}
+
+type csrView struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	CSR        string `json:"csr"`
+	PrivateKey string `json:"private-key,omitempty"`
+	KeyType    string `json:"key-type"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newCSRView(csr *x509.CSR, private bool) *csrView {
+	view := &csrView{
+		Id:      csr.Data.Body.Id,
+		Name:    csr.Data.Body.Name,
+		CSR:     csr.Data.Body.CSR,
+		KeyType: csr.Data.Body.KeyType,
+	}
+	if private {
+		view.PrivateKey = csr.Data.Body.PrivateKey
+	}
+	return view
+}
+
+type pairingKeyView struct {
+	Id   string   `json:"id"`
+	Key  string   `json:"key,omitempty"`
+	Tags []string `json:"tags"`
+}
+
+func (server *Server) handleOrg(env *Environment, method string, parts []string) (int, interface{}, error) {
+	if method != "GET" || len(parts) != 0 {
+		return 0, nil, methodError(method, parts)
+	}
+
+	org := env.controllers.org.org
+	return http.StatusOK, &entityView{Id: org.Id(), Name: org.Data.Body.Name}, nil
+}
+
+func (server *Server) handleAdmins(env *Environment, method string, parts []string, body []byte) (int, interface{}, error) {
+	cont, err := NewAdmin(env)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	params := NewAdminParams()
+	if err := decodeParams(body, params); err != nil {
+		return 0, nil, err
+	}
+
+	switch {
+	case method == "GET" && len(parts) == 0:
+		admins, err := cont.List(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		views := make([]*entityView, 0)
+		for _, admin := range admins {
+			views = append(views, &entityView{Id: admin.Id(), Name: admin.Data.Body.Name})
+		}
+		return http.StatusOK, views, nil
+	case method == "GET" && len(parts) == 1:
+		*params.Name = parts[0]
+		admin, err := cont.Show(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, &entityView{Id: admin.Id(), Name: admin.Data.Body.Name}, nil
+	case method == "POST" && len(parts) == 1 && parts[0] == "invites":
+		invite, err := cont.Invite(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusCreated, map[string]string{"id": invite[0], "key": invite[1]}, nil
+	case method == "DELETE" && len(parts) == 1:
+		*params.Name = parts[0]
+		if err := cont.Delete(params); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]string{}, nil
+	}
+
+	return 0, nil, methodError(method, parts)
+}
+
+func (server *Server) handleCAs(env *Environment, method string, parts []string, body []byte, private bool) (int, interface{}, error) {
+	cont, err := NewCA(env)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	params := NewCAParams()
+	if err := decodeParams(body, params); err != nil {
+		return 0, nil, err
+	}
+
+	// Files are read on the server, so importing isn't allowed over HTTP
+	*params.CertFile = ""
+	*params.KeyFile = ""
+	*params.RequestFile = ""
+	*params.ResponseFile = ""
+	*params.KeyRef = ""
+
+	if len(parts) == 1 {
+		*params.Name = parts[0]
+	}
+
+	switch {
+	case method == "GET" && len(parts) == 0:
+		entries, err := cont.ListEntries(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		views := make([]*caView, 0)
+		for _, entry := range entries {
+			if entry.CA == nil {
+				views = append(views, &caView{Id: entry.Id, Name: entry.Name, Error: errorString(entry.Err)})
+				continue
+			}
+			views = append(views, newCAView(entry.CA, false))
+		}
+		return http.StatusOK, views, nil
+	case method == "GET" && len(parts) == 1:
+		ca, err := cont.Show(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, newCAView(ca, private), nil
+	case method == "POST" && len(parts) == 0:
+		ca, err := cont.New(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusCreated, newCAView(ca, false), nil
+	case method == "PUT" && len(parts) == 1:
+		if err := cont.Update(params); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]string{}, nil
+	case method == "DELETE" && len(parts) == 1:
+		if err := cont.Delete(params); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]string{}, nil
+	}
+
+	return 0, nil, methodError(method, parts)
+}
+
+func (server *Server) handleCerts(env *Environment, method string, parts []string, body []byte, private bool) (int, interface{}, error) {
+	cont, err := NewCertificate(env)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	params := NewCertificateParams()
+	if err := decodeParams(body, params); err != nil {
+		return 0, nil, err
+	}
+
+	*params.CertFile = ""
+	*params.KeyFile = ""
+	*params.StandaloneFile = ""
+
+	if len(parts) == 1 {
+		*params.Name = parts[0]
+	}
+
+	switch {
+	case method == "GET" && len(parts) == 0:
+		entries, err := cont.ListEntries(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		views := make([]*certView, 0)
+		for _, entry := range entries {
+			if entry.Certificate == nil {
+				views = append(views, &certView{Id: entry.Id, Name: entry.Name, Tags: entry.Tags, Error: errorString(entry.Err)})
+				continue
+			}
+			views = append(views, newCertView(entry.Certificate, false))
+		}
+		return http.StatusOK, views, nil
+	case method == "GET" && len(parts) == 1:
+		cert, err := cont.Show(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, newCertView(cert, private), nil
+	case method == "POST" && len(parts) == 0:
+		cert, _, err := cont.New(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusCreated, newCertView(cert, true), nil
+	case method == "PUT" && len(parts) == 1:
+		if err := cont.Update(params); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]string{}, nil
+	case method == "DELETE" && len(parts) == 1:
+		if err := cont.Delete(params); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]string{}, nil
+	}
+
+	return 0, nil, methodError(method, parts)
+}
+
+func (server *Server) handleCSRs(env *Environment, method string, parts []string, body []byte, private bool) (int, interface{}, error) {
+	cont, err := NewCSR(env)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	params := NewCSRParams()
+	if err := decodeParams(body, params); err != nil {
+		return 0, nil, err
+	}
+
+	*params.CsrFile = ""
+	*params.KeyFile = ""
+	*params.StandaloneFile = ""
+
+	if len(parts) >= 1 {
+		*params.Name = parts[0]
+	}
+
+	switch {
+	case method == "GET" && len(parts) == 0:
+		entries, err := cont.ListEntries(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		views := make([]*csrView, 0)
+		for _, entry := range entries {
+			if entry.CSR == nil {
+				views = append(views, &csrView{Id: entry.Id, Name: entry.Name, Error: errorString(entry.Err)})
+				continue
+			}
+			views = append(views, newCSRView(entry.CSR, false))
+		}
+		return http.StatusOK, views, nil
+	case method == "GET" && len(parts) == 1:
+		csr, err := cont.Show(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, newCSRView(csr, private), nil
+	case method == "POST" && len(parts) == 0:
+		csr, err := cont.New(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusCreated, newCSRView(csr, false), nil
+	case method == "POST" && len(parts) == 2 && parts[1] == "sign":
+		cert, err := cont.Sign(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusCreated, newCertView(cert, false), nil
+	case method == "PUT" && len(parts) == 1:
+		if err := cont.Update(params); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]string{}, nil
+	case method == "DELETE" && len(parts) == 1:
+		if err := cont.Delete(params); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]string{}, nil
+	}
+
+	return 0, nil, methodError(method, parts)
+}
+
+func newNodeView(n *node.Node) *entityView {
+	return &entityView{Id: n.Id(), Name: n.Data.Body.Name}
+}
+
+func (server *Server) handleNodes(env *Environment, method string, parts []string) (int, interface{}, error) {
+	cont, err := NewNode(env)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	params := NewNodeParams()
+	fillParams(params)
+
+	switch {
+	case method == "GET" && len(parts) == 0:
+		entries, err := cont.ListEntries(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		views := make([]*entityView, 0)
+		for _, entry := range entries {
+			if entry.Node == nil {
+				views = append(views, &entityView{Id: entry.Id, Name: entry.Name, Error: errorString(entry.Err)})
+				continue
+			}
+			views = append(views, newNodeView(entry.Node))
+		}
+		return http.StatusOK, views, nil
+	case method == "GET" && len(parts) == 1:
+		*params.Name = parts[0]
+		n, err := cont.Show(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, newNodeView(n), nil
+	}
+
+	return 0, nil, methodError(method, parts)
+}
+
+func (server *Server) handlePairingKeys(env *Environment, method string, parts []string, body []byte) (int, interface{}, error) {
+	cont, err := NewPairingKey(env)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	params := NewPairingKeyParams()
+	if err := decodeParams(body, params); err != nil {
+		return 0, nil, err
+	}
+
+	if len(parts) == 1 {
+		*params.Id = parts[0]
+	}
+
+	switch {
+	case method == "GET" && len(parts) == 0:
+		keys, err := cont.List(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		views := make([]*pairingKeyView, 0)
+		for _, key := range keys {
+			views = append(views, &pairingKeyView{Id: key[0], Tags: ParseTags(key[1])})
+		}
+		return http.StatusOK, views, nil
+	case method == "GET" && len(parts) == 1:
+		id, key, tags, err := cont.Show(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, &pairingKeyView{Id: id, Key: key, Tags: ParseTags(tags)}, nil
+	case method == "POST" && len(parts) == 0:
+		id, key, err := cont.New(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusCreated, &pairingKeyView{Id: id, Key: key, Tags: ParseTags(*params.Tags)}, nil
+	case method == "DELETE" && len(parts) == 1:
+		if err := cont.Delete(params); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]string{}, nil
+	}
+
+	return 0, nil, methodError(method, parts)
+}
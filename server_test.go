@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *Environment) {
+	backends, home := initMemoryOrg(t)
+
+	server, err := NewServer(&EnvironmentOptions{API: backends.api, Local: backends.local, Home: home})
+	assert.NoError(t, err)
+
+	env := backends.env(home)
+	assert.NoError(t, env.LoadAdminEnv())
+	return httptest.NewServer(server), env
+}
+
+func doSignedRequest(t *testing.T, ts *httptest.Server, env *Environment, method, path string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+	assert.NoError(t, err)
+	assert.NoError(t, SignRequest(req, env.controllers.admin.admin, body, time.Now()))
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return resp
+}
+
+func TestServerUnauthenticated(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/cas")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServerTamperedRequest(t *testing.T) {
+	ts, env := newTestServer(t)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/cas", nil)
+	assert.NoError(t, SignRequest(req, env.controllers.admin.admin, nil, time.Now()))
+	req.URL.Path = "/certs"
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServerReplayedRequest(t *testing.T) {
+	ts, env := newTestServer(t)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/cas", nil)
+	assert.NoError(t, SignRequest(req, env.controllers.admin.admin, nil, time.Now()))
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	replay, _ := http.NewRequest("GET", ts.URL+"/cas", nil)
+	replay.Header = req.Header.Clone()
+	resp, err = http.DefaultClient.Do(replay)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The nonce is signed, so it can't be swapped for a fresh one
+	replay.Header.Set(NonceHeader, "fresh")
+	resp, err = http.DefaultClient.Do(replay)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServerUseNonce(t *testing.T) {
+	server, _ := NewServer(nil)
+	now := time.Now()
+
+	assert.NoError(t, server.useNonce("a", now, now))
+	assert.True(t, IsVerificationFailed(server.useNonce("a", now, now)))
+
+	// Nonces are forgotten once their requests are out of range
+	later := now.Add(MaxRequestSkew + time.Second)
+	assert.NoError(t, server.useNonce("b", later, later))
+	assert.Len(t, server.nonces, 1)
+}
+
+func TestServerCA(t *testing.T) {
+	ts, env := newTestServer(t)
+	defer ts.Close()
+
+	body, _ := json.Marshal(map[string]interface{}{"Name": "ca1", "CaExpiry": 365, "CertExpiry": 90, "KeyType": "ec"})
+	resp := doSignedRequest(t, ts, env, "POST", "/cas", body)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = doSignedRequest(t, ts, env, "POST", "/cas", body)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = doSignedRequest(t, ts, env, "GET", "/cas/ca1", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	view := new(caView)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(view))
+	assert.Equal(t, "ca1", view.Name)
+	assert.Empty(t, view.PrivateKey)
+
+	resp = doSignedRequest(t, ts, env, "GET", "/cas/missing", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServerListPartial(t *testing.T) {
+	ts, env := newTestServer(t)
+	defer ts.Close()
+
+	ids := make([]string, 0)
+	for _, name := range []string{"ca1", "ca2"} {
+		body, _ := json.Marshal(map[string]interface{}{"Name": name, "CaExpiry": 365, "CertExpiry": 90, "KeyType": "ec"})
+		resp := doSignedRequest(t, ts, env, "POST", "/cas", body)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		view := new(caView)
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(view))
+		ids = append(ids, view.Id)
+	}
+
+	assert.NoError(t, env.api.DeletePrivate(env.controllers.org.OrgId(), ids[1]))
+
+	resp := doSignedRequest(t, ts, env, "GET", "/cas", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	views := make([]*caView, 0)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&views))
+	assert.Len(t, views, 2)
+	assert.Equal(t, "ca1", views[0].Name)
+	assert.Empty(t, views[0].Error)
+	assert.NotEmpty(t, views[0].Certificate)
+	assert.Equal(t, "ca2", views[1].Name)
+	assert.Equal(t, ids[1], views[1].Id)
+	assert.NotEmpty(t, views[1].Error)
+}
+
+func TestStatusForError(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, StatusForError(newError(ErrNotFound, nil, "ca")))
+	assert.Equal(t, http.StatusBadRequest, StatusForError(wrapError(newError(ErrInvalidParams, nil, "name"), "new ca")))
+	assert.Equal(t, http.StatusInternalServerError, StatusForError(wrapError(nil, "other")))
+
+	// Only request authentication failures are 401s
+	csrErr := newError(ErrVerificationFailed, nil, "checking CSR signature")
+	assert.Equal(t, http.StatusUnprocessableEntity, StatusForError(csrErr))
+}
@@ -0,0 +1,194 @@
+package controller
+
+import (
+	stdcrypto "crypto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Key reference schemes of the built-in key providers. The PKCS #11 provider
+// is a stub that fails with ErrNotImplemented until a real one is registered,
+// see RegisterKeyProvider.
+const (
+	KeySchemeSoftToken string = "softtoken"
+	KeySchemeSocket    string = "socket"
+	KeySchemePKCS11    string = "pkcs11"
+)
+
+// KeyRef refers to a private key held by an external signer, e.g.
+// "pkcs11:token=pki;object=root-ca?pin-source=/etc/pki/pin",
+// "socket:/run/pki/signer.sock?id=root-ca" or
+// "softtoken:/var/lib/pki/token?id=root-ca". A CA with a key reference stores
+// it in place of its private key PEM, so the key never leaves the signer.
+type KeyRef struct {
+	Scheme string
+	// Path is what follows the scheme, up to any query
+	Path string
+	// Attrs are the query parameters, and for PKCS #11 the path attributes
+	Attrs map[string]string
+}
+
+var keyRefScheme = regexp.MustCompile(`^[a-z][a-z0-9+.-]*:`)
+
+// IsKeyRef reports whether a stored private key is a key reference rather
+// than PEM.
+func IsKeyRef(key string) bool {
+	return keyRefScheme.MatchString(key) && !strings.ContainsAny(key, "\r\n")
+}
+
+// ParseKeyRef parses a key reference. Errors only hold the reference as
+// String returns it, since it may hold a PIN, and not the parse errors, which
+// may quote part of it.
+func ParseKeyRef(ref string) (*KeyRef, error) {
+	if !IsKeyRef(ref) {
+		return nil, newError(ErrInvalidParams, nil, "not a key reference, it must start with a scheme such as '%s:'", KeySchemeSoftToken)
+	}
+
+	parts := strings.SplitN(ref, ":", 2)
+	keyRef := &KeyRef{Scheme: parts[0], Path: parts[1], Attrs: make(map[string]string)}
+
+	if i := strings.Index(keyRef.Path, "?"); i >= 0 {
+		rawQuery := keyRef.Path[i+1:]
+		keyRef.Path = keyRef.Path[:i]
+
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, newError(ErrInvalidParams, nil, "parsing query of key reference '%s'", keyRef)
+		}
+		for name, values := range query {
+			keyRef.Attrs[name] = values[0]
+		}
+	}
+	rest := keyRef.Path
+
+	if keyRef.Scheme == KeySchemePKCS11 {
+		for _, attr := range strings.Split(rest, ";") {
+			pair := strings.SplitN(attr, "=", 2)
+			if len(pair) != 2 {
+				continue
+			}
+
+			value, err := url.PathUnescape(pair[1])
+			if err != nil {
+				return nil, newError(ErrInvalidParams, nil, "parsing attribute '%s' of key reference '%s'", pair[0], keyRef)
+			}
+			keyRef.Attrs[pair[0]] = value
+		}
+	}
+
+	return keyRef, nil
+}
+
+// String returns the reference without its query or PKCS #11 PIN, which may
+// be secret, e.g. for logging.
+func (ref *KeyRef) String() string {
+	path := ref.Path
+	if ref.Scheme == KeySchemePKCS11 {
+		attrs := make([]string, 0)
+		for _, attr := range strings.Split(path, ";") {
+			if !strings.HasPrefix(attr, "pin-value=") {
+				attrs = append(attrs, attr)
+			}
+		}
+		path = strings.Join(attrs, ";")
+	}
+	return ref.Scheme + ":" + path
+}
+
+// KeyProvider opens keys held by an external signer.
+type KeyProvider interface {
+	// Open returns a signer for the referenced key. Its Public key must be
+	// available without signing.
+	Open(ref *KeyRef) (stdcrypto.Signer, error)
+}
+
+// KeyProviderFunc is a function that's a KeyProvider.
+type KeyProviderFunc func(ref *KeyRef) (stdcrypto.Signer, error)
+
+func (f KeyProviderFunc) Open(ref *KeyRef) (stdcrypto.Signer, error) {
+	return f(ref)
+}
+
+var keyProviders = struct {
+	sync.Mutex
+	providers map[string]KeyProvider
+}{
+	providers: map[string]KeyProvider{
+		KeySchemeSoftToken: KeyProviderFunc(openSoftTokenKey),
+		KeySchemeSocket:    KeyProviderFunc(openSocketKey),
+		KeySchemePKCS11:    KeyProviderFunc(openPKCS11Key),
+	},
+}
+
+// RegisterKeyProvider makes a key provider open references with the scheme,
+// replacing any provider already registered for it. Programs linked with a
+// PKCS #11 library register a provider for KeySchemePKCS11 this way.
+func RegisterKeyProvider(scheme string, provider KeyProvider) {
+	keyProviders.Lock()
+	defer keyProviders.Unlock()
+	keyProviders.providers[scheme] = provider
+}
+
+// KeySchemes returns the schemes with a registered key provider.
+func KeySchemes() []string {
+	keyProviders.Lock()
+	defer keyProviders.Unlock()
+
+	schemes := make([]string, 0, len(keyProviders.providers))
+	for scheme := range keyProviders.providers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// OpenKeyRef returns a signer for a key reference from the provider
+// registered for its scheme.
+func OpenKeyRef(ref string) (stdcrypto.Signer, error) {
+	keyRef, err := ParseKeyRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	keyProviders.Lock()
+	provider, ok := keyProviders.providers[keyRef.Scheme]
+	keyProviders.Unlock()
+
+	if !ok {
+		return nil, newError(ErrNotImplemented, nil, "no key provider for '%s' keys, must be one of %s", keyRef.Scheme, strings.Join(KeySchemes(), ", "))
+	}
+
+	logger.Debugf("opening key '%s'", keyRef)
+	signer, err := provider.Open(keyRef)
+	if err != nil {
+		return nil, wrapError(err, "opening key '%s'", keyRef)
+	}
+	return signer, nil
+}
+
+// openPKCS11Key is the PKCS #11 stub. PKCS #11 modules are native libraries
+// and this package doesn't use cgo, so signing with them needs a provider
+// registered by a program built with one, see ExampleRegisterKeyProvider.
+func openPKCS11Key(ref *KeyRef) (stdcrypto.Signer, error) {
+	return nil, newError(ErrNotImplemented, nil, "no PKCS #11 provider is registered")
+}
+
+// decodeStoredKey returns a signer for a stored private key, which is either
+// PEM or a key reference.
+func decodeStoredKey(key string) (stdcrypto.Signer, error) {
+	if IsKeyRef(key) {
+		return OpenKeyRef(key)
+	}
+	return PemDecodePrivateKey([]byte(key))
+}
+
+// paramKeyRef returns the key reference param, which may be nil.
+func paramKeyRef(keyRef *string) string {
+	if keyRef == nil {
+		return ""
+	}
+	return *keyRef
+}
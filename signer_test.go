@@ -0,0 +1,201 @@
+package controller
+
+import (
+	stdcrypto "crypto"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/pki-io/core/x509"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// A program that signs with PKCS #11 tokens replaces the stub provider with
+// one backed by a PKCS #11 library, e.g. github.com/ThalesIgnite/crypto11,
+// before using any controllers. The reference's attributes say which module,
+// token and key to use.
+func ExampleRegisterKeyProvider() {
+	RegisterKeyProvider(KeySchemePKCS11, KeyProviderFunc(func(ref *KeyRef) (stdcrypto.Signer, error) {
+		pin, err := ioutil.ReadFile(ref.Attrs["pin-source"])
+		if err != nil {
+			return nil, err
+		}
+
+		// With crypto11:
+		//
+		//	ctx, err := crypto11.Configure(&crypto11.Config{
+		//		Path:       ref.Attrs["module-path"],
+		//		TokenLabel: ref.Attrs["token"],
+		//		Pin:        string(pin),
+		//	})
+		//	if err != nil {
+		//		return nil, err
+		//	}
+		//	return ctx.FindKeyPair(nil, []byte(ref.Attrs["object"]))
+		_ = pin
+		return nil, fmt.Errorf("no PKCS #11 library linked for token '%s'", ref.Attrs["token"])
+	}))
+
+	// CAs can now be created with references like
+	// "pkcs11:token=pki;object=root-ca?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=/etc/pki/pin"
+}
+
+func newTestSoftToken(t *testing.T) (*SoftToken, func()) {
+	dir, err := ioutil.TempDir("", "pkiio-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSoftToken(dir), func() { os.RemoveAll(dir) }
+}
+
+// newTestKeyRefCA returns a root CA whose key is held by the signer the
+// reference is for.
+func newTestKeyRefCA(t *testing.T, ref string) *x509.CA {
+	ca, _ := x509.NewCA(nil)
+	ca.Data.Body.Name = "ca"
+	ca.Data.Body.CAExpiry = 365
+	ca.Data.Body.CertExpiry = 90
+	if err := GenerateRootCAWithKeyRef(ca, ref, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func TestParseKeyRef(t *testing.T) {
+	ref, err := ParseKeyRef("pkcs11:token=pki;object=root%20ca;pin-value=1234?module-path=/usr/lib/p11.so")
+	assert.NoError(t, err)
+	assert.Equal(t, KeySchemePKCS11, ref.Scheme)
+	assert.Equal(t, "pki", ref.Attrs["token"])
+	assert.Equal(t, "root ca", ref.Attrs["object"])
+	assert.Equal(t, "/usr/lib/p11.so", ref.Attrs["module-path"])
+	assert.Equal(t, "pkcs11:token=pki;object=root%20ca", ref.String())
+
+	ref, err = ParseKeyRef("socket:/run/pki/signer.sock?id=ca")
+	assert.NoError(t, err)
+	assert.Equal(t, "/run/pki/signer.sock", ref.Path)
+	assert.Equal(t, "ca", ref.Attrs["id"])
+
+	keyPem, _ := PemEncodePrivateKey(mustGenerateKey(t, KeySpecP256))
+	assert.False(t, IsKeyRef(keyPem))
+	_, err = ParseKeyRef(keyPem)
+	assert.True(t, IsInvalidParams(err))
+
+	_, err = OpenKeyRef("vault:ca")
+	assert.True(t, IsNotImplemented(err))
+
+	// Errors never hold the PIN
+	for _, bad := range []string{
+		"pkcs11:token=pki;pin-value=12%zz34",
+		"pkcs11:token=pki;pin-value=1234?module-path=%zz",
+		"pkcs11:token=pki;pin-value=1234\n",
+	} {
+		_, err = ParseKeyRef(bad)
+		assert.True(t, IsInvalidParams(err))
+		assert.NotContains(t, err.Error(), "pin-value=")
+		assert.NotContains(t, err.Error(), "12")
+	}
+}
+
+func mustGenerateKey(t *testing.T, spec string) stdcrypto.Signer {
+	key, err := GenerateKey(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSoftToken(t *testing.T) {
+	token, cleanup := newTestSoftToken(t)
+	defer cleanup()
+
+	ref, err := token.GenerateKey("ca", KeySpecP256)
+	assert.NoError(t, err)
+
+	_, err = token.GenerateKey("ca", KeySpecP256)
+	assert.True(t, IsAlreadyExists(err))
+
+	_, err = token.GenerateKey("../ca", KeySpecP256)
+	assert.True(t, IsInvalidParams(err))
+
+	_, err = OpenKeyRef(token.Ref("missing"))
+	assert.True(t, IsNotFound(err))
+
+	ca := newTestKeyRefCA(t, ref)
+	assert.Equal(t, ref, ca.Data.Body.PrivateKey)
+	assert.Equal(t, "ec", ca.Data.Body.KeyType)
+	assert.NoError(t, checkStoredKeyMatches(ca.Data.Body.Certificate, ca.Data.Body.PrivateKey))
+}
+
+func TestKeySocket(t *testing.T) {
+	token, cleanup := newTestSoftToken(t)
+	defer cleanup()
+
+	socket := path.Join(token.Dir, "signer.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go NewKeyAgent(token).Serve(listener)
+
+	for _, spec := range []string{KeySpecP256, KeySpecRSA2048, KeySpecEd25519} {
+		_, err := token.GenerateKey(spec, spec)
+		assert.NoError(t, err)
+
+		ca := newTestKeyRefCA(t, "socket:"+socket+"?id="+spec)
+		cert, err := x509.PemDecodeX509Certificate([]byte(ca.Data.Body.Certificate))
+		assert.NoError(t, err)
+		assert.NoError(t, cert.CheckSignatureFrom(cert), spec)
+	}
+
+	_, err = OpenKeyRef("socket:" + socket + "?id=missing")
+	assert.Error(t, err)
+}
+
+func TestPKCS11Hook(t *testing.T) {
+	token, cleanup := newTestSoftToken(t)
+	defer cleanup()
+
+	_, err := OpenKeyRef("pkcs11:token=pki;object=ca")
+	assert.True(t, IsNotImplemented(err))
+
+	_, err = token.GenerateKey("ca", KeySpecP384)
+	assert.NoError(t, err)
+
+	RegisterKeyProvider(KeySchemePKCS11, KeyProviderFunc(func(ref *KeyRef) (stdcrypto.Signer, error) {
+		return token.Signer(ref.Attrs["object"])
+	}))
+	defer RegisterKeyProvider(KeySchemePKCS11, KeyProviderFunc(openPKCS11Key))
+
+	signer, err := OpenKeyRef("pkcs11:token=pki;object=ca")
+	assert.NoError(t, err)
+	spec, _ := KeySpecOf(signer)
+	assert.Equal(t, KeySpecP384, spec)
+}
+
+func TestSignCSRWithKeyRef(t *testing.T) {
+	token, cleanup := newTestSoftToken(t)
+	defer cleanup()
+
+	ref, err := token.GenerateKey("ca", KeySpecP256)
+	assert.NoError(t, err)
+	ca := newTestKeyRefCA(t, ref)
+
+	csrPem, _, keyType, err := GenerateCSR(&CSRRequest{KeySpec: KeySpecP256, Subject: pkix.Name{CommonName: "web"}})
+	assert.NoError(t, err)
+	csr, _ := x509.NewCSR(nil)
+	csr.Data.Body.Name = "web"
+	csr.Data.Body.CSR = csrPem
+	csr.Data.Body.KeyType = string(keyType)
+
+	cert, err := signCSR(ca, csr, true, time.Now())
+	assert.NoError(t, err)
+
+	caCert, _ := x509.PemDecodeX509Certificate([]byte(ca.Data.Body.Certificate))
+	signed, err := x509.PemDecodeX509Certificate([]byte(cert.Data.Body.Certificate))
+	assert.NoError(t, err)
+	assert.Equal(t, "web", signed.Subject.CommonName)
+	assert.NoError(t, signed.CheckSignatureFrom(caCert))
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	stdcrypto "crypto"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// SoftToken is a software stand-in for a hardware token, e.g. for tests and
+// development. It's a directory of PEM keys, one per id, referenced as
+// "softtoken:<dir>?id=<id>".
+type SoftToken struct {
+	Dir string
+}
+
+var softTokenId = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+func NewSoftToken(dir string) *SoftToken {
+	return &SoftToken{Dir: dir}
+}
+
+func (token *SoftToken) keyFile(id string) (string, error) {
+	if !softTokenId.MatchString(id) {
+		return "", newError(ErrInvalidParams, nil, "invalid soft token key id '%s'", id)
+	}
+	return filepath.Join(token.Dir, id+".pem"), nil
+}
+
+// Ref returns the key reference for the key with the id.
+func (token *SoftToken) Ref(id string) string {
+	return KeySchemeSoftToken + ":" + token.Dir + "?id=" + url.QueryEscape(id)
+}
+
+// GenerateKey generates a key to the key spec with the id and returns its
+// reference.
+func (token *SoftToken) GenerateKey(id, spec string) (string, error) {
+	key, err := GenerateKey(spec)
+	if err != nil {
+		return "", err
+	}
+	return token.ImportKey(id, key)
+}
+
+// ImportKey adds a key with the id and returns its reference. Existing keys
+// are never replaced.
+func (token *SoftToken) ImportKey(id string, key stdcrypto.Signer) (string, error) {
+	file, err := token.keyFile(id)
+	if err != nil {
+		return "", err
+	}
+
+	keyPem, err := PemEncodePrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(token.Dir, 0700); err != nil {
+		return "", wrapError(err, "creating soft token '%s'", token.Dir)
+	}
+
+	logger.Debugf("writing soft token key '%s'", id)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return "", newError(ErrAlreadyExists, err, "soft token key '%s'", id)
+	} else if err != nil {
+		return "", wrapError(err, "writing soft token key '%s'", id)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(keyPem); err != nil {
+		return "", wrapError(err, "writing soft token key '%s'", id)
+	}
+
+	return token.Ref(id), nil
+}
+
+// Signer returns the key with the id.
+func (token *SoftToken) Signer(id string) (stdcrypto.Signer, error) {
+	file, err := token.keyFile(id)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPem, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, newError(ErrNotFound, err, "soft token key '%s'", id)
+	} else if err != nil {
+		return nil, wrapError(err, "reading soft token key '%s'", id)
+	}
+
+	return PemDecodePrivateKey(keyPem)
+}
+
+func openSoftTokenKey(ref *KeyRef) (stdcrypto.Signer, error) {
+	if ref.Path == "" {
+		return nil, newError(ErrInvalidParams, nil, "soft token key reference needs a directory")
+	}
+	return NewSoftToken(ref.Path).Signer(ref.Attrs["id"])
+}
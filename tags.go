@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TagSeparator splits a tag's key from its value, in tags and in queries.
+const TagSeparator string = "="
+
+// legacyTagSeparators are what flat tags used between a key and a value
+// before tags had values, e.g. "env-prod". See MigrateTag.
+var legacyTagSeparators = []string{"-", ":"}
+
+var tagKeyRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._/-]*$`)
+
+// Tag is a key with an optional value, written "key" or "key=value". Flat
+// tags from before tags had values are tags with just a key.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// NormalizeTag lower cases a tag and trims the space around its key and value.
+// It doesn't validate the tag, so existing tags always load.
+func NormalizeTag(s string) string {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if i := strings.Index(s, TagSeparator); i >= 0 {
+		return strings.TrimSpace(s[:i]) + TagSeparator + strings.TrimSpace(s[i+1:])
+	}
+	return s
+}
+
+// ParseTag parses and validates a tag.
+func ParseTag(s string) (*Tag, error) {
+	s = NormalizeTag(s)
+	tag := new(Tag)
+	if i := strings.Index(s, TagSeparator); i >= 0 {
+		tag.Key = s[:i]
+		tag.Value = s[i+1:]
+		if tag.Value == "" {
+			return nil, newError(ErrInvalidParams, nil, "tag '%s' has an empty value", s)
+		}
+	} else {
+		tag.Key = s
+	}
+
+	if strings.Contains(tag.Key, ":") {
+		return nil, newError(ErrInvalidParams, nil, "tag '%s' has an invalid key, tags with values are written key%svalue", s, TagSeparator)
+	}
+
+	if !tagKeyRegexp.MatchString(tag.Key) {
+		return nil, newError(ErrInvalidParams, nil, "tag '%s' has an invalid key, keys must start with a letter or digit and contain only letters, digits and ._/-", s)
+	}
+
+	return tag, nil
+}
+
+// splitTag splits a normalized tag without validating it.
+func splitTag(s string) *Tag {
+	if i := strings.Index(s, TagSeparator); i >= 0 {
+		return &Tag{Key: s[:i], Value: s[i+1:]}
+	}
+	return &Tag{Key: s}
+}
+
+func (tag *Tag) String() string {
+	if tag.Value == "" {
+		return tag.Key
+	}
+	return tag.Key + TagSeparator + tag.Value
+}
+
+// Matches reports whether tag t is matched by this tag used as a pattern. A
+// tag with just a key matches any tag with that key, whatever its value, and
+// a tag with a value only matches the same key and value.
+func (tag *Tag) Matches(t *Tag) bool {
+	if tag.Key != t.Key {
+		return false
+	}
+	return tag.Value == "" || tag.Value == t.Value
+}
+
+// MatchTag reports whether the tag string t is matched by the tag string
+// pattern, as Tag.Matches.
+func MatchTag(pattern, t string) bool {
+	return splitTag(NormalizeTag(pattern)).Matches(splitTag(NormalizeTag(t)))
+}
+
+// MigrateTag rewrites a flat tag from before tags had values, such as
+// "env-prod" or "env:prod", as a tag with a value, "env=prod", if it starts
+// with one of keys and a legacy separator. Other tags are returned normalized
+// but otherwise unchanged.
+func MigrateTag(t string, keys []string) string {
+	t = NormalizeTag(t)
+	if strings.Contains(t, TagSeparator) {
+		return t
+	}
+
+	for _, key := range keys {
+		for _, sep := range legacyTagSeparators {
+			if strings.HasPrefix(t, key+sep) && len(t) > len(key+sep) {
+				return key + TagSeparator + t[len(key+sep):]
+			}
+		}
+	}
+	return t
+}
+
+// legacyTags reads a flat tag written with legacy separators, such as
+// "env:prod", as the tags with values it could have been migrated to, one for
+// each legacy separator in it. It returns none for a tag with a value.
+func legacyTags(s string) []*Tag {
+	s = NormalizeTag(s)
+	if strings.Contains(s, TagSeparator) {
+		return nil
+	}
+
+	tags := make([]*Tag, 0)
+	for _, sep := range legacyTagSeparators {
+		i := strings.Index(s, sep)
+		if i <= 0 || i+len(sep) == len(s) {
+			continue
+		}
+
+		tag := &Tag{Key: s[:i], Value: s[i+len(sep):]}
+		if tagKeyRegexp.MatchString(tag.Key) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// migrateTags applies MigrateTag to a list of tags, dropping duplicates. It
+// returns the tags and whether any changed.
+func migrateTags(tags, keys []string) ([]string, bool) {
+	migrated := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	changed := false
+	for _, t := range tags {
+		m := MigrateTag(t, keys)
+		if m != t {
+			changed = true
+		}
+
+		if !seen[m] {
+			seen[m] = true
+			migrated = append(migrated, m)
+		}
+	}
+	return migrated, changed
+}
+
+// migrateTagMaps applies MigrateTag to an ID to tags map, returning it with
+// the matching tag to IDs map and how many IDs had tags changed.
+func migrateTagMaps(reverse map[string][]string, keys []string) (map[string][]string, map[string][]string, int) {
+	ids := make([]string, 0, len(reverse))
+	for id := range reverse {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	newForward := make(map[string][]string)
+	newReverse := make(map[string][]string)
+	changed := 0
+	for _, id := range ids {
+		migrated, ok := migrateTags(reverse[id], keys)
+		if ok {
+			changed++
+		}
+
+		newReverse[id] = migrated
+		for _, t := range migrated {
+			newForward[t] = append(newForward[t], id)
+		}
+	}
+	return newForward, newReverse, changed
+}
+
+// ValidateTags checks every tag in a comma separated list. Empty entries are
+// ignored.
+func ValidateTags(tagString string) error {
+	for _, s := range strings.Split(tagString, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		if _, err := ParseTag(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateTagsParam validates an optional tags param. An empty list is valid
+// even when the param is required.
+func validateTagsParam(tags *string, required bool) error {
+	if tags == nil {
+		if required {
+			return newError(ErrInvalidParams, nil, "tags must be set")
+		}
+		return nil
+	}
+	return ValidateTags(*tags)
+}
+
+// matchingTags returns the tags in a tag to IDs map that the pattern matches,
+// sorted.
+func matchingTags(pattern string, forward map[string][]string) []string {
+	p := splitTag(NormalizeTag(pattern))
+	tags := make([]string, 0)
+	for t := range forward {
+		if p.Matches(splitTag(NormalizeTag(t))) {
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// matchedTags returns the tags in a tag to IDs map that match the tag t when
+// used as patterns, sorted.
+func matchedTags(t string, forward map[string][]string) []string {
+	tag := splitTag(NormalizeTag(t))
+	tags := make([]string, 0)
+	for p := range forward {
+		if splitTag(NormalizeTag(p)).Matches(tag) {
+			tags = append(tags, p)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
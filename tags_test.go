@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseTag(t *testing.T) {
+	tag, err := ParseTag(" Env = Prod ")
+	assert.NoError(t, err)
+	assert.Equal(t, &Tag{Key: "env", Value: "prod"}, tag)
+	assert.Equal(t, "env=prod", tag.String())
+
+	// Flat tags are tags with just a key
+	tag, err = ParseTag("web")
+	assert.NoError(t, err)
+	assert.Equal(t, &Tag{Key: "web"}, tag)
+	assert.Equal(t, "web", tag.String())
+
+	for _, s := range []string{"", "=prod", "env=", "-env", "my env", "env!", "env:prod"} {
+		_, err := ParseTag(s)
+		assert.True(t, IsInvalidParams(err), s)
+	}
+}
+
+func TestMatchTag(t *testing.T) {
+	assert.True(t, MatchTag("env", "env=prod"))
+	assert.True(t, MatchTag("env", "env"))
+	assert.True(t, MatchTag("env=prod", "ENV = prod"))
+	assert.False(t, MatchTag("env=prod", "env=dev"))
+	assert.False(t, MatchTag("env=prod", "env"))
+	assert.False(t, MatchTag("env", "environment"))
+}
+
+func TestMigrateTag(t *testing.T) {
+	keys := []string{"env", "role"}
+	assert.Equal(t, "env=prod", MigrateTag("env-prod", keys))
+	assert.Equal(t, "env=prod", MigrateTag("ENV:prod", keys))
+	assert.Equal(t, "role=web-front", MigrateTag("role-web-front", keys))
+	assert.Equal(t, "env=dev", MigrateTag("env=dev", keys))
+	assert.Equal(t, "env", MigrateTag("env", keys))
+	assert.Equal(t, "env-", MigrateTag("env-", keys))
+	assert.Equal(t, "environment-prod", MigrateTag("environment-prod", keys))
+	assert.Equal(t, "us-east", MigrateTag("us-east", keys))
+}
+
+func TestMigrateTagMaps(t *testing.T) {
+	reverse := map[string][]string{"1": {"env-prod", "web"}, "2": {"env-prod", "env=prod"}, "3": {"web"}}
+	forward, reverse, changed := migrateTagMaps(reverse, []string{"env"})
+	assert.Equal(t, 2, changed)
+	assert.Equal(t, []string{"env=prod", "web"}, reverse["1"])
+	assert.Equal(t, []string{"env=prod"}, reverse["2"])
+	assert.Equal(t, []string{"1", "2"}, forward["env=prod"])
+	assert.Equal(t, []string{"1", "3"}, forward["web"])
+	assert.NotContains(t, forward, "env-prod")
+}
+
+func TestParseTagsNormalizes(t *testing.T) {
+	assert.Equal(t, []string{"web", "env=prod"}, ParseTags("Web, env = PROD"))
+}
+
+func TestValidateTags(t *testing.T) {
+	assert.NoError(t, ValidateTags(""))
+	assert.NoError(t, ValidateTags("web, env=prod,"))
+	assert.True(t, IsInvalidParams(ValidateTags("web, env=")))
+
+	params := NewCAParams()
+	assert.NoError(t, params.ValidateTags(false))
+	assert.True(t, IsInvalidParams(params.ValidateTags(true)))
+	params.Tags = stringPtr("role=web")
+	assert.NoError(t, params.ValidateTags(true))
+}
+
+func TestMatchedTags(t *testing.T) {
+	forward := map[string][]string{"env": {"1"}, "env=prod": {"2"}, "env=dev": {"3"}, "web": {"4"}}
+
+	// Patterns in the map that match a tag
+	assert.Equal(t, []string{"env", "env=prod"}, matchedTags("env=prod", forward))
+	assert.Equal(t, []string{"env"}, matchedTags("env", forward))
+
+	// Tags in the map that a pattern matches
+	assert.Equal(t, []string{"env", "env=dev", "env=prod"}, matchingTags("env", forward))
+	assert.Equal(t, []string{"env=dev"}, matchingTags("env=dev", forward))
+}